@@ -0,0 +1,64 @@
+// Command protocoltest runs the conformance script of the wire protocol
+// against clients, or writes the golden frames for implementations that
+// can't use the protocoltest package.
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/arkan/sqlproxy/protocoltest"
+)
+
+var (
+	listen = flag.String("listen", ":8888", "Address the clients under test connect to, each one running the conformance script")
+	dump   = flag.String("dump", "", "Directory the golden frames are written to, as <name>.bin with their length prefix, instead of listening")
+)
+
+func main() {
+	flag.Parse()
+	if *dump != "" {
+		if err := dumpFrames(*dump); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Conformance script listening on %s...\n", *listen)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			defer conn.Close()
+			if err := protocoltest.ServeClient(conn, protocoltest.Script); err != nil {
+				log.Printf("FAIL %s: %v", conn.RemoteAddr(), err)
+				return
+			}
+			log.Printf("PASS %s", conn.RemoteAddr())
+		}()
+	}
+}
+
+// dumpFrames writes every golden frame to a directory.
+func dumpFrames(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, f := range protocoltest.Golden {
+		if err := os.WriteFile(filepath.Join(dir, f.Name+".bin"), f.Encoded(), 0644); err != nil {
+			return err
+		}
+	}
+	log.Printf("%d golden frames written to %s", len(protocoltest.Golden), dir)
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/arkan/sqlproxy/internal/sqltext"
+	"github.com/pkg/errors"
+)
+
+// accessRecord is the access log record of a request, as a JSON line.
+// Status is ok, error, killed by the watchdog, or cancelled when the client
+// disconnected first.
+type accessRecord struct {
+	Time        string  `json:"time"`
+	Client      string  `json:"client"`
+	User        string  `json:"user,omitempty"`
+	Tenant      string  `json:"tenant,omitempty"`
+	Application string  `json:"application,omitempty"`
+	TraceID     string  `json:"trace_id,omitempty"`
+	Op          string  `json:"op"`
+	Fingerprint string  `json:"fingerprint,omitempty"`
+	DurationMS  float64 `json:"duration_ms"`
+	Rows        int64   `json:"rows"`
+	Bytes       int64   `json:"bytes"`
+	Status      string  `json:"status"`
+	ErrorClass  string  `json:"error_class,omitempty"`
+	ErrorCode   string  `json:"error_code,omitempty"`
+}
+
+// accessLog writes the access log records, separate from the application
+// log.
+type accessLog struct {
+	mu  sync.Mutex
+	w   io.WriteCloser
+	enc *json.Encoder
+}
+
+// openAccessLog opens the access log at a target as the log, or writes it to
+// the standard output when the target is "-".
+func openAccessLog(target string) (*accessLog, error) {
+	var w io.WriteCloser = os.Stdout
+	if target != "-" {
+		t, err := openLogTarget(target, "sqlproxy-access")
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to open access log")
+		}
+		w = t
+	}
+
+	return &accessLog{w: w, enc: json.NewEncoder(w)}, nil
+}
+
+// record logs a request which started at a time.
+func (l *accessLog) record(sess *session, op, query string, start time.Time, stats requestStats, err error) {
+	r := accessRecord{
+		Time:        start.UTC().Format(time.RFC3339Nano),
+		Client:      sess.conn.RemoteAddr().String(),
+		User:        sess.user,
+		Tenant:      sess.tenant,
+		Application: sess.application,
+		TraceID:     sess.traceID,
+		Op:          op,
+		DurationMS:  float64(time.Since(start).Microseconds()) / 1000,
+		Rows:        stats.rows,
+		Bytes:       stats.bytes,
+		Status:      "ok",
+	}
+	if query != "" {
+		r.Fingerprint = sqltext.Fingerprint(query)
+	}
+	switch {
+	case err != nil && sess.ctx.Err() != nil:
+		r.Status = "cancelled"
+	case errors.As(err, new(killedError)):
+		code := codeOf(err)
+		r.Status, r.ErrorClass, r.ErrorCode = "killed", code.Class, code.Code
+	case err != nil:
+		code := codeOf(err)
+		r.Status, r.ErrorClass, r.ErrorCode = "error", code.Class, code.Code
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.enc.Encode(r)
+}
+
+// Close closes the access log target.
+func (l *accessLog) Close() error {
+	if l.w == os.Stdout {
+		return nil
+	}
+	return l.w.Close()
+}
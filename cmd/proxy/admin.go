@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// serveAdmin runs the admin HTTP API.
+func serveAdmin(l net.Listener, srv *server) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /usage", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, srv.usage.report())
+	})
+	mux.HandleFunc("GET /connections", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, srv.connections())
+	})
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+	})
+	mux.HandleFunc("GET /pool", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, srv.poolStats())
+	})
+	mux.HandleFunc("PUT /pool/{name...}", func(w http.ResponseWriter, r *http.Request) {
+		var req PoolRebuild
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		found, err := srv.rebuildPool(r.PathValue("name"), req)
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /running", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, srv.watchdog.list())
+	})
+	mux.HandleFunc("GET /top-queries", func(w http.ResponseWriter, r *http.Request) {
+		if srv.queryStats == nil {
+			http.Error(w, "query stats are disabled (-query-stats)", http.StatusNotFound)
+			return
+		}
+		n, err := parseTopN(r.URL.Query().Get("n"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		by := r.URL.Query().Get("by")
+		if by == "" {
+			by = "time"
+		}
+		report, err := srv.queryStats.top(n, by)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, report)
+	})
+	mux.HandleFunc("GET /queries", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, srv.queries.list())
+	})
+	mux.HandleFunc("PUT /queries/{name}", func(w http.ResponseWriter, r *http.Request) {
+		var q storedQuery
+		if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := srv.queries.register(r.PathValue("name"), &q); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("DELETE /queries/{name}", func(w http.ResponseWriter, r *http.Request) {
+		if !srv.queries.unregister(r.PathValue("name")) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET /blue-green", func(w http.ResponseWriter, r *http.Request) {
+		if srv.blueGreen == nil {
+			http.Error(w, "no blue/green backends are configured", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, srv.blueGreenStatus())
+	})
+	mux.HandleFunc("POST /blue-green/switch", func(w http.ResponseWriter, r *http.Request) {
+		if srv.blueGreen == nil {
+			http.Error(w, "no blue/green backends are configured", http.StatusNotFound)
+			return
+		}
+		status, err := srv.switchBlueGreen(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, status)
+	})
+
+	mux.HandleFunc("GET /maintenance", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, srv.maintenance.status())
+	})
+	mux.HandleFunc("POST /maintenance", func(w http.ResponseWriter, r *http.Request) {
+		var req MaintenanceRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := srv.maintenance.start(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, srv.maintenance.status())
+	})
+	mux.HandleFunc("DELETE /maintenance", func(w http.ResponseWriter, r *http.Request) {
+		if !srv.maintenance.end() {
+			http.Error(w, "no maintenance is in progress", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	// Readiness probes don't authenticate.
+	root := http.NewServeMux()
+	root.Handle("/", requireAdmin(srv, mux))
+	root.HandleFunc("GET /ready", func(w http.ResponseWriter, r *http.Request) {
+		if down := srv.unready(); len(down) > 0 {
+			http.Error(w, "unreachable backends: "+strings.Join(down, ", "), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ready")
+	})
+
+	log.Printf("Admin API listening on %s...\n", l.Addr())
+	log.Fatal(http.Serve(l, root))
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("Admin response error:", err)
+	}
+}
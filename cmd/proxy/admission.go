@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Admission queue defaults.
+const (
+	defaultMaxQueue     = 100
+	defaultQueueTimeout = 10 * time.Second
+)
+
+// errOverloaded is returned to requests that can't be queued, or waited too
+// long in the queue.
+var errOverloaded = errors.New("server overloaded, retry later")
+
+// Priority classes of requests, highest first.
+const (
+	priorityInteractive = iota
+	priorityNormal
+	priorityBatch
+	priorityClasses
+)
+
+// priorities are the names of the priority classes, used by clients and in
+// the configuration.
+var priorities = map[string]int{"interactive": priorityInteractive, "normal": priorityNormal, "batch": priorityBatch}
+
+// parsePriority returns a priority class by name, "" being normal.
+func parsePriority(name string) (int, error) {
+	if name == "" {
+		return priorityNormal, nil
+	}
+	p, ok := priorities[name]
+	if !ok {
+		return 0, errors.Errorf("unknown priority %q (interactive, normal or batch)", name)
+	}
+
+	return p, nil
+}
+
+// admission bounds the requests running on a backend. Requests over the limit
+// wait in a bounded queue, so that latency stays bounded when the backend is
+// saturated. Queued requests are served by priority class, and batch requests
+// can only hold half of the slots so that interactive ones always find some.
+//
+// Within a class, identities are served fairly (weighted fair queueing): each
+// queued request gets a virtual finish time, one over the identity weight
+// after the previous request of the identity or after the current virtual
+// time, and requests are served in that order. An identity queueing many
+// requests only delays its own.
+type admission struct {
+	limit      int
+	batchLimit int
+	maxQueue   int
+	timeout    time.Duration
+
+	mu      sync.Mutex
+	running [priorityClasses]int
+	queues  [priorityClasses][]*waiter
+	queued  int
+	// Virtual time of each class, and the finish time of the last request
+	// queued by each identity.
+	vtime  [priorityClasses]float64
+	finish [priorityClasses]map[string]float64
+}
+
+// waiter is a queued request, whose ready channel is closed once it has a
+// slot.
+type waiter struct {
+	priority int
+	finish   float64
+	ready    chan struct{}
+}
+
+// flow identifies the requests shared fairly with others: those of an
+// identity, with its weight.
+type flow struct {
+	name   string
+	weight float64
+}
+
+// newAdmission returns the admission queue of a backend, or nil when the
+// concurrency is not limited.
+func newAdmission(pool poolOptions) *admission {
+	limit := pool.maxConcurrent
+	if limit <= 0 {
+		limit = pool.maxOpenConns
+	}
+	if limit <= 0 {
+		return nil
+	}
+
+	a := &admission{limit: limit, batchLimit: (limit + 1) / 2, maxQueue: pool.maxQueue, timeout: pool.queueTimeout}
+	for p := range a.finish {
+		a.finish[p] = map[string]float64{}
+	}
+	if a.maxQueue <= 0 {
+		a.maxQueue = defaultMaxQueue
+	}
+	if a.timeout <= 0 {
+		a.timeout = defaultQueueTimeout
+	}
+
+	return a
+}
+
+// acquire waits for a slot to run a request of a priority class. The returned
+// function releases it.
+func (a *admission) acquire(ctx context.Context, priority int, f flow) (func(), error) {
+	if a == nil {
+		return func() {}, nil
+	}
+
+	w := &waiter{priority: priority, ready: make(chan struct{})}
+	release := func() { a.release(w) }
+
+	a.mu.Lock()
+	if !a.waitersBefore(priority) && a.canRun(priority) {
+		a.running[priority]++
+		a.mu.Unlock()
+		return release, nil
+	}
+	if a.queued >= a.maxQueue {
+		a.mu.Unlock()
+		return nil, errOverloaded
+	}
+	weight := f.weight
+	if weight <= 0 {
+		weight = 1
+	}
+	w.finish = max(a.vtime[priority], a.finish[priority][f.name]) + 1/weight
+	a.finish[priority][f.name] = w.finish
+	a.queues[priority] = append(a.queues[priority], w)
+	a.queued++
+	a.mu.Unlock()
+
+	timer := time.NewTimer(a.timeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-w.ready:
+		return release, nil
+	case <-timer.C:
+		err = errOverloaded
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	queue := a.queues[priority]
+	for i := range queue {
+		if queue[i] == w {
+			a.queues[priority] = append(queue[:i], queue[i+1:]...)
+			a.queued--
+			// Requests of a lower class may have been waiting behind it.
+			a.dispatch()
+			return nil, err
+		}
+	}
+	// The slot was handed over meanwhile.
+	return release, nil
+}
+
+// canRun reports whether a request of a priority class can get a slot now.
+func (a *admission) canRun(priority int) bool {
+	total := 0
+	for _, n := range a.running {
+		total += n
+	}
+	if total >= a.limit {
+		return false
+	}
+
+	return priority != priorityBatch || a.running[priorityBatch] < a.batchLimit
+}
+
+// waitersBefore reports whether requests of the class, or of a higher one,
+// are queued: they go first.
+func (a *admission) waitersBefore(priority int) bool {
+	for p := 0; p <= priority; p++ {
+		if len(a.queues[p]) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// release frees the slot of a request and hands it over.
+func (a *admission) release(w *waiter) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.running[w.priority]--
+	a.dispatch()
+}
+
+// dispatch gives free slots to the queued requests, highest class first and
+// by finish time within a class.
+func (a *admission) dispatch() {
+	for p := range a.queues {
+		for len(a.queues[p]) > 0 && a.canRun(p) {
+			queue := a.queues[p]
+			next := 0
+			for i, w := range queue {
+				if w.finish < queue[next].finish {
+					next = i
+				}
+			}
+			w := queue[next]
+			a.queues[p] = append(queue[:next], queue[next+1:]...)
+			a.queued--
+			a.running[p]++
+			a.vtime[p] = w.finish
+			close(w.ready)
+		}
+
+		// Identities without queued requests start again from the
+		// virtual time.
+		if len(a.queues[p]) == 0 {
+			clear(a.finish[p])
+		}
+	}
+}
+
+// waiting returns the number of queued requests.
+func (a *admission) waiting() int {
+	if a == nil {
+		return 0
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.queued
+}
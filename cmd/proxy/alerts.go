@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultAlertInterval is how often the alert thresholds are checked by
+// default.
+const defaultAlertInterval = 30 * time.Second
+
+// alertConfig describes a webhook, POSTed an alert when a threshold is
+// crossed and again when the value is back under it. Thresholds left to 0
+// are not checked.
+type alertConfig struct {
+	URL string `json:"url"`
+	// Fraction of the requests failing over an interval, checked when there
+	// are at least MinRequests of them.
+	ErrorRate   float64 `json:"error_rate"`
+	MinRequests int     `json:"min_requests"`
+	// Requests waiting in the admission queue of a pool.
+	QueueDepth int `json:"queue_depth"`
+	// Whether to alert when a backend doesn't answer a ping.
+	BackendUnavailable bool     `json:"backend_unavailable"`
+	Interval           duration `json:"interval"`
+}
+
+func (a *alertConfig) validate() error {
+	u, err := url.Parse(a.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.Errorf("invalid url %q", a.URL)
+	}
+	if a.ErrorRate < 0 || a.ErrorRate > 1 {
+		return errors.New("error rate must be between 0 and 1")
+	}
+	if a.MinRequests < 0 || a.QueueDepth < 0 || a.Interval.Duration < 0 {
+		return errors.New("min requests, queue depth and interval must be positive")
+	}
+	if a.ErrorRate == 0 && a.QueueDepth == 0 && !a.BackendUnavailable {
+		return errors.New("no threshold set")
+	}
+
+	return nil
+}
+
+func (a *alertConfig) interval() time.Duration {
+	if a.Interval.Duration == 0 {
+		return defaultAlertInterval
+	}
+	return a.Interval.Duration
+}
+
+// Alert is the JSON body POSTed to the webhooks. Status is firing when the
+// threshold is crossed, then resolved.
+type Alert struct {
+	Alert     string  `json:"alert"`
+	Status    string  `json:"status"`
+	Pool      string  `json:"pool,omitempty"`
+	Value     float64 `json:"value"`
+	Threshold float64 `json:"threshold"`
+	Message   string  `json:"message"`
+	Time      string  `json:"time"`
+}
+
+// alerter checks the thresholds of the webhooks until it is closed.
+type alerter struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// startAlerter starts checking the thresholds of the alert webhooks.
+func startAlerter(srv *server, alerts []alertConfig) *alerter {
+	ctx, cancel := context.WithCancel(context.Background())
+	a := &alerter{cancel: cancel}
+	for i := range alerts {
+		h := &alertHook{alertConfig: &alerts[i], client: &http.Client{Timeout: 10 * time.Second}, firing: map[string]bool{}}
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			h.run(ctx, srv)
+		}()
+	}
+	log.Printf("Checking %d alert webhooks", len(alerts))
+
+	return a
+}
+
+// Close stops checking.
+func (a *alerter) Close() {
+	a.cancel()
+	a.wg.Wait()
+}
+
+// alertHook is a webhook and the state of its alerts.
+type alertHook struct {
+	*alertConfig
+	client *http.Client
+
+	// firing alerts by name and pool.
+	firing map[string]bool
+	// Request totals at the previous check.
+	requests, failed float64
+}
+
+func (h *alertHook) run(ctx context.Context, srv *server) {
+	ticker := time.NewTicker(h.interval())
+	defer ticker.Stop()
+
+	h.requests, h.failed = requestsTotal.total(), requestErrors.total()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		h.check(ctx, srv)
+	}
+}
+
+// check compares the values since the previous check with the thresholds.
+func (h *alertHook) check(ctx context.Context, srv *server) {
+	if h.ErrorRate > 0 {
+		requests, failed := requestsTotal.total(), requestErrors.total()
+		n, nFailed := requests-h.requests, failed-h.failed
+		h.requests, h.failed = requests, failed
+		if n >= float64(h.MinRequests) && n > 0 {
+			rate := nFailed / n
+			h.update(ctx, "error_rate", "", rate, h.ErrorRate, rate >= h.ErrorRate,
+				fmt.Sprintf("%.0f of %.0f requests failed", nFailed, n))
+		}
+	}
+
+	pools := srv.pools()
+	names := make([]string, 0, len(pools))
+	for pool := range pools {
+		names = append(names, pool)
+	}
+	sort.Strings(names)
+	for _, pool := range names {
+		b := pools[pool]
+		if h.QueueDepth > 0 {
+			queued := b.admission.waiting()
+			h.update(ctx, "queue_depth", pool, float64(queued), float64(h.QueueDepth), queued >= h.QueueDepth,
+				fmt.Sprintf("%d requests queued", queued))
+		}
+		if h.BackendUnavailable {
+			pingCtx, cancel := context.WithTimeout(ctx, h.interval())
+			err := b.DB().PingContext(pingCtx)
+			cancel()
+			if ctx.Err() != nil {
+				return
+			}
+			message, value := "backend available", 0.0
+			if err != nil {
+				message, value = err.Error(), 1
+			}
+			h.update(ctx, "backend_unavailable", pool, value, 1, err != nil, message)
+		}
+	}
+}
+
+// update posts an alert when its state changes.
+func (h *alertHook) update(ctx context.Context, name, pool string, value, threshold float64, crossed bool, message string) {
+	key := name + "/" + pool
+	if crossed == h.firing[key] {
+		return
+	}
+	h.firing[key] = crossed
+
+	alert := Alert{Alert: name, Status: "resolved", Pool: pool, Value: value, Threshold: threshold, Message: message, Time: time.Now().UTC().Format(time.RFC3339)}
+	if crossed {
+		alert.Status = "firing"
+	}
+	if pool != "" {
+		name += " of " + pool
+	}
+	log.Printf("Alert %s %s: %s", name, alert.Status, alert.Message)
+	if err := h.post(ctx, alert); err != nil {
+		log.Printf("Alert webhook %s error: %v", h.URL, err)
+	}
+}
+
+func (h *alertHook) post(ctx context.Context, alert Alert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.Errorf("status %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/arkan/sqlproxy/internal/charset"
+	"github.com/pkg/errors"
+)
+
+// backend holds the pool of connections to the real database. The pool can be
+// replaced at runtime (e.g. when credentials rotate): new statements use the
+// new pool while in-flight statements finish on the old one, which is closed
+// once they are done.
+type backend struct {
+	pool      poolOptions
+	dialect   *dialect
+	admission *admission
+	// charset of the text of the backend, nil when it needs no decoding.
+	charset *charset.Charset
+
+	mu  sync.RWMutex
+	dsn string
+	db  *sql.DB
+	// ready is set once the backend was reached, and stop stops the
+	// attempts to reach it meanwhile.
+	ready atomic.Bool
+	stop  context.CancelFunc
+
+	// Pools of the databases of the server switched to, by name.
+	databasesMu sync.Mutex
+	databases   map[string]*backend
+}
+
+// poolOptions tune the pool of a backend. Zero values keep the database/sql
+// defaults.
+type poolOptions struct {
+	maxOpenConns int
+	maxIdleConns int
+	// Connections opened with the pool, so that the first requests don't
+	// wait for them, and kept idle.
+	warmConns int
+	// Statements run on the new connections, after those setting the time
+	// zone and locale.
+	statements []string
+	// Admission queue: requests running at once (max_open_conns by default,
+	// unlimited if both are zero), and the length and timeout of the queue.
+	maxConcurrent int
+	maxQueue      int
+	queueTimeout  time.Duration
+}
+
+// openBackend connects to the database and makes sure it is reachable,
+// unless -wait-for-backend is false: it is then reached in the background,
+// the statements failing meanwhile. The text of the backend is in the charset
+// named cs, -charset when empty.
+func openBackend(dsn string, d *dialect, cs string, pool poolOptions) (*backend, error) {
+	textCharset, err := lookupCharset(cs)
+	if err != nil {
+		return nil, err
+	}
+	db, err := openPool(dsn, d, pool)
+	if err != nil {
+		return nil, err
+	}
+	b := &backend{pool: pool, dialect: d, admission: newAdmission(pool), charset: textCharset, dsn: dsn, db: db}
+
+	if err := connect(db, pool); err != nil {
+		if *waitForBackend {
+			db.Close()
+			return nil, err
+		}
+		log.Printf("Backend unreachable, retrying in the background: %v", err)
+		ctx, cancel := context.WithCancel(context.Background())
+		b.stop = cancel
+		go b.reach(ctx)
+		return b, nil
+	}
+	b.ready.Store(true)
+
+	return b, nil
+}
+
+// reach pings the backend until it answers, waiting longer between the
+// attempts, up to backendRetryMax.
+func (b *backend) reach(ctx context.Context) {
+	delay := backendRetryMin
+	for {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+		if b.ready.Load() {
+			return
+		}
+		if err := connect(b.DB(), b.pool); err == nil {
+			b.ready.Store(true)
+			log.Println("Backend reached")
+			return
+		}
+		delay = min(delay*2, backendRetryMax)
+	}
+}
+
+// Delays between the attempts to reach a backend down at startup.
+const (
+	backendRetryMin = time.Second
+	backendRetryMax = 30 * time.Second
+)
+
+// DB returns the current pool.
+func (b *backend) DB() *sql.DB {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.db
+}
+
+// DSN returns the DSN of the current pool.
+func (b *backend) DSN() string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.dsn
+}
+
+// Reconnect replaces the pool with a new one using the given DSN. The old pool
+// is only closed once the new one has been successfully pinged.
+func (b *backend) Reconnect(dsn string) error {
+	db, err := openDB(dsn, b.dialect, b.pool)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	old := b.db
+	b.db = db
+	b.dsn = dsn
+	b.mu.Unlock()
+	b.ready.Store(true)
+
+	// Close waits for the statements running on the old pool to finish.
+	go func() {
+		if err := old.Close(); err != nil {
+			log.Println("Close old pool error:", err)
+		}
+	}()
+
+	b.databasesMu.Lock()
+	defer b.databasesMu.Unlock()
+	for name, db := range b.databases {
+		if err := db.Reconnect(dsn); err != nil {
+			log.Printf("Reconnect database %s error: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+// Close the pool.
+func (b *backend) Close() error {
+	if b.stop != nil {
+		b.stop()
+	}
+	b.databasesMu.Lock()
+	for _, db := range b.databases {
+		db.Close()
+	}
+	b.databasesMu.Unlock()
+	return b.DB().Close()
+}
+
+// openDB opens a pool and makes sure the database is reachable.
+func openDB(dsn string, d *dialect, pool poolOptions) (*sql.DB, error) {
+	db, err := openPool(dsn, d, pool)
+	if err != nil {
+		return nil, err
+	}
+	if err := connect(db, pool); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// openPool opens a pool, whose connections get the session time zone and
+// locale, without connecting.
+func openPool(dsn string, d *dialect, pool poolOptions) (*sql.DB, error) {
+	db, err := sql.Open("odbc", dsn)
+	if err != nil {
+		return nil, err
+	}
+	statements, err := sessionStatements(d)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	statements = append(statements, pool.statements...)
+	if len(statements) > 0 {
+		db = sql.OpenDB(&sessionConnector{driver: db.Driver(), dsn: dsn, statements: statements})
+	}
+	if pool.maxOpenConns > 0 {
+		db.SetMaxOpenConns(pool.maxOpenConns)
+	}
+	// database/sql keeps 2 idle connections by default.
+	idle := pool.maxIdleConns
+	if pool.warmConns > max(idle, 2) {
+		idle = pool.warmConns
+	}
+	if idle > 0 {
+		db.SetMaxIdleConns(idle)
+	}
+
+	return db, nil
+}
+
+// connect pings the database, then warms up the pool.
+func connect(db *sql.DB, pool poolOptions) error {
+	if err := db.Ping(); err != nil {
+		return errors.Wrap(err, "failed to ping database")
+	}
+	if pool.warmConns > 1 {
+		warmUp(db, pool.warmConns)
+	}
+
+	return nil
+}
+
+// warmUp opens connections of a pool at once and pings them, before they are
+// kept idle. Failures are logged, the connections being opened on demand.
+func warmUp(db *sql.DB, n int) {
+	if limit := db.Stats().MaxOpenConnections; limit > 0 && n > limit {
+		n = limit
+	}
+	start := time.Now()
+	conns := make([]*sql.Conn, n)
+	errs := make(chan error, n)
+	for i := range conns {
+		go func() {
+			conn, err := db.Conn(context.Background())
+			if err == nil {
+				err = conn.PingContext(context.Background())
+			}
+			conns[i] = conn
+			errs <- err
+		}()
+	}
+
+	var err error
+	warmed := 0
+	for range conns {
+		if e := <-errs; e != nil {
+			err = e
+		} else {
+			warmed++
+		}
+	}
+	for _, conn := range conns {
+		if conn != nil {
+			conn.Close()
+		}
+	}
+	if err != nil {
+		log.Printf("Warmed up %d of %d backend connections: %v", warmed, n, err)
+		return
+	}
+	log.Printf("Warmed up %d backend connections (%v)", n, time.Since(start))
+}
+
+// setDSNAttr sets an attribute of an ODBC connection string (e.g. "PWD"),
+// replacing it if it is already present.
+func setDSNAttr(dsn, key, value string) string {
+	if strings.ContainsAny(value, ";{}") {
+		value = "{" + strings.ReplaceAll(value, "}", "}}") + "}"
+	}
+
+	var attrs []string
+	found := false
+	for _, attr := range splitDSN(dsn) {
+		if strings.TrimSpace(attr) == "" {
+			continue
+		}
+		name, _, _ := strings.Cut(attr, "=")
+		if strings.EqualFold(strings.TrimSpace(name), key) {
+			attr = key + "=" + value
+			found = true
+		}
+		attrs = append(attrs, attr)
+	}
+	if !found {
+		attrs = append(attrs, key+"="+value)
+	}
+
+	return strings.Join(attrs, ";")
+}
+
+// dsnAttr returns an attribute of an ODBC connection string, without braces,
+// or "" when it is not set.
+func dsnAttr(dsn, key string) string {
+	for _, attr := range splitDSN(dsn) {
+		name, value, _ := strings.Cut(attr, "=")
+		if strings.EqualFold(strings.TrimSpace(name), key) {
+			value = strings.TrimSpace(value)
+			if strings.HasPrefix(value, "{") && strings.HasSuffix(value, "}") {
+				value = strings.ReplaceAll(value[1:len(value)-1], "}}", "}")
+			}
+			return value
+		}
+	}
+
+	return ""
+}
+
+// splitDSN splits an ODBC connection string into its attributes, keeping
+// braced values (which may contain semicolons) intact.
+func splitDSN(dsn string) []string {
+	var attrs []string
+	depth, start := 0, 0
+	for i := 0; i < len(dsn); i++ {
+		switch dsn[i] {
+		case '{':
+			depth++
+		case '}':
+			if depth > 0 {
+				depth--
+			}
+		case ';':
+			if depth == 0 {
+				attrs = append(attrs, dsn[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	return append(attrs, dsn[start:])
+}
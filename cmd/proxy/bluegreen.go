@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// blueGreenConfig is a pair of named backends replacing the default one: new
+// sessions start on the active backend, until the admin API switches them to
+// the standby, e.g. once a copy of the database on a new server caught up,
+// while the sessions of the previous one drain.
+type blueGreenConfig struct {
+	Active  string `json:"active"`
+	Standby string `json:"standby"`
+	// How long the sessions of the previous backend may still run after a
+	// switch, before they are closed: until they end when 0.
+	DrainTimeout duration `json:"drain_timeout"`
+}
+
+func (c *blueGreenConfig) validate(backends map[string]*backendConfig) error {
+	for _, name := range []string{c.Active, c.Standby} {
+		if backends[name] == nil {
+			return errors.Errorf("unknown backend %q", name)
+		}
+	}
+	if c.Active == c.Standby {
+		return errors.New("active and standby must be different backends")
+	}
+	if c.DrainTimeout.Duration < 0 {
+		return errors.New("drain timeout must be positive")
+	}
+	return nil
+}
+
+// blueGreen is the state of the blue/green backends.
+type blueGreen struct {
+	backends     map[string]*backend
+	drainTimeout time.Duration
+
+	// switching serializes the switches, the only writers of the names, and
+	// mu guards them.
+	switching       sync.Mutex
+	mu              sync.Mutex
+	active, standby string
+}
+
+func newBlueGreen(cfg *blueGreenConfig, backends map[string]*backend) *blueGreen {
+	return &blueGreen{backends: backends, drainTimeout: cfg.DrainTimeout.Duration, active: cfg.Active, standby: cfg.Standby}
+}
+
+// current returns the active backend and its name.
+func (g *blueGreen) current() (string, *backend) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.active, g.backends[g.active]
+}
+
+// BlueGreenStatus is the state of the blue/green backends, served by the
+// admin API.
+type BlueGreenStatus struct {
+	Active  string `json:"active"`
+	Standby string `json:"standby"`
+	// Client sessions by backend.
+	Sessions map[string]int `json:"sessions"`
+}
+
+// blueGreenStatus returns the state of the blue/green backends.
+func (s *server) blueGreenStatus() BlueGreenStatus {
+	g := s.blueGreen
+	g.mu.Lock()
+	status := BlueGreenStatus{Active: g.active, Standby: g.standby, Sessions: map[string]int{g.active: 0, g.standby: 0}}
+	g.mu.Unlock()
+
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	for _, info := range s.conns {
+		if info.Backend != "" {
+			status.Sessions[info.Backend]++
+		}
+	}
+
+	return status
+}
+
+// switchBlueGreen makes the standby backend the active one for the new
+// sessions, once it answers, and closes those left on the previous one after
+// the drain timeout.
+func (s *server) switchBlueGreen(ctx context.Context) (BlueGreenStatus, error) {
+	g := s.blueGreen
+	g.switching.Lock()
+	defer g.switching.Unlock()
+
+	if err := g.backends[g.standby].DB().PingContext(ctx); err != nil {
+		return BlueGreenStatus{}, errors.Wrapf(err, "backend %s", g.standby)
+	}
+	g.mu.Lock()
+	old, active := g.active, g.standby
+	g.active, g.standby = active, old
+	g.mu.Unlock()
+	log.Printf("Switched new sessions from backend %s to %s", old, active)
+
+	if g.drainTimeout > 0 {
+		time.AfterFunc(g.drainTimeout, func() { s.drain(old) })
+	}
+
+	return s.blueGreenStatus(), nil
+}
+
+// drain closes the client connections of the sessions of a blue/green
+// backend, unless it was switched back to.
+func (s *server) drain(name string) {
+	if active, _ := s.blueGreen.current(); active == name {
+		return
+	}
+
+	drained := s.closeSessions(func(info *connInfo) bool { return info.Backend == name })
+	if drained > 0 {
+		log.Printf("Closed %d sessions of backend %s after the drain timeout", drained, name)
+	}
+}
+
+// useDefaultBackend gives a session the default backend, the active one of
+// the blue/green backends if any.
+func (s *server) useDefaultBackend(sess *session) {
+	sess.backend, sess.router, sess.blueGreen = s.backend, s.routers[""], ""
+	if s.blueGreen != nil {
+		sess.blueGreen, sess.backend = s.blueGreen.current()
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arkan/sqlproxy/internal/sqltext"
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack"
+)
+
+// defaultCacheBytes is the default size of the result cache.
+const defaultCacheBytes = 64 << 20
+
+// cacheConfig enables the result cache for the queries reading the tables
+// of its rules.
+type cacheConfig struct {
+	// Size of the cached results, 64 MiB by default, in memory.
+	MaxBytes int64       `json:"max_bytes"`
+	Rules    []cacheRule `json:"rules"`
+	// External store holding the results instead, shared by the proxies.
+	Store *cacheStoreConfig `json:"store"`
+	// Caching of the read queries run often, matching no rule.
+	Hot *hotCacheConfig `json:"hot"`
+	// Queries whose results are cached at startup and refreshed.
+	Prewarm []prewarmConfig `json:"prewarm"`
+}
+
+// cacheRule caches the results of the queries whose tables all match its
+// glob patterns.
+type cacheRule struct {
+	Tables []string `json:"tables"`
+	TTL    duration `json:"ttl"`
+}
+
+func (c *cacheConfig) validate(identities map[string]*identityConfig) error {
+	for i, rule := range c.Rules {
+		if rule.TTL.Duration <= 0 {
+			return errors.Errorf("rule %d: ttl is required", i+1)
+		}
+		if err := validatePatterns(rule.Tables); err != nil {
+			return errors.Wrapf(err, "rule %d", i+1)
+		}
+	}
+	if c.Store != nil {
+		if err := c.Store.validate(); err != nil {
+			return errors.Wrap(err, "store")
+		}
+	}
+	if c.Hot != nil {
+		if err := c.Hot.validate(); err != nil {
+			return errors.Wrap(err, "hot")
+		}
+	}
+	for i := range c.Prewarm {
+		if err := c.Prewarm[i].validate(identities); err != nil {
+			return errors.Wrapf(err, "prewarm %d", i+1)
+		}
+	}
+
+	return nil
+}
+
+// resultCache holds the results of the cacheable queries in its store.
+// Writes through the proxy invalidate the results reading the tables they
+// modify, on every proxy of the cluster; other writes are only seen once
+// results expire.
+type resultCache struct {
+	rules []cacheRule
+	store cacheStore
+	// Counts of the runs of the queries, when hot queries are cached.
+	hotQueries *hotQueries
+	// cluster sends the invalidations to the other proxies, if any.
+	cluster *cluster
+}
+
+// cacheStore holds the cached results, encoded QueryResponses, and drops
+// those reading the tables invalidated.
+type cacheStore interface {
+	// get returns a cached result reading tables of a tenant, or the
+	// generation to put it with.
+	get(key, scope string, tables []string) ([]byte, uint64, bool)
+	// put caches a result read at a generation, unless it was invalidated
+	// since.
+	put(key, scope string, data []byte, tables []string, ttl time.Duration, gen uint64)
+	invalidate(scope string, tables []string)
+}
+
+// newResultCache returns the cache of a configuration, holding its results
+// in memory or in an external store.
+func newResultCache(cfg *cacheConfig) (*resultCache, error) {
+	c := &resultCache{rules: cfg.Rules}
+	if cfg.Store != nil {
+		store, err := newExternalStore(cfg.Store)
+		if err != nil {
+			return nil, err
+		}
+		c.store = store
+	} else {
+		c.store = newMemoryStore(cfg.MaxBytes)
+	}
+	if cfg.Hot != nil {
+		c.hotQueries = newHotQueries(cfg.Hot)
+	}
+
+	return c, nil
+}
+
+func (c *resultCache) get(key, scope string, tables []string) ([]byte, uint64, bool) {
+	return c.store.get(key, scope, tables)
+}
+
+func (c *resultCache) put(key, scope string, data []byte, tables []string, ttl time.Duration, gen uint64) {
+	c.store.put(key, scope, data, tables, ttl, gen)
+}
+
+// invalidate drops the results reading tables of a tenant.
+func (c *resultCache) invalidate(scope string, tables []string) {
+	c.store.invalidate(scope, tables)
+}
+
+// memoryStore holds the results in memory, least recently used first out.
+type memoryStore struct {
+	maxBytes int64
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	// Keys of the entries by table key.
+	tables map[string]map[string]bool
+	bytes  int64
+	// gen counts the invalidations, so that the result of a query running
+	// meanwhile isn't cached.
+	gen uint64
+}
+
+// cacheEntry is an encoded QueryResponse.
+type cacheEntry struct {
+	key     string
+	data    []byte
+	tables  []string
+	expires time.Time
+}
+
+func newMemoryStore(maxBytes int64) *memoryStore {
+	if maxBytes <= 0 {
+		maxBytes = defaultCacheBytes
+	}
+
+	return &memoryStore{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  map[string]*list.Element{},
+		tables:   map[string]map[string]bool{},
+	}
+}
+
+// rule returns how long the results of a query are cached and the tables it
+// reads, false when it isn't cacheable.
+func (c *resultCache) rule(query string) (time.Duration, []string, bool) {
+	refs := sqltext.TableRefs(sqltext.Tokenize(query))
+	if len(refs) == 0 {
+		return 0, nil, false
+	}
+	// Writes with a RETURNING clause.
+	for _, ref := range refs {
+		if ref.Target {
+			return 0, nil, false
+		}
+	}
+
+	for _, rule := range c.rules {
+		matches := true
+		for _, ref := range refs {
+			if !matchTable(rule.Tables, ref) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			var tables []string
+			for _, ref := range refs {
+				tables = append(tables, ref.Table())
+			}
+			return rule.TTL.Duration, tables, true
+		}
+	}
+
+	return 0, nil, false
+}
+
+// tableKey identifies a table of a tenant ("" for the default backend).
+// Names are unqualified, so that writes to a table invalidate reads however
+// they name it.
+func tableKey(scope, table string) string {
+	return scope + "\x00" + strings.ToLower(table)
+}
+
+func (c *memoryStore) get(key, scope string, tables []string) ([]byte, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem := c.entries[key]
+	if elem == nil {
+		return nil, c.gen, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(elem)
+		return nil, c.gen, false
+	}
+	c.lru.MoveToFront(elem)
+
+	return entry.data, c.gen, true
+}
+
+// put caches a result, evicting the least recently used ones past the size of
+// the cache.
+func (c *memoryStore) put(key, scope string, data []byte, tables []string, ttl time.Duration, gen uint64) {
+	if int64(len(data)) > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen != gen {
+		return
+	}
+
+	if elem := c.entries[key]; elem != nil {
+		c.remove(elem)
+	}
+	entry := &cacheEntry{key: key, data: data, expires: time.Now().Add(ttl)}
+	for _, table := range tables {
+		tk := tableKey(scope, table)
+		entry.tables = append(entry.tables, tk)
+		if c.tables[tk] == nil {
+			c.tables[tk] = map[string]bool{}
+		}
+		c.tables[tk][key] = true
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.bytes += int64(len(data))
+
+	for c.bytes > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove an entry, the lock being held.
+func (c *memoryStore) remove(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	c.lru.Remove(elem)
+	delete(c.entries, entry.key)
+	for _, tk := range entry.tables {
+		delete(c.tables[tk], entry.key)
+		if len(c.tables[tk]) == 0 {
+			delete(c.tables, tk)
+		}
+	}
+	c.bytes -= int64(len(entry.data))
+}
+
+func (c *memoryStore) invalidate(scope string, tables []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	for _, table := range tables {
+		for key := range c.tables[tableKey(scope, table)] {
+			c.remove(c.entries[key])
+		}
+	}
+}
+
+// written invalidates the results reading tables that were modified, here
+// and on the other proxies.
+func (c *resultCache) written(scope string, tables []string) {
+	if len(tables) == 0 {
+		return
+	}
+
+	c.invalidate(scope, tables)
+	if c.cluster != nil {
+		c.cluster.broadcast(scope, tables)
+	}
+}
+
+// written invalidates the cached results reading the tables modified by a
+// statement that ran on the backend, or queues them until the commit of the
+// transaction running it: until then, other sessions still read the rows
+// before the statement, and would cache them again.
+func (sess *session) written(query string) {
+	if sess.cache == nil {
+		return
+	}
+	var tables []string
+	for _, ref := range sqltext.TableRefs(sqltext.Tokenize(query)) {
+		if ref.Target {
+			tables = append(tables, ref.Table())
+		}
+	}
+	if sess.inTx {
+		sess.pendingWrites = append(sess.pendingWrites, tables...)
+		return
+	}
+	sess.cache.written(sess.tenant, tables)
+}
+
+// handleCachedQuery answers a cacheable query from the cache, or runs it and
+// caches its result. Hot queries are counted apart.
+func handleCachedQuery(sess *session, req QueryRequest, ttl time.Duration, tables []string, hot bool) (requestStats, error) {
+	c := sess.cache
+	key, err := sess.cacheKey(req)
+	if err != nil {
+		return requestStats{}, err
+	}
+
+	data, gen, ok := c.get(key, sess.tenant, tables)
+	if ok {
+		var response QueryResponse
+		if err := msgpack.Unmarshal(data, &response); err != nil {
+			return requestStats{}, err
+		}
+		cacheHits.add(1, sess.tenant)
+		if hot {
+			hotCached(sess.tenant, true)
+		}
+		sess.logf("Cache hit: %s", logged(req.Query, req.Args))
+		response.TraceID = sess.traceID
+		stats := requestStats{rows: int64(len(response.Data))}
+		stats.bytes = int64(sendResponse(sess.conn, response))
+		return stats, nil
+	}
+	cacheMisses.add(1, sess.tenant)
+	if hot {
+		hotCached(sess.tenant, false)
+	}
+
+	// Clients missing the same result wait for a single query.
+	response, stats, err := sess.flights.do(sess, req, key, func() (*QueryResponse, requestStats, error) {
+		return c.fill(sess, req, key, ttl, tables, gen)
+	})
+	if err != nil {
+		return stats, err
+	}
+	stats.bytes = int64(sendResponse(sess.conn, response))
+
+	return stats, nil
+}
+
+// fill runs a query and caches its result, read at a generation.
+func (c *resultCache) fill(sess *session, req QueryRequest, key string, ttl time.Duration, tables []string, gen uint64) (*QueryResponse, requestStats, error) {
+	response, stats, err := routedQuery(sess, req)
+	if err != nil {
+		return nil, stats, err
+	}
+	if data, err := msgpack.Marshal(QueryResponse{Columns: response.Columns, Types: response.Types, Data: response.Data}); err == nil {
+		c.put(key, sess.tenant, data, tables, ttl, gen)
+	}
+
+	return response, stats, nil
+}
+
+// cacheKey returns the key of the result of a query of the session.
+func (sess *session) cacheKey(req QueryRequest) (string, error) {
+	route, _, err := sess.route(req.Query, req.Args)
+	if err != nil {
+		return "", err
+	}
+	args, err := msgpack.Marshal(req.Args)
+	if err != nil {
+		return "", err
+	}
+	// Masks depend on the identity, row policies are in the statement, and
+	// tagged values on the client.
+	return strings.Join([]string{sess.tenant, route, boolString(len(sess.masks) > 0), strings.Join(sess.decodes, ","), req.Query, string(args)}, "\x00"), nil
+}
+
+func boolString(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionWrittenInTransaction(t *testing.T) {
+	c, err := newResultCache(&cacheConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached := func() bool {
+		_, _, ok := c.get("key", "t", []string{"countries"})
+		return ok
+	}
+	put := func() {
+		_, gen, _ := c.get("key", "t", []string{"countries"})
+		c.put("key", "t", []byte("result"), []string{"countries"}, time.Minute, gen)
+	}
+
+	sess := &session{cache: c, tenant: "t", inTx: true}
+	put()
+	sess.written("UPDATE countries SET name = 'x'")
+	if !cached() {
+		t.Error("result invalidated before the commit")
+	}
+	c.written(sess.tenant, sess.pendingWrites)
+	if cached() {
+		t.Error("result not invalidated by the commit")
+	}
+
+	sess.inTx, sess.pendingWrites = false, nil
+	put()
+	sess.written("DELETE FROM countries")
+	if cached() {
+		t.Error("result not invalidated by a write outside of a transaction")
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash/fnv"
+	"log"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Defaults of the external cache stores.
+const (
+	defaultStorePrefix  = "sqlproxy:"
+	defaultStoreTimeout = 100 * time.Millisecond
+	storeIdleConns      = 8
+)
+
+// cacheStoreConfig describes an external store of the cached results, Redis
+// or memcached, which survive restarts and are shared by the proxies using
+// it.
+type cacheStoreConfig struct {
+	// "redis" or "memcached".
+	Type string `json:"type"`
+	Addr string `json:"addr"`
+	// Environment variable holding the Redis password, and Redis database.
+	PasswordEnv string `json:"password_env"`
+	DB          int    `json:"db"`
+	// Prefix of the keys, "sqlproxy:" by default.
+	Prefix string `json:"prefix"`
+	// Longest time a request to the store may take, 100ms by default. The
+	// queries run on the backend when the store fails.
+	Timeout duration `json:"timeout"`
+}
+
+func (c *cacheStoreConfig) validate() error {
+	if c.Type != "redis" && c.Type != "memcached" {
+		return errors.Errorf("unknown type %q, expected redis or memcached", c.Type)
+	}
+	if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+		return errors.Errorf("invalid address %q", c.Addr)
+	}
+	if c.DB < 0 || c.Timeout.Duration < 0 {
+		return errors.New("db and timeout must be positive")
+	}
+	if c.Type == "memcached" && (c.PasswordEnv != "" || c.DB != 0) {
+		return errors.New("memcached has no password or database")
+	}
+
+	return nil
+}
+
+// kvClient is a client of a key-value store.
+type kvClient interface {
+	// getMulti returns the values of the keys found.
+	getMulti(keys []string) (map[string][]byte, error)
+	set(key string, value []byte, ttl time.Duration) error
+	// add sets a key unless it exists, reporting whether it did.
+	add(key string, value []byte) (bool, error)
+	// incr increments an integer value, if it exists.
+	incr(key string) error
+}
+
+// externalStore holds the results in a key-value store. Each table has a
+// version, changed by its invalidations: results are stored under their key
+// and the versions of their tables, so that those reading tables
+// invalidated are never read again, and expire.
+type externalStore struct {
+	client kvClient
+	prefix string
+	// failing is set while the store fails, so that its errors are logged
+	// once.
+	failing atomic.Bool
+}
+
+func newExternalStore(cfg *cacheStoreConfig) (*externalStore, error) {
+	timeout := cfg.Timeout.Duration
+	if timeout == 0 {
+		timeout = defaultStoreTimeout
+	}
+	s := &externalStore{prefix: cfg.Prefix}
+	if s.prefix == "" {
+		s.prefix = defaultStorePrefix
+	}
+
+	switch cfg.Type {
+	case "redis":
+		password, err := readSecret("", cfg.PasswordEnv, "")
+		if err != nil {
+			return nil, err
+		}
+		s.client = newRedisClient(cfg.Addr, password, cfg.DB, timeout)
+	case "memcached":
+		s.client = newMemcachedClient(cfg.Addr, timeout)
+	}
+	log.Printf("Caching results in %s at %s", cfg.Type, cfg.Addr)
+
+	return s, nil
+}
+
+// storeKey returns a key of the store, hashed to the charset and length
+// allowed by memcached.
+func (s *externalStore) storeKey(kind string, key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return s.prefix + kind + hex.EncodeToString(sum[:])
+}
+
+// generation returns a hash of the versions of tables, never 0. Versions
+// missing, never set or evicted, start from a value not used before.
+func (s *externalStore) generation(scope string, tables []string) (uint64, error) {
+	keys := make([]string, len(tables))
+	for i, table := range tables {
+		keys[i] = s.storeKey("v:", tableKey(scope, table))
+	}
+	versions, err := s.client.getMulti(keys)
+	if err != nil {
+		return 0, err
+	}
+
+	h := fnv.New64a()
+	for _, key := range keys {
+		version, ok := versions[key]
+		if !ok {
+			version = []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+			added, err := s.client.add(key, version)
+			if err != nil {
+				return 0, err
+			}
+			if !added {
+				found, err := s.client.getMulti([]string{key})
+				if err != nil {
+					return 0, err
+				}
+				version = found[key]
+			}
+		}
+		h.Write(version)
+		h.Write([]byte{0})
+	}
+
+	return max(h.Sum64(), 1), nil
+}
+
+func (s *externalStore) resultKey(key string, gen uint64) string {
+	return s.storeKey("r:", key+"\x00"+strconv.FormatUint(gen, 16))
+}
+
+func (s *externalStore) get(key, scope string, tables []string) ([]byte, uint64, bool) {
+	gen, err := s.generation(scope, tables)
+	if s.failed(err) {
+		return nil, 0, false
+	}
+	rkey := s.resultKey(key, gen)
+	found, err := s.client.getMulti([]string{rkey})
+	if s.failed(err) {
+		return nil, 0, false
+	}
+
+	data, ok := found[rkey]
+	return data, gen, ok
+}
+
+func (s *externalStore) put(key, scope string, data []byte, tables []string, ttl time.Duration, gen uint64) {
+	// The versions of the tables couldn't be read.
+	if gen == 0 {
+		return
+	}
+	s.failed(s.client.set(s.resultKey(key, gen), data, ttl))
+}
+
+func (s *externalStore) invalidate(scope string, tables []string) {
+	for _, table := range tables {
+		if s.failed(s.client.incr(s.storeKey("v:", tableKey(scope, table)))) {
+			return
+		}
+	}
+}
+
+// failed logs the errors of the store when it starts failing, and when it
+// recovers, reporting whether there is one.
+func (s *externalStore) failed(err error) bool {
+	if err != nil {
+		if !s.failing.Swap(true) {
+			log.Printf("Cache store error, results not cached until it recovers: %v", err)
+		}
+		return true
+	}
+	if s.failing.Swap(false) {
+		log.Println("Cache store recovered")
+	}
+	return false
+}
+
+// storeConns are the connections to a store server, dialed on demand and
+// kept idle while they work.
+type storeConns struct {
+	addr    string
+	timeout time.Duration
+	// init runs once on each new connection, such as an authentication.
+	init func(*storeConn) error
+	idle chan *storeConn
+}
+
+// storeConn is a buffered connection to a store server. Requests are
+// flushed before their reply is read.
+type storeConn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+func newStoreConns(addr string, timeout time.Duration, init func(*storeConn) error) *storeConns {
+	return &storeConns{addr: addr, timeout: timeout, init: init, idle: make(chan *storeConn, storeIdleConns)}
+}
+
+// do runs a request on a connection within the timeout. Connections are
+// closed after errors other than those returned by the server.
+func (p *storeConns) do(fn func(c *storeConn) error) error {
+	var c *storeConn
+	select {
+	case c = <-p.idle:
+	default:
+		conn, err := net.DialTimeout("tcp", p.addr, p.timeout)
+		if err != nil {
+			return err
+		}
+		c = &storeConn{Conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+		if p.init != nil {
+			conn.SetDeadline(time.Now().Add(p.timeout))
+			if err := p.init(c); err != nil {
+				conn.Close()
+				return err
+			}
+		}
+	}
+
+	c.SetDeadline(time.Now().Add(p.timeout))
+	err := fn(c)
+	var serverErr storeError
+	if err != nil && !errors.As(err, &serverErr) {
+		c.Close()
+		return err
+	}
+	select {
+	case p.idle <- c:
+	default:
+		c.Close()
+	}
+
+	return err
+}
+
+// storeError is an error returned by a store server, the connection still
+// being usable.
+type storeError string
+
+func (e storeError) Error() string {
+	return string(e)
+}
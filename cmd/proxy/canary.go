@@ -0,0 +1,97 @@
+package main
+
+import (
+	"math/rand"
+	"slices"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	canaryRequests = newMetricVec("counter", "sqlproxy_canary_requests_total", "Requests of the sessions of backends with a canary, by track (canary or primary).", "tenant", "track", "op")
+	canaryErrors   = newMetricVec("counter", "sqlproxy_canary_request_errors_total", "Requests that failed of the sessions of backends with a canary, by track.", "tenant", "track", "op")
+
+	canaryDuration = newHistogramVec("sqlproxy_canary_request_duration_seconds", "Durations of the requests of the sessions of backends with a canary, by track.",
+		[]float64{.001, .005, .01, .05, .1, .5, 1, 5}, "tenant", "track")
+)
+
+// Tracks of the sessions of a backend with a canary.
+const (
+	trackPrimary = "primary"
+	trackCanary  = "canary"
+)
+
+// canaryConfig sends a share of the sessions of a backend, and those of some
+// identities, to a canary: a named backend running a new version of the
+// database or of the schema, validated under real load before the others
+// move to it.
+type canaryConfig struct {
+	Backend string `json:"backend"`
+	// Percentage of the sessions sent to the canary, drawn when they start.
+	Percent float64 `json:"percent"`
+	// Identities whose sessions all go to the canary.
+	Identities []string `json:"identities"`
+}
+
+func (c *canaryConfig) validate(backends map[string]*backendConfig, identities map[string]*identityConfig) error {
+	if backends[c.Backend] == nil {
+		return errors.Errorf("unknown backend %q", c.Backend)
+	}
+	if c.Percent < 0 || c.Percent > 100 {
+		return errors.New("percent must be between 0 and 100")
+	}
+	for _, name := range c.Identities {
+		if identities[name] == nil {
+			return errors.Errorf("unknown identity %s", name)
+		}
+	}
+
+	return nil
+}
+
+// canary returns the canary of the backend of a tenant, "" for the default
+// one, or nil.
+func (s *server) canary(tenant string) *canaryConfig {
+	switch {
+	case s.config == nil:
+		return nil
+	case tenant == "":
+		return s.config.Canary
+	case s.config.Tenants[tenant] != nil:
+		return s.config.Tenants[tenant].Canary
+	}
+	return nil
+}
+
+// assignTrack sends a session to the canary of its backend, if drawn or one
+// of its identities, or keeps it on the primary. Canary sessions run every
+// statement on the canary, as the routes, shards and replicas are those of
+// the primary.
+func (s *server) assignTrack(sess *session) {
+	sess.track = ""
+	c := s.canary(sess.tenant)
+	if c == nil || sess.backend == nil {
+		return
+	}
+
+	sess.track = trackPrimary
+	if slices.Contains(c.Identities, sess.user) || rand.Float64()*100 < c.Percent {
+		sess.track = trackCanary
+		sess.backend = s.backends[c.Backend]
+		sess.router = nil
+	}
+}
+
+// recordTrack counts a request of a session of a backend with a canary.
+func (sess *session) recordTrack(op string, start time.Time, err error) {
+	if sess.track == "" {
+		return
+	}
+
+	canaryRequests.add(1, sess.tenant, sess.track, op)
+	if err != nil {
+		canaryErrors.add(1, sess.tenant, sess.track, op)
+	}
+	canaryDuration.observe(time.Since(start).Seconds(), 1, sess.tenant, sess.track)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"github.com/arkan/sqlproxy/internal/charset"
+	"github.com/arkan/sqlproxy/internal/sqltext"
+	"github.com/pkg/errors"
+)
+
+// lookupCharset returns the charset of the text of a backend, -charset when
+// name is empty, or nil when the text needs no decoding.
+func lookupCharset(name string) (*charset.Charset, error) {
+	if name == "" {
+		name = *charsetName
+	}
+	if name == "" {
+		return nil, nil
+	}
+	cs, err := charset.Lookup(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid charset")
+	}
+
+	return cs, nil
+}
+
+// charset returns the charset of the backend running a statement of the
+// session, nil when the text of the backend needs no decoding.
+func (sess *session) charset(query string, args []interface{}) *charset.Charset {
+	_, b, err := sess.route(query, args)
+	if err != nil || b == nil {
+		b = sess.backend
+	}
+	if b == nil {
+		return nil
+	}
+	return b.charset
+}
+
+// binaryColumns returns the columns of a result matching the binary column
+// patterns, whose binary strings aren't text. It returns nil when none does.
+func binaryColumns(patterns []string, query string, cols []string) []bool {
+	if len(patterns) == 0 {
+		return nil
+	}
+
+	refs := sqltext.TableRefs(sqltext.Tokenize(query))
+	var result []bool
+	for i, col := range cols {
+		for _, pattern := range patterns {
+			if !columnMatches(pattern, refs, col) {
+				continue
+			}
+			if result == nil {
+				result = make([]bool, len(cols))
+			}
+			result[i] = true
+			break
+		}
+	}
+
+	return result
+}
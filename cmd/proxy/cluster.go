@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// maxInvalidationSize is the size of the datagrams of the invalidations.
+const maxInvalidationSize = 64 << 10
+
+// cluster shares the invalidations of the result cache between proxies, as
+// UDP datagrams signed with a shared secret. They are best effort: a lost
+// one leaves results cached until they expire.
+type cluster struct {
+	conn   *net.UDPConn
+	peers  []string
+	secret []byte
+	// node identifies this proxy, as peers may include it.
+	node  string
+	cache *resultCache
+}
+
+// invalidation is a datagram of the cluster.
+type invalidation struct {
+	Node   string   `json:"node"`
+	Scope  string   `json:"scope"`
+	Tables []string `json:"tables"`
+}
+
+// startCluster listens for the invalidations of the peers of a cache and
+// sends them its own.
+func startCluster(addr, peers string, secret []byte, cache *resultCache) (*cluster, error) {
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := listenUDP("cluster", laddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "cluster")
+	}
+
+	node := make([]byte, 8)
+	if _, err := rand.Read(node); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c := &cluster{conn: conn, secret: secret, node: hex.EncodeToString(node), cache: cache}
+	for _, peer := range strings.Split(peers, ",") {
+		if peer = strings.TrimSpace(peer); peer != "" {
+			c.peers = append(c.peers, peer)
+		}
+	}
+	cache.cluster = c
+	go c.listen()
+
+	return c, nil
+}
+
+// sign returns the MAC of a payload.
+func (c *cluster) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// broadcast sends an invalidation to every peer. Their addresses are
+// resolved each time, so that they may be DNS names of changing proxies.
+func (c *cluster) broadcast(scope string, tables []string) {
+	payload, err := json.Marshal(invalidation{Node: c.node, Scope: scope, Tables: tables})
+	if err != nil {
+		return
+	}
+	datagram := append(c.sign(payload), payload...)
+
+	for _, peer := range c.peers {
+		addr, err := net.ResolveUDPAddr("udp", peer)
+		if err != nil {
+			log.Printf("Cluster peer %s error: %v", peer, err)
+			continue
+		}
+		if _, err := c.conn.WriteToUDP(datagram, addr); err != nil {
+			log.Printf("Cluster peer %s error: %v", peer, err)
+		}
+	}
+}
+
+// listen applies the invalidations of the peers.
+func (c *cluster) listen() {
+	buf := make([]byte, maxInvalidationSize)
+	for {
+		n, from, err := c.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Println("Cluster read error:", err)
+			continue
+		}
+		if n < sha256.Size || !hmac.Equal(buf[:sha256.Size], c.sign(buf[sha256.Size:n])) {
+			log.Printf("Cluster: ignored unsigned datagram from %s", from)
+			continue
+		}
+
+		var inv invalidation
+		if err := json.Unmarshal(buf[sha256.Size:n], &inv); err != nil {
+			log.Printf("Cluster: invalid datagram from %s: %v", from, err)
+			continue
+		}
+		if inv.Node == c.node {
+			continue
+		}
+		c.cache.invalidate(inv.Scope, inv.Tables)
+	}
+}
+
+// Close stops listening.
+func (c *cluster) Close() error {
+	return c.conn.Close()
+}
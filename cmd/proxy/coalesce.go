@@ -0,0 +1,107 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// flightGroup runs the identical read queries received at once a single
+// time, their result sent to every client asking for it, so that a herd of
+// clients (e.g. on the expiry of a cached result) costs the backend one
+// query.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// flight is a query running for the requests waiting for its result.
+type flight struct {
+	done     chan struct{}
+	response *QueryResponse
+	err      error
+	// abandoned is set when the query was cancelled with its own session or
+	// by its timeout, the requests waiting running it again.
+	abandoned bool
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{flights: map[string]*flight{}}
+}
+
+// do returns the response of a query of the session, as run by run unless
+// an identical one is running already, whose response is shared. A nil
+// group runs every query.
+func (g *flightGroup) do(sess *session, req QueryRequest, key string, run func() (*QueryResponse, requestStats, error)) (*QueryResponse, requestStats, error) {
+	if g == nil {
+		return run()
+	}
+
+	for {
+		g.mu.Lock()
+		f := g.flights[key]
+		if f == nil {
+			f = &flight{done: make(chan struct{})}
+			g.flights[key] = f
+			g.mu.Unlock()
+
+			response, stats, err := run()
+			g.mu.Lock()
+			delete(g.flights, key)
+			g.mu.Unlock()
+			var coded *codedError
+			f.response, f.err = response, err
+			f.abandoned = err != nil && (sess.ctx.Err() != nil || errors.As(err, &coded) && coded.code.Class == classStatementTimeout)
+			close(f.done)
+			return response, stats, err
+		}
+		g.mu.Unlock()
+
+		// The admission slot is left to other requests while waiting.
+		priority := sess.requestPriority
+		sess.release()
+		sess.release = func() {}
+		ctx, cancel := sess.statementContext()
+		select {
+		case <-f.done:
+			cancel()
+		case <-ctx.Done():
+			cancel()
+			return nil, requestStats{}, sess.timeoutError(ctx, ctx.Err())
+		}
+		if f.abandoned {
+			if err := sess.admit(priority); err != nil {
+				return nil, requestStats{}, err
+			}
+			continue
+		}
+		if f.err != nil {
+			return nil, requestStats{}, f.err
+		}
+
+		coalescedTotal.add(1, sess.tenant)
+		sess.logf("Coalesced: %s", logged(req.Query, req.Args))
+		response := *f.response
+		response.TraceID = sess.traceID
+		return &response, requestStats{rows: int64(len(response.Data))}, nil
+	}
+}
+
+// handleCoalescedQuery runs a read query, or waits for the result of an
+// identical one running.
+func handleCoalescedQuery(sess *session, req QueryRequest) (requestStats, error) {
+	key, err := sess.cacheKey(req)
+	if err != nil {
+		return requestStats{}, err
+	}
+
+	response, stats, err := sess.flights.do(sess, req, key, func() (*QueryResponse, requestStats, error) {
+		return routedQuery(sess, req)
+	})
+	if err != nil {
+		return stats, err
+	}
+	stats.bytes = int64(sendResponse(sess.conn, response))
+
+	return stats, nil
+}
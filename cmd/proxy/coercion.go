@@ -0,0 +1,180 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arkan/sqlproxy/internal/sqltext"
+	"github.com/pkg/errors"
+)
+
+// coercionConfig converts the parameters bound to a column to its type: some
+// ODBC drivers reject the generic values decoded from msgpack, such as a
+// string for a timestamp column or a float for a decimal one.
+type coercionConfig struct {
+	// Column, as "table.column" or "*.column" for every table.
+	Column string `json:"column"`
+	// Type: a stored query parameter type, date or decimal.
+	Type string `json:"type"`
+	// Layouts of the strings converted to times and dates, in the syntax of
+	// the Go time package, in the time zone of the backend (-time-zone)
+	// unless they have one. RFC 3339, "2006-01-02 15:04:05" and "2006-01-02"
+	// by default.
+	Layouts []string `json:"layouts"`
+}
+
+// defaultLayouts are the layouts of the strings converted to times by
+// default.
+var defaultLayouts = []string{time.RFC3339Nano, "2006-01-02 15:04:05.999999999", "2006-01-02"}
+
+func (c *coercionConfig) validate() error {
+	if c.Column == "" {
+		return errors.New("column is required")
+	}
+	if !paramTypes[c.Type] && c.Type != "date" && c.Type != "decimal" {
+		return errors.Errorf("unknown type %q", c.Type)
+	}
+
+	return nil
+}
+
+// coerce converts a value to the type of the column. NULL is accepted for
+// every type.
+func (c *coercionConfig) coerce(v interface{}) (interface{}, error) {
+	s, isString := v.(string)
+	switch {
+	case v == nil:
+		return nil, nil
+	case c.Type == "decimal":
+		return decimalParam(v)
+	case (c.Type == "time" || c.Type == "date") && isString:
+		t, err := c.parseTime(s)
+		if err != nil {
+			return nil, err
+		}
+		v = t
+	}
+	if c.Type != "date" {
+		return coerceParam(c.Type, v)
+	}
+
+	t, err := coerceParam("time", v)
+	if err != nil {
+		return nil, err
+	}
+	date := t.(time.Time)
+	y, m, d := date.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, date.Location()), nil
+}
+
+// parseTime parses a time with the layouts of the column.
+func (c *coercionConfig) parseTime(s string) (time.Time, error) {
+	layouts := c.Layouts
+	if len(layouts) == 0 {
+		layouts = defaultLayouts
+	}
+
+	for _, layout := range layouts {
+		if t, err := time.ParseInLocation(layout, s, backendLocation); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.Errorf("cannot parse %q as a time (%s)", s, strings.Join(layouts, ", "))
+}
+
+// decimalParam converts a number to a decimal string, bound exactly whatever
+// the type of the column.
+func decimalParam(v interface{}) (interface{}, error) {
+	if n, ok := toInt64(v); ok {
+		return strconv.FormatInt(n, 10), nil
+	}
+	switch n := v.(type) {
+	case uint64:
+		return strconv.FormatUint(n, 10), nil
+	case float32:
+		return strconv.FormatFloat(float64(n), 'f', -1, 32), nil
+	case float64:
+		return strconv.FormatFloat(n, 'f', -1, 64), nil
+	case string:
+		if isDecimal(n) {
+			return n, nil
+		}
+		return nil, errors.Errorf("%q is not a decimal number", n)
+	}
+
+	return nil, errors.Errorf("cannot use %T as decimal", v)
+}
+
+// isDecimal reports whether s is a decimal number, signed or not, e.g.
+// "-12.50".
+func isDecimal(s string) bool {
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "-"), "+")
+	digits, dot := 0, false
+	for _, c := range s {
+		switch {
+		case c >= '0' && c <= '9':
+			digits++
+		case c == '.' && !dot:
+			dot = true
+		default:
+			return false
+		}
+	}
+
+	return digits > 0
+}
+
+// coerceArgs converts the arguments of a query bound to the columns of
+// coercion rules, comparing them, assigning them or inserted into them.
+func coerceArgs(coercions []coercionConfig, query string, args []interface{}) error {
+	if len(coercions) == 0 || len(args) == 0 {
+		return nil
+	}
+
+	tokens := sqltext.Tokenize(query)
+	refs := sqltext.TableRefs(tokens)
+	for i, column := range sqltext.PlaceholderColumns(tokens) {
+		if i >= len(args) {
+			break
+		}
+		if column == "" {
+			continue
+		}
+		qualifier, name := "", column
+		if j := strings.LastIndexByte(column, '.'); j >= 0 {
+			qualifier, name = column[:j], column[j+1:]
+		}
+		columnRefs := qualifiedRefs(refs, qualifier)
+		for j := range coercions {
+			c := &coercions[j]
+			if !columnMatches(c.Column, columnRefs, name) {
+				continue
+			}
+			v, err := c.coerce(args[i])
+			if err != nil {
+				return errors.Errorf("parameter %d (%s): %v", i+1, column, err)
+			}
+			args[i] = v
+			break
+		}
+	}
+
+	return nil
+}
+
+// qualifiedRefs returns the tables a column qualifier names, by alias or
+// name, all of them when the column isn't qualified.
+func qualifiedRefs(refs []sqltext.TableRef, qualifier string) []sqltext.TableRef {
+	if qualifier == "" {
+		return refs
+	}
+
+	var result []sqltext.TableRef
+	for _, ref := range refs {
+		if strings.EqualFold(ref.Alias, qualifier) || ref.Alias == "" && ref.Matches(qualifier) {
+			result = append(result, ref)
+		}
+	}
+	return result
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/arkan/sqlproxy/internal/frame"
+	"github.com/pkg/errors"
+)
+
+// parseCompressions returns the compression algorithms of -compression,
+// none when empty.
+func parseCompressions(algorithms string) ([]string, error) {
+	var accepted []string
+	for _, alg := range strings.Split(algorithms, ",") {
+		if alg = strings.TrimSpace(alg); alg == "" {
+			continue
+		}
+		if frame.Negotiate([]string{alg}, frame.Compressions) == "" {
+			return nil, errors.Errorf("unknown compression algorithm %q (%s)", alg, strings.Join(frame.Compressions, ", "))
+		}
+		accepted = append(accepted, alg)
+	}
+
+	return accepted, nil
+}
+
+// negotiateCompression returns the algorithm and compressor of a session,
+// among the algorithms offered by its client, compressing the frames of at
+// least min bytes. The frames aren't compressed when none is accepted.
+func (srv *server) negotiateCompression(offered []string, min int) (string, *frame.Compressor) {
+	alg := frame.Negotiate(offered, srv.compressions)
+	if alg == "" {
+		return "", nil
+	}
+	compressor, err := frame.NewCompressor(alg, min)
+	if err != nil {
+		return "", nil
+	}
+
+	return alg, compressor
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// proxyConfig is the content of the -config file, holding the settings that
+// don't fit in flags.
+type proxyConfig struct {
+	// Tenants by name, each one with its own backend.
+	Tenants map[string]*tenantConfig `json:"tenants"`
+	// Identities by user name. When set, clients must authenticate.
+	Identities map[string]*identityConfig `json:"identities"`
+	// Settings of the identities by role.
+	Roles map[string]*roleConfig `json:"roles"`
+	// Column masks, applied to the results of identities without the
+	// "unmasked" role.
+	Masks []maskConfig `json:"masks"`
+	// Types of the columns whose values are sent tagged.
+	Types []typeConfig `json:"types"`
+	// Types the parameters bound to columns are converted to.
+	Coercions []coercionConfig `json:"coercions"`
+	// Columns holding binary strings, not decoded with the charset of the
+	// backend, as "table.column" or "*.column".
+	BinaryColumns []string `json:"binary_columns"`
+	// Patterns of the statements rejected before they run.
+	Deny []denyRule `json:"deny"`
+	// Stored queries by name, invoked by clients with "@name".
+	Queries map[string]*storedQuery `json:"queries"`
+	// Named backends, and the routes of the statements of the default
+	// backend to them.
+	Backends map[string]*backendConfig `json:"backends"`
+	Routes   []routeConfig             `json:"routes"`
+	// Databases the statements of the default backend may select, by name.
+	Databases map[string]*databaseConfig `json:"databases"`
+	// Shards and read replicas of the default backend.
+	Sharding *shardingConfig `json:"sharding"`
+	Replicas *replicaConfig  `json:"replicas"`
+	// Canary of the default backend, a named backend.
+	Canary *canaryConfig `json:"canary"`
+	// Blue/green named backends replacing the default one.
+	BlueGreen *blueGreenConfig `json:"blue_green"`
+	// Result cache of the queries reading rarely modified tables.
+	Cache *cacheConfig `json:"cache"`
+	// Queries polled for changes, notified to the listeners of their
+	// channel.
+	Watches []watchConfig `json:"watches"`
+	// Targets of the log streams.
+	Logging *loggingConfig `json:"logging"`
+	// Thresholds of the estimates of the planner for the queries.
+	CostGuard *costGuardConfig `json:"cost_guard"`
+	// Webhooks posted alerts when error or availability thresholds are
+	// crossed.
+	Alerts []alertConfig `json:"alerts"`
+}
+
+// tenantConfig describes a tenant and its dedicated backend. Tenants sharing a
+// server but not a schema can select it with a DSN attribute (e.g. Database=).
+type tenantConfig struct {
+	DSN string `json:"dsn"`
+	// SQL dialect of the backend, -dialect by default.
+	Dialect string `json:"dialect"`
+	// Charset of the text of the backend, -charset by default.
+	Charset      string `json:"charset"`
+	MaxOpenConns int    `json:"max_open_conns"`
+	MaxIdleConns int    `json:"max_idle_conns"`
+	// Connections opened at startup (see -warm-conns).
+	WarmConns int `json:"warm_conns"`
+	// Admission queue of the backend (see -max-concurrent).
+	MaxConcurrent int      `json:"max_concurrent"`
+	MaxQueue      int      `json:"max_queue"`
+	QueueTimeout  duration `json:"queue_timeout"`
+	// Quota shared by every identity of the tenant.
+	Quota *quotaConfig `json:"quota"`
+	// Row-level security predicates by table, applied to every identity of
+	// the tenant.
+	RowPolicies map[string]string `json:"row_policies"`
+	// Routes of the statements of the tenant to named backends.
+	Routes []routeConfig `json:"routes"`
+	// Databases the statements of the tenant may select, by name.
+	Databases map[string]*databaseConfig `json:"databases"`
+	// Shards and read replicas of the tenant backend.
+	Sharding *shardingConfig `json:"sharding"`
+	Replicas *replicaConfig  `json:"replicas"`
+	// Canary of the tenant backend, a named backend.
+	Canary *canaryConfig `json:"canary"`
+}
+
+// identityConfig describes a client identity.
+type identityConfig struct {
+	// Password in clear text, or "sha256:" followed by its hex digest.
+	Password string `json:"password"`
+	// Tenant the identity belongs to. Identities without a tenant use the
+	// default backend (-dsn).
+	Tenant string `json:"tenant"`
+	// Quota of an identity without a tenant.
+	Quota *quotaConfig `json:"quota"`
+	// Roles granted to the identity.
+	Roles []string `json:"roles"`
+	// Default priority class of the requests of the identity in the
+	// admission queue: interactive, normal (default) or batch.
+	Priority string `json:"priority"`
+	// Weight of the identity when clients contend for the backend: an
+	// identity of weight 2 gets twice the share of one of weight 1 (the
+	// default).
+	Weight float64 `json:"weight"`
+	// Longest time a statement of the identity may run, instead of that of
+	// its roles or -statement-timeout.
+	StatementTimeout duration `json:"statement_timeout"`
+	// Bytes per second sent to the connections of the identity, shared by
+	// all of them (unlimited when 0).
+	EgressRate int64 `json:"egress_rate"`
+	// Attributes usable as :name variables in row policies, along with :user
+	// and :tenant.
+	Attributes map[string]string `json:"attributes"`
+	// Row-level security predicates by table (e.g. "tenant_id = :tenant_id"),
+	// added to the statements reading or modifying these tables.
+	RowPolicies map[string]string `json:"row_policies"`
+}
+
+// quotaConfig limits the work done for an account over a window of time.
+type quotaConfig struct {
+	// Window over which usage is counted, one hour by default.
+	Window         duration `json:"window"`
+	MaxQueries     int64    `json:"max_queries"`
+	MaxRows        int64    `json:"max_rows"`
+	MaxBytes       int64    `json:"max_bytes"`
+	MaxBackendTime duration `json:"max_backend_time"`
+	// Action when the quota is exceeded: "reject" (default) fails the
+	// requests, "throttle" holds them until the window resets.
+	Action string `json:"action"`
+}
+
+func (q *quotaConfig) validate() error {
+	if q.Action != "" && q.Action != "reject" && q.Action != "throttle" {
+		return errors.Errorf("unknown action %s", q.Action)
+	}
+
+	return nil
+}
+
+func (q *quotaConfig) window() time.Duration {
+	if q.Window.Duration <= 0 {
+		return defaultQuotaWindow
+	}
+	return q.Window.Duration
+}
+
+// duration is a time.Duration written as a string (e.g. "1h30m") in JSON.
+type duration struct {
+	time.Duration
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// loadConfig reads and validates a configuration file.
+func loadConfig(path string) (*proxyConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg proxyConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", path)
+	}
+
+	for _, mask := range cfg.Masks {
+		if mask.Column == "" {
+			return nil, errors.New("mask: column is required")
+		}
+		if mask.Action != "" && mask.Action != "mask" && mask.Action != "null" {
+			return nil, errors.Errorf("mask %s: unknown action %s", mask.Column, mask.Action)
+		}
+	}
+	for name, role := range cfg.Roles {
+		if role.StatementTimeout.Duration < 0 {
+			return nil, errors.Errorf("role %s: statement timeout must be positive", name)
+		}
+	}
+	for i := range cfg.Types {
+		if err := cfg.Types[i].validate(); err != nil {
+			return nil, errors.Wrapf(err, "type %d", i+1)
+		}
+	}
+	for i := range cfg.Coercions {
+		if err := cfg.Coercions[i].validate(); err != nil {
+			return nil, errors.Wrapf(err, "coercion %d", i+1)
+		}
+	}
+	for i := range cfg.Deny {
+		if err := cfg.Deny[i].validate(cfg.Identities); err != nil {
+			return nil, errors.Wrapf(err, "deny rule %d", i+1)
+		}
+	}
+	for name, q := range cfg.Queries {
+		if err := q.validate(); err != nil {
+			return nil, errors.Wrapf(err, "stored query %s", name)
+		}
+	}
+	for name, b := range cfg.Backends {
+		if b.DSN == "" {
+			return nil, errors.Errorf("backend %s: dsn is required", name)
+		}
+	}
+	for i := range cfg.Routes {
+		if err := cfg.Routes[i].validate(cfg.Backends); err != nil {
+			return nil, errors.Wrapf(err, "route %d", i+1)
+		}
+	}
+	for name, db := range cfg.Databases {
+		if err := db.validate(name, cfg.Backends); err != nil {
+			return nil, errors.Wrapf(err, "database %s", name)
+		}
+	}
+	if cfg.Sharding != nil {
+		if err := cfg.Sharding.validate(); err != nil {
+			return nil, errors.Wrap(err, "sharding")
+		}
+	}
+	if cfg.Replicas != nil {
+		if err := cfg.Replicas.validate(); err != nil {
+			return nil, errors.Wrap(err, "replicas")
+		}
+	}
+	if cfg.Canary != nil {
+		if err := cfg.Canary.validate(cfg.Backends, cfg.Identities); err != nil {
+			return nil, errors.Wrap(err, "canary")
+		}
+	}
+	if cfg.BlueGreen != nil {
+		if err := cfg.BlueGreen.validate(cfg.Backends); err != nil {
+			return nil, errors.Wrap(err, "blue/green")
+		}
+		// The replicas are those of one of them.
+		if cfg.Replicas != nil {
+			return nil, errors.New("blue/green backends can't have replicas")
+		}
+	}
+	if cfg.Cache != nil {
+		if err := cfg.Cache.validate(cfg.Identities); err != nil {
+			return nil, errors.Wrap(err, "cache")
+		}
+	}
+	for i := range cfg.Watches {
+		if err := cfg.Watches[i].validate(cfg.Tenants); err != nil {
+			return nil, errors.Wrapf(err, "watch %d", i+1)
+		}
+	}
+	if cfg.CostGuard != nil {
+		if err := cfg.CostGuard.validate(); err != nil {
+			return nil, errors.Wrap(err, "cost guard")
+		}
+	}
+	for i := range cfg.Alerts {
+		if err := cfg.Alerts[i].validate(); err != nil {
+			return nil, errors.Wrapf(err, "alert %d", i+1)
+		}
+	}
+	if cfg.Logging != nil {
+		if err := cfg.Logging.validate(); err != nil {
+			return nil, errors.Wrap(err, "logging")
+		}
+	}
+	for name, tenant := range cfg.Tenants {
+		if tenant.DSN == "" {
+			return nil, errors.Errorf("tenant %s: dsn is required", name)
+		}
+		for i := range tenant.Routes {
+			if err := tenant.Routes[i].validate(cfg.Backends); err != nil {
+				return nil, errors.Wrapf(err, "tenant %s: route %d", name, i+1)
+			}
+		}
+		for dbName, db := range tenant.Databases {
+			if err := db.validate(dbName, cfg.Backends); err != nil {
+				return nil, errors.Wrapf(err, "tenant %s: database %s", name, dbName)
+			}
+		}
+		if tenant.Sharding != nil {
+			if err := tenant.Sharding.validate(); err != nil {
+				return nil, errors.Wrapf(err, "tenant %s: sharding", name)
+			}
+		}
+		if tenant.Replicas != nil {
+			if err := tenant.Replicas.validate(); err != nil {
+				return nil, errors.Wrapf(err, "tenant %s: replicas", name)
+			}
+		}
+		if tenant.Canary != nil {
+			if err := tenant.Canary.validate(cfg.Backends, cfg.Identities); err != nil {
+				return nil, errors.Wrapf(err, "tenant %s: canary", name)
+			}
+		}
+		if tenant.Quota != nil {
+			if err := tenant.Quota.validate(); err != nil {
+				return nil, errors.Wrapf(err, "tenant %s: quota", name)
+			}
+		}
+	}
+	for name, identity := range cfg.Identities {
+		if identity.Quota != nil && identity.Tenant != "" {
+			return nil, errors.Errorf("identity %s: quotas of identities with a tenant are set on the tenant", name)
+		}
+		if identity.Quota != nil {
+			if err := identity.Quota.validate(); err != nil {
+				return nil, errors.Wrapf(err, "identity %s: quota", name)
+			}
+		}
+		if identity.Tenant != "" && cfg.Tenants[identity.Tenant] == nil {
+			return nil, errors.Errorf("identity %s: unknown tenant %s", name, identity.Tenant)
+		}
+		if _, err := parsePriority(identity.Priority); err != nil {
+			return nil, errors.Wrapf(err, "identity %s", name)
+		}
+		if identity.Weight < 0 {
+			return nil, errors.Errorf("identity %s: weight must be positive", name)
+		}
+		if identity.StatementTimeout.Duration < 0 {
+			return nil, errors.Errorf("identity %s: statement timeout must be positive", name)
+		}
+		if identity.EgressRate < 0 {
+			return nil, errors.Errorf("identity %s: egress rate must be positive", name)
+		}
+	}
+
+	return &cfg, nil
+}
+
+// hasRole reports whether the identity has been granted a role.
+func (i *identityConfig) hasRole(role string) bool {
+	for _, r := range i.Roles {
+		if r == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkPassword reports whether password matches the configured one.
+func (i *identityConfig) checkPassword(password string) bool {
+	want := i.Password
+	if digest, ok := strings.CutPrefix(want, "sha256:"); ok {
+		sum := sha256.Sum256([]byte(password))
+		password, want = hex.EncodeToString(sum[:]), strings.ToLower(digest)
+	}
+
+	return subtle.ConstantTimeCompare([]byte(password), []byte(want)) == 1
+}
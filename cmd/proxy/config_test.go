@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigQuotaAction(t *testing.T) {
+	tests := []struct {
+		config string
+		err    string
+	}{
+		{`{"identities": {"a": {"quota": {"max_queries": 1}}}}`, ""},
+		{`{"identities": {"a": {"quota": {"max_queries": 1, "action": "throttle"}}}}`, ""},
+		{`{"identities": {"a": {"quota": {"max_queries": 1, "action": "rejct"}}}}`, "identity a: quota: unknown action rejct"},
+		{`{"tenants": {"t": {"dsn": "x", "quota": {"max_queries": 1, "action": "reject"}}}}`, ""},
+		{`{"tenants": {"t": {"dsn": "x", "quota": {"max_queries": 1, "action": "wait"}}}}`, "tenant t: quota: unknown action wait"},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "config.json")
+		if err := os.WriteFile(path, []byte(test.config), 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := loadConfig(path)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("loadConfig(%s): %v", test.config, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("loadConfig(%s) = %v, want %q", test.config, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// connInfo describes a client connection in the admin connection list.
+type connInfo struct {
+	RemoteAddr    string `json:"remote_addr"`
+	User          string `json:"user,omitempty"`
+	Tenant        string `json:"tenant,omitempty"`
+	Application   string `json:"application,omitempty"`
+	ClientVersion string `json:"client_version,omitempty"`
+	// Blue/green backend of the session, if any.
+	Backend     string            `json:"backend,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	ConnectedAt time.Time         `json:"connected_at"`
+	Requests    int64             `json:"requests"`
+}
+
+// trackConn adds a session to the connection list.
+func (s *server) trackConn(sess *session) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	s.conns[sess] = &connInfo{RemoteAddr: sess.conn.RemoteAddr().String(), Backend: sess.blueGreen, ConnectedAt: time.Now()}
+}
+
+// untrackConn removes a session from the connection list.
+func (s *server) untrackConn(sess *session) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	delete(s.conns, sess)
+}
+
+// updateConn updates the entry of a session in the connection list.
+func (s *server) updateConn(sess *session, update func(info *connInfo)) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	if info := s.conns[sess]; info != nil {
+		update(info)
+	}
+}
+
+// closeSessions closes the client connections of the sessions matching a
+// filter, ending them, and returns their number.
+func (s *server) closeSessions(match func(info *connInfo) bool) int {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	var n int
+	for sess, info := range s.conns {
+		if match(info) {
+			sess.conn.Close()
+			n++
+		}
+	}
+	return n
+}
+
+// connections returns the connection list, oldest first.
+func (s *server) connections() []connInfo {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	list := make([]connInfo, 0, len(s.conns))
+	for _, info := range s.conns {
+		list = append(list, *info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ConnectedAt.Before(list[j].ConnectedAt) })
+
+	return list
+}
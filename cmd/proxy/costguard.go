@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/arkan/sqlproxy/internal/sqltext"
+	"github.com/pkg/errors"
+)
+
+// defaultCostGuardTimeout is the longest time the plan of a query may take
+// by default.
+const defaultCostGuardTimeout = time.Second
+
+// costGuardConfig checks the estimates of the planner before the SELECT
+// statements run, on the backends whose dialect has them (postgres, mysql),
+// to keep queries such as accidental cartesian joins off the backend.
+type costGuardConfig struct {
+	// Highest estimated cost, in the units of the planner, and rows.
+	// Thresholds left to 0 are not checked.
+	MaxCost float64 `json:"max_cost"`
+	MaxRows float64 `json:"max_rows"`
+	// Action on the queries over a threshold: "reject" (default) fails
+	// them, "deprioritize" runs them in the batch priority class.
+	Action string `json:"action"`
+	// Longest time the plan may take, one second by default. Queries whose
+	// plan fails or times out run unchecked.
+	Timeout duration `json:"timeout"`
+}
+
+func (c *costGuardConfig) validate() error {
+	if c.MaxCost < 0 || c.MaxRows < 0 || c.Timeout.Duration < 0 {
+		return errors.New("max cost, max rows and timeout must be positive")
+	}
+	if c.MaxCost == 0 && c.MaxRows == 0 {
+		return errors.New("no threshold set")
+	}
+	if c.Action != "" && c.Action != "reject" && c.Action != "deprioritize" {
+		return errors.Errorf("unknown action %s", c.Action)
+	}
+
+	return nil
+}
+
+func (c *costGuardConfig) timeout() time.Duration {
+	if c.Timeout.Duration == 0 {
+		return defaultCostGuardTimeout
+	}
+	return c.Timeout.Duration
+}
+
+// planEstimate is the cost and number of rows of a query estimated by the
+// planner.
+type planEstimate struct {
+	cost, rows float64
+}
+
+// checkCost returns an error when the estimates of a SELECT statement are
+// over the thresholds of the cost guard, after moving the request to the
+// batch priority class when the action is to deprioritize it.
+func checkCost(sess *session, guard *costGuardConfig, query string, args []interface{}) error {
+	if sqltext.Statement(sqltext.Tokenize(query)) != "SELECT" {
+		return nil
+	}
+	_, b, err := sess.route(query, args)
+	if err != nil {
+		return err
+	}
+	db := sess.db()
+	if b != nil {
+		db = b.DB()
+	} else {
+		b = sess.backend
+	}
+	if b.dialect.estimate == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(sess.ctx, guard.timeout())
+	defer cancel()
+	estimate, err := b.dialect.estimate(ctx, db, query, args)
+	if err != nil {
+		if sess.ctx.Err() != nil {
+			return err
+		}
+		sess.logf("Cost estimate error, query run unchecked: %v", err)
+		return nil
+	}
+
+	var over string
+	switch {
+	case guard.MaxCost > 0 && estimate.cost > guard.MaxCost:
+		over = fmt.Sprintf("estimated cost %.0f is over %.0f", estimate.cost, guard.MaxCost)
+	case guard.MaxRows > 0 && estimate.rows > guard.MaxRows:
+		over = fmt.Sprintf("estimated %.0f rows are over %.0f", estimate.rows, guard.MaxRows)
+	default:
+		return nil
+	}
+
+	action := guard.Action
+	if action == "" {
+		action = "reject"
+	}
+	costlyQueries.add(1, sess.tenant, action)
+	sess.logf("Costly query %s (%s): %s", action, over, loggedQuery(query))
+	if action == "deprioritize" {
+		return sess.deprioritize()
+	}
+	return &codedError{
+		msg:  "query rejected: " + over,
+		code: errorCode{Code: "54000", Class: classCostLimit},
+	}
+}
+
+// postgresEstimate reads the estimates of the root of the plan of a query.
+func postgresEstimate(ctx context.Context, db querier, query string, args []interface{}) (planEstimate, error) {
+	plan, err := queryPlan(ctx, db, "EXPLAIN (FORMAT JSON) "+query, args)
+	if err != nil {
+		return planEstimate{}, err
+	}
+
+	var plans []struct {
+		Plan struct {
+			Cost float64 `json:"Total Cost"`
+			Rows float64 `json:"Plan Rows"`
+		}
+	}
+	if err := json.Unmarshal(plan, &plans); err != nil || len(plans) == 0 {
+		return planEstimate{}, errors.New("unexpected plan format")
+	}
+	return planEstimate{cost: plans[0].Plan.Cost, rows: plans[0].Plan.Rows}, nil
+}
+
+// mysqlEstimate reads the cost of the plan of a query, that of its outer
+// query block being the largest, and the most rows produced by its joins.
+func mysqlEstimate(ctx context.Context, db querier, query string, args []interface{}) (planEstimate, error) {
+	plan, err := queryPlan(ctx, db, "EXPLAIN FORMAT=JSON "+query, args)
+	if err != nil {
+		return planEstimate{}, err
+	}
+
+	var tree interface{}
+	if err := json.Unmarshal(plan, &tree); err != nil {
+		return planEstimate{}, errors.New("unexpected plan format")
+	}
+	return planEstimate{cost: maxJSONNumber(tree, "query_cost"), rows: maxJSONNumber(tree, "rows_produced_per_join")}, nil
+}
+
+// queryPlan returns the first column of the first row of an EXPLAIN
+// statement.
+func queryPlan(ctx context.Context, db querier, explain string, args []interface{}) ([]byte, error) {
+	rows, err := db.QueryContext(ctx, explain, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("empty plan")
+	}
+	var plan []byte
+	if err := rows.Scan(&plan); err != nil {
+		return nil, err
+	}
+	return plan, rows.Err()
+}
+
+// maxJSONNumber returns the largest value of the fields of a name in a
+// decoded JSON document, numbers or numeric strings.
+func maxJSONNumber(v interface{}, name string) float64 {
+	var largest float64
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			var n float64
+			switch field := field.(type) {
+			case float64:
+				n = field
+			case string:
+				n, _ = strconv.ParseFloat(field, 64)
+			}
+			if key == name && n > largest {
+				largest = n
+			}
+			largest = max(largest, maxJSONNumber(field, name))
+		}
+	case []interface{}:
+		for _, item := range v {
+			largest = max(largest, maxJSONNumber(item, name))
+		}
+	}
+
+	return largest
+}
+
+// deprioritize moves the request being handled to the batch priority class,
+// waiting for a slot of it.
+func (sess *session) deprioritize() error {
+	if sess.requestPriority == priorityBatch {
+		return nil
+	}
+
+	sess.release()
+	sess.release = func() {}
+	return sess.admit(priorityBatch)
+}
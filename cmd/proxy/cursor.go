@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack"
+)
+
+// Cursor limits.
+const (
+	maxCursors   = 16
+	maxFetchRows = 10000
+)
+
+// defaultResumeTimeout is how long resumable cursors are kept open after
+// their client disconnected.
+const defaultResumeTimeout = time.Minute
+
+// Open cursor request struct. The statement runs and its result stays open
+// on the backend until the cursor is closed, the client fetching its rows in
+// pages. A resumable cursor outlives its connection for a while, and can be
+// resumed from another one with its token.
+type OpenCursorRequest struct {
+	Op        string        `msgpack:"op"`
+	Query     string        `msgpack:"query"`
+	Args      []interface{} `msgpack:"args"`
+	TraceID   string        `msgpack:"trace_id"`
+	Priority  string        `msgpack:"priority"`
+	Resumable bool          `msgpack:"resumable"`
+}
+
+// Cursor response struct. Token is set for resumable cursors, and Types are
+// those of the typed columns.
+type CursorResponse struct {
+	Cursor  int64    `msgpack:"cursor"`
+	Columns []string `msgpack:"columns"`
+	Types   []string `msgpack:"types"`
+	Token   string   `msgpack:"token"`
+	TraceID string   `msgpack:"trace_id"`
+	Error   string   `msgpack:"error"`
+}
+
+// Fetch request struct, answered by a QueryResponse with up to Rows rows,
+// More being set until the end of the result.
+type FetchRequest struct {
+	Op     string `msgpack:"op"`
+	Cursor int64  `msgpack:"cursor"`
+	Rows   int    `msgpack:"rows"`
+}
+
+// Close cursor request struct, answered by a CursorResponse.
+type CloseCursorRequest struct {
+	Op     string `msgpack:"op"`
+	Cursor int64  `msgpack:"cursor"`
+}
+
+// Resume cursor request struct, answered by a CursorResponse with the ID of
+// the cursor in the new session. Offset is the number of rows the client
+// received: the last page is sent again when its response was lost.
+type ResumeCursorRequest struct {
+	Op     string `msgpack:"op"`
+	Token  string `msgpack:"token"`
+	Offset int64  `msgpack:"offset"`
+}
+
+// cursor is an open result of a session.
+type cursor struct {
+	rows   *sql.Rows
+	cols   []string
+	format *rowFormat
+
+	// Context of the statement, running until the cursor is closed. That of
+	// resumable cursors isn't a child of the session one, cancelled on
+	// disconnect. They have a token, and stay in the session once fetched
+	// to the end, so that the last page can be sent again.
+	ctx    context.Context
+	cancel context.CancelFunc
+	token  string
+	user   string
+	tenant string
+	done   bool
+	// Rows sent, and the last page of them.
+	offset int64
+	last   [][]interface{}
+	replay bool
+	// lastSize is the approximate memory of the last page.
+	lastSize int64
+	// expire closes a detached cursor.
+	expire *time.Timer
+}
+
+// close the cursor result.
+func (c *cursor) close() {
+	c.rows.Close()
+	c.cancel()
+}
+
+func handleOpenCursor(sess *session, srv *server, data []byte) (requestStats, error) {
+	var open OpenCursorRequest
+	if err := msgpack.Unmarshal(data, &open); err != nil {
+		return requestStats{}, err
+	}
+	if err := checkLimits(open.Query, open.Args); err != nil {
+		return requestStats{}, err
+	}
+	if len(sess.cursors) >= maxCursors {
+		return requestStats{}, errors.Errorf("too many open cursors (%d)", maxCursors)
+	}
+
+	req := QueryRequest{Query: open.Query, Args: open.Args}
+	if err := prepareStatement(sess, srv, &req); err != nil {
+		return requestStats{}, err
+	}
+	if sess.tx != nil {
+		// Their rows would be read between the statements of the transaction.
+		return requestStats{}, errors.New("cursors can't be opened in a transaction")
+	}
+	db := sess.db()
+	if _, b, err := sess.router.route(req.Query, req.Args); err != nil {
+		return requestStats{}, err
+	} else if b != nil {
+		db = b.DB()
+	} else if open.Resumable && sess.pinned != nil {
+		// The pinned connection is discarded with the session.
+		return requestStats{}, errors.New("resumable cursors are not supported after SET statements")
+	}
+	sess.logf("handleOpenCursor: %s", logged(req.Query, req.Args))
+
+	// The statement is listed as running, and under the timeout and the
+	// ceiling of the identity, until the cursor is closed.
+	c := &cursor{}
+	if open.Resumable {
+		token := make([]byte, 16)
+		if _, err := rand.Read(token); err != nil {
+			return requestStats{}, err
+		}
+		c.token, c.user, c.tenant = hex.EncodeToString(token), sess.user, sess.tenant
+		c.ctx, c.cancel = sess.watchedContextOf(context.Background(), req.Query)
+		// Opening the cursor is still cancelled with the session.
+		stop := context.AfterFunc(sess.ctx, c.cancel)
+		defer stop()
+	} else {
+		c.ctx, c.cancel = sess.watchedContext(req.Query)
+	}
+
+	var stats requestStats
+	start := time.Now()
+	rows, err := db.QueryContext(c.ctx, req.Query, req.Args...)
+	stats.duration = time.Since(start)
+	if err != nil {
+		c.cancel()
+		return stats, sess.timeoutError(c.ctx, err)
+	}
+	c.rows = rows
+	cols, err := rows.Columns()
+	if err != nil {
+		c.close()
+		return stats, err
+	}
+	c.cols, c.format = cols, sess.rowFormat(req.Query, req.Args, cols)
+
+	sess.lastCursor++
+	sess.cursors[sess.lastCursor] = c
+	stats.bytes = int64(sendResponse(sess.conn, CursorResponse{Cursor: sess.lastCursor, Columns: cols, Types: c.format.types, Token: c.token, TraceID: sess.traceID}))
+
+	return stats, nil
+}
+
+func handleFetch(sess *session, data []byte) (requestStats, error) {
+	var req FetchRequest
+	if err := msgpack.Unmarshal(data, &req); err != nil {
+		return requestStats{}, err
+	}
+	c := sess.cursors[req.Cursor]
+	if c == nil {
+		return requestStats{}, errors.Errorf("unknown cursor %d", req.Cursor)
+	}
+	n := req.Rows
+	if n <= 0 || n > maxFetchRows {
+		n = maxFetchRows
+	}
+
+	var stats requestStats
+	response := QueryResponse{More: !c.done, TraceID: sess.traceID}
+	if c.replay {
+		c.replay = false
+		response.Data = c.last
+	} else if !c.done {
+		start := time.Now()
+		// The last page is replaced.
+		c.last, c.lastSize = nil, 0
+		var size int64
+		sess.startQuery()
+		for len(response.Data) < n {
+			if !c.rows.Next() {
+				response.More = false
+				break
+			}
+			row := scanRow(c.rows, c.cols, c.format)
+			rowSize, err := sess.buffer(row)
+			if err != nil {
+				sess.closeCursor(req.Cursor)
+				return stats, err
+			}
+			response.Data = append(response.Data, row)
+			size += rowSize
+		}
+		stats.duration = time.Since(start)
+		c.offset += int64(len(response.Data))
+		c.last, c.lastSize = response.Data, size
+
+		if !response.More {
+			err := c.rows.Err()
+			c.done = true
+			if c.token == "" || err != nil {
+				sess.closeCursor(req.Cursor)
+			} else {
+				c.close()
+			}
+			if err != nil {
+				return stats, sess.timeoutError(c.ctx, err)
+			}
+		}
+	}
+
+	stats.rows = int64(len(response.Data))
+	stats.bytes = int64(sendResponse(sess.conn, response))
+
+	return stats, nil
+}
+
+func handleCloseCursor(sess *session, data []byte) (requestStats, error) {
+	var req CloseCursorRequest
+	if err := msgpack.Unmarshal(data, &req); err != nil {
+		return requestStats{}, err
+	}
+
+	// Cursors are closed once fetched to the end, closing them again is
+	// fine.
+	sess.closeCursor(req.Cursor)
+	return requestStats{bytes: int64(sendResponse(sess.conn, CursorResponse{Cursor: req.Cursor, TraceID: sess.traceID}))}, nil
+}
+
+func handleResumeCursor(sess *session, srv *server, data []byte) (requestStats, error) {
+	var req ResumeCursorRequest
+	if err := msgpack.Unmarshal(data, &req); err != nil {
+		return requestStats{}, err
+	}
+	if len(sess.cursors) >= maxCursors {
+		return requestStats{}, errors.Errorf("too many open cursors (%d)", maxCursors)
+	}
+
+	c := srv.attachCursor(req.Token, sess)
+	if c == nil {
+		return requestStats{}, errors.New("unknown or expired cursor")
+	}
+	switch req.Offset {
+	case c.offset:
+	case c.offset - int64(len(c.last)):
+		c.replay = true
+	default:
+		srv.detachCursor(c)
+		return requestStats{}, errors.Errorf("cannot resume at row %d, %d rows were sent", req.Offset, c.offset)
+	}
+	sess.logf("Resumed cursor at row %d", req.Offset)
+
+	sess.lastCursor++
+	sess.cursors[sess.lastCursor] = c
+	return requestStats{bytes: int64(sendResponse(sess.conn, CursorResponse{Cursor: sess.lastCursor, Columns: c.cols, Types: c.format.types, Token: c.token, TraceID: sess.traceID}))}, nil
+}
+
+// closeCursor closes a cursor of the session, if it is open.
+func (sess *session) closeCursor(id int64) {
+	if c := sess.cursors[id]; c != nil {
+		c.close()
+		delete(sess.cursors, id)
+	}
+}
+
+// closeCursors closes the cursors of a session ending, resumable ones being
+// detached until they are resumed or expire.
+func (sess *session) closeCursors(srv *server) {
+	for id, c := range sess.cursors {
+		delete(sess.cursors, id)
+		if c.token != "" {
+			srv.detachCursor(c)
+		} else {
+			c.close()
+		}
+	}
+}
+
+// detachCursor keeps a resumable cursor open for the resume timeout.
+func (s *server) detachCursor(c *cursor) {
+	s.cursorsMu.Lock()
+	defer s.cursorsMu.Unlock()
+
+	s.detached[c.token] = c
+	c.expire = time.AfterFunc(s.resumeTimeout, func() {
+		s.cursorsMu.Lock()
+		defer s.cursorsMu.Unlock()
+		if s.detached[c.token] == c {
+			delete(s.detached, c.token)
+			c.close()
+		}
+	})
+}
+
+// attachCursor returns the detached cursor of a token if it belongs to the
+// identity of the session, nil otherwise.
+func (s *server) attachCursor(token string, sess *session) *cursor {
+	s.cursorsMu.Lock()
+	defer s.cursorsMu.Unlock()
+
+	c := s.detached[token]
+	if c == nil || c.user != sess.user || c.tenant != sess.tenant {
+		return nil
+	}
+	c.expire.Stop()
+	delete(s.detached, token)
+
+	return c
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// readyEnv is the file descriptor of the pipe telling the process which
+// started the proxy, in the background or to restart, that it listens.
+const readyEnv = "SQLPROXY_READY_FD"
+
+// serviceHost is the service manager running the proxy, if any.
+type serviceHost interface {
+	// running tells that the proxy listens, stopped with stop when asked.
+	running(stop func())
+	// exited tells that the proxy stopped.
+	exited()
+}
+
+// notifyReady tells the process which started the proxy that it listens, if
+// it waits for it.
+func notifyReady() {
+	fd, err := strconv.Atoi(os.Getenv(readyEnv))
+	if err != nil {
+		return
+	}
+	os.Unsetenv(readyEnv)
+	ready := os.NewFile(uintptr(fd), "ready")
+	ready.Write([]byte{1})
+	ready.Close()
+}
+
+// writePidfile writes the PID of the process to a file, unless it holds the
+// PID of another running process than the one restarting the proxy.
+func writePidfile(path string) error {
+	if data, err := os.ReadFile(path); err == nil {
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err == nil && pid != os.Getpid() && pid != os.Getppid() && processRunning(pid) {
+			return errors.Errorf("the proxy is already running with PID %d (%s)", pid, path)
+		}
+	}
+
+	return errors.Wrap(os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644), "failed to write the pidfile")
+}
+
+// removePidfile removes the pidfile, unless the process restarting the
+// proxy wrote its own PID to it.
+func removePidfile(path string) {
+	data, err := os.ReadFile(path)
+	if err == nil && strings.TrimSpace(string(data)) == strconv.Itoa(os.Getpid()) {
+		os.Remove(path)
+	}
+}
+
+// handleSignals calls stop on SIGTERM or SIGINT, exiting right away on the
+// next one, reopens the log files on SIGHUP, e.g. once logrotate moved them,
+// and restarts the proxy on SIGUSR2.
+func handleSignals(stop func(), logs ...io.Closer) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, append([]os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGHUP}, restartSignals...)...)
+
+	stopping := false
+	for s := range signals {
+		if slices.Contains(restartSignals, s) {
+			if stopping {
+				continue
+			}
+			if err := restart(func() {
+				stopping = true
+				stop()
+			}); err != nil {
+				log.Println("Restart error:", err)
+			}
+			continue
+		}
+		if s == syscall.SIGHUP {
+			for _, l := range logs {
+				if f, ok := l.(*rotatingFile); ok {
+					if err := f.reopen(); err != nil {
+						log.Println("Log reopen error:", err)
+					}
+				}
+			}
+			continue
+		}
+		if stopping {
+			log.Fatalf("Received %s again, exiting", s)
+		}
+		stopping = true
+		log.Printf("Received %s, shutting down", s)
+		go stop()
+	}
+}
+
+// shutdown waits for the sessions to end, for up to a timeout after which
+// their connections are closed.
+func (s *server) shutdown(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		s.sessions.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-time.After(timeout):
+	}
+	if n := s.closeSessions(func(*connInfo) bool { return true }); n > 0 {
+		log.Printf("Closed %d sessions after the shutdown timeout", n)
+	}
+	<-done
+}
@@ -0,0 +1,25 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package main
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// daemonize isn't supported: Windows services are run by the service
+// manager.
+func daemonize() error {
+	return errors.New("-daemon is not supported on this platform")
+}
+
+// processRunning reports whether a process is running.
+func processRunning(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
@@ -0,0 +1,60 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// daemonize starts the proxy again in the background, in a new session
+// without a terminal, and exits once it listens, or fails with it. It
+// returns in the background process.
+func daemonize() error {
+	if os.Getenv(readyEnv) != "" {
+		return nil
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	null, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), readyEnv+"=3")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = null, null, null
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return errors.Wrap(err, "failed to start the proxy in the background")
+	}
+	w.Close()
+
+	// The pipe closes without a byte when it exits first.
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		err := cmd.Wait()
+		return errors.Errorf("the proxy exited at startup (%v), see its log", err)
+	}
+	log.Printf("Proxy running in the background with PID %d", cmd.Process.Pid)
+	os.Exit(0)
+
+	return nil
+}
+
+// processRunning reports whether a process is running.
+func processRunning(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
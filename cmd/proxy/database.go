@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+// databaseConfig is a database the statements of the clients may select by
+// name, on a connection reaching several: a named backend, or a database of
+// the backend of the client, switched to on its connections (USE, or the
+// search_path of PostgreSQL).
+type databaseConfig struct {
+	Backend string `json:"backend"`
+	// Database, or schema for PostgreSQL, switched to: the name of the entry
+	// by default.
+	Name string `json:"name"`
+}
+
+// databaseName matches the names of the databases switched to, inserted in
+// the statements.
+var databaseName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_$]*$`)
+
+func (c *databaseConfig) validate(name string, backends map[string]*backendConfig) error {
+	if c.Backend != "" {
+		if c.Name != "" {
+			return errors.New("backend and name are exclusive")
+		}
+		if backends[c.Backend] == nil {
+			return errors.Errorf("unknown backend %s", c.Backend)
+		}
+		return nil
+	}
+	if !databaseName.MatchString(c.name(name)) {
+		return errors.Errorf("invalid database name %q", c.name(name))
+	}
+
+	return nil
+}
+
+// name returns the database switched to by the entry of a name.
+func (c *databaseConfig) name(entry string) string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return entry
+}
+
+// databaseBackend returns the backend of a database selected by the clients
+// of a tenant ("" for the default backend), whose backend is b.
+func (s *server) databaseBackend(tenant string, b *backend, name string) (*backend, error) {
+	var databases map[string]*databaseConfig
+	if s.config != nil && tenant == "" {
+		databases = s.config.Databases
+	} else if s.config != nil && s.config.Tenants[tenant] != nil {
+		databases = s.config.Tenants[tenant].Databases
+	}
+	cfg := databases[name]
+	if cfg == nil {
+		return nil, errors.Errorf("unknown database %q", name)
+	}
+
+	if cfg.Backend != "" {
+		return s.backends[cfg.Backend], nil
+	}
+	if b == nil {
+		return nil, errors.New("there is no default DSN")
+	}
+	return b.database(cfg.name(name))
+}
+
+// database returns the backend of a database of the server of b, whose
+// connections switch to it, opened on first use.
+func (b *backend) database(name string) (*backend, error) {
+	if b.dialect.databaseSet == "" {
+		return nil, errors.Errorf("databases can't be switched to with the %s dialect", b.dialect.name)
+	}
+
+	b.databasesMu.Lock()
+	defer b.databasesMu.Unlock()
+	if db := b.databases[name]; db != nil {
+		return db, nil
+	}
+
+	// Pools are warmed up at startup only.
+	pool := b.pool
+	pool.warmConns = 0
+	pool.statements = append(pool.statements[:len(pool.statements):len(pool.statements)], fmt.Sprintf(b.dialect.databaseSet, name))
+	db, err := openBackend(b.DSN(), b.dialect, "", pool)
+	if err != nil {
+		return nil, errors.Wrapf(err, "database %s", name)
+	}
+	// Requests are admitted by the backend of their session.
+	db.charset, db.admission = b.charset, b.admission
+	if b.databases == nil {
+		b.databases = map[string]*backend{}
+	}
+	b.databases[name] = db
+	log.Printf("Opened the pool of database %s", name)
+
+	return db, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// retryDeadlocks runs a statement, again when it fails with a deadlock or a
+// serialization failure, up to -deadlock-retries times after a jittered
+// backoff doubled every time. The statements of a transaction, of the client
+// or of a multi request, are never retried: the backend rolled the whole
+// transaction back.
+func (sess *session) retryDeadlocks(ctx context.Context, run func() error) error {
+	err := run()
+	for attempt := 0; attempt < *deadlockRetries && err != nil && !sess.inTx && deadlocked(err); attempt++ {
+		backoff := *deadlockBackoff << attempt
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		sess.logf("Retrying in %s: %v", wait, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		deadlockRetried.add(1, sess.tenant)
+		err = run()
+	}
+
+	return err
+}
+
+// deadlocked reports whether a statement failed with a deadlock or a
+// serialization failure, and may succeed when run again.
+func deadlocked(err error) bool {
+	class := codeOf(err).Class
+	return class == classDeadlock || class == classSerialization
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+// denyRule rejects the statements matching a pattern, e.g. DELETE statements
+// without a WHERE clause, unless the identity is exempted.
+type denyRule struct {
+	// Regular expression matched against the statement.
+	Pattern string `json:"pattern"`
+	// Reason returned to the client, "statement denied" by default.
+	Reason string `json:"reason"`
+	// Identities the rule doesn't apply to.
+	Exempt []string `json:"exempt"`
+
+	re *regexp.Regexp
+}
+
+func (r *denyRule) validate(identities map[string]*identityConfig) error {
+	re, err := regexp.Compile(r.Pattern)
+	if err != nil {
+		return err
+	}
+	r.re = re
+
+	for _, name := range r.Exempt {
+		if identities[name] == nil {
+			return errors.Errorf("unknown identity %s", name)
+		}
+	}
+
+	return nil
+}
+
+// denyRules returns the rules applying to an identity.
+func denyRules(rules []denyRule, user string) []denyRule {
+	var applied []denyRule
+	for _, rule := range rules {
+		exempt := false
+		for _, name := range rule.Exempt {
+			if name == user {
+				exempt = true
+				break
+			}
+		}
+		if !exempt {
+			applied = append(applied, rule)
+		}
+	}
+
+	return applied
+}
+
+// checkDeny returns an error when a statement matches a deny rule of the
+// session.
+func checkDeny(sess *session, query string) error {
+	for _, rule := range sess.deny {
+		if !rule.re.MatchString(query) {
+			continue
+		}
+		sess.logf("Statement denied by %q: %s", rule.Pattern, loggedQuery(query))
+		if rule.Reason != "" {
+			return errors.Errorf("statement denied: %s", rule.Reason)
+		}
+		return errors.New("statement denied")
+	}
+
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// dialect holds what differs between the SQL of the backends. ODBC always
+// uses ? placeholders, whatever the backend.
+type dialect struct {
+	name string
+	// schemaQuery returns the statement listing the objects of a schema
+	// request, with the columns documented on SchemaRequest.
+	schemaQuery func(req *SchemaRequest) (string, []interface{}, error)
+	// explainPrefix is prepended to a statement to get its plan.
+	explainPrefix string
+	// explainOn and explainOff, when set, switch the connection to a mode
+	// where statements return their plan instead of running.
+	explainOn, explainOff string
+	// estimate returns the estimates of the planner for a query, if the
+	// dialect has them.
+	estimate func(ctx context.Context, db querier, query string, args []interface{}) (planEstimate, error)
+	// versionQuery returns the version of the backend server, if the
+	// dialect has one.
+	versionQuery string
+	// timeZoneSet and localeSet are the formats of the statements setting
+	// the time zone and locale of a connection, if the dialect has them.
+	timeZoneSet, localeSet []string
+	// databaseSet is the format of the statement switching a connection to
+	// a database, if the dialect has one.
+	databaseSet string
+	// positionQuery returns the replication position of a primary, the
+	// consistency token of its writes, and caughtUpQuery whether a replica
+	// has replayed them, if the dialect has them.
+	positionQuery, caughtUpQuery string
+}
+
+var dialects = map[string]*dialect{
+	"generic": {
+		name:          "generic",
+		schemaQuery:   informationSchemaQuery,
+		explainPrefix: "EXPLAIN ",
+	},
+	"postgres": {
+		name:          "postgres",
+		schemaQuery:   informationSchemaQuery,
+		explainPrefix: "EXPLAIN ",
+		estimate:      postgresEstimate,
+		versionQuery:  "SELECT version()",
+		timeZoneSet:   []string{"SET TIME ZONE '%s'"},
+		localeSet:     []string{"SET lc_monetary = '%s'", "SET lc_numeric = '%s'", "SET lc_time = '%s'"},
+		databaseSet:   `SET search_path TO "%s"`,
+		positionQuery: "SELECT CAST(pg_current_wal_lsn() AS text)",
+		caughtUpQuery: "SELECT pg_last_wal_replay_lsn() >= CAST(? AS pg_lsn)",
+	},
+	"mysql": {
+		name:          "mysql",
+		schemaQuery:   informationSchemaQuery,
+		explainPrefix: "EXPLAIN ",
+		estimate:      mysqlEstimate,
+		versionQuery:  "SELECT version()",
+		timeZoneSet:   []string{"SET time_zone = '%s'"},
+		localeSet:     []string{"SET lc_time_names = '%s'"},
+		databaseSet:   "USE `%s`",
+		positionQuery: "SELECT @@GLOBAL.gtid_executed",
+		caughtUpQuery: "SELECT GTID_SUBSET(?, @@GLOBAL.gtid_executed)",
+	},
+	"mssql": {
+		name:         "mssql",
+		schemaQuery:  informationSchemaQuery,
+		explainOn:    "SET SHOWPLAN_TEXT ON",
+		explainOff:   "SET SHOWPLAN_TEXT OFF",
+		versionQuery: "SELECT @@VERSION",
+		localeSet:    []string{"SET LANGUAGE '%s'"},
+		databaseSet:  "USE [%s]",
+	},
+	"sqlite": {
+		name:          "sqlite",
+		schemaQuery:   sqliteSchemaQuery,
+		explainPrefix: "EXPLAIN QUERY PLAN ",
+		versionQuery:  "SELECT sqlite_version()",
+	},
+}
+
+// lookupDialect returns a dialect by name.
+func lookupDialect(name string) (*dialect, error) {
+	d, ok := dialects[strings.ToLower(name)]
+	if !ok {
+		var names []string
+		for name := range dialects {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, errors.Errorf("unknown dialect %q (one of %s)", name, strings.Join(names, ", "))
+	}
+
+	return d, nil
+}
+
+// informationSchemaQuery lists objects from the standard INFORMATION_SCHEMA
+// views.
+func informationSchemaQuery(req *SchemaRequest) (string, []interface{}, error) {
+	var query string
+	var filters []string
+	switch req.Kind {
+	case "catalogs":
+		query = "SELECT DISTINCT catalog_name FROM information_schema.schemata"
+		filters = []string{"catalog_name"}
+	case "schemas":
+		query = "SELECT catalog_name, schema_name FROM information_schema.schemata"
+		filters = []string{"catalog_name", "schema_name"}
+	case "tables":
+		query = "SELECT table_catalog, table_schema, table_name, table_type FROM information_schema.tables"
+		filters = []string{"table_catalog", "table_schema", "table_name"}
+	case "columns":
+		query = "SELECT table_catalog, table_schema, table_name, column_name, ordinal_position, data_type, is_nullable FROM information_schema.columns"
+		filters = []string{"table_catalog", "table_schema", "table_name"}
+	default:
+		return "", nil, errors.Errorf("unknown schema kind %q", req.Kind)
+	}
+
+	var conds []string
+	var args []interface{}
+	for i, value := range []string{req.Catalog, req.Schema, req.Table} {
+		if value != "" && i < len(filters) {
+			conds = append(conds, filters[i]+" = ?")
+			args = append(args, value)
+		}
+	}
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+
+	order := "1, 2, 3"
+	switch req.Kind {
+	case "catalogs":
+		order = "1"
+	case "schemas":
+		order = "1, 2"
+	case "columns":
+		order = "1, 2, 3, 5"
+	}
+
+	return query + " ORDER BY " + order, args, nil
+}
+
+// sqliteSchemaQuery lists objects from the SQLite catalog. Attached databases
+// are reported as schemas of the "main" catalog.
+func sqliteSchemaQuery(req *SchemaRequest) (string, []interface{}, error) {
+	schema := req.Schema
+	if schema == "" {
+		schema = "main"
+	}
+	// Schema names can't be bound as parameters.
+	quoted := `"` + strings.ReplaceAll(schema, `"`, `""`) + `"`
+
+	switch req.Kind {
+	case "catalogs":
+		return "SELECT 'main'", nil, nil
+	case "schemas":
+		return "SELECT 'main', name FROM pragma_database_list ORDER BY seq", nil, nil
+	case "tables":
+		query := "SELECT 'main', ?, name, CASE type WHEN 'view' THEN 'VIEW' ELSE 'BASE TABLE' END FROM " + quoted + ".sqlite_master WHERE type IN ('table', 'view')"
+		args := []interface{}{schema}
+		if req.Table != "" {
+			query += " AND name = ?"
+			args = append(args, req.Table)
+		}
+		return query + " ORDER BY name", args, nil
+	case "columns":
+		if req.Table == "" {
+			return "", nil, errors.New("a table is required to list columns with sqlite")
+		}
+		query := "SELECT 'main', ?, ?, name, cid + 1, type, CASE \"notnull\" WHEN 0 THEN 'YES' ELSE 'NO' END FROM pragma_table_info(?, ?) ORDER BY cid"
+		return query, []interface{}{schema, req.Table, req.Table, schema}, nil
+	}
+
+	return "", nil, errors.Errorf("unknown schema kind %q", req.Kind)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// consulDefaultAddr returns the address of the local Consul agent.
+func consulDefaultAddr() string {
+	if addr := os.Getenv("CONSUL_HTTP_ADDR"); addr != "" {
+		return addr
+	}
+	return "127.0.0.1:8500"
+}
+
+// target is an instance of the backend found by service discovery.
+type target struct {
+	host string
+	port int
+}
+
+func (t target) String() string {
+	return net.JoinHostPort(t.host, strconv.Itoa(t.port))
+}
+
+// resolver finds the instances of the backend, in order of preference.
+type resolver interface {
+	resolve() ([]target, error)
+}
+
+// newResolver returns the resolver of a -discover value: "srv:<name>" for a
+// DNS SRV record, or "consul:<service>" for the healthy instances of a Consul
+// service.
+func newResolver(spec, consulAddr string) (resolver, error) {
+	kind, name, _ := strings.Cut(spec, ":")
+	if name == "" {
+		return nil, errors.Errorf("invalid discovery %q", spec)
+	}
+
+	switch kind {
+	case "srv":
+		return srvResolver(name), nil
+	case "consul":
+		if !strings.Contains(consulAddr, "://") {
+			consulAddr = "http://" + consulAddr
+		}
+		return &consulResolver{
+			addr:    strings.TrimRight(consulAddr, "/"),
+			service: name,
+			client:  &http.Client{Timeout: 10 * time.Second},
+		}, nil
+	}
+
+	return nil, errors.Errorf("unknown discovery %q (srv or consul)", kind)
+}
+
+// srvResolver looks up a DNS SRV record (e.g. "_postgres._tcp.db.internal"),
+// whose targets are sorted by priority and randomized by weight.
+type srvResolver string
+
+func (r srvResolver) resolve() ([]target, error) {
+	_, records, err := net.LookupSRV("", "", string(r))
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []target
+	for _, record := range records {
+		targets = append(targets, target{host: strings.TrimSuffix(record.Target, "."), port: int(record.Port)})
+	}
+
+	return targets, nil
+}
+
+// consulResolver lists the instances of a Consul service passing their
+// health checks.
+type consulResolver struct {
+	addr    string
+	service string
+	client  *http.Client
+}
+
+func (r *consulResolver) resolve() ([]target, error) {
+	resp, err := r.client.Get(r.addr + "/v1/health/service/" + url.PathEscape(r.service) + "?passing=1")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("consul: %s", resp.Status)
+	}
+
+	var entries []struct {
+		Node struct {
+			Address string
+		}
+		Service struct {
+			Address string
+			Port    int
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, errors.Wrap(err, "consul")
+	}
+
+	var targets []target
+	for _, entry := range entries {
+		// The service address defaults to the one of its node.
+		host := entry.Service.Address
+		if host == "" {
+			host = entry.Node.Address
+		}
+		targets = append(targets, target{host: host, port: entry.Service.Port})
+	}
+
+	return targets, nil
+}
+
+// pickTarget returns the target to use: the current one while it is still
+// an instance, so that re-resolving doesn't move the pool needlessly, the
+// first one otherwise.
+func pickTarget(targets []target, current *target) (target, error) {
+	if len(targets) == 0 {
+		return target{}, errors.New("no backend instance found")
+	}
+	if current != nil {
+		for _, t := range targets {
+			if t == *current {
+				return t, nil
+			}
+		}
+	}
+
+	return targets[0], nil
+}
+
+// applyTarget sets the host and port of a target in a DSN. Without a port
+// attribute, the port follows the host after a comma, as SQL Server expects.
+func applyTarget(dsn string, t target, hostAttr, portAttr string) string {
+	if portAttr == "" {
+		return setDSNAttr(dsn, hostAttr, fmt.Sprintf("%s,%d", t.host, t.port))
+	}
+
+	dsn = setDSNAttr(dsn, hostAttr, t.host)
+	return setDSNAttr(dsn, portAttr, strconv.Itoa(t.port))
+}
+
+// watchDiscovery re-resolves the backend instances periodically, and calls
+// onChange with the new target when the current one is gone.
+func watchDiscovery(r resolver, current target, interval time.Duration, onChange func(target) error) {
+	for range time.Tick(interval) {
+		targets, err := r.resolve()
+		if err != nil {
+			log.Println("Discovery error:", err)
+			continue
+		}
+		t, err := pickTarget(targets, &current)
+		if err != nil {
+			log.Println("Discovery error:", err)
+			continue
+		}
+		if t == current {
+			continue
+		}
+
+		if err := onChange(t); err != nil {
+			log.Printf("Reconnect to %s error: %v", t, err)
+			continue
+		}
+		log.Printf("Backend instance %s is gone, pool rebuilt on %s", current, t)
+		current = t
+	}
+}
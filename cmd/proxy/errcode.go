@@ -0,0 +1,160 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"strings"
+
+	"github.com/alexbrainman/odbc"
+	"github.com/pkg/errors"
+)
+
+// Error classes, telling applications the errors they may handle apart,
+// whatever the backend.
+const (
+	classUniqueViolation     = "unique_violation"
+	classForeignKeyViolation = "foreign_key_violation"
+	classNotNullViolation    = "not_null_violation"
+	classCheckViolation      = "check_violation"
+	classIntegrity           = "integrity_constraint_violation"
+	classDeadlock            = "deadlock"
+	classSerialization       = "serialization_failure"
+	classSyntax              = "syntax_error"
+	classPrivilege           = "insufficient_privilege"
+	classUndefinedTable      = "undefined_table"
+	classUndefinedColumn     = "undefined_column"
+	classStatementTimeout    = "statement_timeout"
+	classConnection          = "connection_exception"
+	classData                = "data_exception"
+	classOverloaded          = "overloaded"
+	classCostLimit           = "cost_limit_exceeded"
+	classMaintenance         = "maintenance"
+)
+
+// errorCode is the code of an error, sent along its message: the SQLSTATE
+// and vendor code of the backend error, and its class. Retryable errors are
+// transient, the request may succeed when sent again.
+type errorCode struct {
+	Code       string `msgpack:"code"`
+	NativeCode int    `msgpack:"native_code"`
+	Class      string `msgpack:"class"`
+	Retryable  bool   `msgpack:"retryable"`
+}
+
+// codedError is an error of the proxy with a code of its own.
+type codedError struct {
+	msg  string
+	code errorCode
+}
+
+func (e *codedError) Error() string {
+	return e.msg
+}
+
+// sqlStater is implemented by the errors of the drivers telling the
+// SQLSTATE of the error.
+type sqlStater interface {
+	SQLState() string
+}
+
+// codeOf returns the code of an error. Backend errors are found through
+// the wrapping of the proxy.
+func codeOf(err error) errorCode {
+	var coded *codedError
+	if errors.As(err, &coded) {
+		return coded.code
+	}
+	if err == errOverloaded {
+		return errorCode{Class: classOverloaded, Retryable: true}
+	}
+
+	var code errorCode
+	var odbcErr *odbc.Error
+	var stater sqlStater
+	switch {
+	case errors.As(err, &odbcErr) && len(odbcErr.Diag) > 0:
+		code.Code = odbcErr.Diag[0].State
+		code.NativeCode = odbcErr.Diag[0].NativeError
+		code.Class = errorClass(code.Code, code.NativeCode)
+	case errors.As(err, &stater):
+		code.Code = stater.SQLState()
+		code.Class = errorClass(code.Code, code.NativeCode)
+	case errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone):
+		// The backend connection was lost.
+		code.Class = classConnection
+	}
+	code.Retryable = code.transient()
+
+	return code
+}
+
+// transient reports whether an error may not happen again: lost backend
+// connections, overloads, and transactions rolled back by a deadlock or a
+// serialization failure. MySQL lock wait timeouts are transient too.
+func (c errorCode) transient() bool {
+	switch c.Class {
+	case classDeadlock, classSerialization, classConnection, classOverloaded:
+		return true
+	}
+	return c.Code == "HY000" && c.NativeCode == 1205
+}
+
+// errorClass returns the class of a SQLSTATE. The generic states of ODBC,
+// such as 23000 for every integrity constraint, are told apart by the
+// vendor codes of SQL Server and MySQL.
+func errorClass(state string, native int) string {
+	switch state {
+	case "23505":
+		return classUniqueViolation
+	case "23503":
+		return classForeignKeyViolation
+	case "23502":
+		return classNotNullViolation
+	case "23514":
+		return classCheckViolation
+	case "23000":
+		switch native {
+		case 2627, 2601, 1062:
+			return classUniqueViolation
+		case 547, 1451, 1452:
+			return classForeignKeyViolation
+		case 515, 1048:
+			return classNotNullViolation
+		}
+		return classIntegrity
+	case "40P01":
+		return classDeadlock
+	case "40001":
+		if native == 1205 || native == 1213 {
+			return classDeadlock
+		}
+		return classSerialization
+	case "42601":
+		return classSyntax
+	case "42000":
+		switch native {
+		case 229, 230, 1044, 1142, 1143:
+			return classPrivilege
+		}
+		return classSyntax
+	case "42501":
+		return classPrivilege
+	case "42P01", "42S02":
+		return classUndefinedTable
+	case "42703", "42S22":
+		return classUndefinedColumn
+	case "57014", "HYT00":
+		return classStatementTimeout
+	}
+
+	switch {
+	case strings.HasPrefix(state, "23"):
+		return classIntegrity
+	case strings.HasPrefix(state, "08"):
+		return classConnection
+	case strings.HasPrefix(state, "22"):
+		return classData
+	}
+
+	return ""
+}
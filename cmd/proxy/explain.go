@@ -0,0 +1,70 @@
+package main
+
+import (
+	"database/sql/driver"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+// Explain request struct, returning the plan of a statement as a
+// QueryResponse. Its fields are those of a QueryRequest.
+type ExplainRequest struct {
+	Op       string        `msgpack:"op"`
+	Query    string        `msgpack:"query"`
+	Args     []interface{} `msgpack:"args"`
+	TraceID  string        `msgpack:"trace_id"`
+	Priority string        `msgpack:"priority"`
+	Timeout  int64         `msgpack:"timeout_ms"`
+}
+
+func handleExplain(sess *session, srv *server, data []byte) (requestStats, error) {
+	var explain ExplainRequest
+	if err := msgpack.Unmarshal(data, &explain); err != nil {
+		return requestStats{}, err
+	}
+	if err := checkLimits(explain.Query, explain.Args); err != nil {
+		return requestStats{}, err
+	}
+
+	req := QueryRequest{Query: explain.Query, Args: explain.Args, TraceID: explain.TraceID, Priority: explain.Priority, Timeout: explain.Timeout}
+	if err := prepareStatement(sess, srv, &req); err != nil {
+		return requestStats{}, err
+	}
+
+	d := sess.backend.dialect
+	req.Query = d.explainPrefix + req.Query
+	if d.explainOn == "" {
+		return retryPinned(sess, func(db querier) (requestStats, error) {
+			return handleQuery(sess, db, req)
+		})
+	}
+
+	// The plan mode must be set on the connection running the statement:
+	// the pinned one when the session has set variables.
+	ctx := sess.ctx
+	conn := sess.pinned
+	if conn == nil {
+		var err error
+		if conn, err = sess.backend.DB().Conn(ctx); err != nil {
+			return requestStats{}, err
+		}
+		defer conn.Close()
+	}
+
+	if _, err := conn.ExecContext(ctx, d.explainOn); err != nil {
+		return requestStats{}, err
+	}
+	defer func() {
+		if _, err := conn.ExecContext(ctx, d.explainOff); err != nil {
+			// Don't give the connection back to the pool in plan mode.
+			if conn == sess.pinned {
+				sess.unpin()
+			} else {
+				conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+			}
+			sess.logf("Reset explain mode error: %v", err)
+		}
+	}()
+
+	return handleQuery(sess, conn, req)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arkan/sqlproxy/internal/sqltext"
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack"
+)
+
+// Defaults of the hot query cache.
+const (
+	defaultHotRuns    = 10
+	defaultHotWindow  = 10 * time.Second
+	defaultHotTTL     = time.Second
+	defaultHotTracked = 10000
+)
+
+// hotCacheConfig caches the results of the read queries run often, whatever
+// their tables, without rules.
+type hotCacheConfig struct {
+	// Runs of an identical query within a window making it hot, 10 in 10
+	// seconds by default.
+	MinRuns int      `json:"min_runs"`
+	Window  duration `json:"window"`
+	// How long the results of hot queries are cached, one second by default.
+	TTL duration `json:"ttl"`
+	// Most queries counted at once, 10000 by default.
+	MaxTracked int `json:"max_tracked"`
+}
+
+func (c *hotCacheConfig) validate() error {
+	if c.MinRuns < 0 || c.Window.Duration < 0 || c.TTL.Duration < 0 || c.MaxTracked < 0 {
+		return errors.New("min runs, window, ttl and max tracked must be positive")
+	}
+	return nil
+}
+
+// hotQueries counts the runs of the read queries over windows of time. A
+// query is hot once it runs MinRuns times in a window, and stays hot for the
+// next window if it did in the previous one.
+type hotQueries struct {
+	minRuns    int
+	window     time.Duration
+	ttl        time.Duration
+	maxTracked int
+
+	mu     sync.Mutex
+	counts map[string]*hotCount
+}
+
+type hotCount struct {
+	runs  int
+	start time.Time
+	hot   bool
+}
+
+func newHotQueries(cfg *hotCacheConfig) *hotQueries {
+	h := &hotQueries{minRuns: cfg.MinRuns, window: cfg.Window.Duration, ttl: cfg.TTL.Duration, maxTracked: cfg.MaxTracked, counts: map[string]*hotCount{}}
+	if h.minRuns == 0 {
+		h.minRuns = defaultHotRuns
+	}
+	if h.window == 0 {
+		h.window = defaultHotWindow
+	}
+	if h.ttl == 0 {
+		h.ttl = defaultHotTTL
+	}
+	if h.maxTracked == 0 {
+		h.maxTracked = defaultHotTracked
+	}
+
+	return h
+}
+
+// run counts a run of a query and reports whether it is hot.
+func (h *hotQueries) run(key string) bool {
+	now := time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	c := h.counts[key]
+	if c == nil {
+		if len(h.counts) >= h.maxTracked {
+			h.expire(now)
+		}
+		if len(h.counts) >= h.maxTracked {
+			return false
+		}
+		c = &hotCount{start: now}
+		h.counts[key] = c
+	}
+	if now.Sub(c.start) > h.window {
+		c.hot = c.runs >= h.minRuns
+		c.runs, c.start = 0, now
+	}
+	c.runs++
+	if c.runs >= h.minRuns {
+		c.hot = true
+	}
+
+	return c.hot
+}
+
+// expire forgets the queries not hot and not run in the current window, the
+// lock being held.
+func (h *hotQueries) expire(now time.Time) {
+	for key, c := range h.counts {
+		if now.Sub(c.start) > h.window && c.runs < h.minRuns {
+			delete(h.counts, key)
+		}
+	}
+}
+
+// hot returns how long the result of a read query is cached and the tables
+// it reads when it is hot, false otherwise. Queries are identical when their
+// fingerprint, the literals it leaves out and their arguments are.
+func (c *resultCache) hot(scope, query string, args []interface{}) (time.Duration, []string, bool) {
+	if c.hotQueries == nil {
+		return 0, nil, false
+	}
+	tokens := sqltext.Tokenize(query)
+	refs := sqltext.TableRefs(tokens)
+	if len(refs) == 0 || !sqltext.ReadOnly(tokens) {
+		return 0, nil, false
+	}
+
+	encoded, err := msgpack.Marshal(args)
+	if err != nil {
+		return 0, nil, false
+	}
+	key := []string{scope, sqltext.Fingerprint(query)}
+	for _, t := range tokens {
+		if t.Kind == sqltext.String || t.Kind == sqltext.Number {
+			key = append(key, t.Text)
+		}
+	}
+	key = append(key, string(encoded))
+	if !c.hotQueries.run(strings.Join(key, "\x00")) {
+		return 0, nil, false
+	}
+
+	var tables []string
+	for _, ref := range refs {
+		tables = append(tables, ref.Table())
+	}
+	return c.hotQueries.ttl, tables, true
+}
+
+// hotCached counts a hot query answered from the cache or not, and updates
+// the hit ratio.
+func hotCached(tenant string, hit bool) {
+	if hit {
+		hotCacheHits.add(1, tenant)
+	} else {
+		hotCacheMisses.add(1, tenant)
+	}
+	hits := hotCacheHits.total()
+	hotCacheRatio.set(hits / (hits + hotCacheMisses.total()))
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack"
+)
+
+// Idempotency keys are remembered for the TTL, up to maxIdempotencyKeys.
+const (
+	defaultIdempotencyTTL = 10 * time.Minute
+	maxIdempotencyKeys    = 100000
+)
+
+// idempotencyCache remembers the results of the exec requests sent with an
+// idempotency key, so that a client retrying one whose response was lost
+// gets the original result instead of running it twice. Keys are scoped to
+// the identity, and only successful results are remembered.
+type idempotencyCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*idempotentExec
+	// Keys in insertion order, for expiry.
+	order []string
+}
+
+// idempotentExec is the result of an exec request, done being closed once it
+// is known. Args is the digest of the arguments of the request.
+type idempotentExec struct {
+	query    string
+	args     [sha256.Size]byte
+	created  time.Time
+	done     chan struct{}
+	ok       bool
+	response ExecResponse
+}
+
+func newIdempotencyCache(ttl time.Duration) *idempotencyCache {
+	return &idempotencyCache{ttl: ttl, entries: map[string]*idempotentExec{}}
+}
+
+// begin returns the entry of a key. When the request already ran (or is
+// running, in which case begin waits for it), its entry is returned with
+// done set. Otherwise the caller must run the request and call finish.
+func (c *idempotencyCache) begin(ctx context.Context, scope, key, query string, args []interface{}) (entry *idempotentExec, done bool, err error) {
+	encoded, err := msgpack.Marshal(args)
+	if err != nil {
+		return nil, false, err
+	}
+	digest := sha256.Sum256(encoded)
+
+	key = scope + "\x00" + key
+	for {
+		c.mu.Lock()
+		c.expire(time.Now())
+		entry = c.entries[key]
+		if entry == nil {
+			entry = &idempotentExec{query: query, args: digest, created: time.Now(), done: make(chan struct{})}
+			c.entries[key] = entry
+			c.order = append(c.order, key)
+			c.mu.Unlock()
+			return entry, false, nil
+		}
+		c.mu.Unlock()
+
+		if entry.query != query || entry.args != digest {
+			return nil, false, errors.New("idempotency key reused for another statement or other arguments")
+		}
+		select {
+		case <-entry.done:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+		if entry.ok {
+			return entry, true, nil
+		}
+		// The request failed and was forgotten: run it again.
+	}
+}
+
+// finish records the result of a request, forgetting it if it failed.
+func (c *idempotencyCache) finish(scope, key string, entry *idempotentExec, response ExecResponse, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry.ok, entry.response = err == nil, response
+	if err != nil {
+		key = scope + "\x00" + key
+		if c.entries[key] == entry {
+			delete(c.entries, key)
+		}
+	}
+	close(entry.done)
+}
+
+// expire forgets the keys older than the TTL, and the oldest ones past the
+// limit.
+func (c *idempotencyCache) expire(now time.Time) {
+	for len(c.order) > 0 {
+		key := c.order[0]
+		entry := c.entries[key]
+		if entry != nil && len(c.entries) <= maxIdempotencyKeys && now.Sub(entry.created) < c.ttl {
+			break
+		}
+		// The keys of failed requests are left in order, and are already
+		// forgotten or were seen again since.
+		if entry != nil {
+			delete(c.entries, key)
+		}
+		c.order = c.order[1:]
+	}
+}
+
+// handleIdempotentExec runs an exec request unless its idempotency key was
+// seen, in which case the original result is sent again.
+func handleIdempotentExec(sess *session, srv *server, req QueryRequest) (requestStats, error) {
+	scope := sess.tenant + "/" + sess.user
+	entry, done, err := srv.idempotency.begin(sess.ctx, scope, req.IdempotencyKey, req.Query, req.Args)
+	if err != nil {
+		return requestStats{}, err
+	}
+	if done {
+		sess.logf("Replayed exec for idempotency key %q", req.IdempotencyKey)
+		response := entry.response
+		response.TraceID = sess.traceID
+		return requestStats{bytes: int64(sendResponse(sess.conn, response))}, nil
+	}
+
+	var response ExecResponse
+	stats, err := runRouted(sess, req.Query, req.Args, func(db querier) (requestStats, error) {
+		var stats requestStats
+		var err error
+		if isQuery(req.Query) {
+			response, stats, err = execReturning(sess, db, req)
+		} else {
+			response, stats, err = execStatement(sess, db, req.exec())
+		}
+		return stats, err
+	})
+	srv.idempotency.finish(scope, req.IdempotencyKey, entry, response, err)
+	if err != nil {
+		return stats, err
+	}
+	stats.bytes = int64(sendResponse(sess.conn, response))
+
+	return stats, nil
+}
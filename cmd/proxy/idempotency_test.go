@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyCacheBegin(t *testing.T) {
+	ctx := context.Background()
+	c := newIdempotencyCache(time.Minute)
+	const query = "INSERT INTO t (v) VALUES (?)"
+
+	entry, done, err := c.begin(ctx, "id", "key", query, []interface{}{int64(1)})
+	if err != nil || done {
+		t.Fatalf("begin = %v, %v; want a new entry", done, err)
+	}
+	c.finish("id", "key", entry, ExecResponse{RowsAffected: 1}, nil)
+
+	entry, done, err = c.begin(ctx, "id", "key", query, []interface{}{int64(1)})
+	if err != nil || !done || entry.response.RowsAffected != 1 {
+		t.Errorf("begin of a retry = %v, %v; want the original result", done, err)
+	}
+	if _, _, err := c.begin(ctx, "id", "key", query, []interface{}{int64(2)}); err == nil {
+		t.Error("begin with other arguments replayed the original result")
+	}
+	if _, _, err := c.begin(ctx, "id", "key", "DELETE FROM t", nil); err == nil {
+		t.Error("begin of another statement replayed the original result")
+	}
+	if _, done, err := c.begin(ctx, "other", "key", query, []interface{}{int64(2)}); err != nil || done {
+		t.Errorf("begin in another scope = %v, %v; want a new entry", done, err)
+	}
+}
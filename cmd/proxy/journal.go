@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// journal is an append-only file of JSON lines recording the exec requests:
+// an "accepted" entry is synced to disk before a request runs, and an
+// "applied" or "failed" entry follows with its outcome. The accepted entries
+// without an outcome (the proxy stopped, or the backend went away, while they
+// ran) may or may not have been applied, and can be listed and replayed.
+type journal struct {
+	mu   sync.Mutex
+	file *os.File
+	id   int64
+}
+
+// journalEntry is a line of the journal.
+type journalEntry struct {
+	ID     int64     `json:"id"`
+	Time   time.Time `json:"time"`
+	Status string    `json:"status"`
+	// Accepted entries.
+	Tenant         string         `json:"tenant,omitempty"`
+	User           string         `json:"user,omitempty"`
+	Application    string         `json:"application,omitempty"`
+	TraceID        string         `json:"trace_id,omitempty"`
+	IdempotencyKey string         `json:"idempotency_key,omitempty"`
+	Database       string         `json:"database,omitempty"`
+	Query          string         `json:"query,omitempty"`
+	Args           []journalValue `json:"args,omitempty"`
+	// Outcome entries.
+	RowsAffected int64  `json:"rows_affected,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// Journal entry statuses.
+const (
+	journalAccepted = "accepted"
+	journalApplied  = "applied"
+	journalFailed   = "failed"
+)
+
+// journalValue is an argument with its type, which JSON alone loses.
+type journalValue struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// openJournal opens a journal for appending, its IDs following the ones
+// already in the file.
+func openJournal(path string) (*journal, error) {
+	entries, err := readJournal(path)
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open journal")
+	}
+	if err := truncatePartialLine(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	j := &journal{file: file}
+	for _, entry := range entries {
+		if entry.ID > j.id {
+			j.id = entry.ID
+		}
+	}
+
+	return j, nil
+}
+
+// truncatePartialLine removes the end of a file after its last newline, a
+// line cut when the proxy stopped while writing it.
+func truncatePartialLine(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	size := info.Size()
+	var b [1]byte
+	for size > 0 {
+		if _, err := file.ReadAt(b[:], size-1); err != nil {
+			return errors.Wrap(err, "failed to read journal")
+		}
+		if b[0] == '\n' {
+			break
+		}
+		size--
+	}
+	if size == info.Size() {
+		return nil
+	}
+
+	return errors.Wrap(file.Truncate(size), "failed to truncate journal")
+}
+
+// accept records an exec request about to run, and returns its ID.
+func (j *journal) accept(sess *session, req ExecRequest) (int64, error) {
+	args, err := journalValues(req.Args)
+	if err != nil {
+		return 0, err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.id++
+	return j.id, j.write(journalEntry{
+		ID:             j.id,
+		Time:           time.Now(),
+		Status:         journalAccepted,
+		Tenant:         sess.tenant,
+		User:           sess.user,
+		Application:    sess.application,
+		TraceID:        req.TraceID,
+		IdempotencyKey: req.IdempotencyKey,
+		Database:       sess.database,
+		Query:          req.Query,
+		Args:           args,
+	})
+}
+
+// done records the outcome of an exec request.
+func (j *journal) done(id int64, rowsAffected int64, err error) error {
+	entry := journalEntry{ID: id, Time: time.Now(), Status: journalApplied, RowsAffected: rowsAffected}
+	if err != nil {
+		entry.Status, entry.Error = journalFailed, err.Error()
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.write(entry)
+}
+
+// write appends an entry and syncs the file.
+func (j *journal) write(entry journalEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := j.file.Write(append(data, '\n')); err != nil {
+		return errors.Wrap(err, "failed to write journal")
+	}
+
+	return errors.Wrap(j.file.Sync(), "failed to sync journal")
+}
+
+// journalOutcome records the outcome of an exec request in the journal of
+// the session, if any. Requests cut by a lost client or backend connection
+// stay pending, as they may or may not have been applied.
+func journalOutcome(sess *session, id int64, rowsAffected int64, err error) {
+	if sess.journal == nil || (err != nil && (sess.ctx.Err() != nil || errors.Cause(err) == driver.ErrBadConn)) {
+		return
+	}
+	if err := sess.journal.done(id, rowsAffected, err); err != nil {
+		sess.logf("Journal error: %v", err)
+	}
+}
+
+// Close the journal.
+func (j *journal) Close() error {
+	return j.file.Close()
+}
+
+// readJournal reads the entries of a journal.
+func readJournal(path string) ([]journalEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open journal")
+	}
+	defer file.Close()
+
+	var entries []journalEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 64<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// The last line is cut when the proxy stopped while writing it.
+			if !scanner.Scan() {
+				break
+			}
+			return nil, errors.Wrapf(err, "journal line %d", line)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, errors.Wrap(scanner.Err(), "failed to read journal")
+}
+
+// pendingEntries returns the accepted entries of a journal without an
+// outcome.
+func pendingEntries(path string) ([]journalEntry, error) {
+	entries, err := readJournal(path)
+	if err != nil {
+		return nil, err
+	}
+
+	done := map[int64]bool{}
+	for _, entry := range entries {
+		if entry.Status != journalAccepted {
+			done[entry.ID] = true
+		}
+	}
+	var pending []journalEntry
+	for _, entry := range entries {
+		if entry.Status == journalAccepted && !done[entry.ID] {
+			pending = append(pending, entry)
+		}
+	}
+
+	return pending, nil
+}
+
+// printPending writes the pending entries of a journal to stdout, a JSON line
+// each.
+func printPending(path string) error {
+	pending, err := pendingEntries(path)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	for _, entry := range pending {
+		if err := enc.Encode(entry); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// replayJournal runs the pending entries of a journal again, in order, on the
+// backend of their tenant (or the one of their database, or they are routed
+// to), and records their outcome. It stops at the first failure.
+func replayJournal(path string, srv *server) error {
+	pending, err := pendingEntries(path)
+	if err != nil {
+		return err
+	}
+	j, err := openJournal(path)
+	if err != nil {
+		return err
+	}
+	defer j.Close()
+
+	for _, entry := range pending {
+		b := srv.backend
+		if entry.Tenant != "" {
+			b = srv.tenants[entry.Tenant]
+		}
+		if b == nil {
+			return errors.Errorf("journal entry %d: no backend for tenant %q", entry.ID, entry.Tenant)
+		}
+		args, err := journalArgs(entry.Args)
+		if err != nil {
+			return errors.Wrapf(err, "journal entry %d", entry.ID)
+		}
+		if entry.Database != "" {
+			if b, err = srv.databaseBackend(entry.Tenant, b, entry.Database); err != nil {
+				return errors.Wrapf(err, "journal entry %d", entry.ID)
+			}
+		} else if _, routed, err := srv.routers[entry.Tenant].route(entry.Query, args); err != nil {
+			return errors.Wrapf(err, "journal entry %d", entry.ID)
+		} else if routed != nil {
+			b = routed
+		}
+
+		var rows int64
+		result, err := b.DB().ExecContext(context.Background(), entry.Query, args...)
+		if err == nil {
+			rows, _ = result.RowsAffected()
+		}
+		if err := j.done(entry.ID, rows, err); err != nil {
+			return err
+		}
+		if err != nil {
+			return errors.Wrapf(err, "journal entry %d", entry.ID)
+		}
+		fmt.Printf("Replayed journal entry %d: %d rows affected\n", entry.ID, rows)
+	}
+
+	return nil
+}
+
+// journalValues converts request arguments to journal values.
+func journalValues(args []interface{}) ([]journalValue, error) {
+	values := make([]journalValue, len(args))
+	for i, arg := range args {
+		var typ string
+		switch arg.(type) {
+		case nil:
+			values[i] = journalValue{Type: "null"}
+			continue
+		case bool:
+			typ = "bool"
+		case int8, int16, int32, int64, int:
+			typ = "int"
+		case uint8, uint16, uint32, uint64, uint:
+			typ = "uint"
+		case float32, float64:
+			typ = "float"
+		case string:
+			typ = "string"
+		case []byte:
+			typ = "bytes"
+		case time.Time:
+			typ = "time"
+		default:
+			return nil, errors.Errorf("argument %d: cannot journal %T", i+1, arg)
+		}
+
+		data, err := json.Marshal(arg)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = journalValue{Type: typ, Value: data}
+	}
+
+	return values, nil
+}
+
+// journalArgs converts journal values back to arguments.
+func journalArgs(values []journalValue) ([]interface{}, error) {
+	args := make([]interface{}, len(values))
+	for i, value := range values {
+		var dest interface{}
+		switch value.Type {
+		case "null":
+			continue
+		case "bool":
+			dest = new(bool)
+		case "int":
+			dest = new(int64)
+		case "uint":
+			dest = new(uint64)
+		case "float":
+			dest = new(float64)
+		case "string":
+			dest = new(string)
+		case "bytes":
+			dest = new([]byte)
+		case "time":
+			dest = new(time.Time)
+		default:
+			return nil, errors.Errorf("argument %d: unknown type %q", i+1, value.Type)
+		}
+		if err := json.Unmarshal(value.Value, dest); err != nil {
+			return nil, errors.Wrapf(err, "argument %d", i+1)
+		}
+
+		switch v := dest.(type) {
+		case *bool:
+			args[i] = *v
+		case *int64:
+			args[i] = *v
+		case *uint64:
+			args[i] = *v
+		case *float64:
+			args[i] = *v
+		case *string:
+			args[i] = *v
+		case *[]byte:
+			args[i] = *v
+		case *time.Time:
+			args[i] = *v
+		}
+	}
+
+	return args, nil
+}
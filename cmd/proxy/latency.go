@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// latencyInjection delays requests, to rehearse how applications behave when
+// the backend gets slow.
+type latencyInjection struct {
+	min, max time.Duration
+	// Percentage of the requests delayed.
+	percent float64
+}
+
+// parseLatency parses an -inject-latency value, a duration or a range such
+// as 50ms~200ms.
+func parseLatency(spec string, percent float64) (*latencyInjection, error) {
+	if percent < 0 || percent > 100 {
+		return nil, errors.New("-inject-latency-percent must be between 0 and 100")
+	}
+
+	low, high, isRange := strings.Cut(spec, "~")
+	min, err := time.ParseDuration(strings.TrimSpace(low))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid -inject-latency")
+	}
+	max := min
+	if isRange {
+		if max, err = time.ParseDuration(strings.TrimSpace(high)); err != nil {
+			return nil, errors.Wrap(err, "invalid -inject-latency")
+		}
+	}
+	if min < 0 || max < min {
+		return nil, errors.Errorf("invalid -inject-latency %q, expected min~max", spec)
+	}
+
+	return &latencyInjection{min: min, max: max, percent: percent}, nil
+}
+
+// delay waits for a random latency within the range, for the percentage of
+// the requests delayed, or until the context is done.
+func (l *latencyInjection) delay(ctx context.Context) error {
+	if l == nil || rand.Float64()*100 >= l.percent {
+		return nil
+	}
+	d := l.min
+	if l.max > l.min {
+		d += time.Duration(rand.Int63n(int64(l.max - l.min)))
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+)
+
+// checkLimits rejects the statements longer than -max-query-length, or whose
+// arguments are more than -max-args or larger than -max-arg-bytes (0 for no
+// limit).
+func checkLimits(query string, args []interface{}) error {
+	if *maxQueryLength > 0 && len(query) > *maxQueryLength {
+		return errors.Errorf("statement is too long (%d bytes, at most %d)", len(query), *maxQueryLength)
+	}
+	if *maxArgs > 0 && len(args) > *maxArgs {
+		return errors.Errorf("too many arguments (%d, at most %d)", len(args), *maxArgs)
+	}
+	if *maxArgBytes > 0 {
+		for i, arg := range args {
+			var size int
+			switch v := arg.(type) {
+			case string:
+				size = len(v)
+			case []byte:
+				size = len(v)
+			}
+			if size > *maxArgBytes {
+				return errors.Errorf("argument %d is too large (%d bytes, at most %d)", i+1, size, *maxArgBytes)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// loggingConfig sets the targets of the log streams, used when their flag
+// (-log-file, -access-log) is not set. A target is a file, "syslog" for the
+// local syslog daemon, syslog://host:port or syslog+tcp://host:port for a
+// remote one, "journald", or "eventlog" for the Windows event log.
+type loggingConfig struct {
+	Log       string `json:"log"`
+	AccessLog string `json:"access_log"`
+}
+
+func (c *loggingConfig) validate() error {
+	for _, target := range []string{c.Log, c.AccessLog} {
+		if _, _, err := parseLogTarget(target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseLogTarget returns the kind of a log target (file, syslog, journald or
+// eventlog) and its address: the file path, or the network address of a
+// remote syslog daemon as network://host:port.
+func parseLogTarget(target string) (string, string, error) {
+	switch {
+	case target == "journald", target == "eventlog":
+		return target, "", nil
+	case target == "syslog" || target == "syslog:":
+		return "syslog", "", nil
+	case strings.HasPrefix(target, "syslog://"), strings.HasPrefix(target, "syslog+tcp://"):
+		u, err := url.Parse(target)
+		if err != nil || u.Host == "" || u.Port() == "" {
+			return "", "", errors.Errorf("invalid syslog address %q, expected syslog://host:port", target)
+		}
+		network := "udp"
+		if u.Scheme == "syslog+tcp" {
+			network = "tcp"
+		}
+		return "syslog", network + "://" + u.Host, nil
+	}
+
+	return "file", target, nil
+}
+
+// openLogTarget opens a log target, tagging its records with the name of the
+// stream in syslog and journald.
+func openLogTarget(target, tag string) (io.WriteCloser, error) {
+	kind, addr, err := parseLogTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	switch kind {
+	case "journald":
+		return dialJournald(tag)
+	case "syslog":
+		return dialSyslog(addr, tag)
+	case "eventlog":
+		return openEventLog(tag)
+	}
+
+	return openRotatingFile(addr, logRotation())
+}
+
+// openLog sends the log to a target. Syslog and journald time their records
+// themselves.
+func openLog(target string) (io.Closer, error) {
+	w, err := openLogTarget(target, "sqlproxy")
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := w.(*rotatingFile); !ok {
+		log.SetFlags(0)
+	}
+	log.SetOutput(w)
+
+	return w, nil
+}
+
+// Syslog and journald priorities of the records: daemon facility,
+// informational severity.
+const (
+	syslogPriority   = 3<<3 | 6
+	journaldPriority = 6
+)
+
+// syslogWriter sends each write as a syslog message, in the RFC 3164 format
+// to the local daemon and RFC 5424 to a remote one.
+type syslogWriter struct {
+	tag      string
+	hostname string
+	remote   bool
+	tcp      bool
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// dialSyslog connects to a remote syslog daemon at network://host:port, or
+// to the local one when addr is empty.
+func dialSyslog(addr, tag string) (*syslogWriter, error) {
+	w := &syslogWriter{tag: tag}
+	w.hostname, _ = os.Hostname()
+	if addr == "" {
+		for _, path := range []string{"/dev/log", "/var/run/syslog", "/var/run/log"} {
+			for _, network := range []string{"unixgram", "unix"} {
+				if conn, err := net.Dial(network, path); err == nil {
+					w.conn = conn
+					return w, nil
+				}
+			}
+		}
+		return nil, errors.New("failed to connect to the local syslog daemon")
+	}
+
+	network, hostport, _ := strings.Cut(addr, "://")
+	conn, err := net.DialTimeout(network, hostport, 10*time.Second)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to syslog")
+	}
+	w.conn, w.remote, w.tcp = conn, true, network == "tcp"
+
+	return w, nil
+}
+
+func (w *syslogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimRight(string(p), "\n")
+	var line string
+	if w.remote {
+		line = fmt.Sprintf("<%d>1 %s %s %s %d - - %s", syslogPriority, time.Now().Format(time.RFC3339Nano), w.hostname, w.tag, os.Getpid(), msg)
+	} else {
+		line = fmt.Sprintf("<%d>%s %s[%d]: %s", syslogPriority, time.Now().Format(time.Stamp), w.tag, os.Getpid(), msg)
+	}
+	if w.tcp {
+		// Octet counting framing (RFC 6587).
+		line = fmt.Sprintf("%d %s", len(line), line)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.conn.Write([]byte(line)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *syslogWriter) Close() error {
+	return w.conn.Close()
+}
+
+// journaldWriter sends each write as a journal entry, with the native
+// protocol of journald.
+type journaldWriter struct {
+	tag  string
+	conn net.Conn
+}
+
+func dialJournald(tag string) (*journaldWriter, error) {
+	conn, err := net.Dial("unixgram", "/run/systemd/journal/socket")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to journald")
+	}
+
+	return &journaldWriter{tag: tag, conn: conn}, nil
+}
+
+func (w *journaldWriter) Write(p []byte) (int, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "PRIORITY=%d\nSYSLOG_IDENTIFIER=%s\n", journaldPriority, w.tag)
+	// Values with newlines are sent with their length.
+	msg := bytes.TrimRight(p, "\n")
+	b.WriteString("MESSAGE\n")
+	binary.Write(&b, binary.LittleEndian, uint64(len(msg)))
+	b.Write(msg)
+	b.WriteByte('\n')
+
+	if _, err := w.conn.Write(b.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *journaldWriter) Close() error {
+	return w.conn.Close()
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maintenance holds the requests while the backends are under maintenance,
+// from the admin API: they wait for its end for up to a queue timeout, or are
+// rejected with a retryable error, so that a short maintenance window delays
+// the applications instead of failing them.
+type maintenance struct {
+	mu     sync.Mutex
+	window *maintenanceWindow
+}
+
+// maintenanceWindow is a maintenance in progress, done closed when it ends.
+type maintenanceWindow struct {
+	since        time.Time
+	queueTimeout time.Duration
+	done         chan struct{}
+	// timer ends the maintenance after its duration, if it has one.
+	timer *time.Timer
+}
+
+// MaintenanceRequest starts a maintenance. Requests wait for up to
+// QueueTimeout, and are rejected right away when it is 0. It ends after
+// Duration, if set, or when ended with the admin API.
+type MaintenanceRequest struct {
+	QueueTimeout duration `json:"queue_timeout"`
+	Duration     duration `json:"duration"`
+}
+
+// MaintenanceStatus is the state of the maintenance mode, served by the
+// admin API.
+type MaintenanceStatus struct {
+	Active       bool       `json:"active"`
+	Since        *time.Time `json:"since,omitempty"`
+	QueueTimeout *duration  `json:"queue_timeout,omitempty"`
+}
+
+// errMaintenance rejects the requests received in maintenance mode.
+var errMaintenance = &codedError{
+	msg:  "the backend is under maintenance, retry later",
+	code: errorCode{Code: "57P03", Class: classMaintenance, Retryable: true},
+}
+
+// start begins a maintenance, or changes the one in progress.
+func (m *maintenance) start(req MaintenanceRequest) error {
+	if req.QueueTimeout.Duration < 0 || req.Duration.Duration < 0 {
+		return errors.New("durations must be positive")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w := m.window
+	if w == nil {
+		w = &maintenanceWindow{since: time.Now(), done: make(chan struct{})}
+		m.window = w
+		log.Printf("Maintenance mode started, requests queued for %s", req.QueueTimeout)
+	}
+	w.queueTimeout = req.QueueTimeout.Duration
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	if req.Duration.Duration > 0 {
+		w.timer = time.AfterFunc(req.Duration.Duration, func() { m.end() })
+	}
+
+	return nil
+}
+
+// end ends the maintenance, if any, running the requests waiting. It
+// reports whether one was in progress.
+func (m *maintenance) end() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w := m.window
+	if w == nil {
+		return false
+	}
+
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	close(w.done)
+	m.window = nil
+	log.Printf("Maintenance mode ended after %s", time.Since(w.since).Round(time.Millisecond))
+
+	return true
+}
+
+// status returns the state of the maintenance mode.
+func (m *maintenance) status() MaintenanceStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w := m.window
+	if w == nil {
+		return MaintenanceStatus{}
+	}
+
+	return MaintenanceStatus{Active: true, Since: &w.since, QueueTimeout: &duration{w.queueTimeout}}
+}
+
+// wait returns once no maintenance is in progress, or errMaintenance when
+// it lasts more than its queue timeout.
+func (m *maintenance) wait(sess *session) error {
+	m.mu.Lock()
+	w := m.window
+	var timeout time.Duration
+	if w != nil {
+		timeout = w.queueTimeout
+	}
+	m.mu.Unlock()
+	if w == nil {
+		return nil
+	}
+	if timeout == 0 {
+		maintenanceReqs.add(1, sess.tenant, "rejected")
+		return errMaintenance
+	}
+
+	ctx, cancel := context.WithTimeout(sess.ctx, timeout)
+	defer cancel()
+	select {
+	case <-w.done:
+		maintenanceReqs.add(1, sess.tenant, "resumed")
+		return nil
+	case <-ctx.Done():
+		if sess.ctx.Err() != nil {
+			return sess.ctx.Err()
+		}
+		maintenanceReqs.add(1, sess.tenant, "rejected")
+		return errMaintenance
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/arkan/sqlproxy/internal/sqltext"
+)
+
+// unmaskedRole is the role allowing an identity to see masked columns.
+const unmaskedRole = "unmasked"
+
+// maskConfig hides the values of a column from the identities without the
+// unmasked role.
+type maskConfig struct {
+	// Column to mask, as "table.column" or "*.column" for every table.
+	Column string `json:"column"`
+	// Action: "mask" (default) replaces strings with asterisks and other
+	// values with NULL, "null" replaces every value with NULL.
+	Action string `json:"action"`
+}
+
+// matches reports whether the mask applies to a result column of a statement
+// reading the given tables.
+func (m *maskConfig) matches(refs []sqltext.TableRef, column string) bool {
+	return columnMatches(m.Column, refs, column)
+}
+
+// columnMatches reports whether a "table.column" or "*.column" pattern
+// matches a result column of a statement reading the given tables.
+func columnMatches(pattern string, refs []sqltext.TableRef, column string) bool {
+	table, name := "*", pattern
+	if i := strings.LastIndexByte(pattern, '.'); i >= 0 {
+		table, name = pattern[:i], pattern[i+1:]
+	}
+	if !strings.EqualFold(name, column) {
+		return false
+	}
+	if table == "*" {
+		return true
+	}
+
+	for _, ref := range refs {
+		if ref.Matches(table) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// apply the mask to a value.
+func (m *maskConfig) apply(v interface{}) interface{} {
+	if m.Action == "null" {
+		return nil
+	}
+
+	switch v.(type) {
+	case string, []byte:
+		return "****"
+	}
+	return nil
+}
+
+// columnMasks returns the mask of each result column of a query, nil for the
+// columns that are not masked. It returns nil when no column is masked.
+func columnMasks(masks []maskConfig, query string, cols []string) []*maskConfig {
+	if len(masks) == 0 {
+		return nil
+	}
+
+	refs := sqltext.TableRefs(sqltext.Tokenize(query))
+	var result []*maskConfig
+	for i, col := range cols {
+		for j := range masks {
+			if !masks[j].matches(refs, col) {
+				continue
+			}
+			if result == nil {
+				result = make([]*maskConfig, len(cols))
+			}
+			result[i] = &masks[j]
+			break
+		}
+	}
+
+	return result
+}
+
+// endsSelectList are the keywords ending a select list.
+var endsSelectList = map[string]bool{
+	"FROM": true, "INTO": true, "WHERE": true, "GROUP": true, "HAVING": true,
+	"ORDER": true, "LIMIT": true, "OFFSET": true, "FETCH": true, "FOR": true,
+	"WINDOW": true, "UNION": true, "INTERSECT": true, "EXCEPT": true,
+	"MINUS": true, "RETURNING": true,
+}
+
+// setOperators are the keywords combining the rows of several queries.
+var setOperators = map[string]bool{"UNION": true, "INTERSECT": true, "EXCEPT": true, "MINUS": true}
+
+// checkMasks rejects the statements which could return the values of masked
+// columns under another name, since masks match the result columns by name:
+// masked columns may only be selected as they are, by the select list (or
+// RETURNING clause) of the statement itself rather than of a subquery, a
+// common table expression or a set operation, and the tables holding them
+// can't be renamed by column lists or returned as whole rows.
+func checkMasks(sess *session, query string) error {
+	if len(sess.masks) == 0 {
+		return nil
+	}
+
+	reason := maskedSelection(sess.masks, query)
+	if reason == "" {
+		return nil
+	}
+	sess.logf("Statement of %q denied, %s: %s", sess.user, reason, loggedQuery(query))
+	return &codedError{
+		msg:  "permission denied: " + reason,
+		code: errorCode{Code: "42501", Class: classPrivilege},
+	}
+}
+
+// maskedSelection returns why a statement could return masked values
+// unmasked, "" when it can't.
+func maskedSelection(masks []maskConfig, query string) string {
+	tokens := sqltext.Tokenize(query)
+	refs := sqltext.TableRefs(tokens)
+
+	// Significant tokens and their parenthesis depth.
+	var sig []sqltext.Token
+	var depths []int
+	depth := 0
+	for _, t := range tokens {
+		if !t.Significant() {
+			continue
+		}
+		if t.Kind == sqltext.Punct && t.Text == ")" && depth > 0 {
+			depth--
+		}
+		sig = append(sig, t)
+		depths = append(depths, depth)
+		if t.Kind == sqltext.Punct && t.Text == "(" {
+			depth++
+		}
+	}
+
+	masked := func(i int) bool {
+		t := sig[i]
+		if !t.IsIdent() || i+1 < len(sig) && sig[i+1].Text == "(" {
+			return false
+		}
+		for j := range masks {
+			if masks[j].matches(refs, t.Ident()) {
+				return true
+			}
+		}
+		return false
+	}
+	// Tables holding masked columns.
+	maskedTable := func(ref sqltext.TableRef) bool {
+		for j := range masks {
+			table, _, _ := strings.Cut(masks[j].Column, ".")
+			if table == "*" || ref.Matches(table) {
+				return true
+			}
+		}
+		return false
+	}
+	// References to a whole row of a table holding masked columns, such as
+	// to_json(u).
+	wholeRow := func(i int) bool {
+		t := sig[i]
+		if !t.IsIdent() || i+1 < len(sig) && (sig[i+1].Text == "." || sig[i+1].Text == "(") || i > 0 && sig[i-1].Text == "." {
+			return false
+		}
+		for _, ref := range refs {
+			if (strings.EqualFold(ref.Alias, t.Ident()) || ref.Alias == "" && ref.Matches(t.Ident())) && maskedTable(ref) {
+				return true
+			}
+		}
+		return false
+	}
+
+	setOperation, columnLists := false, false
+	for i, t := range sig {
+		switch {
+		case t.Kind == sqltext.Word && setOperators[strings.ToUpper(t.Text)]:
+			setOperation = true
+		// Derived tables renaming their columns, t(a, b), and common table
+		// expressions, t(a, b) AS (...).
+		case t.Text == ")" && i+2 < len(sig) && sig[i+1].Is("AS") && sig[i+2].IsIdent() && i+3 < len(sig) && sig[i+3].Text == "(",
+			t.Text == ")" && i+2 < len(sig) && sig[i+1].IsIdent() && !sig[i+1].IsKeyword() && !sig[i+1].Is("FILTER") && !sig[i+1].Is("WITHIN") && sig[i+2].Text == "(",
+			t.Text == ")" && i+2 < len(sig) && sig[i+1].Is("AS") && (sig[i+2].Text == "(" || sig[i+2].Is("MATERIALIZED") || sig[i+2].Is("NOT")):
+			columnLists = true
+		}
+	}
+	// Their columns would come out under other names, even selected with *.
+	if setOperation || columnLists {
+		for _, ref := range refs {
+			if maskedTable(ref) {
+				return "table " + ref.Name + ", holding masked columns, can't be read by a set operation or renamed by a column list"
+			}
+		}
+	}
+
+	for i, t := range sig {
+		if !t.Is("SELECT") && !t.Is("RETURNING") && !t.Is("OUTPUT") {
+			continue
+		}
+		d := depths[i]
+		start := skipSelectModifiers(sig, i+1)
+		for j := start; ; j++ {
+			end := j == len(sig) || depths[j] < d ||
+				depths[j] == d && (sig[j].Text == "," || sig[j].Text == ";" || sig[j].Text == ")" ||
+					sig[j].Kind == sqltext.Word && endsSelectList[strings.ToUpper(sig[j].Text)])
+			if !end {
+				continue
+			}
+
+			item := sig[start:j]
+			for k := start; k < j; k++ {
+				switch {
+				case wholeRow(k):
+					return "table " + sig[k].Ident() + ", holding masked columns, can't be returned as whole rows"
+				case !masked(k):
+				case d > 0:
+					return "masked column " + sig[k].Ident() + " can only be selected by the statement itself"
+				case !bareColumn(item):
+					return "masked column " + sig[k].Ident() + " can only be selected as it is"
+				}
+			}
+			if j == len(sig) || sig[j].Text != "," || depths[j] != d {
+				break
+			}
+			start = j + 1
+		}
+	}
+
+	return ""
+}
+
+// skipSelectModifiers returns the index of the first item of the select list
+// starting at sig[i], following DISTINCT, DISTINCT ON (...), ALL and TOP n.
+func skipSelectModifiers(sig []sqltext.Token, i int) int {
+	for i < len(sig) {
+		switch {
+		case sig[i].Is("ALL") || sig[i].Is("DISTINCTROW") || sig[i].Is("PERCENT"):
+			i++
+		case sig[i].Is("DISTINCT") || sig[i].Is("TOP"):
+			i++
+			if i < len(sig) && sig[i].Is("ON") {
+				i++
+			}
+			if i < len(sig) && sig[i].Kind == sqltext.Number {
+				i++
+			} else if i < len(sig) && sig[i].Text == "(" {
+				for depth := 0; i < len(sig); i++ {
+					if sig[i].Text == "(" {
+						depth++
+					} else if sig[i].Text == ")" {
+						if depth--; depth == 0 {
+							i++
+							break
+						}
+					}
+				}
+			}
+		case sig[i].Is("WITH") && i+1 < len(sig) && sig[i+1].Is("TIES"):
+			i += 2
+		default:
+			return i
+		}
+	}
+
+	return i
+}
+
+// bareColumn reports whether a select list item is a column, qualified or
+// not, keeping its name if it has an alias.
+func bareColumn(item []sqltext.Token) bool {
+	alias := ""
+	switch n := len(item); {
+	case n >= 3 && item[n-2].Is("AS"):
+		alias, item = item[n-1].Ident(), item[:n-2]
+	case n >= 2 && item[n-1].IsIdent() && item[n-2].IsIdent():
+		alias, item = item[n-1].Ident(), item[:n-1]
+	}
+
+	for i, t := range item {
+		if i%2 == 0 && !t.IsIdent() || i%2 == 1 && t.Text != "." {
+			return false
+		}
+	}
+	return len(item)%2 == 1 && (alias == "" || strings.EqualFold(alias, item[len(item)-1].Ident()))
+}
@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestMaskedSelection(t *testing.T) {
+	masks := []maskConfig{{Column: "users.ssn"}, {Column: "*.card"}}
+	allowed := []string{
+		"SELECT ssn FROM users",
+		"SELECT u.ssn, name FROM users u WHERE ssn = ?",
+		"SELECT users.ssn AS ssn FROM users",
+		"SELECT DISTINCT ssn FROM users",
+		"SELECT TOP 10 ssn FROM users ORDER BY ssn",
+		"SELECT * FROM users",
+		"SELECT u.* FROM users u",
+		"SELECT count(*) FROM users WHERE ssn LIKE '1%'",
+		"SELECT id FROM orders WHERE customer IN (SELECT id FROM users WHERE ssn = ?)",
+		"SELECT ssn AS x FROM customers",
+		"UPDATE users SET name = ? RETURNING ssn",
+		"SELECT card FROM payments",
+	}
+	for _, query := range allowed {
+		if reason := maskedSelection(masks, query); reason != "" {
+			t.Errorf("%q: %s", query, reason)
+		}
+	}
+
+	denied := []string{
+		// Aliases and expressions.
+		"SELECT ssn AS x FROM users",
+		"SELECT ssn x FROM users",
+		"SELECT u.ssn AS x FROM users u",
+		"SELECT lower(ssn) FROM users",
+		"SELECT ssn || '' FROM users",
+		"SELECT CASE WHEN ssn IS NULL THEN '' ELSE ssn END FROM users",
+		"SELECT card AS c FROM payments",
+		"UPDATE users SET name = ? RETURNING ssn AS x",
+		// Subqueries, common table expressions and set operations.
+		"SELECT (SELECT ssn FROM users LIMIT 1) AS x",
+		"SELECT x FROM (SELECT ssn AS x FROM users) t",
+		"SELECT ssn FROM (SELECT ssn FROM users) t",
+		"WITH t AS (SELECT ssn FROM users) SELECT ssn FROM t",
+		"SELECT name FROM customers UNION SELECT ssn FROM users",
+		// Column lists and whole rows.
+		"WITH t(x) AS (SELECT * FROM users) SELECT x FROM t",
+		"SELECT x FROM (SELECT * FROM users) AS t(x)",
+		"SELECT to_json(u) FROM users u",
+		"SELECT row_to_json(users) FROM users",
+	}
+	for _, query := range denied {
+		if maskedSelection(masks, query) == "" {
+			t.Errorf("%q is not denied", query)
+		}
+	}
+}
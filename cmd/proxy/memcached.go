@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// memcachedClient is a client of a memcached server, speaking its text
+// protocol.
+type memcachedClient struct {
+	conns *storeConns
+}
+
+func newMemcachedClient(addr string, timeout time.Duration) *memcachedClient {
+	return &memcachedClient{conns: newStoreConns(addr, timeout, nil)}
+}
+
+// memcachedMaxTTL is the longest expiration time in seconds, past which
+// memcached takes it for a Unix time.
+const memcachedMaxTTL = 30 * 24 * time.Hour
+
+func (m *memcachedClient) getMulti(keys []string) (map[string][]byte, error) {
+	found := map[string][]byte{}
+	err := m.conns.do(func(c *storeConn) error {
+		c.w.WriteString("get " + strings.Join(keys, " ") + "\r\n")
+		if err := c.w.Flush(); err != nil {
+			return err
+		}
+
+		for {
+			line, err := memcachedLine(c)
+			if err != nil || line == "END" {
+				return err
+			}
+			// VALUE <key> <flags> <bytes>
+			fields := strings.Fields(line)
+			if len(fields) < 4 || fields[0] != "VALUE" {
+				return errors.Errorf("unexpected memcached reply %q", line)
+			}
+			n, err := strconv.Atoi(fields[3])
+			if err != nil {
+				return err
+			}
+			data := make([]byte, n+2)
+			if _, err := io.ReadFull(c.r, data); err != nil {
+				return err
+			}
+			found[fields[1]] = data[:n]
+		}
+	})
+
+	return found, err
+}
+
+// store runs a set or add command, reporting whether the value was stored.
+func (m *memcachedClient) store(command, key string, value []byte, ttl time.Duration) (bool, error) {
+	exptime := int64(0)
+	switch {
+	case ttl > memcachedMaxTTL:
+		exptime = time.Now().Add(ttl).Unix()
+	case ttl > 0:
+		exptime = int64((ttl + time.Second - 1) / time.Second)
+	}
+
+	var line string
+	err := m.conns.do(func(c *storeConn) error {
+		c.w.WriteString(command + " " + key + " 0 " + strconv.FormatInt(exptime, 10) + " " + strconv.Itoa(len(value)) + "\r\n")
+		c.w.Write(value)
+		c.w.WriteString("\r\n")
+		if err := c.w.Flush(); err != nil {
+			return err
+		}
+		var err error
+		line, err = memcachedLine(c)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	switch line {
+	case "STORED":
+		return true, nil
+	case "NOT_STORED":
+		return false, nil
+	}
+	return false, errors.Errorf("unexpected memcached reply %q", line)
+}
+
+func (m *memcachedClient) set(key string, value []byte, ttl time.Duration) error {
+	_, err := m.store("set", key, value, ttl)
+	return err
+}
+
+func (m *memcachedClient) add(key string, value []byte) (bool, error) {
+	return m.store("add", key, value, 0)
+}
+
+func (m *memcachedClient) incr(key string) error {
+	return m.conns.do(func(c *storeConn) error {
+		c.w.WriteString("incr " + key + " 1\r\n")
+		if err := c.w.Flush(); err != nil {
+			return err
+		}
+		// The new value, or NOT_FOUND.
+		_, err := memcachedLine(c)
+		return err
+	})
+}
+
+// memcachedLine reads a line of a reply, returning the errors of the server.
+func memcachedLine(c *storeConn) (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "ERROR" || strings.HasPrefix(line, "CLIENT_ERROR") || strings.HasPrefix(line, "SERVER_ERROR") {
+		return "", storeError("memcached: " + line)
+	}
+
+	return line, nil
+}
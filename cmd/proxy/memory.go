@@ -0,0 +1,70 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+)
+
+// buffer accounts for a row buffered by the current request before it is
+// sent. It fails when the rows of the query exceed -max-query-memory, or
+// those of the request and the last pages kept by the cursors of the
+// connection exceed -max-conn-memory (0 for no limit).
+func (sess *session) buffer(row []interface{}) (int64, error) {
+	var n int64
+	for _, v := range row {
+		n += valueSize(v)
+	}
+	sess.queryMemory += n
+	sess.requestMemory += n
+
+	if *maxQueryMemory > 0 && sess.queryMemory > *maxQueryMemory {
+		memoryExceeded.add(1, sess.tenant)
+		return n, errors.Errorf("result exceeds the memory budget of a query (%d bytes): fetch it with a cursor or a stream", *maxQueryMemory)
+	}
+	if *maxConnMemory > 0 {
+		used := sess.requestMemory
+		for _, c := range sess.cursors {
+			used += c.lastSize
+		}
+		if used > *maxConnMemory {
+			memoryExceeded.add(1, sess.tenant)
+			return n, errors.Errorf("connection exceeds its memory budget (%d bytes)", *maxConnMemory)
+		}
+	}
+
+	return n, nil
+}
+
+// startQuery resets the memory of the running query.
+func (sess *session) startQuery() {
+	sess.queryMemory = 0
+}
+
+// releaseMemory forgets the rows buffered by the request, once sent.
+func (sess *session) releaseMemory() {
+	sess.queryMemory = 0
+	sess.requestMemory = 0
+}
+
+// valueSize approximates the memory held by a value of a row.
+func valueSize(v interface{}) int64 {
+	const header = 16
+	switch v := v.(type) {
+	case string:
+		return header + int64(len(v))
+	case []byte:
+		return header + 8 + int64(len(v))
+	case jsonValue:
+		return header + 8 + int64(len(v))
+	case intArray:
+		return header + 8 + 8*int64(len(v))
+	case textArray:
+		n := int64(header + 8)
+		for _, s := range v {
+			n += header + int64(len(s))
+		}
+		return n
+	}
+
+	// Numbers, booleans, times, UUIDs and NULLs.
+	return header
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// collector is a metric served by the admin API in the Prometheus text
+// format.
+type collector interface {
+	write(w io.Writer)
+}
+
+// metrics are the registered collectors, in exposition order.
+var metrics []collector
+
+var (
+	connectionsOpen = newMetricVec("gauge", "sqlproxy_connections", "Open client connections.", "application")
+	requestsTotal   = newMetricVec("counter", "sqlproxy_requests_total", "Requests handled.", "tenant", "application", "op")
+	requestErrors   = newMetricVec("counter", "sqlproxy_request_errors_total", "Requests that failed.", "tenant", "application", "op")
+	rowsTotal       = newMetricVec("counter", "sqlproxy_rows_total", "Rows returned or affected.", "tenant", "application")
+	overloadedTotal = newMetricVec("counter", "sqlproxy_overloaded_total", "Requests rejected by the admission queue.", "tenant")
+	panicsTotal     = newMetricVec("counter", "sqlproxy_panics_total", "Panics, each closing its client connection.", "tenant")
+	cacheHits       = newMetricVec("counter", "sqlproxy_cache_hits_total", "Queries answered from the result cache.", "tenant")
+	cacheMisses     = newMetricVec("counter", "sqlproxy_cache_misses_total", "Cacheable queries run on the backend.", "tenant")
+	hotCacheHits    = newMetricVec("counter", "sqlproxy_hot_cache_hits_total", "Hot queries answered from the result cache.", "tenant")
+	hotCacheMisses  = newMetricVec("counter", "sqlproxy_hot_cache_misses_total", "Hot queries run on the backend.", "tenant")
+	hotCacheRatio   = newMetricVec("gauge", "sqlproxy_hot_cache_hit_ratio", "Fraction of the hot queries answered from the result cache.")
+	memoryExceeded  = newMetricVec("counter", "sqlproxy_memory_exceeded_total", "Requests aborted by a memory budget.", "tenant")
+	costlyQueries   = newMetricVec("counter", "sqlproxy_costly_queries_total", "Queries over the thresholds of the cost guard.", "tenant", "action")
+	coalescedTotal  = newMetricVec("counter", "sqlproxy_coalesced_queries_total", "Queries answered with the result of an identical one running.", "tenant")
+	deadlockRetried = newMetricVec("counter", "sqlproxy_deadlock_retries_total", "Statements run again after a deadlock or a serialization failure.", "tenant")
+	queriesKilled   = newMetricVec("counter", "sqlproxy_queries_killed_total", "Statements killed by the watchdog for running longer than their ceiling.", "tenant")
+	maintenanceReqs = newMetricVec("counter", "sqlproxy_maintenance_requests_total", "Requests received in maintenance mode, by outcome (resumed or rejected).", "tenant", "outcome")
+
+	notificationsTotal   = newMetricVec("counter", "sqlproxy_notifications_total", "Notifications published.", "tenant")
+	notificationsDropped = newMetricVec("counter", "sqlproxy_notifications_dropped_total", "Notifications dropped for slow listeners.", "tenant")
+
+	idleTxRolledBack = newMetricVec("counter", "sqlproxy_idle_transactions_total", "Transactions rolled back for staying idle longer than -tx-idle-timeout.", "tenant")
+	slowClients      = newMetricVec("counter", "sqlproxy_slow_clients_total", "Connections closed for not reading their responses within -write-timeout.")
+	throttledSeconds = newMetricVec("counter", "sqlproxy_throttled_seconds_total", "Time responses waited for the egress rate limits.", "tenant")
+)
+
+// metricVec is a counter or a gauge with labels.
+type metricVec struct {
+	kind   string
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newMetricVec(kind, name, help string, labels ...string) *metricVec {
+	m := &metricVec{kind: kind, name: name, help: help, labels: labels, values: map[string]float64{}}
+	metrics = append(metrics, m)
+	return m
+}
+
+// add v to the metric with the given label values.
+func (m *metricVec) add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[key] += v
+}
+
+// set the metric with the given label values to v.
+func (m *metricVec) set(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[key] = v
+}
+
+// total returns the sum of the metric over every label value.
+func (m *metricVec) total() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var total float64
+	for _, v := range m.values {
+		total += v
+	}
+	return total
+}
+
+func (m *metricVec) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %g\n", m.name, formatLabels(m.labels, strings.Split(key, "\xff")), m.values[key])
+	}
+}
+
+// histogramVec is a histogram with labels.
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: map[string]*histogram{}}
+	metrics = append(metrics, h)
+	return h
+}
+
+// observe v n times with the given label values.
+func (h *histogramVec) observe(v float64, n uint64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	values := h.values[key]
+	if values == nil {
+		values = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = values
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			values.counts[i] += n
+		}
+	}
+	values.count += n
+	values.sum += v * float64(n)
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	labels := append(h.labels[:len(h.labels):len(h.labels)], "le")
+	for _, key := range keys {
+		values, labelValues := h.values[key], strings.Split(key, "\xff")
+		if len(h.labels) == 0 {
+			labelValues = nil
+		}
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, append(labelValues, fmt.Sprint(bound))), values.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, append(labelValues, "+Inf")), values.count)
+		fmt.Fprintf(w, "%s_sum%s %g\n", h.name, formatLabels(h.labels, labelValues), values.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, labelValues), values.count)
+	}
+}
+
+// formatLabels returns the {name="value",...} suffix of a sample.
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+		pairs[i] = name + `="` + value + `"`
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// writeMetrics writes every metric.
+func writeMetrics(w io.Writer) {
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/arkan/sqlproxy/internal/sqltext"
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack"
+)
+
+// Multi request struct, running the semicolon-separated statements of a
+// script in order. Args are those of the ? placeholders of every statement.
+type MultiRequest struct {
+	Op       string        `msgpack:"op"`
+	Query    string        `msgpack:"query"`
+	Args     []interface{} `msgpack:"args"`
+	TraceID  string        `msgpack:"trace_id"`
+	Priority string        `msgpack:"priority"`
+	Timeout  int64         `msgpack:"timeout_ms"`
+	// Transaction runs the statements in a transaction, rolled back when one
+	// of them fails.
+	Transaction bool `msgpack:"transaction"`
+}
+
+// Multi response struct, with the results of the statements that ran. When
+// one fails, Error names it and the following ones aren't run.
+type MultiResponse struct {
+	Results []StatementResult `msgpack:"results"`
+	TraceID string            `msgpack:"trace_id"`
+	Error   string            `msgpack:"error"`
+	errorCode
+}
+
+// StatementResult is the result of a statement of a multi request: rows for
+// those returning some, counts for the others.
+type StatementResult struct {
+	Columns      []string        `msgpack:"columns"`
+	Data         [][]interface{} `msgpack:"data"`
+	RowsAffected int64           `msgpack:"rows_affected"`
+	LastInsertID int64           `msgpack:"last_insert_id"`
+}
+
+// txBeginner is implemented by *sql.DB and *sql.Conn.
+type txBeginner interface {
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+func handleMulti(sess *session, srv *server, data []byte) (requestStats, error) {
+	var multi MultiRequest
+	if err := msgpack.Unmarshal(data, &multi); err != nil {
+		return requestStats{}, err
+	}
+	if err := checkLimits(multi.Query, multi.Args); err != nil {
+		return requestStats{}, err
+	}
+
+	// Statements and their share of the arguments.
+	var reqs []QueryRequest
+	args := multi.Args
+	for _, query := range sqltext.Split(multi.Query) {
+		n := sqltext.Placeholders(sqltext.Tokenize(query))
+		if n > len(args) {
+			return requestStats{}, errors.Errorf("statements have more placeholders than the %d arguments", len(multi.Args))
+		}
+		reqs = append(reqs, QueryRequest{Query: query, Args: args[:n], TraceID: multi.TraceID})
+		args = args[n:]
+	}
+	if len(reqs) == 0 {
+		return requestStats{}, errors.New("empty statement")
+	}
+	if len(args) > 0 {
+		return requestStats{}, errors.Errorf("statements have fewer placeholders than the %d arguments", len(multi.Args))
+	}
+	for i := range reqs {
+		if err := prepareStatement(sess, srv, &reqs[i]); err != nil {
+			return requestStats{}, errors.Wrapf(err, "statement %d", i+1)
+		}
+		if isSetStatement(reqs[i].Query) {
+			return requestStats{}, errors.Errorf("statement %d: SET statements must be sent alone", i+1)
+		}
+		// Statements of a script share a connection.
+		if _, b, err := sess.router.route(reqs[i].Query, reqs[i].Args); err != nil {
+			return requestStats{}, errors.Wrapf(err, "statement %d", i+1)
+		} else if b != nil {
+			return requestStats{}, errors.Errorf("statement %d: routed statements must be sent alone", i+1)
+		}
+	}
+
+	var db querier = sess.db()
+	var tx *sql.Tx
+	// In the transaction of the session, statements are part of it.
+	if multi.Transaction && sess.tx == nil {
+		var err error
+		if tx, err = sess.db().(txBeginner).BeginTx(sess.ctx, nil); err != nil {
+			return requestStats{}, err
+		}
+		defer tx.Rollback()
+		db = tx
+		sess.inTx = true
+		defer func() { sess.inTx, sess.pending, sess.pendingWrites = false, nil, nil }()
+	}
+
+	var stats requestStats
+	response := MultiResponse{TraceID: sess.traceID}
+	for i, req := range reqs {
+		result, reqStats, err := runMultiStatement(sess, db, req)
+		stats.rows += reqStats.rows
+		stats.duration += reqStats.duration
+		if err != nil {
+			sess.logf("Multi statement %d error: %v", i+1, err)
+			response.Error = errors.Wrapf(err, "statement %d", i+1).Error()
+			response.errorCode = codeOf(err)
+			break
+		}
+		response.Results = append(response.Results, result)
+	}
+	if tx != nil && response.Error == "" {
+		if err := tx.Commit(); err != nil {
+			response.Error = errors.Wrap(err, "commit").Error()
+			response.errorCode = codeOf(err)
+		} else {
+			for _, n := range sess.pending {
+				sess.notify.publish(sess.tenant, n)
+			}
+			if sess.cache != nil {
+				sess.cache.written(sess.tenant, sess.pendingWrites)
+			}
+		}
+	}
+	stats.bytes = int64(sendResponse(sess.conn, response))
+
+	return stats, nil
+}
+
+// runMultiStatement runs a statement of a multi request.
+func runMultiStatement(sess *session, db querier, req QueryRequest) (StatementResult, requestStats, error) {
+	if !isQuery(req.Query) {
+		response, stats, err := execStatement(sess, db, req.exec())
+		return StatementResult{RowsAffected: response.RowsAffected, LastInsertID: response.LastInsertID}, stats, err
+	}
+
+	if !sqltext.ReadOnly(sqltext.Tokenize(req.Query)) {
+		response, stats, err := execReturning(sess, db, req)
+		return StatementResult{Columns: response.Columns, Data: response.Data, RowsAffected: response.RowsAffected}, stats, err
+	}
+
+	response, stats, err := queryStatement(sess, db, req)
+	if err != nil {
+		return StatementResult{}, stats, err
+	}
+
+	return StatementResult{Columns: response.Columns, Data: response.Data}, stats, nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/arkan/sqlproxy/internal/sqltext"
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack"
+)
+
+// Notification limits.
+const (
+	maxChannels       = 64
+	maxPayloadBytes   = 8000
+	notificationQueue = 256
+)
+
+// Listen request struct, subscribing the session to notification channels
+// (op "listen") or unsubscribing it (op "unlisten", from all of them when
+// Channels is empty). Answered by a ListenResponse.
+type ListenRequest struct {
+	Op       string   `msgpack:"op"`
+	Channels []string `msgpack:"channels"`
+	TraceID  string   `msgpack:"trace_id"`
+}
+
+// Listen response struct, with the channels the session listens to.
+type ListenResponse struct {
+	Channels []string `msgpack:"channels"`
+	TraceID  string   `msgpack:"trace_id"`
+	Error    string   `msgpack:"error"`
+}
+
+// Notify request struct, sending a notification to the sessions of the
+// tenant listening to a channel. Answered by a NotifyResponse.
+type NotifyRequest struct {
+	Op      string `msgpack:"op"`
+	Channel string `msgpack:"channel"`
+	Payload string `msgpack:"payload"`
+	TraceID string `msgpack:"trace_id"`
+}
+
+// Notify response struct, with the number of sessions notified.
+type NotifyResponse struct {
+	Listeners int    `msgpack:"listeners"`
+	TraceID   string `msgpack:"trace_id"`
+	Error     string `msgpack:"error"`
+}
+
+// NotificationFrame is sent to a listening session when a notification is
+// published on one of its channels, between the responses to its requests.
+type NotificationFrame struct {
+	Notification Notification `msgpack:"notification"`
+}
+
+// Notification of a channel.
+type Notification struct {
+	Channel string `msgpack:"channel"`
+	Payload string `msgpack:"payload"`
+}
+
+// notifyHub delivers the notifications to the listening sessions. Channels
+// are scoped by tenant.
+type notifyHub struct {
+	mu        sync.Mutex
+	listeners map[string]map[*session]bool
+}
+
+func newNotifyHub() *notifyHub {
+	return &notifyHub{listeners: map[string]map[*session]bool{}}
+}
+
+// channelKey scopes a channel by tenant.
+func channelKey(tenant, channel string) string {
+	return tenant + "\x00" + channel
+}
+
+func (h *notifyHub) listen(sess *session, channel string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := channelKey(sess.tenant, channel)
+	if h.listeners[key] == nil {
+		h.listeners[key] = map[*session]bool{}
+	}
+	h.listeners[key][sess] = true
+}
+
+func (h *notifyHub) unlisten(sess *session, channel string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := channelKey(sess.tenant, channel)
+	delete(h.listeners[key], sess)
+	if len(h.listeners[key]) == 0 {
+		delete(h.listeners, key)
+	}
+}
+
+// publish queues a notification for the listeners of its channel, and
+// returns their number. Notifications are dropped for the sessions too slow
+// to read them.
+func (h *notifyHub) publish(tenant string, n Notification) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	listeners := h.listeners[channelKey(tenant, n.Channel)]
+	for sess := range listeners {
+		select {
+		case sess.notifications <- n:
+		default:
+			notificationsDropped.add(1, tenant)
+			log.Printf("Notification on %q dropped for %s: queue full", n.Channel, sess.conn.RemoteAddr())
+		}
+	}
+	notificationsTotal.add(1, tenant)
+
+	return len(listeners)
+}
+
+func handleListen(sess *session, srv *server, op string, data []byte) (requestStats, error) {
+	var req ListenRequest
+	if err := msgpack.Unmarshal(data, &req); err != nil {
+		return requestStats{}, err
+	}
+
+	if op == "listen" {
+		for _, channel := range req.Channels {
+			if channel == "" {
+				return requestStats{}, errors.New("empty channel name")
+			}
+		}
+		if sess.notifications == nil {
+			sess.notifications = make(chan Notification, notificationQueue)
+			go sess.sendNotifications()
+		}
+		for _, channel := range req.Channels {
+			if !sess.channels[channel] && len(sess.channels) >= maxChannels {
+				return requestStats{}, errors.Errorf("too many channels (%d)", maxChannels)
+			}
+			sess.channels[channel] = true
+			srv.notify.listen(sess, channel)
+		}
+	} else {
+		channels := req.Channels
+		if len(channels) == 0 {
+			for channel := range sess.channels {
+				channels = append(channels, channel)
+			}
+		}
+		for _, channel := range channels {
+			delete(sess.channels, channel)
+			srv.notify.unlisten(sess, channel)
+		}
+	}
+	sess.logf("%s: %v", op, req.Channels)
+
+	response := ListenResponse{Channels: []string{}, TraceID: sess.traceID}
+	for channel := range sess.channels {
+		response.Channels = append(response.Channels, channel)
+	}
+	return requestStats{bytes: int64(sendResponse(sess.conn, response))}, nil
+}
+
+func handleNotify(sess *session, data []byte) (requestStats, error) {
+	var req NotifyRequest
+	if err := msgpack.Unmarshal(data, &req); err != nil {
+		return requestStats{}, err
+	}
+	if req.Channel == "" {
+		return requestStats{}, errors.New("empty channel name")
+	}
+	if len(req.Payload) > maxPayloadBytes {
+		return requestStats{}, errors.Errorf("payload of %d bytes exceeds the limit of %d", len(req.Payload), maxPayloadBytes)
+	}
+
+	n := sess.notify.publish(sess.tenant, Notification{Channel: req.Channel, Payload: req.Payload})
+	return requestStats{bytes: int64(sendResponse(sess.conn, NotifyResponse{Listeners: n, TraceID: sess.traceID}))}, nil
+}
+
+// sendNotifications sends the queued notifications of a listening session
+// until it ends.
+func (sess *session) sendNotifications() {
+	for {
+		select {
+		case n := <-sess.notifications:
+			sendResponse(sess.conn, NotificationFrame{Notification: n})
+		case <-sess.ctx.Done():
+			return
+		}
+	}
+}
+
+// unlistenAll unsubscribes a session ending from its channels.
+func (sess *session) unlistenAll(srv *server) {
+	for channel := range sess.channels {
+		srv.notify.unlisten(sess, channel)
+	}
+}
+
+// notified publishes the notification of a NOTIFY statement that ran on the
+// backend, or queues it until the commit of the transaction running it.
+func (sess *session) notified(query string) {
+	n, ok := notifyStatement(query)
+	if !ok {
+		return
+	}
+	if sess.inTx {
+		sess.pending = append(sess.pending, n)
+		return
+	}
+	sess.notify.publish(sess.tenant, n)
+}
+
+// notifyStatement returns the notification of a "NOTIFY channel [,
+// 'payload']" statement. Unquoted channel names are folded to lower case, as
+// PostgreSQL does.
+func notifyStatement(query string) (Notification, bool) {
+	var tokens []sqltext.Token
+	for _, t := range sqltext.Tokenize(query) {
+		if t.Significant() {
+			tokens = append(tokens, t)
+		}
+	}
+	if len(tokens) > 0 && tokens[len(tokens)-1].Kind == sqltext.Punct && tokens[len(tokens)-1].Text == ";" {
+		tokens = tokens[:len(tokens)-1]
+	}
+	if len(tokens) < 2 || !tokens[0].Is("NOTIFY") || !tokens[1].IsIdent() {
+		return Notification{}, false
+	}
+
+	n := Notification{Channel: tokens[1].Ident()}
+	if tokens[1].Kind == sqltext.Word {
+		n.Channel = strings.ToLower(n.Channel)
+	}
+	switch {
+	case len(tokens) == 2:
+	case len(tokens) == 4 && tokens[2].Text == "," && tokens[3].Kind == sqltext.String:
+		n.Payload = stringLiteral(tokens[3].Text)
+	default:
+		return Notification{}, false
+	}
+
+	return n, true
+}
+
+// stringLiteral returns the value of a 'string' or $tag$string$tag$ literal.
+func stringLiteral(text string) string {
+	if strings.HasPrefix(text, "$") {
+		if end := strings.Index(text[1:], "$"); end >= 0 {
+			tag := text[:end+2]
+			return strings.TrimSuffix(strings.TrimPrefix(text, tag), tag)
+		}
+	}
+	if i := strings.IndexByte(text, '\''); i >= 0 && len(text) >= i+2 {
+		return strings.ReplaceAll(text[i+1:len(text)-1], "''", "'")
+	}
+
+	return text
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var (
+	poolOpen              = newMetricVec("gauge", "sqlproxy_pool_open_connections", "Open backend connections.", "pool")
+	poolInUse             = newMetricVec("gauge", "sqlproxy_pool_in_use_connections", "Backend connections in use.", "pool")
+	poolIdle              = newMetricVec("gauge", "sqlproxy_pool_idle_connections", "Idle backend connections.", "pool")
+	poolMaxOpen           = newMetricVec("gauge", "sqlproxy_pool_max_open_connections", "Most open backend connections (none when 0).", "pool")
+	poolQueued            = newMetricVec("gauge", "sqlproxy_pool_queued_requests", "Requests waiting in the admission queue.", "pool")
+	poolWaits             = newMetricVec("counter", "sqlproxy_pool_waits_total", "Waits for a backend connection.", "pool")
+	poolWaitSeconds       = newMetricVec("counter", "sqlproxy_pool_wait_seconds_total", "Time waited for backend connections.", "pool")
+	poolMaxLifetimeClosed = newMetricVec("counter", "sqlproxy_pool_max_lifetime_closed_total", "Backend connections closed for their maximum lifetime.", "pool")
+	poolMaxIdleClosed     = newMetricVec("counter", "sqlproxy_pool_max_idle_closed_total", "Backend connections closed for the maximum of idle ones or their idle time.", "pool")
+
+	poolWaitDuration = newHistogramVec("sqlproxy_pool_wait_duration_seconds", "Waits for a backend connection, by their mean duration over each sampling interval.",
+		[]float64{.001, .005, .01, .05, .1, .5, 1, 5}, "pool")
+	poolUtilization = newHistogramVec("sqlproxy_pool_utilization", "Samples of the fraction of the most open backend connections in use.",
+		[]float64{.25, .5, .75, .9, 1}, "pool")
+)
+
+// PoolStats are the statistics of a backend pool (see sql.DBStats).
+type PoolStats struct {
+	MaxOpenConnections int           `msgpack:"max_open_connections" json:"max_open_connections"`
+	OpenConnections    int           `msgpack:"open_connections" json:"open_connections"`
+	InUse              int           `msgpack:"in_use" json:"in_use"`
+	Idle               int           `msgpack:"idle" json:"idle"`
+	WaitCount          int64         `msgpack:"wait_count" json:"wait_count"`
+	WaitDuration       time.Duration `msgpack:"wait_duration" json:"wait_duration"`
+	MaxIdleClosed      int64         `msgpack:"max_idle_closed" json:"max_idle_closed"`
+	MaxIdleTimeClosed  int64         `msgpack:"max_idle_time_closed" json:"max_idle_time_closed"`
+	MaxLifetimeClosed  int64         `msgpack:"max_lifetime_closed" json:"max_lifetime_closed"`
+	// Requests waiting in the admission queue.
+	Queued int `msgpack:"queued" json:"queued"`
+}
+
+// Pool stats request struct.
+type PoolStatsRequest struct {
+	Op string `msgpack:"op"`
+}
+
+// Pool stats response struct, with the statistics of the session backend.
+type PoolStatsResponse struct {
+	Stats PoolStats `msgpack:"stats"`
+	Error string    `msgpack:"error"`
+}
+
+// Stats returns the statistics of the current pool.
+func (b *backend) Stats() PoolStats {
+	s := b.DB().Stats()
+	return PoolStats{
+		MaxOpenConnections: s.MaxOpenConnections,
+		OpenConnections:    s.OpenConnections,
+		InUse:              s.InUse,
+		Idle:               s.Idle,
+		WaitCount:          s.WaitCount,
+		WaitDuration:       s.WaitDuration,
+		MaxIdleClosed:      s.MaxIdleClosed,
+		MaxIdleTimeClosed:  s.MaxIdleTimeClosed,
+		MaxLifetimeClosed:  s.MaxLifetimeClosed,
+		Queued:             b.admission.waiting(),
+	}
+}
+
+// pools returns every backend by pool: "default", "tenant:<name>",
+// "backend:<name>" for named backends, "shard:<n>" or
+// "tenant:<name>/shard:<n>" for shards, and "replica:<n>" or
+// "tenant:<name>/replica:<n>" for replicas.
+func (s *server) pools() map[string]*backend {
+	pools := map[string]*backend{}
+	if s.backend != nil {
+		pools["default"] = s.backend
+	}
+	for name, b := range s.tenants {
+		pools["tenant:"+name] = b
+	}
+	for name, b := range s.backends {
+		pools["backend:"+name] = b
+	}
+	for name, r := range s.routers {
+		prefix := ""
+		if name != "" {
+			prefix = "tenant:" + name + "/"
+		}
+		if r.shards != nil {
+			for i, b := range r.shards.shards {
+				pools[prefix+"shard:"+strconv.Itoa(i)] = b
+			}
+		}
+		if r.replicas != nil {
+			for i, b := range r.replicas.replicas {
+				pools[prefix+"replica:"+strconv.Itoa(i)] = b
+			}
+		}
+	}
+
+	return pools
+}
+
+// PoolRebuild is the DSN of the new pool of a backend, the current one when
+// empty, e.g. once its credentials were rotated or its host moved.
+type PoolRebuild struct {
+	DSN string `json:"dsn"`
+}
+
+// rebuildPool replaces the pool of a backend by name: new statements use the
+// new pool once it answers, while those running finish on the old one,
+// closed then.
+func (s *server) rebuildPool(name string, req PoolRebuild) (bool, error) {
+	b := s.pools()[name]
+	if b == nil {
+		return false, nil
+	}
+
+	dsn := req.DSN
+	if dsn == "" {
+		dsn = b.DSN()
+	}
+	if err := b.Reconnect(dsn); err != nil {
+		return true, err
+	}
+	log.Printf("Pool %s rebuilt", name)
+
+	return true, nil
+}
+
+// poolStats returns the statistics of every backend by pool.
+func (s *server) poolStats() map[string]PoolStats {
+	stats := map[string]PoolStats{}
+	for pool, b := range s.pools() {
+		stats[pool] = b.Stats()
+	}
+	return stats
+}
+
+// unready returns the pools whose backend wasn't reached yet, sorted.
+func (s *server) unready() []string {
+	var down []string
+	for pool, b := range s.pools() {
+		if !b.ready.Load() {
+			down = append(down, pool)
+		}
+	}
+	sort.Strings(down)
+	return down
+}
+
+func handlePoolStats(sess *session) (requestStats, error) {
+	response := PoolStatsResponse{Stats: sess.backend.Stats()}
+	return requestStats{bytes: int64(sendResponse(sess.conn, response))}, nil
+}
+
+// samplePools updates the pool metrics from the statistics of every backend
+// at each interval.
+func samplePools(srv *server, interval time.Duration) {
+	last := map[string]PoolStats{}
+	for range time.Tick(interval) {
+		for pool, stats := range srv.poolStats() {
+			poolOpen.set(float64(stats.OpenConnections), pool)
+			poolInUse.set(float64(stats.InUse), pool)
+			poolIdle.set(float64(stats.Idle), pool)
+			poolMaxOpen.set(float64(stats.MaxOpenConnections), pool)
+			poolQueued.set(float64(stats.Queued), pool)
+			// The statistics are totals since the pool opened.
+			poolWaits.set(float64(stats.WaitCount), pool)
+			poolWaitSeconds.set(stats.WaitDuration.Seconds(), pool)
+			poolMaxLifetimeClosed.set(float64(stats.MaxLifetimeClosed), pool)
+			poolMaxIdleClosed.set(float64(stats.MaxIdleClosed+stats.MaxIdleTimeClosed), pool)
+
+			// Pools rebuilt since the last sample start from 0.
+			previous := last[pool]
+			if stats.WaitCount < previous.WaitCount {
+				previous = PoolStats{}
+			}
+			if waits := stats.WaitCount - previous.WaitCount; waits > 0 {
+				mean := (stats.WaitDuration - previous.WaitDuration).Seconds() / float64(waits)
+				poolWaitDuration.observe(mean, uint64(waits), pool)
+			}
+			if stats.MaxOpenConnections > 0 {
+				poolUtilization.observe(float64(stats.InUse)/float64(stats.MaxOpenConnections), 1, pool)
+			}
+			last[pool] = stats
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// driverTypes are the value types decoded by the Go driver, in the order of
+// its hello request.
+var driverTypes = []string{"uuid", "int[]", "text[]", "json", "timestamptz"}
+
+// prewarmConfig is a query run when the proxy starts, then on a schedule, to
+// cache its result before clients ask for it, e.g. those of the dashboards
+// opened at 9am. It must match a cache rule, whose TTL applies.
+type prewarmConfig struct {
+	Query string        `json:"query"`
+	Args  []interface{} `json:"args"`
+	// Identity the query runs as, whose tenant, row policies and masks
+	// apply. The result is cached for anonymous clients when empty.
+	User string `json:"user"`
+	// Value types decoded by the clients the result is cached for, those of
+	// the Go driver by default.
+	Types []string `json:"types"`
+	// Interval of the refreshes, and times of day ("08:55", local time) the
+	// result is refreshed at. The query runs at startup only without them.
+	Refresh duration `json:"refresh"`
+	At      []string `json:"at"`
+}
+
+func (p *prewarmConfig) validate(identities map[string]*identityConfig) error {
+	if p.Query == "" {
+		return errors.New("query is required")
+	}
+	if p.User != "" && identities[p.User] == nil {
+		return errors.Errorf("unknown identity %s", p.User)
+	}
+	if p.Refresh.Duration < 0 {
+		return errors.New("refresh must be positive")
+	}
+	for _, at := range p.At {
+		if _, err := time.Parse("15:04", at); err != nil {
+			return errors.Errorf("invalid time of day %q, expected hh:mm", at)
+		}
+	}
+
+	return nil
+}
+
+// next returns when the result is refreshed after now, zero if never.
+func (p *prewarmConfig) next(now time.Time) time.Time {
+	var next time.Time
+	if p.Refresh.Duration > 0 {
+		next = now.Add(p.Refresh.Duration)
+	}
+	for _, at := range p.At {
+		t, _ := time.Parse("15:04", at)
+		day := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+		if !day.After(now) {
+			day = day.AddDate(0, 0, 1)
+		}
+		if next.IsZero() || day.Before(next) {
+			next = day
+		}
+	}
+
+	return next
+}
+
+// prewarmer runs the prewarmed queries until it is closed.
+type prewarmer struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// startPrewarmer runs the prewarmed queries, then refreshes their results
+// on their schedule.
+func startPrewarmer(srv *server, queries []prewarmConfig) *prewarmer {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &prewarmer{cancel: cancel}
+	for i := range queries {
+		cfg := &queries[i]
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for {
+				start := time.Now()
+				if rows, err := prewarm(ctx, srv, cfg); err != nil && ctx.Err() == nil {
+					log.Printf("Prewarm %d error: %v", i+1, err)
+				} else if err == nil {
+					log.Printf("Prewarmed %d: %d rows cached (%v)", i+1, rows, time.Since(start))
+				}
+
+				next := cfg.next(time.Now())
+				if next.IsZero() {
+					return
+				}
+				timer := time.NewTimer(time.Until(next))
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					timer.Stop()
+					return
+				}
+			}
+		}()
+	}
+	log.Printf("Prewarming %d queries", len(queries))
+
+	return p
+}
+
+// Close stops the refreshes.
+func (p *prewarmer) Close() {
+	p.cancel()
+	p.wg.Wait()
+}
+
+// prewarm runs a query in a session of its own, as those of its clients,
+// and caches its result under their key. It returns the rows cached.
+func prewarm(ctx context.Context, srv *server, cfg *prewarmConfig) (int64, error) {
+	sess := newSession(nil, srv)
+	defer sess.cancel()
+	stop := context.AfterFunc(ctx, sess.cancel)
+	defer stop()
+
+	if cfg.User != "" {
+		if err := srv.bind(sess, cfg.User, srv.config.Identities[cfg.User]); err != nil {
+			return 0, err
+		}
+	}
+	if sess.backend == nil {
+		return 0, errors.New("there is no default DSN")
+	}
+	types := cfg.Types
+	if types == nil {
+		types = driverTypes
+	}
+	sess.decode(srv, types)
+	sess.timeout = sess.statementTimeout
+
+	// The integers of the clients are floats in JSON.
+	args := make([]interface{}, len(cfg.Args))
+	for i, arg := range cfg.Args {
+		if f, ok := arg.(float64); ok && f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+			arg = int64(f)
+		}
+		args[i] = arg
+	}
+	req := QueryRequest{Query: cfg.Query, Args: args}
+	if err := prepareStatement(sess, srv, &req); err != nil {
+		return 0, err
+	}
+	ttl, tables, ok := srv.cache.rule(req.Query)
+	if !ok {
+		return 0, errors.New("the query matches no cache rule")
+	}
+	key, err := sess.cacheKey(req)
+	if err != nil {
+		return 0, err
+	}
+
+	release, err := sess.backend.admission.acquire(sess.ctx, priorityBatch, flow{name: sess.user, weight: sess.weight})
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	defer sess.releaseMemory()
+
+	_, gen, _ := srv.cache.get(key, sess.tenant, tables)
+	_, stats, err := srv.cache.fill(sess, req, key, ttl, tables, gen)
+	return stats.rows, err
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/arkan/sqlproxy/internal/sqltext"
+)
+
+// logStatement logs a statement which ran on db for a duration. Successful
+// statements are sampled with -log-sample, unless they ran longer than
+// -slow-query, and failed ones always logged.
+func (sess *session) logStatement(db querier, kind, query string, args []interface{}, d time.Duration, err error) {
+	slow := *slowQuery > 0 && d >= *slowQuery
+	switch {
+	case err != nil:
+		sess.logf("%s: %s (%s): %v", kind, logged(query, args), d, err)
+	case slow:
+		sess.logf("Slow %s: %s (%s)%s", kind, logged(query, args), d, sess.slowPlan(db, query, args))
+	case *logSample >= 1 || rand.Float64() < *logSample:
+		sess.logf("%s: %s (%s)", kind, logged(query, args), d)
+	}
+}
+
+// explainedStatements are the statements whose plan is logged with
+// -slow-explain.
+var explainedStatements = map[string]bool{"SELECT": true, "INSERT": true, "UPDATE": true, "DELETE": true, "MERGE": true}
+
+// slowPlan returns the plan of a slow statement with -slow-explain, as the
+// lines following its log entry, explained again on the connection it ran
+// on. Statements aren't explained in transactions, where a failed EXPLAIN
+// aborts them with some backends, nor with dialects setting a plan mode on
+// the connection.
+func (sess *session) slowPlan(db querier, query string, args []interface{}) string {
+	d := sess.backend.dialect
+	if !*slowExplain || sess.inTx || d.explainPrefix == "" || d.explainOn != "" || !explainedStatements[sqltext.Statement(sqltext.Tokenize(query))] {
+		return ""
+	}
+
+	ctx, cancel := sess.statementContext()
+	defer cancel()
+	rows, err := db.QueryContext(ctx, d.explainPrefix+query, args...)
+	if err != nil {
+		return fmt.Sprintf(" (explain error: %v)", err)
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return fmt.Sprintf(" (explain error: %v)", err)
+	}
+
+	var plan strings.Builder
+	values := make([]interface{}, len(cols))
+	dest := make([]interface{}, len(cols))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return fmt.Sprintf(" (explain error: %v)", err)
+		}
+		plan.WriteString("\n\t")
+		for i, v := range values {
+			if i > 0 {
+				plan.WriteString(" | ")
+			}
+			switch v := v.(type) {
+			case nil:
+				plan.WriteString("NULL")
+			case []byte:
+				plan.Write(v)
+			default:
+				fmt.Fprint(&plan, v)
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Sprintf(" (explain error: %v)", err)
+	}
+
+	// Plans may hold the values of the arguments.
+	return loggedQuery(plan.String())
+}
+
+// logged returns a statement and its arguments as they are logged: with
+// -log-redact, its literals are replaced by ? and only the number of its
+// arguments is logged.
+func logged(query string, args []interface{}) string {
+	if *logRedact {
+		return fmt.Sprintf("%s - %d args", loggedQuery(query), len(args))
+	}
+	return fmt.Sprintf("%s - %v", query, args)
+}
+
+// loggedQuery returns a statement as it is logged.
+func loggedQuery(query string) string {
+	if *logRedact {
+		return sqltext.Redact(query)
+	}
+	return query
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/arkan/sqlproxy/internal/sqltext"
+)
+
+// Access roles, granted to identities along with their other roles. They
+// decide the statements an identity may run and whether it may use the admin
+// API, all checked here.
+const (
+	readOnlyRole  = "read-only"
+	readWriteRole = "read-write"
+	adminRole     = "admin"
+)
+
+// access is a level of access, each one allowing what those below it do.
+type access int
+
+const (
+	// Statements returning rows without modifying anything, and those of
+	// the session (SET, transactions).
+	accessRead access = iota
+	// Writes (INSERT, UPDATE, DELETE, MERGE), and queries locking rows.
+	accessWrite
+	// Any statement, DDL included.
+	accessAdmin
+)
+
+var accessRoles = map[access]string{accessRead: readOnlyRole, accessWrite: readWriteRole, accessAdmin: adminRole}
+
+// controlStatements are the statements of the session and its transactions,
+// and those listening to notifications, run by every identity.
+var controlStatements = map[string]bool{
+	"SET": true, "RESET": true, "BEGIN": true, "START": true, "COMMIT": true,
+	"END": true, "ROLLBACK": true, "SAVEPOINT": true, "RELEASE": true,
+	"LISTEN": true, "UNLISTEN": true,
+}
+
+// dmlStatements are the statements of the read-write role: writes, and
+// queries modifying or locking rows.
+var dmlStatements = map[string]bool{
+	"SELECT": true, "VALUES": true, "TABLE": true, "SHOW": true, "EXPLAIN": true,
+	"DESCRIBE": true, "DESC": true, "INSERT": true, "UPDATE": true,
+	"DELETE": true, "MERGE": true, "REPLACE": true, "UPSERT": true,
+	"NOTIFY": true,
+}
+
+// opAccess is the access required by the request ops which don't run a
+// statement: listening to notifications is a read, publishing one a write.
+var opAccess = map[string]access{"listen": accessRead, "unlisten": accessRead, "notify": accessWrite}
+
+// identityAccess returns the access of an identity: the highest of its
+// access roles. Identities granted none of them are not restricted.
+func identityAccess(identity *identityConfig) access {
+	switch {
+	case identity.hasRole(adminRole):
+		return accessAdmin
+	case identity.hasRole(readWriteRole):
+		return accessWrite
+	case identity.hasRole(readOnlyRole):
+		return accessRead
+	}
+
+	return accessAdmin
+}
+
+// statementAccess returns the access required to run a statement: the
+// highest of those of its statements when it holds several.
+func statementAccess(query string) access {
+	statements := sqltext.Split(query)
+	if len(statements) == 0 {
+		return singleStatementAccess(query)
+	}
+
+	required := accessRead
+	for _, statement := range statements {
+		if a := singleStatementAccess(statement); a > required {
+			required = a
+		}
+	}
+	return required
+}
+
+// singleStatementAccess returns the access required to run a single
+// statement. Control statements holding a write, such as a procedural BEGIN
+// block, aren't run by every identity.
+func singleStatementAccess(query string) access {
+	tokens := sqltext.Tokenize(query)
+	statement := sqltext.Statement(tokens)
+	switch {
+	case sqltext.ReadOnly(tokens), controlStatements[statement] && !sqltext.Modifies(tokens):
+		return accessRead
+	case dmlStatements[statement]:
+		return accessWrite
+	}
+
+	return accessAdmin
+}
+
+// checkAccess returns an error when the access of the session is too low to
+// run a statement.
+func checkAccess(sess *session, query string) error {
+	required := statementAccess(query)
+	if sess.access >= required {
+		return nil
+	}
+
+	sess.logf("Statement of %q denied, %s role required: %s", sess.user, accessRoles[required], loggedQuery(query))
+	return accessDenied(required)
+}
+
+// checkOpAccess returns an error when the access of the session is too low
+// for a request op of opAccess.
+func checkOpAccess(sess *session, op string) error {
+	required := opAccess[op]
+	if sess.access >= required {
+		return nil
+	}
+
+	sess.logf("Request %s of %q denied, %s role required", op, sess.user, accessRoles[required])
+	return accessDenied(required)
+}
+
+// accessDenied returns the error of a statement or request requiring a
+// higher access.
+func accessDenied(required access) error {
+	return &codedError{
+		msg:  fmt.Sprintf("permission denied: the %s role is required", accessRoles[required]),
+		code: errorCode{Code: "42501", Class: classPrivilege},
+	}
+}
+
+// requireAdmin restricts an admin API handler to the identities granted the
+// admin role, authenticated with HTTP basic authentication, when clients must
+// authenticate, and its requests changing anything to the admin token
+// otherwise.
+func requireAdmin(srv *server, h http.Handler) http.Handler {
+	if !srv.requiresAuth() {
+		return requireAdminToken(srv.adminToken, h)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		identity := srv.config.Identities[user]
+		if !ok || identity == nil || !identity.checkPassword(password) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="sqlproxy"`)
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+		if !identity.hasRole(adminRole) {
+			http.Error(w, "the admin role is required", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// requireAdminToken restricts the admin API requests other than GET and HEAD
+// to those with the bearer token of -admin-token-env, refusing them all when
+// there is none.
+func requireAdminToken(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if token == "" {
+			http.Error(w, "an admin token (-admin-token-env) is required to change the proxy when clients don't authenticate", http.StatusForbidden)
+			return
+		}
+		bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="sqlproxy"`)
+			http.Error(w, "admin token required", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
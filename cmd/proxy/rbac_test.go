@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStatementAccess(t *testing.T) {
+	tests := []struct {
+		query string
+		want  access
+	}{
+		{"SELECT 1", accessRead},
+		{"SET search_path = app", accessRead},
+		{"BEGIN", accessRead},
+		{"BEGIN; COMMIT", accessRead},
+		{"SELECT 1; SELECT 2", accessRead},
+		{"SELECT * FROM users FOR UPDATE", accessWrite},
+		{"DELETE FROM users", accessWrite},
+		{"DROP TABLE users", accessAdmin},
+		{"BEGIN; DROP TABLE users", accessAdmin},
+		{"COMMIT; DELETE FROM users", accessWrite},
+		{"SELECT 1; DROP TABLE users", accessAdmin},
+		{"BEGIN DELETE FROM users END", accessAdmin},
+		{"SELECT ';'; DROP TABLE users", accessAdmin},
+	}
+	for _, test := range tests {
+		if got := statementAccess(test.query); got != test.want {
+			t.Errorf("statementAccess(%q) = %s, want %s", test.query, accessRoles[got], accessRoles[test.want])
+		}
+	}
+}
+
+func TestCheckOpAccess(t *testing.T) {
+	tests := []struct {
+		access access
+		op     string
+		denied bool
+	}{
+		{accessRead, "listen", false},
+		{accessRead, "unlisten", false},
+		{accessRead, "notify", true},
+		{accessWrite, "notify", false},
+		{accessAdmin, "notify", false},
+	}
+	for _, test := range tests {
+		sess := &session{user: "alice", access: test.access}
+		if err := checkOpAccess(sess, test.op); (err != nil) != test.denied {
+			t.Errorf("checkOpAccess(%s, %q) = %v, denied: %v", accessRoles[test.access], test.op, err, test.denied)
+		}
+	}
+
+	// NOTIFY and LISTEN statements require the access of their ops.
+	for query, want := range map[string]access{"LISTEN jobs": accessRead, "UNLISTEN jobs": accessRead, "NOTIFY jobs, 'done'": accessWrite} {
+		if got := statementAccess(query); got != want {
+			t.Errorf("statementAccess(%q) = %s, want %s", query, accessRoles[got], accessRoles[want])
+		}
+	}
+}
+
+func TestRequireAdminToken(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		token, method, auth string
+		want                int
+	}{
+		{"", "GET", "", http.StatusOK},
+		{"", "PUT", "", http.StatusForbidden},
+		{"", "PUT", "Bearer ", http.StatusForbidden},
+		{"secret", "HEAD", "", http.StatusOK},
+		{"secret", "POST", "", http.StatusUnauthorized},
+		{"secret", "POST", "Bearer wrong", http.StatusUnauthorized},
+		{"secret", "DELETE", "Basic secret", http.StatusUnauthorized},
+		{"secret", "PUT", "Bearer secret", http.StatusOK},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "/queries/q", nil)
+		if test.auth != "" {
+			r.Header.Set("Authorization", test.auth)
+		}
+		w := httptest.NewRecorder()
+		requireAdminToken(test.token, ok).ServeHTTP(w, r)
+		if w.Code != test.want {
+			t.Errorf("%s with token %q and %q = %d, want %d", test.method, test.token, test.auth, w.Code, test.want)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"log"
+	"runtime/debug"
+
+	"github.com/pkg/errors"
+)
+
+// errPanic is returned for a request that panicked. Its session may be in
+// any state, so its connection is closed.
+var errPanic = errors.New("internal error")
+
+// handleRequestSafely handles a request, turning a panic into errPanic.
+func handleRequestSafely(sess *session, srv *server, op string, priority int, data []byte) (stats requestStats, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			sess.logf("Request panic: %v\n%s", r, debug.Stack())
+			panicsTotal.add(1, sess.tenant)
+			err = errPanic
+		}
+	}()
+
+	return handleRequest(sess, srv, op, priority, data)
+}
+
+// recoverConnection logs a panic outside of a request, e.g. while saying
+// hello, and lets its connection close.
+func recoverConnection(remote string) {
+	if r := recover(); r != nil {
+		log.Printf("Connection panic from %s: %v\n%s", remote, r, debug.Stack())
+		panicsTotal.add(1, "")
+	}
+}
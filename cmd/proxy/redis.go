@@ -0,0 +1,137 @@
+package main
+
+import (
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// redisClient is a client of a Redis server, speaking RESP.
+type redisClient struct {
+	conns *storeConns
+}
+
+func newRedisClient(addr, password string, db int, timeout time.Duration) *redisClient {
+	var init func(*storeConn) error
+	if password != "" || db != 0 {
+		init = func(c *storeConn) error {
+			if password != "" {
+				if _, err := redisCommand(c, "AUTH", password); err != nil {
+					return err
+				}
+			}
+			if db != 0 {
+				if _, err := redisCommand(c, "SELECT", strconv.Itoa(db)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	return &redisClient{conns: newStoreConns(addr, timeout, init)}
+}
+
+func (r *redisClient) do(args ...string) (interface{}, error) {
+	var reply interface{}
+	err := r.conns.do(func(c *storeConn) error {
+		var err error
+		reply, err = redisCommand(c, args...)
+		return err
+	})
+	return reply, err
+}
+
+func (r *redisClient) getMulti(keys []string) (map[string][]byte, error) {
+	reply, err := r.do(append([]string{"MGET"}, keys...)...)
+	if err != nil {
+		return nil, err
+	}
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != len(keys) {
+		return nil, errors.New("unexpected MGET reply")
+	}
+
+	found := map[string][]byte{}
+	for i, v := range values {
+		if v, ok := v.([]byte); ok {
+			found[keys[i]] = v
+		}
+	}
+	return found, nil
+}
+
+func (r *redisClient) set(key string, value []byte, ttl time.Duration) error {
+	_, err := r.do("SET", key, string(value), "PX", strconv.FormatInt(max(ttl.Milliseconds(), 1), 10))
+	return err
+}
+
+func (r *redisClient) add(key string, value []byte) (bool, error) {
+	reply, err := r.do("SET", key, string(value), "NX")
+	return reply != nil, err
+}
+
+func (r *redisClient) incr(key string) error {
+	_, err := r.do("INCR", key)
+	return err
+}
+
+// redisCommand sends a command and reads its reply: a string, an int64, a
+// []byte, nil or a []interface{} of them.
+func redisCommand(c *storeConn, args ...string) (interface{}, error) {
+	c.w.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		c.w.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	return redisReply(c)
+}
+
+func redisReply(c *storeConn) (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("invalid redis reply")
+	}
+	kind, text := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return text, nil
+	case '-':
+		return nil, storeError("redis: " + text)
+	case ':':
+		return strconv.ParseInt(text, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(text)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(text)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			if values[i], err = redisReply(c); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+
+	return nil, errors.Errorf("unknown redis reply type %q", kind)
+}
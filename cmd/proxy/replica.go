@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/arkan/sqlproxy/internal/sqltext"
+	"github.com/pkg/errors"
+)
+
+// defaultStickyWindow is how long the reads of a session go to the primary
+// after it writes, by default.
+const defaultStickyWindow = time.Second
+
+// positionTimeout is the longest time the replication position of a backend
+// is read in.
+const positionTimeout = 500 * time.Millisecond
+
+// replicaConfig splits the reads of a backend, the primary, off to its read
+// replicas.
+type replicaConfig struct {
+	// DSNs of the replicas, the reads balanced over them.
+	DSNs []string `json:"dsns"`
+	// Charset of the text of the replicas, -charset by default.
+	Charset      string `json:"charset"`
+	MaxOpenConns int    `json:"max_open_conns"`
+	MaxIdleConns int    `json:"max_idle_conns"`
+	WarmConns    int    `json:"warm_conns"`
+	// How long the reads of a session go to the primary after it writes, so
+	// that it reads its writes despite the replication lag: one second by
+	// default.
+	StickyWindow duration `json:"sticky_window"`
+}
+
+func (c *replicaConfig) validate() error {
+	if len(c.DSNs) == 0 {
+		return errors.New("dsns are required")
+	}
+	if c.StickyWindow.Duration < 0 {
+		return errors.New("sticky window must be positive")
+	}
+	return nil
+}
+
+// replicaSet holds the backends of the replicas.
+type replicaSet struct {
+	replicas []*backend
+	sticky   time.Duration
+	next     atomic.Uint64
+}
+
+// openReplicas opens the backend of every replica, of the dialect of the
+// primary.
+func openReplicas(cfg *replicaConfig, d *dialect) (*replicaSet, error) {
+	s := &replicaSet{sticky: cfg.StickyWindow.Duration}
+	if s.sticky == 0 {
+		s.sticky = defaultStickyWindow
+	}
+	for i, dsn := range cfg.DSNs {
+		b, err := openBackend(dsn, d, cfg.Charset, poolOptions{maxOpenConns: cfg.MaxOpenConns, maxIdleConns: cfg.MaxIdleConns, warmConns: cfg.WarmConns})
+		if err != nil {
+			s.Close()
+			return nil, errors.Wrapf(err, "replica %d", i)
+		}
+		s.replicas = append(s.replicas, b)
+	}
+
+	return s, nil
+}
+
+// pick returns the next replica, in turn.
+func (s *replicaSet) pick() *backend {
+	return s.replicas[(s.next.Add(1)-1)%uint64(len(s.replicas))]
+}
+
+// Close the replica backends.
+func (s *replicaSet) Close() {
+	for _, b := range s.replicas {
+		b.Close()
+	}
+}
+
+// replica returns the replica reading a statement of the session, or nil
+// when it runs on the primary: writes, the statements of transactions and
+// sessions with variables, and the reads within the sticky window of the
+// last of those.
+func (sess *session) replica(query string) *backend {
+	if sess.router == nil || sess.router.replicas == nil {
+		return nil
+	}
+	s := sess.router.replicas
+
+	if sess.tx != nil || sess.pinned != nil || !sqltext.ReadOnly(sqltext.Tokenize(query)) {
+		sess.lastWrite = time.Now()
+		return nil
+	}
+	if time.Since(sess.lastWrite) < s.sticky {
+		return nil
+	}
+	if c := sess.consistency; c != nil {
+		if !c.checked {
+			c.replica, c.checked = s.caughtUp(sess.ctx, sess.backend.dialect, c.token), true
+		}
+		return c.replica
+	}
+	return s.pick()
+}
+
+// consistencyCheck is the consistency token of a read, and the replica
+// found caught up to it once checked.
+type consistencyCheck struct {
+	token   string
+	checked bool
+	replica *backend
+}
+
+// caughtUp returns a replica caught up to a consistency token, trying them
+// in turn, or nil.
+func (s *replicaSet) caughtUp(ctx context.Context, d *dialect, token string) *backend {
+	if d.caughtUpQuery == "" {
+		return nil
+	}
+
+	first := s.next.Add(1) - 1
+	for i := range uint64(len(s.replicas)) {
+		b := s.replicas[(first+i)%uint64(len(s.replicas))]
+		ctx, cancel := context.WithTimeout(ctx, positionTimeout)
+		var v interface{}
+		err := b.DB().QueryRowContext(ctx, d.caughtUpQuery, token).Scan(&v)
+		cancel()
+		if err == nil && isTrue(v) {
+			return b
+		}
+	}
+
+	return nil
+}
+
+// consistencyToken returns the replication position of the primary after a
+// write of the session ran on db, the consistency token its reads may send,
+// or "" when the backend has no replicas, or the write isn't committed.
+func (sess *session) consistencyToken(db querier) string {
+	if sess.router == nil || sess.router.replicas == nil || sess.tx != nil || db != sess.db() || sess.backend.dialect.positionQuery == "" {
+		return ""
+	}
+
+	ctx, cancel := context.WithTimeout(sess.ctx, positionTimeout)
+	defer cancel()
+	var token string
+	if err := sess.backend.DB().QueryRowContext(ctx, sess.backend.dialect.positionQuery).Scan(&token); err != nil {
+		log.Println("Replication position error:", err)
+		return ""
+	}
+	return token
+}
+
+// isTrue reports whether a boolean read from a backend is true, whatever
+// its type.
+func isTrue(v interface{}) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case int64:
+		return v != 0
+	case []byte:
+		b, _ := strconv.ParseBool(string(v))
+		return b
+	case string:
+		b, _ := strconv.ParseBool(v)
+		return b
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// inheritedEnv lists the sockets inherited from the process which restarted
+// the proxy, as name=fd pairs separated by commas.
+const inheritedEnv = "SQLPROXY_INHERITED"
+
+// filer is a socket whose file descriptor can be handed over.
+type filer interface {
+	File() (*os.File, error)
+}
+
+// sockets are the listening sockets of the proxy by name, handed over to the
+// new process on a graceful restart.
+var sockets = struct {
+	mu        sync.Mutex
+	open      map[string]filer
+	inherited map[string]int
+}{open: map[string]filer{}}
+
+// inherited returns the file of an inherited socket, or nil.
+func inherited(name string) *os.File {
+	sockets.mu.Lock()
+	defer sockets.mu.Unlock()
+
+	if sockets.inherited == nil {
+		sockets.inherited = map[string]int{}
+		for _, pair := range strings.Split(os.Getenv(inheritedEnv), ",") {
+			name, fd, _ := strings.Cut(pair, "=")
+			if n, err := strconv.Atoi(fd); err == nil {
+				sockets.inherited[name] = n
+			}
+		}
+		os.Unsetenv(inheritedEnv)
+	}
+	fd, ok := sockets.inherited[name]
+	if !ok {
+		return nil
+	}
+	delete(sockets.inherited, name)
+
+	return os.NewFile(uintptr(fd), name)
+}
+
+func register(name string, socket filer) {
+	sockets.mu.Lock()
+	defer sockets.mu.Unlock()
+	sockets.open[name] = socket
+}
+
+// listenTCP returns the inherited listener of a name, or listens on an
+// address.
+func listenTCP(name, addr string, lc net.ListenConfig) (net.Listener, error) {
+	var l net.Listener
+	if f := inherited(name); f != nil {
+		var err error
+		l, err = net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "inherited %s listener", name)
+		}
+	} else {
+		var err error
+		if l, err = lc.Listen(context.Background(), "tcp", addr); err != nil {
+			return nil, err
+		}
+	}
+	register(name, l.(*net.TCPListener))
+
+	return l, nil
+}
+
+// listenUDP returns the inherited UDP socket of a name, or listens on an
+// address.
+func listenUDP(name string, addr *net.UDPAddr) (*net.UDPConn, error) {
+	var conn *net.UDPConn
+	if f := inherited(name); f != nil {
+		c, err := net.FilePacketConn(f)
+		f.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "inherited %s socket", name)
+		}
+		udp, ok := c.(*net.UDPConn)
+		if !ok {
+			c.Close()
+			return nil, errors.Errorf("inherited %s socket isn't UDP", name)
+		}
+		conn = udp
+	} else {
+		var err error
+		if conn, err = net.ListenUDP("udp", addr); err != nil {
+			return nil, err
+		}
+	}
+	register(name, conn)
+
+	return conn, nil
+}
@@ -0,0 +1,17 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package main
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// restartSignals is empty: sockets can't be handed over to a process on
+// this platform.
+var restartSignals []os.Signal
+
+func restart(stop func()) error {
+	return errors.New("graceful restarts are not supported on this platform")
+}
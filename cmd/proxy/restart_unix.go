@@ -0,0 +1,85 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// restartSignals restart the proxy gracefully.
+var restartSignals = []os.Signal{syscall.SIGUSR2}
+
+// restart starts the executable of the proxy again, possibly upgraded, with
+// the same arguments and the listening sockets, and calls stop once it
+// listens: the sessions of this process end as on SIGTERM, while the new
+// one accepts the connections. This process goes on when it fails.
+func restart(stop func()) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	sockets.mu.Lock()
+	names := make([]string, 0, len(sockets.open))
+	for name := range sockets.open {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var files []*os.File
+	var pairs []string
+	for _, name := range names {
+		f, err := sockets.open[name].File()
+		if err != nil {
+			sockets.mu.Unlock()
+			closeFiles(files)
+			return errors.Wrapf(err, "%s socket", name)
+		}
+		pairs = append(pairs, name+"="+strconv.Itoa(3+len(files)))
+		files = append(files, f)
+	}
+	sockets.mu.Unlock()
+	defer closeFiles(files)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), inheritedEnv+"="+strings.Join(pairs, ","), readyEnv+"="+strconv.Itoa(3+len(files)))
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, w)
+	if err := cmd.Start(); err != nil {
+		w.Close()
+		return errors.Wrap(err, "failed to start the new process")
+	}
+	w.Close()
+	pid := cmd.Process.Pid
+	log.Printf("Restarting, new process started with PID %d", pid)
+
+	// The pipe closes without a byte when it exits first.
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		err := cmd.Wait()
+		return errors.Errorf("the new process exited at startup (%v)", err)
+	}
+	// It is not waited for, running on once this process exits.
+	cmd.Process.Release()
+	log.Printf("New process %d listening, shutting down", pid)
+	stop()
+
+	return nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
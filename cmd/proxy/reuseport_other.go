@@ -0,0 +1,15 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package main
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// reusePort isn't supported: SO_REUSEADDR on Windows lets another process
+// take over the port rather than share it.
+func reusePort(network, address string, c syscall.RawConn) error {
+	return errors.New("-reuse-port is not supported on this platform")
+}
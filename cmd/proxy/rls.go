@@ -0,0 +1,252 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/arkan/sqlproxy/internal/sqltext"
+	"github.com/pkg/errors"
+)
+
+// rowPolicies are the row-level security predicates of a session, by table.
+// Their variables are already replaced by the values of the session.
+type rowPolicies map[string]string
+
+// newRowPolicies binds the policies of an identity and its tenant to their
+// variables: :user, :tenant and the identity attributes.
+func newRowPolicies(user, tenant string, identity *identityConfig, tenantPolicies map[string]string) (rowPolicies, error) {
+	vars := map[string]string{"user": user, "tenant": tenant}
+	for k, v := range identity.Attributes {
+		vars[k] = v
+	}
+
+	policies := rowPolicies{}
+	for _, set := range []map[string]string{tenantPolicies, identity.RowPolicies} {
+		for table, predicate := range set {
+			bound, err := bindPredicate(predicate, vars)
+			if err != nil {
+				return nil, errors.Wrapf(err, "row policy on %s", table)
+			}
+			table = strings.ToLower(table)
+			if policies[table] != "" {
+				bound = policies[table] + " AND " + bound
+			}
+			policies[table] = bound
+		}
+	}
+
+	return policies, nil
+}
+
+// bindPredicate replaces the :name variables of a predicate by their value,
+// as string literals.
+func bindPredicate(predicate string, vars map[string]string) (string, error) {
+	tokens := sqltext.Tokenize(predicate)
+	for i, t := range tokens {
+		if t.Kind != sqltext.Param || !strings.HasPrefix(t.Text, ":") {
+			continue
+		}
+		v, ok := vars[t.Text[1:]]
+		if !ok {
+			return "", errors.Errorf("unknown variable %s", t.Text)
+		}
+		tokens[i].Text = "'" + strings.ReplaceAll(v, "'", "''") + "'"
+	}
+
+	return "(" + sqltext.Join(tokens) + ")", nil
+}
+
+// predicate returns the policy applying to a table reference, if any.
+func (p rowPolicies) predicate(ref sqltext.TableRef) string {
+	for table, predicate := range p {
+		if ref.Matches(table) {
+			return predicate
+		}
+	}
+
+	return ""
+}
+
+// apply rewrites a statement so that it only sees and modifies the rows
+// allowed by the policies:
+//   - tables read by the statement are replaced by a derived table holding
+//     the allowed rows only, keeping the table name as alias so qualified
+//     column references still resolve;
+//   - the predicate of the target of UPDATE and DELETE is added to the
+//     statement WHERE clause.
+//
+// Statements naming a table with a policy where no reference to it was
+// found, and which couldn't be rewritten, are rejected, as are merges,
+// REPLACE and upserts (ON CONFLICT, ON DUPLICATE KEY) into such a table.
+func (p rowPolicies) apply(query string) (string, error) {
+	if len(p) == 0 {
+		return query, nil
+	}
+
+	tokens := sqltext.Tokenize(query)
+	replace := map[int]string{}
+	insert := map[int]string{}
+	rewritten := false
+	covered := map[string]bool{}
+
+	for _, ref := range sqltext.TableRefs(tokens) {
+		predicate := p.predicate(ref)
+		if predicate == "" {
+			continue
+		}
+		for table := range p {
+			if ref.Matches(table) {
+				covered[table] = true
+			}
+		}
+
+		if !ref.Target {
+			name := sqltext.Join(tokens[ref.Start:ref.End])
+			derived := "(SELECT * FROM " + name + " WHERE " + predicate + ")"
+			if ref.Alias == "" {
+				derived += " " + tokens[ref.End-1].Text
+			}
+			replace[ref.Start] = derived
+			for i := ref.Start + 1; i < ref.End; i++ {
+				replace[i] = ""
+			}
+			rewritten = true
+			continue
+		}
+
+		switch kw, i := prevKeyword(tokens, ref.Start); kw {
+		case "UPDATE", "FROM":
+			restrictWhere(tokens, ref.End, predicate, insert)
+			rewritten = true
+		case "INTO":
+			// Inserted rows aren't checked, but rows updated by upserts and
+			// merges would escape the predicate.
+			if statement, _ := prevKeyword(tokens, i); statement != "INSERT" || upserts(tokens, ref.End) {
+				return "", errors.Errorf("statement on %s, which has a row policy, can't be restricted", ref.Name)
+			}
+		}
+	}
+
+	for table := range p {
+		if !covered[table] && mentions(tokens, table) {
+			return "", errors.Errorf("statement on %s, which has a row policy, can't be restricted", table)
+		}
+	}
+	if !rewritten {
+		return query, nil
+	}
+
+	var b strings.Builder
+	for i, t := range tokens {
+		b.WriteString(insert[i])
+		if text, ok := replace[i]; ok {
+			b.WriteString(text)
+		} else {
+			b.WriteString(t.Text)
+		}
+	}
+	b.WriteString(insert[len(tokens)])
+
+	return b.String(), nil
+}
+
+// mentions reports whether an identifier of the tokens is the name of a
+// table, qualified or not.
+func mentions(tokens []sqltext.Token, table string) bool {
+	name := table[strings.LastIndexByte(table, '.')+1:]
+	for _, t := range tokens {
+		if t.IsIdent() && strings.EqualFold(t.Ident(), name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// endsWhere are the keywords ending the WHERE clause of UPDATE and DELETE.
+var endsWhere = map[string]bool{"ORDER": true, "LIMIT": true, "RETURNING": true, "OPTION": true}
+
+// restrictWhere adds the predicate to the WHERE clause of the statement whose
+// target ends at tokens[start], creating the clause if needed.
+func restrictWhere(tokens []sqltext.Token, start int, predicate string, insert map[int]string) {
+	depth, where, end := 0, -1, len(tokens)
+
+scan:
+	for i := start; i < len(tokens); i++ {
+		t := tokens[i]
+		switch {
+		case t.Text == "(":
+			depth++
+		case t.Text == ")":
+			if depth == 0 {
+				end = i
+				break scan
+			}
+			depth--
+		case depth > 0:
+		case t.Text == ";":
+			end = i
+			break scan
+		case t.Is("WHERE") && where < 0:
+			where = i
+		case t.Kind == sqltext.Word && endsWhere[strings.ToUpper(t.Text)]:
+			end = i
+			break scan
+		}
+	}
+
+	// Before the comments ending the clause, which a line comment would
+	// swallow the predicate into.
+	for end > start && !tokens[end-1].Significant() {
+		end--
+	}
+	suffix := ""
+	if end < len(tokens) && tokens[end].Kind == sqltext.Word {
+		suffix = " "
+	}
+	if where < 0 {
+		insert[end] += " WHERE " + predicate + suffix
+		return
+	}
+	insert[where+1] += " ("
+	insert[end] += ") AND " + predicate + suffix
+}
+
+// upserts reports whether the INSERT whose target ends at tokens[start] has
+// an ON CONFLICT or ON DUPLICATE KEY clause.
+func upserts(tokens []sqltext.Token, start int) bool {
+	depth, on := 0, false
+	for _, t := range tokens[start:] {
+		if !t.Significant() {
+			continue
+		}
+		switch {
+		case t.Text == "(":
+			depth++
+		case t.Text == ")":
+			if depth == 0 {
+				return false
+			}
+			depth--
+		case depth > 0:
+		case t.Text == ";":
+			return false
+		case on && (t.Is("CONFLICT") || t.Is("DUPLICATE")):
+			return true
+		}
+		on = depth == 0 && t.Is("ON")
+	}
+
+	return false
+}
+
+// prevKeyword returns the significant token preceding tokens[i], upper-cased,
+// and its index, skipping the modifiers of the table such as IGNORE or ONLY.
+func prevKeyword(tokens []sqltext.Token, i int) (string, int) {
+	for i--; i >= 0; i-- {
+		if tokens[i].Significant() && !tokens[i].IsModifier() {
+			return strings.ToUpper(tokens[i].Text), i
+		}
+	}
+
+	return "", -1
+}
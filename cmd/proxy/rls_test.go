@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestRowPoliciesApply(t *testing.T) {
+	policies := rowPolicies{"orders": "(tenant_id = 'a')"}
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"UPDATE orders SET total = 0", "UPDATE orders SET total = 0 WHERE (tenant_id = 'a')"},
+		{"UPDATE orders SET total = 0 --", "UPDATE orders SET total = 0 WHERE (tenant_id = 'a') --"},
+		{"DELETE FROM orders -- bye", "DELETE FROM orders WHERE (tenant_id = 'a') -- bye"},
+		{"DELETE FROM orders WHERE id = 1 -- bye\n", "DELETE FROM orders WHERE ( id = 1) AND (tenant_id = 'a') -- bye\n"},
+		{"DELETE FROM orders /* bye */", "DELETE FROM orders WHERE (tenant_id = 'a') /* bye */"},
+		{"UPDATE orders SET total = 0 /* a */ -- b", "UPDATE orders SET total = 0 WHERE (tenant_id = 'a') /* a */ -- b"},
+		{"UPDATE IGNORE orders SET total = 0", "UPDATE IGNORE orders SET total = 0 WHERE (tenant_id = 'a')"},
+		{"UPDATE LOW_PRIORITY orders SET total = 0", "UPDATE LOW_PRIORITY orders SET total = 0 WHERE (tenant_id = 'a')"},
+		{"UPDATE ONLY orders SET total = 0", "UPDATE ONLY orders SET total = 0 WHERE (tenant_id = 'a')"},
+		{"DELETE LOW_PRIORITY QUICK IGNORE FROM orders", "DELETE LOW_PRIORITY QUICK IGNORE FROM orders WHERE (tenant_id = 'a')"},
+		{"DELETE FROM ONLY orders WHERE id = 1", "DELETE FROM ONLY orders WHERE ( id = 1) AND (tenant_id = 'a')"},
+		{"SELECT * FROM orders", "SELECT * FROM (SELECT * FROM orders WHERE (tenant_id = 'a')) orders"},
+		{"INSERT IGNORE INTO orders (id) VALUES (1)", "INSERT IGNORE INTO orders (id) VALUES (1)"},
+		{"INSERT INTO orders (id) SELECT id FROM src JOIN x ON src.id = x.id", "INSERT INTO orders (id) SELECT id FROM src JOIN x ON src.id = x.id"},
+		{"SELECT * FROM customers", "SELECT * FROM customers"},
+	}
+	for _, test := range tests {
+		got, err := policies.apply(test.query)
+		if err != nil {
+			t.Errorf("apply(%q): %v", test.query, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("apply(%q) = %q, want %q", test.query, got, test.want)
+		}
+	}
+}
+
+func TestRowPoliciesApplyUnrestricted(t *testing.T) {
+	policies := rowPolicies{"orders": "(tenant_id = 'a')"}
+	for _, query := range []string{
+		"TRUNCATE orders",
+		"DELETE orders",
+		"MERGE INTO orders o USING src s ON o.id = s.id WHEN MATCHED THEN DELETE",
+		"INSERT INTO orders (id) VALUES (1) ON DUPLICATE KEY UPDATE total = 0",
+		"INSERT INTO orders (id) VALUES (1) ON CONFLICT (id) DO UPDATE SET total = 0",
+		"INSERT INTO orders (id) SELECT id FROM src ON CONFLICT DO NOTHING",
+		"REPLACE INTO orders (id) VALUES (1)",
+	} {
+		if got, err := policies.apply(query); err == nil {
+			t.Errorf("apply(%q) = %q, want an error", query, got)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// rotation is how log files are rotated, set by the -log-max-* and
+// -log-compress flags.
+type rotation struct {
+	// Size of a file before it is rotated, never rotated when 0.
+	maxSize int64
+	// Age and number of the rotated files kept, all of them when 0.
+	maxAge     time.Duration
+	maxBackups int
+	compress   bool
+}
+
+func logRotation() rotation {
+	return rotation{maxSize: *logMaxSize, maxAge: *logMaxAge, maxBackups: *logMaxBackups, compress: *logCompress}
+}
+
+// rotatingFile is a log file rotated once it reaches its size: it is renamed
+// after the time of the rotation, such as proxy-20260105T092012.750.log,
+// compressed with gzip if required, and the rotated files beyond the age or
+// number kept are removed.
+type rotatingFile struct {
+	path string
+	rotation
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+	// cleaning serializes the compression and removal of rotated files,
+	// done in the background.
+	cleaning sync.Mutex
+}
+
+// openRotatingFile opens a log file, appending to it.
+func openRotatingFile(path string, r rotation) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, rotation: r}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %s", f.path)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+
+	return nil
+}
+
+// Write appends to the file, rotating it first when the write would exceed
+// its size.
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+
+	return n, err
+}
+
+// reopen closes the file and opens it again at its path, e.g. once moved by
+// logrotate.
+func (f *rotatingFile) reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.file.Close()
+	return f.open()
+}
+
+// rotate renames the file and opens a new one.
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	ext := filepath.Ext(f.path)
+	rotated := strings.TrimSuffix(f.path, ext) + "-" + time.Now().UTC().Format("20060102T150405.000") + ext
+	renameErr := os.Rename(f.path, rotated)
+	// Writes go on in the same file when it can't be renamed.
+	if err := f.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return errors.Wrap(renameErr, "failed to rotate the log file")
+	}
+
+	go f.cleanup(rotated)
+	return nil
+}
+
+// cleanup compresses a file just rotated, and removes the rotated files not
+// kept.
+func (f *rotatingFile) cleanup(rotated string) {
+	f.cleaning.Lock()
+	defer f.cleaning.Unlock()
+
+	if f.compress {
+		if err := compressFile(rotated); err != nil {
+			// Not to the log, this file may be the log.
+			os.Stderr.WriteString("Log compression error: " + err.Error() + "\n")
+		}
+	}
+
+	ext := filepath.Ext(f.path)
+	prefix := strings.TrimSuffix(f.path, ext) + "-"
+	matches, _ := filepath.Glob(prefix + "[0-9]*T*" + ext)
+	compressed, _ := filepath.Glob(prefix + "[0-9]*T*" + ext + ".gz")
+	rotatedFiles := append(matches, compressed...)
+	// Names sort by rotation time, newest first.
+	sort.Sort(sort.Reverse(sort.StringSlice(rotatedFiles)))
+	for i, name := range rotatedFiles {
+		remove := f.maxBackups > 0 && i >= f.maxBackups
+		if f.maxAge > 0 {
+			if info, err := os.Stat(name); err == nil && time.Since(info.ModTime()) > f.maxAge {
+				remove = true
+			}
+		}
+		if remove {
+			os.Remove(name)
+		}
+	}
+}
+
+// compressFile replaces a file with its gzip-compressed version.
+func compressFile(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(name+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+	src.Close()
+
+	return os.Remove(name)
+}
+
+// Close closes the file.
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/arkan/sqlproxy/internal/sqltext"
+	"github.com/pkg/errors"
+)
+
+// backendConfig describes a named backend, which statements are routed to
+// by the tables they reference.
+type backendConfig struct {
+	DSN string `json:"dsn"`
+	// SQL dialect of the backend, -dialect by default.
+	Dialect string `json:"dialect"`
+	// Charset of the text of the backend, -charset by default.
+	Charset      string `json:"charset"`
+	MaxOpenConns int    `json:"max_open_conns"`
+	MaxIdleConns int    `json:"max_idle_conns"`
+	WarmConns    int    `json:"warm_conns"`
+}
+
+// routeConfig sends the statements referencing tables matching a pattern to
+// a named backend.
+type routeConfig struct {
+	// Glob patterns of table names (e.g. "analytics_*"), matched against the
+	// qualified name when they have a dot, case insensitively.
+	Tables  []string `json:"tables"`
+	Backend string   `json:"backend"`
+}
+
+func (r *routeConfig) validate(backends map[string]*backendConfig) error {
+	if backends[r.Backend] == nil {
+		return errors.Errorf("unknown backend %q", r.Backend)
+	}
+	return validatePatterns(r.Tables)
+}
+
+// tableRoute is a route with its backend.
+type tableRoute struct {
+	tables  []string
+	name    string
+	backend *backend
+}
+
+// matches reports whether a table matches one of the patterns of the route.
+func (r *tableRoute) matches(table sqltext.TableRef) bool {
+	return matchTable(r.tables, table)
+}
+
+// matchTable reports whether a table matches one of the glob patterns, with
+// its qualified name for the patterns with a dot.
+func matchTable(patterns []string, table sqltext.TableRef) bool {
+	for _, pattern := range patterns {
+		name := table.Table()
+		if strings.Contains(pattern, ".") {
+			name = table.Name
+		}
+		if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(name)); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validatePatterns checks the syntax of glob patterns of table names.
+func validatePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.Wrapf(err, "pattern %q", pattern)
+		}
+	}
+
+	return nil
+}
+
+// router finds where the statements of a backend run: the backends of the
+// tables they reference, then the shards of the backend, then its replicas
+// for the reads.
+type router struct {
+	routes   []tableRoute
+	shards   *shardRouter
+	replicas *replicaSet
+}
+
+// openBackends opens the named backends.
+func openBackends(cfg map[string]*backendConfig, defaultDialect *dialect) (map[string]*backend, error) {
+	backends := map[string]*backend{}
+	for name, c := range cfg {
+		d := defaultDialect
+		if c.Dialect != "" {
+			var err error
+			if d, err = lookupDialect(c.Dialect); err != nil {
+				closeBackends(backends)
+				return nil, errors.Wrapf(err, "backend %s", name)
+			}
+		}
+
+		b, err := openBackend(c.DSN, d, c.Charset, poolOptions{maxOpenConns: c.MaxOpenConns, maxIdleConns: c.MaxIdleConns, warmConns: c.WarmConns})
+		if err != nil {
+			closeBackends(backends)
+			return nil, errors.Wrapf(err, "backend %s", name)
+		}
+		backends[name] = b
+	}
+
+	return backends, nil
+}
+
+func closeBackends(backends map[string]*backend) {
+	for _, b := range backends {
+		b.Close()
+	}
+}
+
+// newRouter returns the router of a backend, or nil when it has no routes,
+// shards or replicas.
+func newRouter(routes []routeConfig, sharding *shardingConfig, replicas *replicaConfig, backends map[string]*backend, d *dialect) (*router, error) {
+	if len(routes) == 0 && sharding == nil && replicas == nil {
+		return nil, nil
+	}
+
+	r := &router{}
+	for _, route := range routes {
+		r.routes = append(r.routes, tableRoute{tables: route.Tables, name: route.Backend, backend: backends[route.Backend]})
+	}
+	if sharding != nil {
+		shards, err := openShards(sharding, d)
+		if err != nil {
+			return nil, errors.Wrap(err, "sharding")
+		}
+		r.shards = shards
+	}
+	if replicas != nil {
+		set, err := openReplicas(replicas, d)
+		if err != nil {
+			r.Close()
+			return nil, errors.Wrap(err, "replicas")
+		}
+		r.replicas = set
+	}
+
+	return r, nil
+}
+
+// route returns the backend of a statement and its name for the logs, or nil
+// when it runs on the regular backend. The tables of a statement must all be
+// on the same backend.
+func (r *router) route(query string, args []interface{}) (string, *backend, error) {
+	if r == nil {
+		return "", nil, nil
+	}
+
+	if len(r.routes) > 0 {
+		var route *tableRoute
+		for n, table := range sqltext.TableRefs(sqltext.Tokenize(query)) {
+			match := r.match(table)
+			if n > 0 && !sameBackend(match, route) {
+				return "", nil, errors.New("statement references tables of several backends")
+			}
+			route = match
+		}
+		if route != nil {
+			return "backend " + route.name, route.backend, nil
+		}
+	}
+
+	i, shard, err := r.shards.route(query, args)
+	if shard == nil || err != nil {
+		return "", nil, err
+	}
+	return "shard " + strconv.Itoa(i), shard, nil
+}
+
+// match returns the first route of a table, or nil.
+func (r *router) match(table sqltext.TableRef) *tableRoute {
+	for i := range r.routes {
+		if r.routes[i].matches(table) {
+			return &r.routes[i]
+		}
+	}
+
+	return nil
+}
+
+// sameBackend reports whether two routes, nil for the regular backend, lead
+// to the same backend.
+func sameBackend(a, b *tableRoute) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.backend == b.backend
+}
+
+// route returns the backend of a statement of the session and its name for
+// the logs, or nil when it runs on the regular backend: that of the database
+// it selected, of its route, or a replica.
+func (sess *session) route(query string, args []interface{}) (string, *backend, error) {
+	if sess.databaseBackend != nil {
+		return "database " + sess.database, sess.databaseBackend, nil
+	}
+	name, b, err := sess.router.route(query, args)
+	if b == nil && err == nil {
+		if replica := sess.replica(query); replica != nil {
+			return "replicas", replica, nil
+		}
+	}
+	return name, b, err
+}
+
+// Close the shard and replica backends. Named backends are shared, and
+// closed by the server.
+func (r *router) Close() {
+	if r != nil && r.shards != nil {
+		r.shards.Close()
+	}
+	if r != nil && r.replicas != nil {
+		r.replicas.Close()
+	}
+}
+
+// runRouted runs fn on the backend a statement is routed to, or on the
+// statement target of the session. Session variables only apply to the
+// latter.
+func runRouted(sess *session, query string, args []interface{}, fn func(db querier) (requestStats, error)) (requestStats, error) {
+	name, b, err := sess.route(query, args)
+	if err != nil {
+		return requestStats{}, err
+	}
+	if b == nil {
+		return retryPinned(sess, fn)
+	}
+	if sess.tx != nil {
+		return requestStats{}, errors.Errorf("statement routed to %s can't run in a transaction", name)
+	}
+
+	sess.logf("Routed to %s", name)
+	sess.routedTo = name
+	defer func() { sess.routedTo = "" }()
+	return fn(b.DB())
+}
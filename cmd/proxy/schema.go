@@ -0,0 +1,42 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack"
+)
+
+// Schema request struct, listing the objects of the backend. The response is
+// a QueryResponse whose columns depend on the kind:
+//   - catalogs: catalog
+//   - schemas: catalog, schema
+//   - tables: catalog, schema, table, type
+//   - columns: catalog, schema, table, column, position, data type, nullable
+//     ("YES" or "NO")
+type SchemaRequest struct {
+	Op   string `msgpack:"op"`
+	Kind string `msgpack:"kind"`
+	// Optional filters.
+	Catalog string `msgpack:"catalog"`
+	Schema  string `msgpack:"schema"`
+	Table   string `msgpack:"table"`
+	TraceID string `msgpack:"trace_id"`
+}
+
+func handleSchema(sess *session, data []byte) (requestStats, error) {
+	var req SchemaRequest
+	if err := msgpack.Unmarshal(data, &req); err != nil {
+		return requestStats{}, err
+	}
+	if *storedOnly {
+		return requestStats{}, errors.New("only stored queries are allowed")
+	}
+
+	query, args, err := sess.backend.dialect.schemaQuery(&req)
+	if err != nil {
+		return requestStats{}, err
+	}
+
+	return retryPinned(sess, func(db querier) (requestStats, error) {
+		return handleQuery(sess, db, QueryRequest{Query: query, Args: args})
+	})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// credentials assembles the backend DSN from its sources: the -dsn flag (or
+// its env/file variants), an optional password (env/file), Vault and the
+// instance found by service discovery.
+type credentials struct {
+	mu     sync.Mutex
+	secret *vaultSecret
+	target *target
+}
+
+// setVaultSecret records the latest Vault secret.
+func (c *credentials) setVaultSecret(secret *vaultSecret) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.secret = secret
+}
+
+// setTarget records the backend instance to connect to.
+func (c *credentials) setTarget(t target) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.target = &t
+}
+
+// DSN builds the backend DSN from the current state of every source.
+func (c *credentials) DSN() (string, error) {
+	dsn, err := readSecret(*dsn, *dsnEnv, *dsnFile)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read DSN")
+	}
+
+	password, err := readSecret("", *passwordEnv, *passwordFile)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read password")
+	}
+	if password != "" {
+		dsn = setDSNAttr(dsn, "PWD", password)
+	}
+
+	c.mu.Lock()
+	secret, t := c.secret, c.target
+	c.mu.Unlock()
+	if secret != nil {
+		dsn, err = applyVaultSecret(dsn, secret)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if t != nil {
+		dsn = applyTarget(dsn, *t, *discoverHostAttr, *discoverPortAttr)
+	}
+
+	if dsn == "" {
+		return "", errors.New("DSN is required")
+	}
+
+	return dsn, nil
+}
+
+// secretFiles returns the files the DSN is read from.
+func secretFiles() []string {
+	var files []string
+	for _, path := range []string{*dsnFile, *passwordFile} {
+		if path != "" {
+			files = append(files, path)
+		}
+	}
+
+	return files
+}
+
+// readSecret returns the value of the first source set: the file content, the
+// environment variable or the literal value.
+func readSecret(value, env, file string) (string, error) {
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	if env != "" {
+		v, ok := os.LookupEnv(env)
+		if !ok {
+			return "", errors.Errorf("environment variable %s is not set", env)
+		}
+		return v, nil
+	}
+
+	return value, nil
+}
+
+// watchFiles polls the files and calls onChange when the content of any of
+// them changes. Content is compared rather than modification times so that
+// secrets swapped with a symlink (e.g. Kubernetes volumes) are detected. A
+// change is kept, and onChange called again at the next poll, until it
+// succeeds.
+func watchFiles(files []string, interval time.Duration, onChange func() error) {
+	contents := make(map[string][]byte, len(files))
+	for _, path := range files {
+		contents[path], _ = os.ReadFile(path)
+	}
+
+	for range time.Tick(interval) {
+		changed := map[string][]byte{}
+		for _, path := range files {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				log.Println("Read secret file error:", err)
+				continue
+			}
+			if !bytes.Equal(data, contents[path]) {
+				changed[path] = data
+			}
+		}
+
+		if len(changed) == 0 {
+			continue
+		}
+		if err := onChange(); err != nil {
+			log.Println("Secret rotation error:", err)
+			continue
+		}
+		for path, data := range changed {
+			contents[path] = data
+		}
+		log.Println("Secret files changed, backend pool rebuilt")
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchFilesRetriesFailedChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(path, []byte("a"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := make(chan int, 10)
+	n := 0
+	go watchFiles([]string{path}, 10*time.Millisecond, func() error {
+		n++
+		calls <- n
+		if n == 1 {
+			return errors.New("backend down")
+		}
+		return nil
+	})
+	time.Sleep(50 * time.Millisecond)
+	if err := os.WriteFile(path, []byte("b"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for want := 1; want <= 2; want++ {
+		select {
+		case got := <-calls:
+			if got != want {
+				t.Fatalf("call %d, want %d", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("onChange called %d times, want %d", want-1, want)
+		}
+	}
+	select {
+	case got := <-calls:
+		t.Errorf("call %d after a successful change", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
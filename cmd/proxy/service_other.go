@@ -0,0 +1,23 @@
+//go:build !windows
+
+package main
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+func openEventLog(source string) (io.WriteCloser, error) {
+	return nil, errors.New("the event log is only available on Windows")
+}
+
+// startService returns nil: services are run by other means, such as
+// systemd.
+func startService(name string) (serviceHost, error) {
+	return nil, nil
+}
+
+func controlService(command, name string) error {
+	return errors.New("-service is only supported on Windows")
+}
@@ -0,0 +1,189 @@
+//go:build windows
+
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// eventSources are the event log sources of the log streams.
+var eventSources = []string{"sqlproxy", "sqlproxy-access"}
+
+// eventLogWriter writes each write as an event.
+type eventLogWriter struct {
+	log *eventlog.Log
+}
+
+func openEventLog(source string) (*eventLogWriter, error) {
+	l, err := eventlog.Open(source)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open the event log")
+	}
+
+	return &eventLogWriter{log: l}, nil
+}
+
+func (w *eventLogWriter) Write(p []byte) (int, error) {
+	if err := w.log.Info(1, strings.TrimRight(string(p), "\n")); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *eventLogWriter) Close() error {
+	return w.log.Close()
+}
+
+// windowsService reports the state of the proxy to the service manager.
+type windowsService struct {
+	// ready receives the function stopping the proxy once it listens, and
+	// stopped is closed once it stopped.
+	ready   chan func()
+	stopped chan struct{}
+	// done is closed once the service manager was told it stopped.
+	done chan struct{}
+}
+
+// startService runs the proxy as a Windows service when it was started by
+// the service manager, or returns nil.
+func startService(name string) (serviceHost, error) {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return nil, err
+	}
+
+	s := &windowsService{ready: make(chan func(), 1), stopped: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		if err := svc.Run(name, s); err != nil {
+			log.Fatal(errors.Wrap(err, "service"))
+		}
+	}()
+
+	return s, nil
+}
+
+func (s *windowsService) running(stop func()) {
+	s.ready <- stop
+}
+
+func (s *windowsService) exited() {
+	close(s.stopped)
+	<-s.done
+}
+
+// Execute reports the state of the proxy to the service manager, stopping it
+// when asked.
+func (s *windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	for {
+		select {
+		case stop := <-s.ready:
+			status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+			s.serve(requests, status, stop)
+			return false, 0
+		case <-s.stopped:
+			return false, 0
+		case r := <-requests:
+			if r.Cmd == svc.Interrogate {
+				status <- r.CurrentStatus
+			}
+		}
+	}
+}
+
+// serve handles the requests of the service manager while the proxy runs.
+func (s *windowsService) serve(requests <-chan svc.ChangeRequest, status chan<- svc.Status, stop func()) {
+	for {
+		select {
+		case <-s.stopped:
+			return
+		case r := <-requests:
+			switch r.Cmd {
+			case svc.Interrogate:
+				status <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				log.Println("Service stop requested, shutting down")
+				status <- svc.Status{State: svc.StopPending, WaitHint: uint32((*shutdownTimeout + 10*time.Second).Milliseconds())}
+				stop()
+			}
+		}
+	}
+}
+
+// controlService runs a -service command: install the service, with the
+// other flags as its arguments, uninstall, start or stop it.
+func controlService(command, name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to the service manager")
+	}
+	defer m.Disconnect()
+
+	if command == "install" {
+		exe, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		s, err := m.CreateService(name, exe, mgr.Config{
+			DisplayName: "SQL proxy (" + name + ")",
+			Description: "Proxy of the SQL databases reached with ODBC",
+			StartType:   mgr.StartAutomatic,
+		}, serviceArgs()...)
+		if err != nil {
+			return errors.Wrapf(err, "failed to install service %s", name)
+		}
+		defer s.Close()
+		for _, source := range eventSources {
+			err := eventlog.InstallAsEventCreate(source, eventlog.Error|eventlog.Warning|eventlog.Info)
+			if err != nil && !strings.Contains(err.Error(), "already exists") {
+				return errors.Wrapf(err, "failed to install event log source %s", source)
+			}
+		}
+		log.Printf("Service %s installed", name)
+		return nil
+	}
+
+	s, err := m.OpenService(name)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open service %s", name)
+	}
+	defer s.Close()
+	switch command {
+	case "uninstall":
+		err = s.Delete()
+	case "start":
+		err = s.Start()
+	case "stop":
+		_, err = s.Control(svc.Stop)
+	default:
+		return errors.Errorf("unknown -service command %q, expected install, uninstall, start or stop", command)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to %s service %s", command, name)
+	}
+	log.Printf("Service %s: %s done", name, command)
+
+	return nil
+}
+
+// serviceArgs returns the flags set on the command line but -service, the
+// arguments of the service.
+func serviceArgs() []string {
+	var args []string
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name != "service" {
+			args = append(args, "-"+f.Name+"="+f.Value.String())
+		}
+	})
+	return args
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arkan/sqlproxy/internal/frame"
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack"
+)
+
+// requestHeader is decoded first to find out what kind of request a frame
+// holds. Frames without an op are queries or execs.
+type requestHeader struct {
+	Op      string `msgpack:"op"`
+	TraceID string `msgpack:"trace_id"`
+	// Priority class hint: interactive, normal or batch. The identity
+	// priority is used when empty.
+	Priority string `msgpack:"priority"`
+	// Statement timeout hint in milliseconds, lowering that of the identity.
+	Timeout int64 `msgpack:"timeout_ms"`
+	// Statement of the requests having one, for the access log.
+	Query string `msgpack:"query"`
+}
+
+// Hello request struct, sent by drivers before any other request. The
+// application, library version and tags describe the client in logs,
+// metrics and the admin connection list.
+type HelloRequest struct {
+	Op          string            `msgpack:"op"`
+	User        string            `msgpack:"user"`
+	Password    string            `msgpack:"password"`
+	Application string            `msgpack:"application"`
+	Version     string            `msgpack:"version"`
+	Tags        map[string]string `msgpack:"tags"`
+	// Types of the tagged values the client decodes.
+	Types []string `msgpack:"types"`
+	// Signing algorithms of the client, in order of preference, and its
+	// nonce.
+	Signing []string `msgpack:"signing"`
+	Nonce   []byte   `msgpack:"nonce"`
+	// Compression algorithms of the client, in order of preference, and the
+	// size of the smallest frames it wants compressed.
+	Compression []string `msgpack:"compression"`
+	CompressMin int      `msgpack:"compress_min"`
+}
+
+// Hello response struct. Capabilities lists the features of the proxy, so
+// drivers can avoid the ones older proxies don't have.
+type HelloResponse struct {
+	Capabilities []string `msgpack:"capabilities"`
+	// Signing algorithm of the frames that follow, the response included,
+	// and the nonce of the proxy.
+	Signing string `msgpack:"signing"`
+	Nonce   []byte `msgpack:"nonce"`
+	// Compression algorithm of the frames that follow the response, if any.
+	Compression string `msgpack:"compression"`
+	Error       string `msgpack:"error"`
+}
+
+// capabilities advertised in the hello response.
+var capabilities = []string{"schema", "explain", "stored_queries", "version", "pool_stats", "streaming", "cursors", "resumable_cursors", "idempotency_keys", "multi_statements", "exec_returning", "notifications", "transactions", "ping", "databases"}
+
+// server holds the state shared by all client connections.
+type server struct {
+	config *proxyConfig
+	// Default backend, used by anonymous clients and identities without a
+	// tenant.
+	backend *backend
+	tenants map[string]*backend
+	// Named backends, and the routers of the backends by tenant, "" for the
+	// default one.
+	backends map[string]*backend
+	routers  map[string]*router
+	usage    *usageTracker
+	queries  *queryRegistry
+
+	// Client connections, for the admin connection list, and their
+	// sessions, waited for on shutdown.
+	connsMu  sync.Mutex
+	conns    map[*session]*connInfo
+	sessions sync.WaitGroup
+
+	// Resumable cursors of disconnected clients, by token.
+	cursorsMu     sync.Mutex
+	detached      map[string]*cursor
+	resumeTimeout time.Duration
+
+	// Bearer token of the admin API requests changing anything, when clients
+	// don't authenticate.
+	adminToken string
+
+	// Results of the exec requests with an idempotency key.
+	idempotency *idempotencyCache
+	// Journal of the exec requests, if enabled.
+	journal *journal
+	// Result cache, if enabled.
+	cache *resultCache
+	// Identical read queries running, if coalesced.
+	flights *flightGroup
+	// Statements prepared on the backend pools, if cached.
+	statements *statementCache
+	// Watchdog of the statements running longer than their ceiling.
+	watchdog *watchdog
+	// Blue/green backends replacing the default one, if configured.
+	blueGreen *blueGreen
+	// Listening sessions by channel.
+	notify *notifyHub
+	// Egress rate limiters of the identities.
+	egressMu sync.Mutex
+	egress   map[string]*rateLimiter
+	// Access log, if enabled.
+	accessLog *accessLog
+	// Aggregates of the statements by fingerprint, if enabled.
+	queryStats *queryStats
+	// Signing of the frames, if required.
+	signing *frameSigning
+	// Compression algorithms of the frames accepted, in order of preference.
+	compressions []string
+	// Latency added to the requests, if enabled.
+	latency *latencyInjection
+	// Maintenance mode, holding the requests.
+	maintenance maintenance
+}
+
+// newServer opens the backend of every tenant. Tenants without a dialect use
+// the default one.
+func newServer(cfg *proxyConfig, defaultBackend *backend, defaultDialect *dialect) (*server, error) {
+	srv := &server{
+		config:   cfg,
+		backend:  defaultBackend,
+		tenants:  map[string]*backend{},
+		backends: map[string]*backend{},
+		routers:  map[string]*router{},
+		egress:   map[string]*rateLimiter{},
+		usage:    newUsageTracker(),
+		queries:  newQueryRegistry(nil),
+		conns:    map[*session]*connInfo{},
+
+		detached:      map[string]*cursor{},
+		resumeTimeout: defaultResumeTimeout,
+		idempotency:   newIdempotencyCache(defaultIdempotencyTTL),
+		notify:        newNotifyHub(),
+	}
+	if cfg == nil {
+		return srv, nil
+	}
+	srv.queries = newQueryRegistry(cfg.Queries)
+	if cfg.Cache != nil {
+		cache, err := newResultCache(cfg.Cache)
+		if err != nil {
+			return nil, errors.Wrap(err, "cache")
+		}
+		srv.cache = cache
+	}
+	backends, err := openBackends(cfg.Backends, defaultDialect)
+	if err != nil {
+		return nil, err
+	}
+	srv.backends = backends
+	if cfg.BlueGreen != nil {
+		srv.blueGreen = newBlueGreen(cfg.BlueGreen, backends)
+	}
+	r, err := newRouter(cfg.Routes, cfg.Sharding, cfg.Replicas, backends, defaultDialect)
+	if err != nil {
+		srv.Close()
+		return nil, err
+	}
+	if r != nil {
+		srv.routers[""] = r
+	}
+
+	for name, tenant := range cfg.Tenants {
+		d := defaultDialect
+		if tenant.Dialect != "" {
+			var err error
+			if d, err = lookupDialect(tenant.Dialect); err != nil {
+				srv.Close()
+				return nil, errors.Wrapf(err, "tenant %s", name)
+			}
+		}
+
+		b, err := openBackend(tenant.DSN, d, tenant.Charset, poolOptions{
+			maxOpenConns:  tenant.MaxOpenConns,
+			maxIdleConns:  tenant.MaxIdleConns,
+			warmConns:     tenant.WarmConns,
+			maxConcurrent: tenant.MaxConcurrent,
+			maxQueue:      tenant.MaxQueue,
+			queueTimeout:  tenant.QueueTimeout.Duration,
+		})
+		if err != nil {
+			srv.Close()
+			return nil, errors.Wrapf(err, "tenant %s", name)
+		}
+		srv.tenants[name] = b
+
+		r, err := newRouter(tenant.Routes, tenant.Sharding, tenant.Replicas, backends, d)
+		if err != nil {
+			srv.Close()
+			return nil, errors.Wrapf(err, "tenant %s", name)
+		}
+		if r != nil {
+			srv.routers[name] = r
+		}
+	}
+
+	if defaultBackend == nil && srv.blueGreen == nil {
+		if !srv.requiresAuth() {
+			srv.Close()
+			return nil, errors.New("DSN is required for anonymous clients")
+		}
+		for name, identity := range cfg.Identities {
+			if identity.Tenant == "" {
+				srv.Close()
+				return nil, errors.Errorf("identity %s has no tenant and there is no default DSN", name)
+			}
+		}
+	}
+
+	return srv, nil
+}
+
+// requiresAuth reports whether clients must authenticate.
+func (s *server) requiresAuth() bool {
+	return s.config != nil && len(s.config.Identities) > 0
+}
+
+// Close the tenant, named and shard backends.
+func (s *server) Close() {
+	for _, b := range s.tenants {
+		b.Close()
+	}
+	closeBackends(s.backends)
+	for _, r := range s.routers {
+		r.Close()
+	}
+}
+
+// session is the state of one client connection.
+type session struct {
+	conn net.Conn
+	// Signer and compressor of the frames negotiated by the hello, read by
+	// readFrames once handshake is closed, and signing of the server when
+	// the frames must be signed.
+	signer     *frame.Signer
+	compressor *frame.Compressor
+	handshake  chan struct{}
+	signing    *frameSigning
+	// ctx is cancelled when the client disconnects.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Requests read from the client, also read by streamed results for the
+	// acknowledgements.
+	frames        <-chan requestFrame
+	authenticated bool
+	user          string
+	tenant        string
+	backend       *backend
+	// Routes and shards of the backend, if any.
+	router *router
+	// Track of the session when its backend has a canary, primary or canary,
+	// and its blue/green backend by name, if any.
+	track     string
+	blueGreen string
+	// Database selected by the statement being handled, and its backend.
+	database        string
+	databaseBackend *backend
+	// Route of the statement being handled, "" on the backend of the
+	// session.
+	routedTo string
+	// Last statement that may have written, whose reads go to the primary
+	// for a while, and consistency token of the statement being handled.
+	lastWrite   time.Time
+	consistency *consistencyCheck
+	// Usage account: the tenant, or the identity when it has no tenant.
+	account *account
+	// Row-level security policies of the identity.
+	policies rowPolicies
+	// Statements the identity may run.
+	access access
+	// Column masks and deny rules applying to the identity.
+	masks []maskConfig
+	deny  []denyRule
+	// Value types decoded by the client, and the typed columns.
+	decodes []string
+	types   []typeConfig
+	// offsets is set when timestamps are sent with their offset.
+	offsets bool
+	// Columns not decoded with the charset of the backend.
+	binaryColumns []string
+	// Backend connection dedicated to the session once it has set session
+	// variables, and the SET statements to replay when it is replaced.
+	pinned   *sql.Conn
+	setStmts []ExecRequest
+	// Transaction begun by the client, where its statements run.
+	tx *sql.Tx
+	// Open cursors by ID.
+	cursors    map[int64]*cursor
+	lastCursor int64
+	// Egress rate limiter of the identity, if it has one.
+	egress *rateLimiter
+	// Approximate bytes of the rows buffered by the running query, and by
+	// the request until its response is sent.
+	queryMemory   int64
+	requestMemory int64
+	// Journal of the exec requests, result cache and running queries of the
+	// server.
+	journal *journal
+	cache   *resultCache
+	flights *flightGroup
+	// Tables written by the transaction of the session, whose cached results
+	// are invalidated once it commits.
+	pendingWrites []string
+	// Statements prepared on the backend pools, if cached.
+	statements *statementCache
+	// Notification hub of the server, the channels the session listens to
+	// and the notifications queued for it. Those of NOTIFY statements run in
+	// a transaction are pending until it commits.
+	notify        *notifyHub
+	channels      map[string]bool
+	notifications chan Notification
+	inTx          bool
+	pending       []Notification
+	// Default priority class of the requests, and share of the backend in
+	// the admission queue.
+	priority int
+	weight   float64
+	// Client description sent in the hello request.
+	application string
+	// Admission slot of the request being handled, and its priority class.
+	release         func()
+	requestPriority int
+	// Trace ID of the request being handled, set by the client.
+	traceID string
+	// Statement timeout of the identity, and that of the request being
+	// handled, lowered by the hint of the client.
+	statementTimeout time.Duration
+	timeout          time.Duration
+	// Hard ceiling of the statements of the identity, killed past it by the
+	// watchdog, and the role it comes from.
+	maxQueryTime     time.Duration
+	maxQueryTimeRole string
+	watchdog         *watchdog
+}
+
+// anonymousAccount is the usage account of unauthenticated clients.
+const anonymousAccount = "anonymous"
+
+func newSession(conn net.Conn, srv *server) *session {
+	ctx, cancel := context.WithCancel(context.Background())
+	sess := &session{
+		conn:          conn,
+		handshake:     make(chan struct{}),
+		signing:       srv.signing,
+		ctx:           ctx,
+		cancel:        cancel,
+		authenticated: !srv.requiresAuth(),
+		backend:       srv.backend,
+		router:        srv.routers[""],
+		account:       srv.usage.account(anonymousAccount, nil),
+		access:        accessAdmin,
+		priority:      priorityNormal,
+		cursors:       map[int64]*cursor{},
+		journal:       srv.journal,
+		cache:         srv.cache,
+		flights:       srv.flights,
+		statements:    srv.statements,
+		notify:        srv.notify,
+		channels:      map[string]bool{},
+
+		statementTimeout: *statementTimeout,
+		maxQueryTime:     *maxQueryTime,
+		watchdog:         srv.watchdog,
+	}
+	if srv.config != nil {
+		sess.masks = srv.config.Masks
+		sess.deny = srv.config.Deny
+	}
+	srv.useDefaultBackend(sess)
+	srv.assignTrack(sess)
+
+	return sess
+}
+
+// logf logs a line about the current request, with the client application
+// and the trace ID.
+func (sess *session) logf(format string, v ...interface{}) {
+	var prefix []string
+	for _, s := range []string{sess.application, sess.traceID} {
+		if s != "" {
+			prefix = append(prefix, s)
+		}
+	}
+	if len(prefix) > 0 {
+		format = "[" + strings.Join(prefix, " ") + "] " + format
+	}
+	log.Printf(format, v...)
+}
+
+// handleHello authenticates the session and binds it to its tenant backend.
+// The error is reported to the client, and the connection must be closed.
+func handleHello(sess *session, srv *server, data []byte) error {
+	var req HelloRequest
+	if err := msgpack.Unmarshal(data, &req); err != nil {
+		return err
+	}
+
+	sess.decode(srv, req.Types)
+
+	var alg string
+	var signer *frame.Signer
+	var nonce []byte
+	if srv.signing != nil {
+		var err error
+		if alg, signer, nonce, err = srv.signing.negotiate(req.Signing, req.Nonce); err != nil {
+			sendResponse(sess.conn, HelloResponse{Error: err.Error()})
+			return err
+		}
+	}
+	if err := srv.authenticate(sess, &req); err != nil {
+		sendResponse(sess.conn, HelloResponse{Error: err.Error()})
+		return err
+	}
+	// A metric label, set once the client is known.
+	connectionsOpen.add(-1, sess.application)
+	sess.application = applicationLabel(req.Application)
+	connectionsOpen.add(1, sess.application)
+	sess.throttle(sess.egress)
+	if signer != nil {
+		// Frames are signed whole, before they are throttled.
+		sess.signer = signer
+		sess.conn = frame.NewSignedConn(sess.conn, signer)
+	}
+	srv.updateConn(sess, func(info *connInfo) {
+		info.User = sess.user
+		info.Tenant = sess.tenant
+		info.Application = sess.application
+		info.ClientVersion = req.Version
+		info.Tags = req.Tags
+	})
+
+	// The frames read from now on may be compressed, those sent once the
+	// response is.
+	compression, compressor := srv.negotiateCompression(req.Compression, req.CompressMin)
+	if compressor != nil {
+		sess.compressor = compressor
+	}
+	sendResponse(sess.conn, HelloResponse{Capabilities: capabilities, Signing: alg, Nonce: nonce, Compression: compression})
+	if compressor != nil {
+		sess.conn = frame.NewCompressedConn(sess.conn, compressor)
+	}
+	return nil
+}
+
+// maxApplicationLength is the length the application names of the clients
+// are truncated to.
+const maxApplicationLength = 64
+
+// applicationLabel returns the application name of a client, truncated.
+func applicationLabel(application string) string {
+	if len(application) <= maxApplicationLength {
+		return application
+	}
+	return strings.ToValidUTF8(application[:maxApplicationLength], "")
+}
+
+// verified reports whether a request frame may be handled: its signature must
+// have been checked when the frames are signed.
+func (sess *session) verified(f requestFrame) bool {
+	return f.signed || sess.signing == nil
+}
+
+// openHello returns the msgpack value of the first request frame, a hello
+// signed with the key alone when the frames are signed. Clients signing
+// frames are told when they aren't, rather than disconnected.
+func (sess *session) openHello(data []byte) ([]byte, error) {
+	if sess.signing != nil {
+		return sess.signing.openHello(data)
+	}
+	if value, _, err := frame.Split(data); err == nil && isHello(value) {
+		return value, nil
+	}
+	return data, nil
+}
+
+// decode sets the value types decoded by the client of the session.
+func (sess *session) decode(srv *server, types []string) {
+	sess.decodes = types
+	sess.offsets = *timestamps == "offset" && decodesType(types, "timestamptz")
+	if srv.config != nil {
+		sess.types = sessionTypes(srv.config.Types, types)
+		sess.binaryColumns = srv.config.BinaryColumns
+	}
+}
+
+func (s *server) authenticate(sess *session, req *HelloRequest) error {
+	if !s.requiresAuth() {
+		sess.authenticated = true
+		return nil
+	}
+
+	identity := s.config.Identities[req.User]
+	if identity == nil || !identity.checkPassword(req.Password) {
+		sess.logf("Authentication failed for %q from %s", req.User, sess.conn.RemoteAddr())
+		return errors.New("authentication failed")
+	}
+
+	return s.bind(sess, req.User, identity)
+}
+
+// bind gives a session the settings of an identity.
+func (s *server) bind(sess *session, user string, identity *identityConfig) error {
+	var tenantPolicies map[string]string
+	if identity.Tenant != "" {
+		tenantPolicies = s.config.Tenants[identity.Tenant].RowPolicies
+	}
+	policies, err := newRowPolicies(user, identity.Tenant, identity, tenantPolicies)
+	if err != nil {
+		sess.logf("Invalid row policies for %q: %v", user, err)
+		return errors.New("invalid row policies")
+	}
+
+	sess.authenticated = true
+	sess.user = user
+	sess.tenant = identity.Tenant
+	sess.policies = policies
+	sess.access = identityAccess(identity)
+	sess.priority, _ = parsePriority(identity.Priority)
+	sess.weight = identity.Weight
+	sess.statementTimeout = identityTimeout(identity, s.config.Roles)
+	sess.maxQueryTime, sess.maxQueryTimeRole = identityMaxQueryTime(identity, s.config.Roles)
+	sess.egress = s.egressLimiter(user, identity.EgressRate)
+	if identity.hasRole(unmaskedRole) {
+		sess.masks = nil
+	}
+	sess.deny = denyRules(s.config.Deny, user)
+	if identity.Tenant != "" {
+		sess.backend = s.tenants[identity.Tenant]
+		sess.router = s.routers[identity.Tenant]
+		sess.blueGreen = ""
+		sess.account = s.usage.account("tenant:"+identity.Tenant, s.config.Tenants[identity.Tenant].Quota)
+	} else {
+		s.useDefaultBackend(sess)
+		sess.account = s.usage.account("identity:"+user, identity.Quota)
+	}
+	s.assignTrack(sess)
+	s.updateConn(sess, func(info *connInfo) { info.Backend = sess.blueGreen })
+
+	return nil
+}
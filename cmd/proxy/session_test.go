@@ -0,0 +1,18 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestApplicationLabel(t *testing.T) {
+	if got := applicationLabel("billing"); got != "billing" {
+		t.Errorf("applicationLabel(billing) = %q", got)
+	}
+	long := strings.Repeat("a", maxApplicationLength-1) + "é" + strings.Repeat("b", 1000)
+	got := applicationLabel(long)
+	if len(got) > maxApplicationLength || !utf8.ValidString(got) || !strings.HasPrefix(long, got) {
+		t.Errorf("applicationLabel of %d bytes = %q", len(long), got)
+	}
+}
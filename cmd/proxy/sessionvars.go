@@ -0,0 +1,114 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+
+	"github.com/arkan/sqlproxy/internal/sqltext"
+	"github.com/pkg/errors"
+)
+
+// isSetStatement reports whether a statement sets a session variable (e.g.
+// SET search_path, SET TIME ZONE, SET NOCOUNT ON).
+func isSetStatement(query string) bool {
+	for _, t := range sqltext.Tokenize(query) {
+		if t.Significant() {
+			return t.Is("SET")
+		}
+	}
+
+	return false
+}
+
+// db returns where the statements of the session run: its transaction, the
+// pinned connection once the session has set variables, or the backend pool.
+func (sess *session) db() querier {
+	if sess.tx != nil {
+		return sess.tx
+	}
+	if sess.pinned != nil {
+		return sess.pinned
+	}
+	return sess.backend.DB()
+}
+
+// pin dedicates a backend connection to the session and replays the SET
+// statements of the session on it.
+func (sess *session) pin() error {
+	ctx := sess.ctx
+	conn, err := sess.backend.DB().Conn(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, req := range sess.setStmts {
+		if _, err := conn.ExecContext(ctx, req.Query, req.Args...); err != nil {
+			conn.Close()
+			return errors.Wrap(err, "failed to restore session variables")
+		}
+	}
+	sess.pinned = conn
+
+	return nil
+}
+
+// unpin closes the pinned connection, if any. It is not given back to the
+// pool, where its variables would leak to other sessions.
+func (sess *session) unpin() {
+	if sess.pinned != nil {
+		sess.pinned.Raw(func(interface{}) error { return driver.ErrBadConn })
+		sess.pinned.Close()
+		sess.pinned = nil
+	}
+}
+
+// handleSet runs a SET statement on the pinned connection, pinning one if
+// needed, and records it to be replayed on a new connection.
+func handleSet(sess *session, req ExecRequest) (requestStats, error) {
+	if sess.tx != nil {
+		// It would run on another connection than the transaction.
+		return requestStats{}, errors.New("SET statements can't run in a transaction")
+	}
+	if sess.pinned == nil {
+		if err := sess.pin(); err != nil {
+			return requestStats{}, err
+		}
+	}
+
+	stats, err := handleExec(sess, sess.pinned, req)
+	if err != nil {
+		if len(sess.setStmts) == 0 {
+			sess.unpin()
+		}
+		return stats, err
+	}
+
+	// Only the last run of a statement matters.
+	stmts := sess.setStmts[:0]
+	for _, s := range sess.setStmts {
+		if s.Query != req.Query {
+			stmts = append(stmts, s)
+		}
+	}
+	sess.setStmts = append(stmts, req)
+
+	return stats, nil
+}
+
+// retryPinned runs fn on the statement target of the session. When the
+// pinned connection is broken, it is replaced by a new one with the session
+// variables restored and fn is run again: drivers only report a bad
+// connection when the statement was not sent. Transactions are never
+// retried.
+func retryPinned(sess *session, fn func(db querier) (requestStats, error)) (requestStats, error) {
+	stats, err := fn(sess.db())
+	if sess.pinned == nil || sess.tx != nil || !(errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone)) {
+		return stats, err
+	}
+
+	sess.unpin()
+	if err := sess.pin(); err != nil {
+		return stats, err
+	}
+	return fn(sess.db())
+}
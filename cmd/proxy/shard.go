@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+// shardingConfig routes statements to the shards of a manually sharded
+// database, by a key bound as a parameter. Statements matching no rule run
+// on the regular backend.
+type shardingConfig struct {
+	// DSNs of the shards. A key always maps to the same shard as long as
+	// their number doesn't change.
+	Shards []string `json:"shards"`
+	// Dialect of the shards, the one of the regular backend by default.
+	Dialect string `json:"dialect"`
+	// Charset of the text of the shards, -charset by default.
+	Charset      string      `json:"charset"`
+	MaxOpenConns int         `json:"max_open_conns"`
+	MaxIdleConns int         `json:"max_idle_conns"`
+	WarmConns    int         `json:"warm_conns"`
+	Rules        []shardRule `json:"rules"`
+}
+
+// shardRule extracts the shard key of the statements matching a pattern.
+type shardRule struct {
+	// Regular expression matched against the statement (e.g.
+	// "(?i)\\bFROM orders\\b").
+	Pattern string `json:"pattern"`
+	// Position of the parameter holding the shard key, from 1.
+	Param int `json:"param"`
+
+	re *regexp.Regexp
+}
+
+func (c *shardingConfig) validate() error {
+	if len(c.Shards) == 0 {
+		return errors.New("shards are required")
+	}
+	for i := range c.Rules {
+		rule := &c.Rules[i]
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return errors.Wrapf(err, "rule %d", i+1)
+		}
+		if rule.Param < 1 {
+			return errors.Errorf("rule %d: param must be at least 1", i+1)
+		}
+		rule.re = re
+	}
+
+	return nil
+}
+
+// shardRouter holds the backends of the shards.
+type shardRouter struct {
+	rules  []shardRule
+	shards []*backend
+}
+
+// openShards opens the backend of every shard.
+func openShards(cfg *shardingConfig, defaultDialect *dialect) (*shardRouter, error) {
+	d := defaultDialect
+	if cfg.Dialect != "" {
+		var err error
+		if d, err = lookupDialect(cfg.Dialect); err != nil {
+			return nil, err
+		}
+	}
+
+	r := &shardRouter{rules: cfg.Rules}
+	for i, dsn := range cfg.Shards {
+		b, err := openBackend(dsn, d, cfg.Charset, poolOptions{maxOpenConns: cfg.MaxOpenConns, maxIdleConns: cfg.MaxIdleConns, warmConns: cfg.WarmConns})
+		if err != nil {
+			r.Close()
+			return nil, errors.Wrapf(err, "shard %d", i)
+		}
+		r.shards = append(r.shards, b)
+	}
+
+	return r, nil
+}
+
+// route returns the shard of a statement, or nil when it matches no rule.
+func (r *shardRouter) route(query string, args []interface{}) (int, *backend, error) {
+	if r == nil {
+		return 0, nil, nil
+	}
+
+	for _, rule := range r.rules {
+		if !rule.re.MatchString(query) {
+			continue
+		}
+		if rule.Param > len(args) {
+			return 0, nil, errors.Errorf("shard key parameter %d is missing", rule.Param)
+		}
+		key := args[rule.Param-1]
+		if key == nil {
+			return 0, nil, errors.New("shard key is null")
+		}
+
+		// Keys of any type hash as their text: 42 and "42" are on the same
+		// shard.
+		h := fnv.New64a()
+		if b, ok := key.([]byte); ok {
+			h.Write(b)
+		} else {
+			fmt.Fprint(h, key)
+		}
+		i := int(h.Sum64() % uint64(len(r.shards)))
+		return i, r.shards[i], nil
+	}
+
+	return 0, nil, nil
+}
+
+// Close the shard backends.
+func (r *shardRouter) Close() {
+	for _, b := range r.shards {
+		b.Close()
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/arkan/sqlproxy/internal/frame"
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack"
+)
+
+// frameSigning is the shared key and the algorithms of the frame signing,
+// required of every client when enabled.
+type frameSigning struct {
+	key        []byte
+	algorithms []string
+}
+
+// newFrameSigning returns the frame signing of the -sign-* flags, nil when
+// there is no key.
+func newFrameSigning(env, file, algorithms string) (*frameSigning, error) {
+	if env == "" && file == "" {
+		return nil, nil
+	}
+	key, err := readSecret("", env, file)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read the signing key")
+	}
+	if key == "" {
+		return nil, errors.New("the signing key is empty")
+	}
+
+	s := &frameSigning{key: []byte(key)}
+	for _, alg := range strings.Split(algorithms, ",") {
+		alg = strings.TrimSpace(alg)
+		if frame.Negotiate([]string{alg}, frame.Algorithms) == "" {
+			return nil, errors.Errorf("unknown signing algorithm %q (%s)", alg, strings.Join(frame.Algorithms, ", "))
+		}
+		s.algorithms = append(s.algorithms, alg)
+	}
+
+	return s, nil
+}
+
+// openHello checks the MAC of a hello request, signed with the key and the
+// nonce of the client it holds, and returns its msgpack value.
+func (s *frameSigning) openHello(data []byte) ([]byte, error) {
+	value, mac, err := frame.Split(data)
+	if err != nil {
+		return nil, err
+	}
+	var req HelloRequest
+	if err := msgpack.Unmarshal(value, &req); err != nil {
+		return nil, frame.ErrSignature
+	}
+	if err := frame.OpenHello(s.key, req.Nonce, value, mac); err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+// negotiate returns the algorithm, signer and nonce of a session, among the
+// algorithms offered by its client with its nonce.
+func (s *frameSigning) negotiate(offered []string, clientNonce []byte) (string, *frame.Signer, []byte, error) {
+	alg := frame.Negotiate(offered, s.algorithms)
+	if alg == "" {
+		return "", nil, nil, errors.New("frame signing is required")
+	}
+	nonce, err := frame.Nonce()
+	if err != nil {
+		return "", nil, nil, err
+	}
+	signer, err := frame.NewSigner(alg, s.key, clientNonce, nonce, false)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	return alg, signer, nonce, nil
+}
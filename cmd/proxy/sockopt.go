@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// tcpOptions are the socket options of the client connections.
+type tcpOptions struct {
+	// Idle time before keepalive probes and interval between them, the Go
+	// defaults (15s) when 0. A negative keepAlive disables them.
+	keepAlive         time.Duration
+	keepAliveInterval time.Duration
+	noDelay           bool
+	// Socket buffer sizes, the OS defaults when 0.
+	readBuffer  int
+	writeBuffer int
+}
+
+// apply sets the options of a TCP connection.
+func (o tcpOptions) apply(conn net.Conn) error {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	err := tcp.SetKeepAliveConfig(net.KeepAliveConfig{
+		Enable:   o.keepAlive >= 0,
+		Idle:     o.keepAlive,
+		Interval: o.keepAliveInterval,
+	})
+	if err != nil {
+		return err
+	}
+	if err := tcp.SetNoDelay(o.noDelay); err != nil {
+		return err
+	}
+	if o.readBuffer > 0 {
+		if err := tcp.SetReadBuffer(o.readBuffer); err != nil {
+			return err
+		}
+	}
+	if o.writeBuffer > 0 {
+		if err := tcp.SetWriteBuffer(o.writeBuffer); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
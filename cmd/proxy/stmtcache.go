@@ -0,0 +1,133 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"sync"
+)
+
+// statementCache keeps the statements run on the backend pools prepared,
+// shared by the sessions: database/sql prepares a statement once on every
+// connection of its pool, instead of once per request. The least recently
+// used ones are closed first.
+type statementCache struct {
+	size int
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[statementKey]*list.Element
+}
+
+// statementKey identifies a statement of a pool.
+type statementKey struct {
+	db    *sql.DB
+	query string
+}
+
+// cachedStatement is a prepared statement, closed once evicted and no longer
+// used by a request.
+type cachedStatement struct {
+	key     statementKey
+	stmt    *sql.Stmt
+	refs    int
+	evicted bool
+}
+
+func newStatementCache(size int) *statementCache {
+	return &statementCache{size: size, lru: list.New(), entries: map[statementKey]*list.Element{}}
+}
+
+// prepared returns the querier running a query on db, its prepared
+// statement on a pool, and the function releasing it once run. Queries run
+// on db when the cache is nil, db is a session connection or transaction, or
+// the statement can't be prepared, the query reporting the error.
+func (c *statementCache) prepared(ctx context.Context, db querier, query string) (querier, func()) {
+	pool, ok := db.(*sql.DB)
+	if c == nil || !ok {
+		return db, func() {}
+	}
+	key := statementKey{db: pool, query: query}
+
+	entry := c.acquire(key)
+	if entry == nil {
+		stmt, err := pool.PrepareContext(ctx, query)
+		if err != nil {
+			return db, func() {}
+		}
+		entry = c.add(&cachedStatement{key: key, stmt: stmt})
+	}
+
+	return preparedStatement{entry.stmt}, func() { c.release(entry) }
+}
+
+// acquire returns the statement of a key, nil if it isn't prepared.
+func (c *statementCache) acquire(key statementKey) *cachedStatement {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem := c.entries[key]
+	if elem == nil {
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	entry := elem.Value.(*cachedStatement)
+	entry.refs++
+
+	return entry
+}
+
+// add caches a statement, unless another request prepared it meanwhile, and
+// returns the one acquired, evicting the least recently used ones past the
+// size of the cache.
+func (c *statementCache) add(entry *cachedStatement) *cachedStatement {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem := c.entries[entry.key]; elem != nil {
+		entry.stmt.Close()
+		c.lru.MoveToFront(elem)
+		entry = elem.Value.(*cachedStatement)
+		entry.refs++
+		return entry
+	}
+	entry.refs++
+	c.entries[entry.key] = c.lru.PushFront(entry)
+
+	for c.lru.Len() > c.size {
+		elem := c.lru.Back()
+		evicted := elem.Value.(*cachedStatement)
+		c.lru.Remove(elem)
+		delete(c.entries, evicted.key)
+		evicted.evicted = true
+		if evicted.refs == 0 {
+			evicted.stmt.Close()
+		}
+	}
+
+	return entry
+}
+
+func (c *statementCache) release(entry *cachedStatement) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry.refs--
+	if entry.evicted && entry.refs == 0 {
+		entry.stmt.Close()
+	}
+}
+
+// preparedStatement runs the statement it was prepared with, ignoring the
+// query passed.
+type preparedStatement struct {
+	stmt *sql.Stmt
+}
+
+func (p preparedStatement) QueryContext(ctx context.Context, _ string, args ...interface{}) (*sql.Rows, error) {
+	return p.stmt.QueryContext(ctx, args...)
+}
+
+func (p preparedStatement) ExecContext(ctx context.Context, _ string, args ...interface{}) (sql.Result, error) {
+	return p.stmt.ExecContext(ctx, args...)
+}
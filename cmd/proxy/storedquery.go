@@ -0,0 +1,285 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// storedQuery is a statement registered under a name, that clients invoke
+// with "@name" and its parameters.
+type storedQuery struct {
+	SQL    string       `json:"sql"`
+	Params []queryParam `json:"params"`
+}
+
+// queryParam describes a parameter of a stored query.
+type queryParam struct {
+	Name string `json:"name"`
+	// Type: string, int, uint, float, bool, time (RFC 3339) or bytes.
+	Type string `json:"type"`
+}
+
+// validate the definition of a stored query.
+func (q *storedQuery) validate() error {
+	if strings.TrimSpace(q.SQL) == "" {
+		return errors.New("sql is required")
+	}
+	for _, p := range q.Params {
+		if !paramTypes[p.Type] {
+			return errors.Errorf("parameter %s: unknown type %q", p.Name, p.Type)
+		}
+	}
+
+	return nil
+}
+
+// bind checks and converts the arguments of an invocation.
+func (q *storedQuery) bind(args []interface{}) ([]interface{}, error) {
+	if len(args) != len(q.Params) {
+		return nil, errors.Errorf("expected %d parameters, got %d", len(q.Params), len(args))
+	}
+
+	bound := make([]interface{}, len(args))
+	for i, p := range q.Params {
+		v, err := coerceParam(p.Type, args[i])
+		if err != nil {
+			return nil, errors.Errorf("parameter %s: %v", p.Name, err)
+		}
+		bound[i] = v
+	}
+
+	return bound, nil
+}
+
+// paramTypes are the types of stored query parameters.
+var paramTypes = map[string]bool{"string": true, "int": true, "uint": true, "float": true, "bool": true, "time": true, "bytes": true}
+
+// coerceParam converts a value to a parameter type. NULL is accepted for
+// every type.
+func coerceParam(typ string, v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	s, isString := v.(string)
+	switch typ {
+	case "string":
+		if isString {
+			return s, nil
+		}
+	case "int":
+		if isString {
+			return strconv.ParseInt(s, 10, 64)
+		}
+		if n, ok := toInt64(v); ok {
+			return n, nil
+		}
+	case "uint":
+		if isString {
+			return strconv.ParseUint(s, 10, 64)
+		}
+		if n, ok := v.(uint64); ok {
+			return n, nil
+		}
+		if n, ok := toInt64(v); ok && n >= 0 {
+			return uint64(n), nil
+		}
+	case "float":
+		if isString {
+			return strconv.ParseFloat(s, 64)
+		}
+		if n, ok := toInt64(v); ok {
+			return float64(n), nil
+		}
+		switch f := v.(type) {
+		case float32:
+			return float64(f), nil
+		case float64:
+			return f, nil
+		}
+	case "bool":
+		if isString {
+			return strconv.ParseBool(s)
+		}
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+	case "time":
+		if isString {
+			return time.Parse(time.RFC3339Nano, s)
+		}
+		switch t := v.(type) {
+		case time.Time:
+			return t, nil
+		case *time.Time:
+			return *t, nil
+		}
+	case "bytes":
+		switch b := v.(type) {
+		case []byte:
+			return b, nil
+		case string:
+			return []byte(b), nil
+		}
+	default:
+		return nil, errors.Errorf("unknown type %q", typ)
+	}
+
+	return nil, errors.Errorf("cannot use %T as %s", v, typ)
+}
+
+// toInt64 converts the integer types decoded by msgpack.
+func toInt64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int8:
+		return int64(n), true
+	case int16:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case int:
+		return int64(n), true
+	case uint8:
+		return int64(n), true
+	case uint16:
+		return int64(n), true
+	case uint32:
+		return int64(n), true
+	case uint64:
+		if n <= 1<<63-1 {
+			return int64(n), true
+		}
+	}
+
+	return 0, false
+}
+
+// backendArgs converts the unsigned arguments above the int64 range to
+// decimal strings: ODBC binds no unsigned 64-bit parameters, and backends
+// convert them back exactly. Tagged UUIDs are sent in their canonical form,
+// arrays as PostgreSQL array literals and JSON documents as text. Timestamps
+// are bound as wall-clock times of the session time zone.
+func backendArgs(args []interface{}) []interface{} {
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case uint64:
+			if v > math.MaxInt64 {
+				args[i] = strconv.FormatUint(v, 10)
+			}
+		case *uuidValue:
+			args[i] = v.String()
+		case *intArray:
+			elems := make([]string, len(*v))
+			for j, n := range *v {
+				elems[j] = strconv.FormatInt(n, 10)
+			}
+			args[i] = arrayLiteral(elems, false)
+		case *textArray:
+			args[i] = arrayLiteral(*v, true)
+		case *jsonValue:
+			args[i] = string(*v)
+		case *timestampValue:
+			args[i] = v.In(backendLocation)
+		case *time.Time:
+			args[i] = v.In(backendLocation)
+		}
+	}
+
+	return args
+}
+
+// storedQueryName returns the name of the stored query invoked by a
+// statement of the form "@name".
+func storedQueryName(query string) (string, bool) {
+	query = strings.TrimSpace(query)
+	if !strings.HasPrefix(query, "@") || len(query) == 1 {
+		return "", false
+	}
+	for _, r := range query[1:] {
+		if r != '_' && r != '-' && r != '.' && !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9') {
+			return "", false
+		}
+	}
+
+	return query[1:], true
+}
+
+// queryRegistry holds the stored queries, registered in the configuration
+// file or through the admin API.
+type queryRegistry struct {
+	mu      sync.RWMutex
+	queries map[string]*storedQuery
+}
+
+func newQueryRegistry(queries map[string]*storedQuery) *queryRegistry {
+	r := &queryRegistry{queries: map[string]*storedQuery{}}
+	for name, q := range queries {
+		r.queries[name] = q
+	}
+
+	return r
+}
+
+// resolve replaces the invocation of a stored query by its statement.
+func (r *queryRegistry) resolve(name string, req *QueryRequest) error {
+	r.mu.RLock()
+	q := r.queries[name]
+	r.mu.RUnlock()
+	if q == nil {
+		return errors.Errorf("unknown stored query %s", name)
+	}
+
+	args, err := q.bind(req.Args)
+	if err != nil {
+		return errors.Wrap(err, name)
+	}
+	req.Query, req.Args = q.SQL, args
+
+	return nil
+}
+
+// register adds or replaces a stored query.
+func (r *queryRegistry) register(name string, q *storedQuery) error {
+	if _, ok := storedQueryName("@" + name); !ok {
+		return errors.Errorf("invalid stored query name %q", name)
+	}
+	if err := q.validate(); err != nil {
+		return errors.Wrap(err, name)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.queries[name] = q
+
+	return nil
+}
+
+// unregister removes a stored query.
+func (r *queryRegistry) unregister(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, ok := r.queries[name]
+	delete(r.queries, name)
+	return ok
+}
+
+// list returns the stored queries by name.
+func (r *queryRegistry) list() map[string]*storedQuery {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	queries := make(map[string]*storedQuery, len(r.queries))
+	for name, q := range r.queries {
+		queries[name] = q
+	}
+
+	return queries
+}
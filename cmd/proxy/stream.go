@@ -0,0 +1,144 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack"
+)
+
+// Streaming defaults.
+const (
+	defaultWindowRows = 1000
+	// streamBatchRows is the maximum number of rows of a streamed response.
+	streamBatchRows = 100
+)
+
+// Ack request struct, sent by the client of a streamed result for the
+// responses it has consumed, so that the proxy can send more.
+type AckRequest struct {
+	Op    string `msgpack:"op"`
+	Rows  int    `msgpack:"rows"`
+	Bytes int    `msgpack:"bytes"`
+}
+
+// stream is a result being streamed to a client.
+type stream struct {
+	sess *session
+	// Rows and bytes sent but not acknowledged yet, and their limits.
+	rows, bytes       int
+	maxRows, maxBytes int
+	// closed is set when the client stops the stream early.
+	closed bool
+}
+
+// full reports whether the window of the client is full.
+func (s *stream) full() bool {
+	return s.rows >= s.maxRows || (s.maxBytes > 0 && s.bytes >= s.maxBytes)
+}
+
+// poll handles the requests of the client: it waits for one if the window is
+// full, and only handles those already sent otherwise.
+func (s *stream) poll() error {
+	for !s.closed {
+		var f requestFrame
+		var ok bool
+		if s.full() {
+			f, ok = <-s.sess.frames
+		} else {
+			select {
+			case f, ok = <-s.sess.frames:
+			default:
+				return nil
+			}
+		}
+		if !ok {
+			return s.sess.ctx.Err()
+		}
+		if !s.sess.verified(f) {
+			return errors.New("unsigned request")
+		}
+
+		var ack AckRequest
+		if err := msgpack.Unmarshal(f.data, &ack); err != nil {
+			return err
+		}
+		switch ack.Op {
+		case "ack":
+			s.rows -= ack.Rows
+			s.bytes -= ack.Bytes
+		case "close_stream":
+			s.closed = true
+		default:
+			return errors.Errorf("unexpected %q request while streaming", ack.Op)
+		}
+	}
+
+	return nil
+}
+
+// send a response of the stream, once the client has room for it.
+func (s *stream) send(response QueryResponse) (int, error) {
+	if err := s.poll(); err != nil || s.closed {
+		return 0, err
+	}
+
+	n := sendResponse(s.sess.conn, response)
+	s.rows += len(response.Data)
+	s.bytes += n
+	return n, nil
+}
+
+// streamRows sends a result in batches, pausing while the window of the
+// client is full. The client can stop it early with a "close_stream"
+// request.
+func streamRows(sess *session, rows *sql.Rows, cols []string, format *rowFormat, req QueryRequest, start time.Time) (requestStats, error) {
+	var stats requestStats
+
+	s := &stream{sess: sess, maxRows: req.WindowRows, maxBytes: req.WindowBytes}
+	if s.maxRows <= 0 {
+		s.maxRows = defaultWindowRows
+	}
+	batchRows := min(streamBatchRows, s.maxRows)
+
+	response := QueryResponse{Columns: cols, Types: format.types, ColumnTypes: columnInfo(rows, format), More: true, TraceID: sess.traceID}
+	for !s.closed && rows.Next() {
+		row := scanRow(rows, cols, format)
+		if _, err := sess.buffer(row); err != nil {
+			stats.duration = time.Since(start)
+			return stats, err
+		}
+		response.Data = append(response.Data, row)
+		if len(response.Data) < batchRows {
+			continue
+		}
+
+		n, err := s.send(response)
+		stats.bytes += int64(n)
+		if err != nil {
+			stats.duration = time.Since(start)
+			return stats, err
+		}
+		if n > 0 {
+			stats.rows += int64(len(response.Data))
+		}
+		response = QueryResponse{More: true, TraceID: sess.traceID}
+		sess.releaseMemory()
+	}
+	stats.duration = time.Since(start)
+	if err := rows.Err(); err != nil {
+		return stats, err
+	}
+
+	// The last response is sent even when the client stopped the stream,
+	// which waits for it.
+	if s.closed {
+		response.Data = nil
+	}
+	response.More = false
+	stats.rows += int64(len(response.Data))
+	stats.bytes += int64(sendResponse(sess.conn, response))
+
+	return stats, nil
+}
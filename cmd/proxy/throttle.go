@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// throttleChunk is the most bytes written to a throttled connection at once.
+const throttleChunk = 16 << 10
+
+// rateLimiter is a token bucket limiting the bytes sent per second, with a
+// burst of one second.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// reserve takes n bytes from the bucket, and returns how long to wait before
+// sending them.
+func (l *rateLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// throttledConn limits the rate of the writes to a client connection. A
+// write is sent in chunks, and never interleaved with another one. The write
+// timeout applies to each chunk, once the limits allow to send it.
+type throttledConn struct {
+	net.Conn
+	ctx      context.Context
+	limiters []*rateLimiter
+	tenant   string
+
+	mu sync.Mutex
+}
+
+func (c *throttledConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var written int
+	for len(b) > 0 {
+		chunk := b[:min(len(b), throttleChunk)]
+		var wait time.Duration
+		for _, l := range c.limiters {
+			wait = max(wait, l.reserve(len(chunk)))
+		}
+		if wait > 0 {
+			throttledSeconds.add(wait.Seconds(), c.tenant)
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-c.ctx.Done():
+				timer.Stop()
+				return written, c.ctx.Err()
+			}
+		}
+
+		if *writeTimeout > 0 {
+			c.Conn.SetWriteDeadline(time.Now().Add(*writeTimeout))
+		}
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+
+	return written, nil
+}
+
+// egressLimiter returns the limiter shared by the connections of an
+// identity, nil when it has no egress rate.
+func (s *server) egressLimiter(user string, rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	s.egressMu.Lock()
+	defer s.egressMu.Unlock()
+
+	l := s.egress[user]
+	if l == nil || l.rate != float64(rate) {
+		l = newRateLimiter(rate)
+		s.egress[user] = l
+	}
+	return l
+}
+
+// throttle limits the rate of the responses of the session to
+// -max-conn-rate, and to the egress rate of its identity.
+func (sess *session) throttle(identity *rateLimiter) {
+	var limiters []*rateLimiter
+	if *maxConnRate > 0 {
+		limiters = append(limiters, newRateLimiter(*maxConnRate))
+	}
+	if identity != nil {
+		limiters = append(limiters, identity)
+	}
+	if len(limiters) > 0 {
+		sess.conn = &throttledConn{Conn: sess.conn, ctx: sess.ctx, limiters: limiters, tenant: sess.tenant}
+	}
+}
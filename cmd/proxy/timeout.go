@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// roleConfig holds the settings of the identities granted a role.
+type roleConfig struct {
+	// Longest time a statement of the identities may run, instead of
+	// -statement-timeout.
+	StatementTimeout duration `json:"statement_timeout"`
+	// Hard ceiling of the statements of the identities, past which the
+	// watchdog kills them, instead of -max-query-time.
+	MaxQueryTime duration `json:"max_query_time"`
+}
+
+// identityTimeout returns the statement timeout of an identity: its own, or
+// the longest of those of its roles, or -statement-timeout.
+func identityTimeout(identity *identityConfig, roles map[string]*roleConfig) time.Duration {
+	if identity.StatementTimeout.Duration > 0 {
+		return identity.StatementTimeout.Duration
+	}
+
+	var timeout time.Duration
+	for _, name := range identity.Roles {
+		if role := roles[name]; role != nil && role.StatementTimeout.Duration > timeout {
+			timeout = role.StatementTimeout.Duration
+		}
+	}
+	if timeout == 0 {
+		return *statementTimeout
+	}
+
+	return timeout
+}
+
+// requestTimeout returns the statement timeout of a request, given the
+// timeout hint of the client in milliseconds. Hints may only lower the
+// timeout of the identity.
+func (sess *session) requestTimeout(hint int64) time.Duration {
+	timeout := time.Duration(hint) * time.Millisecond
+	if hint <= 0 || (sess.statementTimeout > 0 && timeout > sess.statementTimeout) {
+		return sess.statementTimeout
+	}
+
+	return timeout
+}
+
+// statementContext returns the context of a statement of the current
+// request, cancelled when its timeout passes.
+func (sess *session) statementContext() (context.Context, context.CancelFunc) {
+	return sess.timeoutContext(sess.ctx)
+}
+
+// timeoutContext returns a child of a context cancelled when the timeout of
+// the current request passes.
+func (sess *session) timeoutContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if sess.timeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, sess.timeout)
+}
+
+// timeoutError returns the error of a statement, telling when it was
+// cancelled by its timeout.
+func (sess *session) timeoutError(ctx context.Context, err error) error {
+	if killed, ok := context.Cause(ctx).(killedError); ok && err != nil {
+		return killed
+	}
+	if err != nil && ctx.Err() == context.DeadlineExceeded && sess.ctx.Err() == nil {
+		return &codedError{
+			msg:  fmt.Sprintf("statement timeout of %s exceeded", sess.timeout),
+			code: errorCode{Code: "57014", Class: classStatementTimeout},
+		}
+	}
+	return err
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// backendLocation is the time zone of the timestamps read from the backends:
+// -time-zone, or the local one. ODBC returns them as wall-clock times.
+var backendLocation = time.Local
+
+// loadTimeZone checks the time zone, locale and timestamp flags.
+func loadTimeZone() error {
+	if *timeZone != "" {
+		loc, err := time.LoadLocation(*timeZone)
+		if err != nil {
+			return errors.Wrap(err, "invalid -time-zone")
+		}
+		backendLocation = loc
+	}
+	if strings.ContainsAny(*locale, `'";\`) {
+		return errors.Errorf("invalid -locale %q", *locale)
+	}
+	if *timestamps != "utc" && *timestamps != "offset" {
+		return errors.Errorf("invalid -timestamps %q (utc or offset)", *timestamps)
+	}
+
+	return nil
+}
+
+// sessionStatements returns the statements setting the time zone and locale
+// of the connections of a backend.
+func sessionStatements(d *dialect) ([]string, error) {
+	var statements []string
+	for _, setting := range []struct {
+		flag, value string
+		formats     []string
+	}{
+		{"-time-zone", *timeZone, d.timeZoneSet},
+		{"-locale", *locale, d.localeSet},
+	} {
+		if setting.value == "" {
+			continue
+		}
+		if len(setting.formats) == 0 {
+			return nil, errors.Errorf("%s is not supported by the %s dialect", setting.flag, d.name)
+		}
+		for _, format := range setting.formats {
+			statements = append(statements, fmt.Sprintf(format, setting.value))
+		}
+	}
+
+	return statements, nil
+}
+
+// sessionConnector opens the connections of a pool, running the session
+// statements on each of them.
+type sessionConnector struct {
+	driver     driver.Driver
+	dsn        string
+	statements []string
+}
+
+func (c *sessionConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.driver.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	for _, query := range c.statements {
+		if err := execDriverConn(conn, query); err != nil {
+			conn.Close()
+			return nil, errors.Wrapf(err, "session statement %q", query)
+		}
+	}
+
+	return conn, nil
+}
+
+func (c *sessionConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+func execDriverConn(conn driver.Conn, query string) error {
+	stmt, err := conn.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(nil)
+	return err
+}
+
+// wireTime returns a timestamp read from the backend as a time of the
+// session time zone, in the form sent to a client: UTC, or tagged with its
+// offset.
+func wireTime(t time.Time, offsets bool) interface{} {
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), backendLocation)
+	if offsets {
+		return timestampValue{t}
+	}
+	return t.UTC()
+}
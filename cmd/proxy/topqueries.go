@@ -0,0 +1,174 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/arkan/sqlproxy/internal/sqltext"
+	"github.com/pkg/errors"
+)
+
+// latencyBuckets are the buckets of the statement durations of a
+// fingerprint, each 2^(1/4) times as long as the previous one from a
+// microsecond, so that percentiles are off by 19% at most. The last one
+// counts the durations over about 30 seconds.
+const latencyBuckets = 100
+
+// queryStats aggregate the statements of every fingerprint over a rolling
+// window, for the top queries report of the admin API.
+type queryStats struct {
+	// Tracked fingerprints, and window.
+	max    int
+	window time.Duration
+
+	mu          sync.Mutex
+	stats       map[string]*fingerprintStats
+	windowStart time.Time
+	// Statements of the fingerprints not tracked once max were.
+	untracked int64
+}
+
+// fingerprintStats are the aggregates of the statements of a fingerprint.
+type fingerprintStats struct {
+	count, errors, rows int64
+	total               time.Duration
+	buckets             [latencyBuckets]int64
+}
+
+func newQueryStats(max int, window time.Duration) *queryStats {
+	return &queryStats{max: max, window: window, stats: map[string]*fingerprintStats{}, windowStart: time.Now()}
+}
+
+// record a statement which ran for a duration.
+func (q *queryStats) record(query string, stats requestStats, err error) {
+	fingerprint := sqltext.Fingerprint(query)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.rollWindow(time.Now())
+	s := q.stats[fingerprint]
+	if s == nil {
+		if len(q.stats) >= q.max {
+			q.untracked++
+			return
+		}
+		s = &fingerprintStats{}
+		q.stats[fingerprint] = s
+	}
+	s.count++
+	if err != nil {
+		s.errors++
+	}
+	s.rows += stats.rows
+	s.total += stats.duration
+	s.buckets[latencyBucket(stats.duration)]++
+}
+
+// rollWindow starts a new window if the current one is over.
+func (q *queryStats) rollWindow(now time.Time) {
+	if now.Sub(q.windowStart) >= q.window {
+		elapsed := now.Sub(q.windowStart) / q.window * q.window
+		q.windowStart = q.windowStart.Add(elapsed)
+		q.stats = map[string]*fingerprintStats{}
+		q.untracked = 0
+	}
+}
+
+// latencyBucket returns the bucket of a duration.
+func latencyBucket(d time.Duration) int {
+	if d <= time.Microsecond {
+		return 0
+	}
+	i := int(math.Ceil(4 * math.Log2(float64(d)/float64(time.Microsecond))))
+	if i >= latencyBuckets {
+		return latencyBuckets - 1
+	}
+	return i
+}
+
+// percentile returns the upper bound of the bucket of the p-th percentile of
+// the durations.
+func (s *fingerprintStats) percentile(p float64) time.Duration {
+	rank := int64(math.Ceil(p / 100 * float64(s.count)))
+	var n int64
+	for i, count := range s.buckets {
+		if n += count; n >= rank {
+			return time.Duration(float64(time.Microsecond) * math.Pow(2, float64(i)/4)).Round(time.Microsecond)
+		}
+	}
+	return 0
+}
+
+// topQuery is a fingerprint of the top queries report.
+type topQuery struct {
+	Fingerprint string   `json:"fingerprint"`
+	Count       int64    `json:"count"`
+	Errors      int64    `json:"errors"`
+	Rows        int64    `json:"rows"`
+	TotalTime   duration `json:"total_time"`
+	MeanTime    duration `json:"mean_time"`
+	P99Time     duration `json:"p99_time"`
+}
+
+// topQueriesReport is the top queries report of the admin API.
+type topQueriesReport struct {
+	WindowStart time.Time  `json:"window_start"`
+	Untracked   int64      `json:"untracked"`
+	Queries     []topQuery `json:"queries"`
+}
+
+// topQuerySorts are the orders of the top queries report.
+var topQuerySorts = map[string]func(a, b *topQuery) bool{
+	"time":  func(a, b *topQuery) bool { return a.TotalTime.Duration > b.TotalTime.Duration },
+	"mean":  func(a, b *topQuery) bool { return a.MeanTime.Duration > b.MeanTime.Duration },
+	"p99":   func(a, b *topQuery) bool { return a.P99Time.Duration > b.P99Time.Duration },
+	"count": func(a, b *topQuery) bool { return a.Count > b.Count },
+	"rows":  func(a, b *topQuery) bool { return a.Rows > b.Rows },
+}
+
+// top returns the n fingerprints of the window first by an order of
+// topQuerySorts, all of them when n is 0.
+func (q *queryStats) top(n int, by string) (topQueriesReport, error) {
+	less := topQuerySorts[by]
+	if less == nil {
+		return topQueriesReport{}, errors.Errorf("unknown order %q (time, mean, p99, count or rows)", by)
+	}
+
+	q.mu.Lock()
+	q.rollWindow(time.Now())
+	report := topQueriesReport{WindowStart: q.windowStart, Untracked: q.untracked, Queries: make([]topQuery, 0, len(q.stats))}
+	for fingerprint, s := range q.stats {
+		report.Queries = append(report.Queries, topQuery{
+			Fingerprint: fingerprint,
+			Count:       s.count,
+			Errors:      s.errors,
+			Rows:        s.rows,
+			TotalTime:   duration{s.total},
+			MeanTime:    duration{s.total / time.Duration(s.count)},
+			P99Time:     duration{s.percentile(99)},
+		})
+	}
+	q.mu.Unlock()
+
+	sort.Slice(report.Queries, func(i, j int) bool { return less(&report.Queries[i], &report.Queries[j]) })
+	if n > 0 && n < len(report.Queries) {
+		report.Queries = report.Queries[:n]
+	}
+	return report, nil
+}
+
+// parseTopN parses the n parameter of the top queries report, 20 when empty.
+func parseTopN(s string) (int, error) {
+	if s == "" {
+		return 20, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, errors.Errorf("invalid n %q", s)
+	}
+	return n, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack"
+)
+
+// Begin request struct, starting a transaction on the backend of the
+// session (op "begin"). Its statements run in it until a "commit" or
+// "rollback" request. Isolation is the name of a sql.IsolationLevel, such as
+// "Serializable", the default level of the backend when empty. Answered by
+// a TxResponse, as commits and rollbacks are.
+type BeginRequest struct {
+	Op        string `msgpack:"op"`
+	Isolation string `msgpack:"isolation"`
+	ReadOnly  bool   `msgpack:"read_only"`
+	TraceID   string `msgpack:"trace_id"`
+}
+
+// Transaction response struct, with the consistency token of a commit when
+// the backend has replicas.
+type TxResponse struct {
+	Consistency string `msgpack:"consistency_token"`
+	TraceID     string `msgpack:"trace_id"`
+	Error       string `msgpack:"error"`
+}
+
+// Ping response struct, answering a "ping" request once the backend of the
+// session is reachable.
+type PingResponse struct {
+	TraceID string `msgpack:"trace_id"`
+	Error   string `msgpack:"error"`
+}
+
+// isolationLevel returns the level of an isolation name.
+func isolationLevel(name string) (sql.IsolationLevel, error) {
+	if name == "" {
+		return sql.LevelDefault, nil
+	}
+	for level := sql.LevelDefault; level <= sql.LevelLinearizable; level++ {
+		if level.String() == name {
+			return level, nil
+		}
+	}
+
+	return 0, errors.Errorf("unknown isolation level %q", name)
+}
+
+func handleBegin(sess *session, data []byte) (requestStats, error) {
+	var req BeginRequest
+	if err := msgpack.Unmarshal(data, &req); err != nil {
+		return requestStats{}, err
+	}
+	if sess.tx != nil {
+		return requestStats{}, errors.New("a transaction is already running")
+	}
+	level, err := isolationLevel(req.Isolation)
+	if err != nil {
+		return requestStats{}, err
+	}
+
+	// The transaction is rolled back by the backend driver when the session
+	// ends.
+	tx, err := sess.db().(txBeginner).BeginTx(sess.ctx, &sql.TxOptions{Isolation: level, ReadOnly: req.ReadOnly})
+	if err != nil {
+		return requestStats{}, err
+	}
+	sess.tx, sess.inTx = tx, true
+	sess.logf("begin")
+
+	return requestStats{bytes: int64(sendResponse(sess.conn, TxResponse{TraceID: sess.traceID}))}, nil
+}
+
+// handleEndTx commits (op "commit") or rolls back the transaction of the
+// session. The notifications of its NOTIFY statements are published, and
+// the cached results of the tables it wrote invalidated, once it commits.
+func handleEndTx(sess *session, op string) (requestStats, error) {
+	tx := sess.tx
+	if tx == nil {
+		return requestStats{}, errors.New("no transaction is running")
+	}
+	pending, pendingWrites := sess.pending, sess.pendingWrites
+	sess.tx, sess.inTx, sess.pending, sess.pendingWrites = nil, false, nil, nil
+
+	var err error
+	if op == "commit" {
+		err = tx.Commit()
+	} else {
+		err = tx.Rollback()
+	}
+	if err != nil {
+		return requestStats{}, errors.Wrap(err, op)
+	}
+	if op == "commit" {
+		for _, n := range pending {
+			sess.notify.publish(sess.tenant, n)
+		}
+		if sess.cache != nil {
+			sess.cache.written(sess.tenant, pendingWrites)
+		}
+	}
+	sess.logf("%s", op)
+	response := TxResponse{TraceID: sess.traceID}
+	if op == "commit" {
+		response.Consistency = sess.consistencyToken(sess.db())
+	}
+
+	return requestStats{bytes: int64(sendResponse(sess.conn, response))}, nil
+}
+
+func handlePing(sess *session) (requestStats, error) {
+	ctx, cancel := sess.statementContext()
+	defer cancel()
+	if err := sess.backend.DB().PingContext(ctx); err != nil {
+		return requestStats{}, sess.timeoutError(ctx, err)
+	}
+
+	return requestStats{bytes: int64(sendResponse(sess.conn, PingResponse{TraceID: sess.traceID}))}, nil
+}
+
+// nextFrame returns the next request of a session, false once its client
+// is gone or its transaction was idle for longer than -tx-idle-timeout: the
+// session then ends, rolling it back and releasing its backend connection.
+func (sess *session) nextFrame(frames <-chan requestFrame) (requestFrame, bool) {
+	if sess.tx == nil || *txIdleTimeout <= 0 {
+		f, ok := <-frames
+		return f, ok
+	}
+
+	timer := time.NewTimer(*txIdleTimeout)
+	defer timer.Stop()
+	select {
+	case f, ok := <-frames:
+		return f, ok
+	case <-timer.C:
+		sess.logf("Rolling back the transaction of %s (user %q), idle for %s", sess.conn.RemoteAddr(), sess.user, *txIdleTimeout)
+		idleTxRolledBack.add(1, sess.tenant)
+		return requestFrame{}, false
+	}
+}
+
+// rollback rolls back the transaction of a session ending, if any.
+func (sess *session) rollback() {
+	if sess.tx != nil {
+		sess.tx.Rollback()
+		sess.tx, sess.inTx, sess.pending, sess.pendingWrites = nil, false, nil, nil
+	}
+}
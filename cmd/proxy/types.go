@@ -0,0 +1,411 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arkan/sqlproxy/internal/sqltext"
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack"
+)
+
+// Msgpack extension types of the tagged values.
+const (
+	extUUID = iota + 1
+	extIntArray
+	extTextArray
+	extJSON
+	extTimestamp
+)
+
+func init() {
+	msgpack.RegisterExt(extUUID, (*uuidValue)(nil))
+	msgpack.RegisterExt(extIntArray, (*intArray)(nil))
+	msgpack.RegisterExt(extTextArray, (*textArray)(nil))
+	msgpack.RegisterExt(extJSON, (*jsonValue)(nil))
+	msgpack.RegisterExt(extTimestamp, (*timestampValue)(nil))
+}
+
+// valueTypes are the types of the values sent tagged, to the clients decoding
+// them.
+var valueTypes = map[string]bool{"uuid": true, "int[]": true, "text[]": true, "json": true}
+
+// typeConfig declares the type of a column, the backends not telling it to
+// ODBC. Values of typed columns are sent tagged to the clients decoding the
+// type, instead of backend-dependent strings or binary strings.
+type typeConfig struct {
+	// Column, as "table.column" or "*.column" for every table.
+	Column string `json:"column"`
+	// Type: uuid, int[], text[] or json.
+	Type string `json:"type"`
+}
+
+func (t *typeConfig) validate() error {
+	if t.Column == "" {
+		return errors.New("column is required")
+	}
+	if !valueTypes[t.Type] {
+		return errors.Errorf("unknown type %q", t.Type)
+	}
+
+	return nil
+}
+
+// decodesType reports whether a client decodes a value type.
+func decodesType(decoded []string, name string) bool {
+	for _, d := range decoded {
+		if d == name {
+			return true
+		}
+	}
+	return false
+}
+
+// sessionTypes returns the column types of the value types a client
+// decodes.
+func sessionTypes(types []typeConfig, decoded []string) []typeConfig {
+	var result []typeConfig
+	for _, t := range types {
+		for _, name := range decoded {
+			if t.Type == name {
+				result = append(result, t)
+				break
+			}
+		}
+	}
+
+	return result
+}
+
+// columnTypes returns the type of each result column of a query, "" for the
+// untyped ones. It returns nil when no column is typed.
+func columnTypes(types []typeConfig, query string, cols []string) []string {
+	if len(types) == 0 {
+		return nil
+	}
+
+	refs := sqltext.TableRefs(sqltext.Tokenize(query))
+	var result []string
+	for i, col := range cols {
+		for _, t := range types {
+			if !columnMatches(t.Column, refs, col) {
+				continue
+			}
+			if result == nil {
+				result = make([]string, len(cols))
+			}
+			result[i] = t.Type
+			break
+		}
+	}
+
+	return result
+}
+
+// typedValue returns the tagged value of a column of a type, or the value
+// itself when it isn't one of the type.
+func typedValue(typ string, v interface{}) interface{} {
+	switch typ {
+	case "uuid":
+		switch s := v.(type) {
+		case string:
+			if u, ok := parseUUID(s); ok {
+				return u
+			}
+		case []byte:
+			if len(s) == 16 {
+				var u uuidValue
+				copy(u[:], s)
+				return u
+			}
+			if u, ok := parseUUID(string(s)); ok {
+				return u
+			}
+		}
+	case "int[]":
+		if elems, ok := parseArray(v); ok {
+			a := make(intArray, len(elems))
+			for i, e := range elems {
+				n, err := strconv.ParseInt(e, 10, 64)
+				if err != nil {
+					return v
+				}
+				a[i] = n
+			}
+			return a
+		}
+	case "text[]":
+		if elems, ok := parseArray(v); ok {
+			return textArray(elems)
+		}
+	case "json":
+		switch s := v.(type) {
+		case string:
+			if json.Valid([]byte(s)) {
+				return jsonValue(s)
+			}
+		case []byte:
+			if json.Valid(s) {
+				return jsonValue(s)
+			}
+		}
+	}
+
+	return v
+}
+
+// ColumnType describes a result column, as the backend driver does.
+// ScanType is the Go type of its values: int64, float64, bool, string,
+// []byte or time.Time, or empty when unknown. Nullable is "yes", "no" or
+// empty when unknown, and Length, Precision and Scale 0 when unknown.
+type ColumnType struct {
+	DatabaseType string `msgpack:"database_type"`
+	ScanType     string `msgpack:"scan_type"`
+	Nullable     string `msgpack:"nullable"`
+	Length       int64  `msgpack:"length"`
+	Precision    int64  `msgpack:"precision"`
+	Scale        int64  `msgpack:"scale"`
+}
+
+// columnInfo returns the column types of a result sent in a format. The
+// values of masked columns have no known type.
+func columnInfo(rows *sql.Rows, f *rowFormat) []ColumnType {
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil
+	}
+
+	result := make([]ColumnType, len(types))
+	for i, ct := range types {
+		c := ColumnType{DatabaseType: ct.DatabaseTypeName()}
+		if t := ct.ScanType(); t != nil {
+			switch {
+			case t == reflect.TypeOf(time.Time{}):
+				c.ScanType = "time.Time"
+			case t == reflect.TypeOf([]byte(nil)):
+				c.ScanType = "[]byte"
+				if f.charset != nil && (f.binary == nil || !f.binary[i]) {
+					c.ScanType = "string"
+				}
+			case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+				c.ScanType = "int64"
+			case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+				c.ScanType = "float64"
+			case t.Kind() == reflect.Bool || t.Kind() == reflect.String:
+				c.ScanType = t.Kind().String()
+			}
+		}
+		if i < len(f.masks) && f.masks[i] != nil {
+			c.ScanType = ""
+		}
+		if nullable, ok := ct.Nullable(); ok {
+			c.Nullable = "no"
+			if nullable {
+				c.Nullable = "yes"
+			}
+		}
+		if length, ok := ct.Length(); ok {
+			c.Length = length
+		}
+		if precision, scale, ok := ct.DecimalSize(); ok {
+			c.Precision, c.Scale = precision, scale
+		}
+		result[i] = c
+	}
+
+	return result
+}
+
+// uuidValue is a UUID, sent as a 16-byte extension.
+type uuidValue [16]byte
+
+func (u uuidValue) MarshalMsgpack() ([]byte, error) {
+	return u[:], nil
+}
+
+func (u *uuidValue) UnmarshalMsgpack(data []byte) error {
+	if len(data) != len(u) {
+		return errors.Errorf("invalid UUID of %d bytes", len(data))
+	}
+	copy(u[:], data)
+	return nil
+}
+
+// String returns the canonical form of the UUID.
+func (u uuidValue) String() string {
+	s := hex.EncodeToString(u[:])
+	return s[:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
+
+// parseUUID parses a UUID in its canonical form, with or without hyphens
+// or braces.
+func parseUUID(s string) (uuidValue, bool) {
+	var u uuidValue
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "{"), "}")
+	if len(s) == 36 {
+		if s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+			return u, false
+		}
+		s = s[:8] + s[9:13] + s[14:18] + s[19:23] + s[24:]
+	}
+	if len(s) != 32 {
+		return u, false
+	}
+	if _, err := hex.Decode(u[:], []byte(s)); err != nil {
+		return u, false
+	}
+
+	return u, true
+}
+
+// intArray is an int[] array, sent as an extension holding a msgpack array of
+// integers.
+type intArray []int64
+
+func (a intArray) MarshalMsgpack() ([]byte, error) {
+	return msgpack.Marshal([]int64(a))
+}
+
+func (a *intArray) UnmarshalMsgpack(data []byte) error {
+	return msgpack.Unmarshal(data, (*[]int64)(a))
+}
+
+// textArray is a text[] array, sent as an extension holding a msgpack array
+// of strings.
+type textArray []string
+
+func (a textArray) MarshalMsgpack() ([]byte, error) {
+	return msgpack.Marshal([]string(a))
+}
+
+func (a *textArray) UnmarshalMsgpack(data []byte) error {
+	return msgpack.Unmarshal(data, (*[]string)(a))
+}
+
+// jsonValue is a JSON document, sent as an extension holding its text.
+type jsonValue []byte
+
+func (j jsonValue) MarshalMsgpack() ([]byte, error) {
+	return j, nil
+}
+
+func (j *jsonValue) UnmarshalMsgpack(data []byte) error {
+	*j = append((*j)[:0], data...)
+	return nil
+}
+
+// timestampValue is a timestamp with its offset, sent as an extension
+// holding a msgpack array of its Unix seconds, nanoseconds and offset in
+// seconds.
+type timestampValue struct {
+	time.Time
+}
+
+func (t timestampValue) MarshalMsgpack() ([]byte, error) {
+	_, offset := t.Zone()
+	return msgpack.Marshal([]int64{t.Unix(), int64(t.Nanosecond()), int64(offset)})
+}
+
+func (t *timestampValue) UnmarshalMsgpack(data []byte) error {
+	var parts []int64
+	if err := msgpack.Unmarshal(data, &parts); err != nil {
+		return err
+	}
+	if len(parts) != 3 {
+		return errors.Errorf("invalid timestamp of %d parts", len(parts))
+	}
+	t.Time = time.Unix(parts[0], parts[1]).In(time.FixedZone("", int(parts[2])))
+	return nil
+}
+
+// parseArray returns the elements of a one-dimensional PostgreSQL array
+// literal, such as {1,2} or {a,"b c"}. Arrays with NULL elements aren't
+// parsed, slices having no room for them.
+func parseArray(v interface{}) ([]string, bool) {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return nil, false
+	}
+	if len(s) < 2 || s[0] != '{' || s[len(s)-1] != '}' {
+		return nil, false
+	}
+	s = s[1 : len(s)-1]
+	elems := []string{}
+	if s == "" {
+		return elems, true
+	}
+
+	for {
+		var elem strings.Builder
+		if strings.HasPrefix(s, `"`) {
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				elem.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, false
+			}
+			s = s[i+1:]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			raw := strings.TrimSpace(s[:end])
+			if raw == "" || strings.EqualFold(raw, "NULL") || strings.ContainsAny(raw, `{}"`) {
+				return nil, false
+			}
+			elem.WriteString(raw)
+			s = s[end:]
+		}
+		elems = append(elems, elem.String())
+
+		if s == "" {
+			return elems, true
+		}
+		if s[0] != ',' {
+			return nil, false
+		}
+		s = s[1:]
+	}
+}
+
+// arrayLiteral returns the PostgreSQL literal of an array, with its elements
+// quoted when they are strings.
+func arrayLiteral(elems []string, quote bool) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, e := range elems {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		if !quote {
+			b.WriteString(e)
+			continue
+		}
+		b.WriteByte('"')
+		for _, r := range e {
+			if r == '"' || r == '\\' {
+				b.WriteByte('\\')
+			}
+			b.WriteRune(r)
+		}
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+
+	return b.String()
+}
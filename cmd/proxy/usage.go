@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultQuotaWindow is the quota window used when none is configured.
+const defaultQuotaWindow = time.Hour
+
+// requestStats describe the work done for a request.
+type requestStats struct {
+	rows     int64
+	bytes    int64
+	duration time.Duration
+}
+
+// usage counters of an account.
+type usage struct {
+	Queries     int64    `json:"queries"`
+	Rows        int64    `json:"rows"`
+	Bytes       int64    `json:"bytes"`
+	BackendTime duration `json:"backend_time"`
+}
+
+func (u *usage) add(stats requestStats) {
+	u.Queries++
+	u.Rows += stats.rows
+	u.Bytes += stats.bytes
+	u.BackendTime.Duration += stats.duration
+}
+
+// exceeds returns the first limit of the quota reached by the usage.
+func (u *usage) exceeds(q *quotaConfig) string {
+	switch {
+	case q.MaxQueries > 0 && u.Queries >= q.MaxQueries:
+		return "queries"
+	case q.MaxRows > 0 && u.Rows >= q.MaxRows:
+		return "rows"
+	case q.MaxBytes > 0 && u.Bytes >= q.MaxBytes:
+		return "bytes"
+	case q.MaxBackendTime.Duration > 0 && u.BackendTime.Duration >= q.MaxBackendTime.Duration:
+		return "backend time"
+	}
+
+	return ""
+}
+
+// usageTracker accounts the work done for each tenant (or identity without a
+// tenant) and enforces their quotas.
+type usageTracker struct {
+	mu       sync.Mutex
+	accounts map[string]*account
+}
+
+func newUsageTracker() *usageTracker {
+	return &usageTracker{accounts: map[string]*account{}}
+}
+
+// account returns the account with the given name, creating it if needed.
+func (t *usageTracker) account(name string, quota *quotaConfig) *account {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	a := t.accounts[name]
+	if a == nil {
+		a = &account{quota: quota, windowStart: time.Now()}
+		t.accounts[name] = a
+	}
+
+	return a
+}
+
+// accountReport is the usage of an account as reported by the admin API.
+type accountReport struct {
+	Total       usage        `json:"total"`
+	Window      usage        `json:"window"`
+	WindowStart time.Time    `json:"window_start"`
+	Quota       *quotaConfig `json:"quota,omitempty"`
+}
+
+// report returns the usage of every account.
+func (t *usageTracker) report() map[string]accountReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	report := make(map[string]accountReport, len(t.accounts))
+	for name, a := range t.accounts {
+		a.mu.Lock()
+		a.rollWindow(time.Now())
+		report[name] = accountReport{Total: a.total, Window: a.window, WindowStart: a.windowStart, Quota: a.quota}
+		a.mu.Unlock()
+	}
+
+	return report
+}
+
+// account is the usage of a tenant, or of an identity without a tenant.
+type account struct {
+	quota *quotaConfig
+
+	mu          sync.Mutex
+	total       usage
+	window      usage
+	windowStart time.Time
+}
+
+// admit checks the quota before running a request. Depending on the quota
+// action, requests over quota are rejected or held until the window resets.
+func (a *account) admit(ctx context.Context) error {
+	if a.quota == nil {
+		return nil
+	}
+
+	for {
+		a.mu.Lock()
+		now := time.Now()
+		a.rollWindow(now)
+		limit := a.window.exceeds(a.quota)
+		reset := a.windowStart.Add(a.quota.window())
+		a.mu.Unlock()
+
+		if limit == "" {
+			return nil
+		}
+		if a.quota.Action != "throttle" {
+			return errors.Errorf("quota exceeded (%s), retry after %s", limit, reset.Format(time.RFC3339))
+		}
+		select {
+		case <-time.After(reset.Sub(now)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// record the work done for a request.
+func (a *account) record(stats requestStats) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.rollWindow(time.Now())
+	a.total.add(stats)
+	a.window.add(stats)
+}
+
+// rollWindow starts a new quota window if the current one is over.
+func (a *account) rollWindow(now time.Time) {
+	window := defaultQuotaWindow
+	if a.quota != nil {
+		window = a.quota.window()
+	}
+
+	if now.Sub(a.windowStart) >= window {
+		elapsed := now.Sub(a.windowStart) / window * window
+		a.windowStart = a.windowStart.Add(elapsed)
+		a.window = usage{}
+	}
+}
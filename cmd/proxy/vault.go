@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// vaultClient is a minimal client for the Vault HTTP API, covering what the
+// proxy needs to fetch and renew backend credentials.
+type vaultClient struct {
+	addr   string
+	token  string
+	client *http.Client
+}
+
+// vaultSecret is the subset of a Vault secret response used by the proxy.
+type vaultSecret struct {
+	LeaseID       string                 `json:"lease_id"`
+	LeaseDuration int                    `json:"lease_duration"`
+	Renewable     bool                   `json:"renewable"`
+	Data          map[string]interface{} `json:"data"`
+}
+
+func newVaultClient(addr, token string) *vaultClient {
+	return &vaultClient{
+		addr:   strings.TrimRight(addr, "/"),
+		token:  token,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// read a secret, e.g. "database/creds/readonly" or "secret/data/sqlproxy".
+func (c *vaultClient) read(path string) (*vaultSecret, error) {
+	return c.do(http.MethodGet, "/v1/"+strings.TrimLeft(path, "/"), nil)
+}
+
+// renew a lease, asking for the given increment (in seconds).
+func (c *vaultClient) renew(leaseID string, increment int) (*vaultSecret, error) {
+	body := map[string]interface{}{"lease_id": leaseID, "increment": increment}
+	return c.do(http.MethodPut, "/v1/sys/leases/renew", body)
+}
+
+func (c *vaultClient) do(method, path string, body interface{}) (*vaultSecret, error) {
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequest(method, c.addr+path, &payload)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", c.token)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "vault request failed")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(resp.Body).Decode(&failure)
+		return nil, errors.Errorf("vault %s %s: %s %s", method, path, resp.Status, strings.Join(failure.Errors, ", "))
+	}
+
+	var secret vaultSecret
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return nil, errors.Wrap(err, "failed to decode vault response")
+	}
+
+	return &secret, nil
+}
+
+// fields returns the key/value pairs of the secret, unwrapping the KV v2
+// envelope when present.
+func (s *vaultSecret) fields() map[string]string {
+	data := s.Data
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+
+	fields := make(map[string]string, len(data))
+	for k, v := range data {
+		if v != nil {
+			fields[k] = fmt.Sprint(v)
+		}
+	}
+
+	return fields
+}
+
+// applyVaultSecret builds the backend DSN from a secret: a "dsn" field replaces
+// the DSN entirely, while "username" and "password" fields are set as the UID
+// and PWD attributes of the given DSN.
+func applyVaultSecret(dsn string, secret *vaultSecret) (string, error) {
+	fields := secret.fields()
+	if v, ok := fields["dsn"]; ok {
+		return v, nil
+	}
+
+	password, ok := fields["password"]
+	if !ok {
+		return "", errors.New("vault secret has neither a dsn nor a password field")
+	}
+	if dsn == "" {
+		return "", errors.New("a DSN is required when the vault secret only holds credentials")
+	}
+	if username, ok := fields["username"]; ok {
+		dsn = setDSNAttr(dsn, "UID", username)
+	}
+
+	return setDSNAttr(dsn, "PWD", password), nil
+}
+
+// watch keeps the secret alive: renewable leases are renewed, and when a lease
+// can no longer be renewed (max TTL reached, revoked...) fresh credentials are
+// read and handed to rotate. Secrets without a lease are never refreshed.
+func (c *vaultClient) watch(path string, secret *vaultSecret, rotate func(*vaultSecret) error) {
+	const retryDelay = 10 * time.Second
+
+	for secret.LeaseDuration > 0 {
+		// Act when two thirds of the lease have elapsed.
+		time.Sleep(time.Duration(secret.LeaseDuration) * time.Second * 2 / 3)
+
+		if secret.Renewable {
+			renewed, err := c.renew(secret.LeaseID, secret.LeaseDuration)
+			if err == nil {
+				// A shorter lease than requested means the max TTL is near:
+				// stop renewing and rotate before it expires.
+				secret.Renewable = renewed.Renewable && renewed.LeaseDuration >= secret.LeaseDuration
+				secret.LeaseDuration = renewed.LeaseDuration
+				continue
+			}
+			log.Println("Vault lease renewal error:", err)
+		}
+
+		fresh, err := c.read(path)
+		if err == nil {
+			err = rotate(fresh)
+		}
+		if err != nil {
+			log.Println("Vault credentials rotation error:", err)
+			secret = &vaultSecret{LeaseDuration: int(retryDelay / time.Second * 3 / 2)}
+			continue
+		}
+		log.Println("Vault credentials rotated")
+		secret = fresh
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/pkg/errors"
+)
+
+// version of the proxy, set at build time with
+// -ldflags "-X main.version=v1.2.3".
+var version = "dev"
+
+// Version request struct.
+type VersionRequest struct {
+	Op string `msgpack:"op"`
+}
+
+// Version response struct. BackendVersion is empty when the dialect has no
+// way to get it.
+type VersionResponse struct {
+	Version        string `msgpack:"version"`
+	Revision       string `msgpack:"revision"`
+	GoVersion      string `msgpack:"go_version"`
+	BackendDriver  string `msgpack:"backend_driver"`
+	BackendVersion string `msgpack:"backend_version"`
+	Error          string `msgpack:"error"`
+}
+
+// revision returns the VCS revision the proxy was built from, if known.
+func revision() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+
+	rev, modified := "", false
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			rev = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	if rev != "" && modified {
+		rev += "-dirty"
+	}
+
+	return rev
+}
+
+// versionString is printed by -version.
+func versionString() string {
+	s := "sqlproxy " + version
+	if rev := revision(); rev != "" {
+		s += " (" + rev + ")"
+	}
+
+	return fmt.Sprintf("%s %s %s/%s", s, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
+
+func handleVersion(sess *session) (requestStats, error) {
+	response := VersionResponse{
+		Version:   version,
+		Revision:  revision(),
+		GoVersion: runtime.Version(),
+	}
+
+	// The ODBC driver is named by the DRIVER attribute, unless the DSN
+	// refers to a data source.
+	response.BackendDriver = dsnAttr(sess.backend.DSN(), "DRIVER")
+	if response.BackendDriver == "" {
+		response.BackendDriver = "odbc"
+	}
+
+	if q := sess.backend.dialect.versionQuery; q != "" {
+		err := sess.backend.DB().QueryRowContext(sess.ctx, q).Scan(&response.BackendVersion)
+		if err != nil {
+			return requestStats{}, errors.Wrap(err, "failed to get the backend version")
+		}
+	}
+
+	return requestStats{bytes: int64(sendResponse(sess.conn, response))}, nil
+}
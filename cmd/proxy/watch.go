@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/arkan/sqlproxy/internal/charset"
+	"github.com/pkg/errors"
+)
+
+// defaultWatchInterval is how often watched queries are polled by default.
+const defaultWatchInterval = 5 * time.Second
+
+// watchConfig describes a query polled on a backend, such as "SELECT
+// max(updated_at) FROM orders", its channel being notified when its result
+// changes. The payload of the notification is the first row of the new
+// result, as a JSON object.
+type watchConfig struct {
+	Channel string `json:"channel"`
+	Query   string `json:"query"`
+	// Tenant whose backend runs the query and whose listeners are notified,
+	// the default backend when empty.
+	Tenant   string   `json:"tenant"`
+	Interval duration `json:"interval"`
+}
+
+func (w *watchConfig) validate(tenants map[string]*tenantConfig) error {
+	if w.Channel == "" {
+		return errors.New("channel is required")
+	}
+	if w.Query == "" {
+		return errors.New("query is required")
+	}
+	if w.Tenant != "" && tenants[w.Tenant] == nil {
+		return errors.Errorf("unknown tenant %s", w.Tenant)
+	}
+	if w.Interval.Duration < 0 {
+		return errors.New("interval must be positive")
+	}
+
+	return nil
+}
+
+func (w *watchConfig) interval() time.Duration {
+	if w.Interval.Duration == 0 {
+		return defaultWatchInterval
+	}
+	return w.Interval.Duration
+}
+
+// watcher polls the watched queries until it is closed.
+type watcher struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// startWatcher starts polling the watched queries of the configuration.
+func startWatcher(srv *server, watches []watchConfig) (*watcher, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &watcher{cancel: cancel}
+	for i := range watches {
+		cfg := &watches[i]
+		b := srv.backend
+		if cfg.Tenant != "" {
+			b = srv.tenants[cfg.Tenant]
+		}
+		if b == nil {
+			w.Close()
+			return nil, errors.Errorf("watch %s: there is no default DSN", cfg.Channel)
+		}
+
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			poll(ctx, srv.notify, cfg, b)
+		}()
+	}
+	log.Printf("Watching %d queries", len(watches))
+
+	return w, nil
+}
+
+// Close stops polling.
+func (w *watcher) Close() {
+	w.cancel()
+	w.wg.Wait()
+}
+
+// poll runs a watched query at its interval, notifying its channel when the
+// result differs from the previous one. The first result is the reference.
+func poll(ctx context.Context, hub *notifyHub, cfg *watchConfig, b *backend) {
+	ticker := time.NewTicker(cfg.interval())
+	defer ticker.Stop()
+
+	var last []byte
+	for {
+		queryCtx, cancel := context.WithTimeout(ctx, cfg.interval())
+		result, err := watchResult(queryCtx, b.DB(), b.charset, cfg.Query)
+		cancel()
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err != nil:
+			log.Printf("Watch %s error: %v", cfg.Channel, err)
+		case last != nil && !bytes.Equal(result, last):
+			n := hub.publish(cfg.Tenant, Notification{Channel: cfg.Channel, Payload: string(result)})
+			log.Printf("Watch %s changed, %d listeners notified", cfg.Channel, n)
+			fallthrough
+		default:
+			last = result
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// watchResult returns the first row of the result of a query as a JSON
+// object, null when there is none.
+func watchResult(ctx context.Context, db *sql.DB, cs *charset.Charset, query string) ([]byte, error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return []byte("null"), nil
+	}
+
+	row := map[string]interface{}{}
+	for i, v := range scanRow(rows, cols, &rowFormat{charset: cs}) {
+		if b, ok := v.([]byte); ok {
+			v = string(b)
+		}
+		row[cols[i]] = v
+	}
+
+	return json.Marshal(row)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/arkan/sqlproxy/internal/sqltext"
+	"github.com/pkg/errors"
+)
+
+// watchdogInterval is how often the watchdog looks for the statements over
+// their ceiling.
+const watchdogInterval = time.Second
+
+// watchdog tracks the statements running on the backends, listed by the
+// admin API, and kills those running longer than the hard ceiling of their
+// identity (-max-query-time, or max_query_time of its roles), whatever their
+// timeout, and logs them. The ODBC driver cancels the statements on the
+// backend once their context is.
+type watchdog struct {
+	mu      sync.Mutex
+	running map[*runningStatement]bool
+}
+
+// runningStatement is a statement running on the backend, with what the
+// audit record of its kill tells.
+type runningStatement struct {
+	client, user, tenant, application, traceID string
+
+	// Statement, and the pool or route it runs on.
+	query   string
+	backend string
+	start   time.Time
+	// Ceiling of the statement, none when 0, and its role, "" for
+	// -max-query-time.
+	limit time.Duration
+	role  string
+	kill  context.CancelCauseFunc
+}
+
+// killedError is the error of a statement killed by the watchdog.
+type killedError struct {
+	*codedError
+}
+
+func (e killedError) Unwrap() error { return e.codedError }
+
+func newWatchdog() *watchdog {
+	return &watchdog{running: map[*runningStatement]bool{}}
+}
+
+// run kills the statements over their ceiling until the process exits.
+func (w *watchdog) run() {
+	for range time.Tick(watchdogInterval) {
+		w.mu.Lock()
+		var over []*runningStatement
+		for s := range w.running {
+			if s.limit > 0 && time.Since(s.start) > s.limit {
+				over = append(over, s)
+				delete(w.running, s)
+			}
+		}
+		w.mu.Unlock()
+
+		for _, s := range over {
+			s.killed()
+		}
+	}
+}
+
+// killed cancels a statement and logs what was killed and why.
+func (s *runningStatement) killed() {
+	source := "-max-query-time"
+	if s.role != "" {
+		source = "role " + s.role
+	}
+	msg := fmt.Sprintf("statement killed after running longer than %s (%s)", s.limit, source)
+	s.kill(killedError{&codedError{msg: msg, code: errorCode{Code: "57014", Class: classStatementTimeout}}})
+
+	queriesKilled.add(1, s.tenant)
+	log.Printf("Killed a statement of %s (user %q, tenant %q, application %q, trace %q) running for %s, longer than %s (%s): %s",
+		s.client, s.user, s.tenant, s.application, s.traceID, time.Since(s.start).Round(time.Millisecond), s.limit, source, sqltext.Fingerprint(s.query))
+}
+
+// watchedContext returns the context of a statement running on the backend,
+// listed as running until it is cancelled, and also cancelled by the watchdog
+// once it runs longer than the ceiling of the identity.
+func (sess *session) watchedContext(query string) (context.Context, context.CancelFunc) {
+	return sess.watchedContextOf(sess.ctx, query)
+}
+
+// watchedContextOf is watchedContext for a statement whose context is a
+// child of another one than that of the session, such as a resumable cursor
+// outliving it.
+func (sess *session) watchedContextOf(parent context.Context, query string) (context.Context, context.CancelFunc) {
+	ctx, cancel := sess.timeoutContext(parent)
+	if sess.watchdog == nil {
+		return ctx, cancel
+	}
+	backend := sess.routedTo
+	switch {
+	case backend != "":
+	case sess.tenant != "":
+		backend = "tenant:" + sess.tenant
+	default:
+		backend = "default"
+	}
+
+	ctx, kill := context.WithCancelCause(ctx)
+	s := &runningStatement{
+		client:      sess.conn.RemoteAddr().String(),
+		user:        sess.user,
+		tenant:      sess.tenant,
+		application: sess.application,
+		traceID:     sess.traceID,
+		query:       query,
+		backend:     backend,
+		start:       time.Now(),
+		limit:       sess.maxQueryTime,
+		role:        sess.maxQueryTimeRole,
+		kill:        kill,
+	}
+	w := sess.watchdog
+	w.mu.Lock()
+	w.running[s] = true
+	w.mu.Unlock()
+
+	return ctx, func() {
+		w.mu.Lock()
+		delete(w.running, s)
+		w.mu.Unlock()
+		kill(nil)
+		cancel()
+	}
+}
+
+// RunningStatement is a statement running on a backend, as listed by the
+// admin API. Limit is its ceiling, 0s when it has none.
+type RunningStatement struct {
+	Fingerprint string    `json:"fingerprint"`
+	Client      string    `json:"client"`
+	User        string    `json:"user,omitempty"`
+	Tenant      string    `json:"tenant,omitempty"`
+	Application string    `json:"application,omitempty"`
+	TraceID     string    `json:"trace_id,omitempty"`
+	Backend     string    `json:"backend"`
+	Start       time.Time `json:"start"`
+	Elapsed     duration  `json:"elapsed"`
+	Limit       duration  `json:"limit"`
+}
+
+// list returns the statements running, the longest running first.
+func (w *watchdog) list() []RunningStatement {
+	w.mu.Lock()
+	running := make([]*runningStatement, 0, len(w.running))
+	for s := range w.running {
+		running = append(running, s)
+	}
+	w.mu.Unlock()
+
+	sort.Slice(running, func(i, j int) bool { return running[i].start.Before(running[j].start) })
+	statements := make([]RunningStatement, len(running))
+	for i, s := range running {
+		statements[i] = RunningStatement{
+			Fingerprint: sqltext.Fingerprint(s.query),
+			Client:      s.client,
+			User:        s.user,
+			Tenant:      s.tenant,
+			Application: s.application,
+			TraceID:     s.traceID,
+			Backend:     s.backend,
+			Start:       s.start,
+			Elapsed:     duration{time.Since(s.start).Round(time.Millisecond)},
+			Limit:       duration{s.limit},
+		}
+	}
+	return statements
+}
+
+// identityMaxQueryTime returns the ceiling of the statements of an identity:
+// the longest of those of its roles, and its role, or -max-query-time.
+func identityMaxQueryTime(identity *identityConfig, roles map[string]*roleConfig) (time.Duration, string) {
+	var limit time.Duration
+	var role string
+	for _, name := range identity.Roles {
+		if r := roles[name]; r != nil && r.MaxQueryTime.Duration > limit {
+			limit, role = r.MaxQueryTime.Duration, name
+		}
+	}
+	if limit == 0 {
+		return *maxQueryTime, ""
+	}
+
+	return limit, role
+}
+
+// printRunning prints the statements running on the proxy of an admin API
+// URL, the longest running first.
+func printRunning(w io.Writer, adminURL string) error {
+	resp, err := http.Get(strings.TrimSuffix(adminURL, "/") + "/running")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return errors.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var statements []RunningStatement
+	if err := json.NewDecoder(resp.Body).Decode(&statements); err != nil {
+		return errors.Wrap(err, "invalid response")
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ELAPSED\tCLIENT\tUSER\tTENANT\tAPPLICATION\tBACKEND\tSTATEMENT")
+	for _, s := range statements {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", s.Elapsed, s.Client, s.User, s.Tenant, s.Application, s.Backend, s.Fingerprint)
+	}
+	return tw.Flush()
+}
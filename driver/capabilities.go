@@ -0,0 +1,37 @@
+package driver
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Capabilities advertised by the proxy. Proxies older than a feature don't
+// advertise it, and those older than capabilities advertise none.
+const (
+	CapSchema           = "schema"
+	CapExplain          = "explain"
+	CapStoredQueries    = "stored_queries"
+	CapVersion          = "version"
+	CapPoolStats        = "pool_stats"
+	CapStreaming        = "streaming"
+	CapCursors          = "cursors"
+	CapResumableCursors = "resumable_cursors"
+	CapIdempotencyKeys  = "idempotency_keys"
+	CapMultiStatements  = "multi_statements"
+	CapExecReturning    = "exec_returning"
+	CapNotifications    = "notifications"
+	CapTransactions     = "transactions"
+	CapPing             = "ping"
+	CapDatabases        = "databases"
+)
+
+// Supports reports whether the proxy behind db advertised a capability.
+func Supports(ctx context.Context, db *sql.DB, capability string) (bool, error) {
+	var ok bool
+	err := withConn(ctx, db, func(c *Conn) error {
+		ok = c.Supports(capability)
+		return nil
+	})
+
+	return ok, err
+}
@@ -0,0 +1,106 @@
+package driver
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Column type struct, describing a result column as the backend driver of
+// the proxy does. Unknown values are empty or 0.
+type ColumnType struct {
+	DatabaseType string `msgpack:"database_type"`
+	ScanType     string `msgpack:"scan_type"`
+	Nullable     string `msgpack:"nullable"`
+	Length       int64  `msgpack:"length"`
+	Precision    int64  `msgpack:"precision"`
+	Scale        int64  `msgpack:"scale"`
+}
+
+// scanTypes are the Go types of the scan types of the proxy.
+var scanTypes = map[string]reflect.Type{
+	"int64":     reflect.TypeOf(int64(0)),
+	"float64":   reflect.TypeOf(float64(0)),
+	"bool":      reflect.TypeOf(false),
+	"string":    reflect.TypeOf(""),
+	"[]byte":    reflect.TypeOf([]byte(nil)),
+	"time.Time": reflect.TypeOf(time.Time{}),
+}
+
+// columnType returns what the backend tells of a column, if anything.
+func (r *Rows) columnType(index int) ColumnType {
+	if index < len(r.columnTypes) {
+		return r.columnTypes[index]
+	}
+	return ColumnType{}
+}
+
+// typed returns the type of a typed column, "" for the others.
+func (r *Rows) typed(index int) string {
+	if index < len(r.types) {
+		return r.types[index]
+	}
+	return ""
+}
+
+// ColumnTypeDatabaseTypeName returns the type of a typed column, such as
+// "UUID", or else that of the backend.
+func (r *Rows) ColumnTypeDatabaseTypeName(index int) string {
+	if typ := r.typed(index); typ != "" {
+		return strings.ToUpper(typ)
+	}
+	return strings.ToUpper(r.columnType(index).DatabaseType)
+}
+
+// ColumnTypeScanType returns the Go type of the values of a column,
+// interface{} when it is unknown.
+func (r *Rows) ColumnTypeScanType(index int) reflect.Type {
+	switch r.typed(index) {
+	case "uuid":
+		if r.format.uuidBytes {
+			return reflect.TypeOf([16]byte{})
+		}
+		return scanTypes["string"]
+	case "int[]":
+		return reflect.TypeOf([]int64(nil))
+	case "text[]":
+		return reflect.TypeOf([]string(nil))
+	case "json":
+		if r.format.rawJSON {
+			return reflect.TypeOf(json.RawMessage(nil))
+		}
+		return scanTypes["[]byte"]
+	}
+	if t := scanTypes[r.columnType(index).ScanType]; t != nil {
+		return t
+	}
+
+	return reflect.TypeOf((*interface{})(nil)).Elem()
+}
+
+// ColumnTypeNullable reports whether a column may be NULL, when the backend
+// tells it.
+func (r *Rows) ColumnTypeNullable(index int) (nullable, ok bool) {
+	switch r.columnType(index).Nullable {
+	case "yes":
+		return true, true
+	case "no":
+		return false, true
+	}
+	return false, false
+}
+
+// ColumnTypeLength returns the length of a variable-length column, when the
+// backend tells it.
+func (r *Rows) ColumnTypeLength(index int) (int64, bool) {
+	length := r.columnType(index).Length
+	return length, length > 0
+}
+
+// ColumnTypePrecisionScale returns the precision and scale of a decimal
+// column, when the backend tells them.
+func (r *Rows) ColumnTypePrecisionScale(index int) (precision, scale int64, ok bool) {
+	ct := r.columnType(index)
+	return ct.Precision, ct.Scale, ct.Precision > 0
+}
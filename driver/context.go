@@ -0,0 +1,146 @@
+package driver
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type traceIDKey struct{}
+
+// WithTraceID returns a context whose statements carry a trace ID. The proxy
+// logs it with the statement and echoes it in errors, to correlate a failure
+// across the application, proxy and backend logs.
+func WithTraceID(ctx context.Context, traceID string) context.Context {
+	return context.WithValue(ctx, traceIDKey{}, traceID)
+}
+
+// TraceID returns the trace ID of a context, or "".
+func TraceID(ctx context.Context) string {
+	traceID, _ := ctx.Value(traceIDKey{}).(string)
+	return traceID
+}
+
+type priorityKey struct{}
+
+// Priority classes of statements in the admission queue of the proxy.
+const (
+	PriorityInteractive = "interactive"
+	PriorityNormal      = "normal"
+	PriorityBatch       = "batch"
+)
+
+// WithPriority returns a context whose statements have a priority class,
+// instead of the default of the identity. Interactive statements are run
+// before queued normal ones, which run before batch ones.
+func WithPriority(ctx context.Context, priority string) context.Context {
+	return context.WithValue(ctx, priorityKey{}, priority)
+}
+
+// Priority returns the priority class of a context, or "".
+func Priority(ctx context.Context) string {
+	priority, _ := ctx.Value(priorityKey{}).(string)
+	return priority
+}
+
+type idempotencyKeyKey struct{}
+
+// WithIdempotencyKey returns a context whose exec statements carry an
+// idempotency key. The proxy remembers the result of a statement that
+// succeeded, and returns it when the statement is retried with the same key
+// instead of running it again. Keys must be unique per statement, e.g. a
+// UUID generated before the first attempt.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyKey{}, key)
+}
+
+// IdempotencyKey returns the idempotency key of a context, or "".
+func IdempotencyKey(ctx context.Context) string {
+	key, _ := ctx.Value(idempotencyKeyKey{}).(string)
+	return key
+}
+
+type databaseKey struct{}
+
+// WithDatabase returns a context whose statements select a database of the
+// configuration of the proxy, a named backend or a database of the server,
+// instead of the one of the DSN.
+func WithDatabase(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, databaseKey{}, name)
+}
+
+// Database returns the database of a context, or "".
+func Database(ctx context.Context) string {
+	name, _ := ctx.Value(databaseKey{}).(string)
+	return name
+}
+
+// Consistency holds the consistency token of the last write of a context,
+// the replication position of the primary once it ran, so that its reads
+// run on a replica caught up to it, or on the primary: the reads of a
+// request follow its writes, whichever connection or session they use.
+type Consistency struct {
+	mu    sync.Mutex
+	token string
+}
+
+// Token returns the consistency token, to be sent with another context,
+// e.g. to the next request of a user.
+func (c *Consistency) Token() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.token
+}
+
+// SetToken sets the consistency token, e.g. the one of the last request of
+// a user.
+func (c *Consistency) SetToken(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token = token
+}
+
+// update sets the token of a write, if any: the proxy only returns them for
+// backends with replicas.
+func (c *Consistency) update(token string) {
+	if c != nil && token != "" {
+		c.SetToken(token)
+	}
+}
+
+type consistencyKey struct{}
+
+// WithConsistency returns a context whose writes set the consistency token
+// of c, and whose queries send it.
+func WithConsistency(ctx context.Context, c *Consistency) context.Context {
+	return context.WithValue(ctx, consistencyKey{}, c)
+}
+
+// consistencyOf returns the consistency of a context, or nil.
+func consistencyOf(ctx context.Context) *Consistency {
+	c, _ := ctx.Value(consistencyKey{}).(*Consistency)
+	return c
+}
+
+// consistencyToken returns the consistency token queries of a context send.
+func consistencyToken(ctx context.Context) string {
+	if c := consistencyOf(ctx); c != nil {
+		return c.Token()
+	}
+	return ""
+}
+
+type statementTimeoutKey struct{}
+
+// WithStatementTimeout returns a context whose statements have a timeout,
+// enforced by the proxy. It may only lower the statement timeout of the
+// identity.
+func WithStatementTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	return context.WithValue(ctx, statementTimeoutKey{}, timeout)
+}
+
+// StatementTimeout returns the statement timeout of a context, or 0.
+func StatementTimeout(ctx context.Context) time.Duration {
+	timeout, _ := ctx.Value(statementTimeoutKey{}).(time.Duration)
+	return timeout
+}
@@ -0,0 +1,252 @@
+package driver
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+)
+
+// Open cursor request struct.
+type OpenCursorRequest struct {
+	Op        string        `msgpack:"op"`
+	Query     string        `msgpack:"query"`
+	Args      []interface{} `msgpack:"args"`
+	TraceID   string        `msgpack:"trace_id"`
+	Priority  string        `msgpack:"priority"`
+	Resumable bool          `msgpack:"resumable"`
+}
+
+// Cursor response struct.
+type CursorResponse struct {
+	Cursor  int64    `msgpack:"cursor"`
+	Columns []string `msgpack:"columns"`
+	Token   string   `msgpack:"token"`
+	TraceID string   `msgpack:"trace_id"`
+	Error   string   `msgpack:"error"`
+	errorCode
+}
+
+// Fetch request struct.
+type FetchRequest struct {
+	Op     string `msgpack:"op"`
+	Cursor int64  `msgpack:"cursor"`
+	Rows   int    `msgpack:"rows"`
+}
+
+// Close cursor request struct.
+type CloseCursorRequest struct {
+	Op     string `msgpack:"op"`
+	Cursor int64  `msgpack:"cursor"`
+}
+
+// Resume cursor request struct.
+type ResumeCursorRequest struct {
+	Op     string `msgpack:"op"`
+	Token  string `msgpack:"token"`
+	Offset int64  `msgpack:"offset"`
+}
+
+// Cursor is a result kept open by the proxy, fetched in pages. It holds a
+// connection of the pool until closed, other statements can run on it with
+// Conn in the meantime.
+type Cursor struct {
+	db      *sql.DB
+	conn    *sql.Conn
+	id      int64
+	columns []string
+	done    bool
+	// Token of a resumable cursor, and the rows fetched.
+	token  string
+	offset int64
+}
+
+// OpenCursor runs a query and keeps its result open on the backend.
+func OpenCursor(ctx context.Context, db *sql.DB, query string, args ...interface{}) (*Cursor, error) {
+	return openCursor(ctx, db, OpenCursorRequest{Op: "open_cursor", Query: query, Args: args})
+}
+
+// OpenResumableCursor opens a cursor that survives the loss of its
+// connection: Fetch resumes it on a new one, where it left off. The proxy
+// keeps it for a while after a disconnection. Resumable cursors can't be
+// opened after SET statements.
+func OpenResumableCursor(ctx context.Context, db *sql.DB, query string, args ...interface{}) (*Cursor, error) {
+	return openCursor(ctx, db, OpenCursorRequest{Op: "open_cursor", Query: query, Args: args, Resumable: true})
+}
+
+func openCursor(ctx context.Context, db *sql.DB, request OpenCursorRequest) (*Cursor, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	capability := CapCursors
+	if request.Resumable {
+		capability = CapResumableCursors
+	}
+	request.TraceID, request.Priority = TraceID(ctx), Priority(ctx)
+
+	cur := &Cursor{db: db, conn: conn}
+	err = cur.raw(ctx, func(c *Conn) error {
+		if !c.Supports(capability) {
+			return fmt.Errorf("sqlproxy: the proxy does not support %s", capability)
+		}
+		return cur.open(c, request)
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return cur, nil
+}
+
+// open sends an open or resume request.
+func (cur *Cursor) open(c *Conn, request interface{}) error {
+	err := c.send(request)
+	if err != nil {
+		return err
+	}
+
+	var response CursorResponse
+	err = readResponse(c, &response)
+	if err != nil {
+		return err
+	}
+	if response.Error != "" {
+		return responseError(response.Error, response.TraceID, response.errorCode)
+	}
+	cur.id, cur.columns, cur.token = response.Cursor, response.Columns, response.Token
+
+	return nil
+}
+
+// Columns returns the column names of the result.
+func (cur *Cursor) Columns() []string {
+	return cur.columns
+}
+
+// Conn returns the connection of the cursor.
+func (cur *Cursor) Conn() *sql.Conn {
+	return cur.conn
+}
+
+// Fetch returns the next n rows of the result, fewer at its end, and io.EOF
+// once all of them were fetched. The proxy caps n. A resumable cursor whose
+// connection failed is resumed on a new one.
+func (cur *Cursor) Fetch(ctx context.Context, n int) ([][]driver.Value, error) {
+	if cur.done {
+		return nil, io.EOF
+	}
+
+	data, err := cur.fetch(ctx, n)
+	if err == driver.ErrBadConn && cur.token != "" {
+		if err = cur.resume(ctx); err == nil {
+			data, err = cur.fetch(ctx, n)
+		}
+	}
+	if err == nil && len(data) == 0 && cur.done {
+		err = io.EOF
+	}
+
+	return data, err
+}
+
+func (cur *Cursor) fetch(ctx context.Context, n int) ([][]driver.Value, error) {
+	var data [][]driver.Value
+	err := cur.raw(ctx, func(c *Conn) error {
+		err := c.send(FetchRequest{Op: "fetch", Cursor: cur.id, Rows: n})
+		if err != nil {
+			return badConn(ctx)
+		}
+
+		response, err := readQueryResponse(c)
+		if err != nil {
+			return badConn(ctx)
+		}
+		cur.done = !response.More
+		if response.Error != "" {
+			return responseError(response.Error, response.TraceID, response.errorCode)
+		}
+		data = response.Data
+		c.formatRows(data)
+		cur.offset += int64(len(data))
+		return nil
+	})
+
+	return data, err
+}
+
+// resume the cursor on a new connection, the current one being discarded.
+func (cur *Cursor) resume(ctx context.Context) error {
+	cur.conn.Close()
+	conn, err := cur.db.Conn(ctx)
+	if err != nil {
+		cur.conn = nil
+		return err
+	}
+	cur.conn = conn
+
+	return cur.raw(ctx, func(c *Conn) error {
+		return cur.open(c, ResumeCursorRequest{Op: "resume_cursor", Token: cur.token, Offset: cur.offset})
+	})
+}
+
+// Close the cursor and release its connection.
+func (cur *Cursor) Close() error {
+	if cur.conn == nil {
+		return nil
+	}
+
+	var err error
+	if !cur.done || cur.token != "" {
+		// The proxy closes cursors fetched to the end by itself, but
+		// resumable ones.
+		err = cur.raw(context.Background(), func(c *Conn) error {
+			err := c.send(CloseCursorRequest{Op: "close_cursor", Cursor: cur.id})
+			if err != nil {
+				return err
+			}
+
+			var response CursorResponse
+			err = readResponse(c, &response)
+			if err != nil {
+				return err
+			}
+			if response.Error != "" {
+				return responseError(response.Error, response.TraceID, response.errorCode)
+			}
+			return nil
+		})
+		cur.done = true
+	}
+	if closeErr := cur.conn.Close(); err == nil {
+		err = closeErr
+	}
+	cur.conn = nil
+
+	return err
+}
+
+// badConn is the error of a fetch whose connection failed, that of its
+// context when it ended it.
+func badConn(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return driver.ErrBadConn
+}
+
+// raw runs fn with the connection of the cursor, its requests ending with the
+// context.
+func (cur *Cursor) raw(ctx context.Context, fn func(c *Conn) error) error {
+	return cur.conn.Raw(func(driverConn interface{}) error {
+		c, ok := driverConn.(*Conn)
+		if !ok {
+			return fmt.Errorf("sqlproxy: not a sqlproxy connection (%T)", driverConn)
+		}
+		defer c.watch(ctx)()
+		return fn(c)
+	})
+}
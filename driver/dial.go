@@ -0,0 +1,383 @@
+package driver
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DialFunc connects to an address, like net.Dialer.DialContext.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// dial connects to the proxy, through a SOCKS5 or HTTP CONNECT proxy when
+// configured. An address of the form "srv:<name>" is resolved with a DNS SRV
+// record on every connection, so that new connections follow the instances
+// of the proxy, whose targets are tried in order.
+func dial(ctx context.Context, cfg *Config) (net.Conn, error) {
+	name, ok := strings.CutPrefix(cfg.Addr, "srv:")
+	if !ok {
+		return dialTCP(ctx, cfg, cfg.Addr)
+	}
+
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, fmt.Errorf("sqlproxy: %w", err)
+	}
+
+	err = fmt.Errorf("sqlproxy: no proxy instance in %s", name)
+	for _, record := range records {
+		var conn net.Conn
+		target := net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port)))
+		if conn, err = dialTCP(ctx, cfg, target); err == nil {
+			return conn, nil
+		}
+	}
+
+	return nil, err
+}
+
+// dialTCP connects to an address, directly or through the configured proxy,
+// over TLS when configured.
+func dialTCP(ctx context.Context, cfg *Config, addr string) (net.Conn, error) {
+	conn, err := dialPlain(ctx, cfg, addr)
+	if err != nil || cfg.TLS == nil {
+		return conn, err
+	}
+	tlsConn, err := startTLS(ctx, conn, cfg, addr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+// dialPlain connects to an address, directly or through the configured
+// proxy.
+func dialPlain(ctx context.Context, cfg *Config, addr string) (net.Conn, error) {
+	dial := cfg.Dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	if cfg.Proxy == nil {
+		conn, err := dial(ctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := setSocketOptions(conn, cfg); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+
+	conn, err := dial(ctx, "tcp", cfg.Proxy.Host)
+	if err != nil {
+		return nil, fmt.Errorf("sqlproxy: dial %s: %w", cfg.Proxy.Redacted(), err)
+	}
+	if err := setSocketOptions(conn, cfg); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The handshake is part of the dial.
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	tunnel := conn
+	if cfg.Proxy.Scheme == "http" {
+		tunnel, err = connectHTTP(conn, cfg.Proxy, addr)
+	} else {
+		err = connectSOCKS5(conn, cfg.Proxy, addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("sqlproxy: %s: %w", cfg.Proxy.Redacted(), err)
+	}
+
+	return tunnel, nil
+}
+
+// setSocketOptions sets the TCP options of the configuration on a
+// connection, unless a custom dialer returned another kind of connection.
+func setSocketOptions(conn net.Conn, cfg *Config) error {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	err := tcp.SetKeepAliveConfig(net.KeepAliveConfig{
+		Enable:   cfg.KeepAlive >= 0,
+		Idle:     cfg.KeepAlive,
+		Interval: cfg.KeepAliveInterval,
+	})
+	if err == nil {
+		err = tcp.SetNoDelay(cfg.NoDelay)
+	}
+	if err == nil && cfg.ReadBuffer > 0 {
+		err = tcp.SetReadBuffer(cfg.ReadBuffer)
+	}
+	if err == nil && cfg.WriteBuffer > 0 {
+		err = tcp.SetWriteBuffer(cfg.WriteBuffer)
+	}
+	if err != nil {
+		return fmt.Errorf("sqlproxy: socket options: %w", err)
+	}
+
+	return nil
+}
+
+// parseProxyURL parses the URL of a SOCKS5 (socks5://) or HTTP CONNECT
+// (http://) proxy, with optional credentials.
+func parseProxyURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q (socks5 or http)", u.Scheme)
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("missing port in proxy %s", u.Redacted())
+	}
+
+	return u, nil
+}
+
+// connectSOCKS5 asks a SOCKS5 proxy (RFC 1928) to connect to an address,
+// resolved by the proxy, authenticating with a user and password (RFC 1929)
+// when given.
+func connectSOCKS5(conn net.Conn, proxy *url.URL, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+	if len(host) > 255 {
+		return fmt.Errorf("host name %q is too long", host)
+	}
+
+	method := byte(0x00)
+	if proxy.User != nil {
+		method = 0x02
+	}
+	if _, err := conn.Write([]byte{0x05, 1, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 || reply[1] != method {
+		return fmt.Errorf("SOCKS5 authentication method refused")
+	}
+
+	if method == 0x02 {
+		user := proxy.User.Username()
+		password, _ := proxy.User.Password()
+		if len(user) > 255 || len(password) > 255 {
+			return fmt.Errorf("SOCKS5 credentials are too long")
+		}
+		auth := []byte{0x01, byte(len(user))}
+		auth = append(auth, user...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return fmt.Errorf("SOCKS5 authentication failed")
+		}
+	}
+
+	request := []byte{0x05, 0x01, 0x00, 0x03, byte(len(host))}
+	request = append(request, host...)
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	// Version, reply, reserved and address type, then the bound address.
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0x00 {
+		return fmt.Errorf("SOCKS5 connect to %s failed (reply %d)", addr, header[1])
+	}
+	var size int
+	switch header[3] {
+	case 0x01:
+		size = net.IPv4len
+	case 0x04:
+		size = net.IPv6len
+	case 0x03:
+		if _, err := io.ReadFull(conn, header[:1]); err != nil {
+			return err
+		}
+		size = int(header[0])
+	default:
+		return fmt.Errorf("invalid SOCKS5 address type %d", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, size+2))
+
+	return err
+}
+
+// connectHTTP asks an HTTP proxy to open a tunnel to an address with the
+// CONNECT method, authenticating with basic credentials when given.
+func connectHTTP(conn net.Conn, proxy *url.URL, addr string) (net.Conn, error) {
+	request := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		request += "Proxy-Authorization: Basic " + credentials + "\r\n"
+	}
+	if _, err := io.WriteString(conn, request+"\r\n"); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CONNECT to %s failed: %s", addr, resp.Status)
+	}
+	// The proxy may have sent tunneled bytes along its response.
+	if r.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: r}, nil
+	}
+
+	return conn, nil
+}
+
+// bufferedConn is a connection whose first bytes were read ahead.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// deadlineConn sets the read and write timeouts before every read and write
+// of a connection, ending them at the deadline of the context of the request
+// being answered, and records its first error.
+type deadlineConn struct {
+	net.Conn
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	err          error
+
+	mu  sync.Mutex
+	ctx context.Context
+}
+
+// watch ends the reads and writes of the connection at the deadline of a
+// context, or once it is cancelled, failing with its error: the connection
+// is then discarded, the response being left unread. The function returned
+// stops watching once the request is answered.
+func (c *deadlineConn) watch(ctx context.Context) func() {
+	if ctx == nil || ctx.Done() == nil {
+		return func() {}
+	}
+	c.mu.Lock()
+	c.ctx = ctx
+	c.mu.Unlock()
+
+	stop := context.AfterFunc(ctx, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.ctx == ctx {
+			c.Conn.SetDeadline(time.Now())
+		}
+	})
+	return func() {
+		stop()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.ctx = nil
+		c.Conn.SetDeadline(time.Time{})
+	}
+}
+
+// setDeadline sets the deadline of a read or write, the earliest of its
+// timeout and of the deadline of the watched context, and returns the
+// context.
+func (c *deadlineConn) setDeadline(set func(time.Time) error, timeout time.Duration) context.Context {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if c.ctx != nil {
+		if d, ok := c.ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+			deadline = d
+		}
+		if c.ctx.Err() != nil {
+			deadline = time.Now()
+		}
+	}
+	if !deadline.IsZero() {
+		set(deadline)
+	}
+
+	return c.ctx
+}
+
+// failed records the first error of the connection, that of the watched
+// context when it ended the read or write.
+func (c *deadlineConn) failed(ctx context.Context, err error) error {
+	if ctx != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if c.err == nil {
+		c.err = err
+	}
+
+	return err
+}
+
+func (c *deadlineConn) Read(p []byte) (int, error) {
+	ctx := c.setDeadline(c.Conn.SetReadDeadline, c.readTimeout)
+	n, err := c.Conn.Read(p)
+	if err != nil {
+		err = c.failed(ctx, err)
+	}
+
+	return n, err
+}
+
+func (c *deadlineConn) Write(p []byte) (int, error) {
+	ctx := c.setDeadline(c.Conn.SetWriteDeadline, c.writeTimeout)
+	n, err := c.Conn.Write(p)
+	if err != nil {
+		err = c.failed(ctx, err)
+	}
+
+	return n, err
+}
@@ -1,13 +1,17 @@
 package driver
 
 import (
+	"context"
 	"database/sql"
 	"database/sql/driver"
-	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
+	"reflect"
+	"time"
 
+	"github.com/arkan/sqlproxy/internal/frame"
+	"github.com/arkan/sqlproxy/internal/sqltext"
 	"github.com/vmihailenco/msgpack"
 )
 
@@ -21,21 +25,216 @@ type Driver struct{}
 
 // Open a connection to the proxy.
 func (d *Driver) Open(dsn string) (driver.Conn, error) {
-	conn, err := net.Dial("tcp", dsn)
+	cfg, err := ParseDSN(dsn)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Conn{conn: conn}, nil
+	return open(context.Background(), cfg)
 }
 
-// Connection implementation.
+// OpenConnector parses a DSN once for every connection of a sql.DB.
+func (d *Driver) OpenConnector(dsn string) (driver.Connector, error) {
+	return NewConnector(dsn, nil)
+}
+
+// Connector opens connections with a configuration, see sql.OpenDB.
+type Connector struct {
+	cfg *Config
+}
+
+// NewConnector returns a connector for a DSN, whose connections are dialed
+// with dial when not nil, e.g. over an SSH tunnel or an in-memory pipe:
+//
+//	connector, err := driver.NewConnector("localhost:8888", sshClient.DialContext)
+//	db := sql.OpenDB(connector)
+func NewConnector(dsn string, dial DialFunc) (*Connector, error) {
+	cfg, err := ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Dial = dial
+
+	return &Connector{cfg: cfg}, nil
+}
+
+// Connect opens a connection to the proxy.
+func (c *Connector) Connect(ctx context.Context) (driver.Conn, error) {
+	return open(ctx, c.cfg)
+}
+
+// Driver returns the sqlproxy driver.
+func (c *Connector) Driver() driver.Driver {
+	return &Driver{}
+}
+
+// open dials the proxy and says hello.
+func open(ctx context.Context, cfg *Config) (driver.Conn, error) {
+	dialCtx := ctx
+	if cfg.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, cfg.DialTimeout)
+		defer cancel()
+	}
+	netConn, err := dial(dialCtx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	conn := &deadlineConn{Conn: netConn, readTimeout: cfg.ReadTimeout, writeTimeout: cfg.WriteTimeout}
+
+	c := &Conn{conn: conn, cfg: cfg}
+	if err := c.hello(cfg); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Connection implementation. database/sql runs a statement of a
+// transaction or a sql.Conn while another one's rows are iterated: stream is
+// the streamed result still being received, read to its end, up to
+// MaxBufferBytes, before another request is sent.
 type Conn struct {
-	conn net.Conn
+	conn         net.Conn
+	cfg          *Config
+	capabilities map[string]bool
+	stream       *Rows
+
+	// Operation and query of the last request, telling which one failed.
+	op, query string
+}
+
+// hello authenticates the connection and gets the proxy capabilities.
+func (c *Conn) hello(cfg *Config) error {
+	request := HelloRequest{
+		Op:          "hello",
+		User:        cfg.User,
+		Password:    cfg.Password,
+		Application: cfg.Application,
+		Version:     libraryVersion(),
+		Tags:        cfg.Tags,
+		Types:       decodedTypes,
+	}
+	if cfg.SigningKey != "" {
+		nonce, err := frame.Nonce()
+		if err != nil {
+			return err
+		}
+		request.Signing, request.Nonce = frame.Algorithms, nonce
+	}
+	if cfg.Compression != "" {
+		request.Compression, request.CompressMin = []string{cfg.Compression}, cfg.CompressMin
+	}
+	c.op, c.query = requestOp(request)
+	data, err := msgpack.Marshal(request)
+	if err != nil {
+		return err
+	}
+	if cfg.SigningKey != "" {
+		// Before the algorithm is negotiated, with the key alone.
+		data = frame.SealHello([]byte(cfg.SigningKey), request.Nonce, data)
+	}
+	if _, err := c.conn.Write(frame.Encode(data)); err != nil {
+		return c.opError(err)
+	}
+
+	var response HelloResponse
+	if cfg.SigningKey != "" {
+		err = c.signedHello(cfg, request.Nonce, &response)
+	} else {
+		err = readResponse(c, &response)
+	}
+	if err != nil {
+		return err
+	}
+	if response.Error != "" {
+		return fmt.Errorf("sqlproxy: %s", response.Error)
+	}
+	// Older proxies don't compress the frames that follow.
+	if response.Compression != "" {
+		compressor, err := frame.NewCompressor(response.Compression, cfg.CompressMin)
+		if err != nil {
+			return fmt.Errorf("sqlproxy: %w", err)
+		}
+		conn := c.conn.(*deadlineConn)
+		conn.Conn = frame.NewCompressedConn(conn.Conn, compressor)
+	}
+
+	c.capabilities = map[string]bool{}
+	for _, name := range response.Capabilities {
+		c.capabilities[name] = true
+	}
+
+	return nil
+}
+
+// signedHello reads the hello response, signed with the algorithm and nonce
+// it names, and signs the frames that follow.
+func (c *Conn) signedHello(cfg *Config, nonce []byte, response *HelloResponse) error {
+	data, err := frame.Read(c.conn, 0)
+	if err != nil {
+		return c.opError(err)
+	}
+	value, _, err := frame.Split(data)
+	if err != nil {
+		return c.opError(err)
+	}
+	if err := frame.Unmarshal(value, response); err != nil {
+		return c.opError(err)
+	}
+	if response.Error != "" {
+		return nil
+	}
+	if response.Signing == "" {
+		return fmt.Errorf("sqlproxy: the proxy does not sign frames")
+	}
+
+	signer, err := frame.NewSigner(response.Signing, []byte(cfg.SigningKey), nonce, response.Nonce, true)
+	if err != nil {
+		return fmt.Errorf("sqlproxy: %w", err)
+	}
+	if _, err := signer.Open(data); err != nil {
+		return c.opError(err)
+	}
+	// Frames are signed under the timeouts of the connection.
+	conn := c.conn.(*deadlineConn)
+	conn.Conn = frame.NewSignedConn(conn.Conn, signer)
+
+	return nil
+}
+
+// IsValid reports whether the connection can be reused: after an I/O error
+// (a timeout included), responses may be out of sync with requests.
+func (c *Conn) IsValid() bool {
+	if conn, ok := c.conn.(*deadlineConn); ok {
+		return conn.err == nil
+	}
+	return true
+}
+
+// watch ends the request being answered when its context is done, see
+// deadlineConn.watch.
+func (c *Conn) watch(ctx context.Context) func() {
+	if conn, ok := c.conn.(*deadlineConn); ok {
+		return conn.watch(ctx)
+	}
+	return func() {}
+}
+
+// Supports reports whether the proxy advertised a capability.
+func (c *Conn) Supports(capability string) bool {
+	return c.capabilities[capability]
 }
 
 func (c *Conn) Prepare(query string) (driver.Stmt, error) {
-	return &Stmt{conn: c.conn, query: query}, nil
+	stmt := &Stmt{conn: c, query: query, database: c.cfg.Database, databases: c.Supports(CapDatabases), idempotency: c.Supports(CapIdempotencyKeys), format: c.valueFormat(), hooks: c.cfg.Hooks}
+	// Older proxies send results at once.
+	if c.cfg.Stream && c.Supports(CapStreaming) {
+		stmt.stream = c.cfg
+	}
+
+	return stmt, nil
 }
 
 // Close the connection.
@@ -43,14 +242,71 @@ func (c *Conn) Close() error {
 	return c.conn.Close()
 }
 
-func (c *Conn) Begin() (driver.Tx, error) {
-	return nil, fmt.Errorf("transactions are not supported")
+// send sends a request, once the rest of the streamed result is received.
+func (c *Conn) send(request interface{}) error {
+	if c.stream != nil {
+		if err := c.stream.buffer(); err != nil {
+			return err
+		}
+	}
+	c.op, c.query = requestOp(request)
+	return c.write(request)
+}
+
+// write sends a request, part of the last one sent.
+func (c *Conn) write(request interface{}) error {
+	return c.opError(sendRequest(c.conn, request))
+}
+
+// opError returns the error of the last request, nil if err is.
+func (c *Conn) opError(err error) error {
+	if err == nil {
+		return nil
+	}
+	e := &OpError{Op: c.op, Addr: c.cfg.Addr, Err: err}
+	if c.query != "" {
+		e.Fingerprint = sqltext.Fingerprint(c.query)
+	}
+	return e
+}
+
+// requestOp returns the operation of a request and its query, if any.
+func requestOp(request interface{}) (op, query string) {
+	switch r := request.(type) {
+	case QueryRequest:
+		return "query", r.Query
+	case ExecRequest:
+		return "exec", r.Query
+	case OpenCursorRequest:
+		return r.Op, r.Query
+	case ExplainRequest:
+		return r.Op, r.Query
+	case MultiRequest:
+		return r.Op, r.Query
+	}
+	if v := reflect.ValueOf(request); v.Kind() == reflect.Struct {
+		if op := v.FieldByName("Op"); op.Kind() == reflect.String {
+			return op.String(), ""
+		}
+	}
+	return "request", ""
 }
 
 // Statement implementation
 type Stmt struct {
-	conn  net.Conn
+	conn  *Conn
 	query string
+	// stream holds the window of streamed results, nil to get them at once.
+	stream *Config
+	// database is the one of the DSN, and databases is set when the proxy
+	// supports selecting them.
+	database  string
+	databases bool
+	// idempotency is set when the proxy supports idempotency keys.
+	idempotency bool
+	// format of the tagged values of results.
+	format valueFormat
+	hooks  *Hooks
 }
 
 // Close the statement.
@@ -63,50 +319,191 @@ func (s *Stmt) NumInput() int {
 	return -1 // Variable number of parameters
 }
 
+// Hello request struct, sent before any other request to authenticate and
+// describe the client.
+type HelloRequest struct {
+	Op          string            `msgpack:"op"`
+	User        string            `msgpack:"user"`
+	Password    string            `msgpack:"password"`
+	Application string            `msgpack:"application"`
+	Version     string            `msgpack:"version"`
+	Tags        map[string]string `msgpack:"tags"`
+	Types       []string          `msgpack:"types"`
+	Signing     []string          `msgpack:"signing"`
+	Nonce       []byte            `msgpack:"nonce"`
+	Compression []string          `msgpack:"compression"`
+	CompressMin int               `msgpack:"compress_min"`
+}
+
+// Hello response struct.
+type HelloResponse struct {
+	Capabilities []string `msgpack:"capabilities"`
+	Signing      string   `msgpack:"signing"`
+	Nonce        []byte   `msgpack:"nonce"`
+	Compression  string   `msgpack:"compression"`
+	Error        string   `msgpack:"error"`
+}
+
 // Query request/response structs
 type QueryRequest struct {
-	Query string         `msgpack:"query"`
-	Args  []driver.Value `msgpack:"args"`
+	Query       string         `msgpack:"query"`
+	Args        []driver.Value `msgpack:"args"`
+	Database    string         `msgpack:"database"`
+	Consistency string         `msgpack:"consistency_token"`
+	TraceID     string         `msgpack:"trace_id"`
+	Priority    string         `msgpack:"priority"`
+	Timeout     int64          `msgpack:"timeout_ms"`
+	Stream      bool           `msgpack:"stream"`
+	WindowRows  int            `msgpack:"window_rows"`
+	WindowBytes int            `msgpack:"window_bytes"`
 }
 
-// Query response struct.
+// Query response struct. More is set on the responses of a streamed result
+// but the last one.
 type QueryResponse struct {
-	Columns []string         `msgpack:"columns"`
-	Data    [][]driver.Value `msgpack:"data"`
+	Columns     []string         `msgpack:"columns"`
+	Types       []string         `msgpack:"types"`
+	ColumnTypes []ColumnType     `msgpack:"column_types"`
+	Data        [][]driver.Value `msgpack:"data"`
+	More        bool             `msgpack:"more"`
+	TraceID     string           `msgpack:"trace_id"`
+	Error       string           `msgpack:"error"`
+	errorCode
 }
 
 // Exec request/response structs
 type ExecRequest struct {
-	Query string         `msgpack:"query"`
-	Args  []driver.Value `msgpack:"args"`
+	Query          string         `msgpack:"query"`
+	Args           []driver.Value `msgpack:"args"`
+	Database       string         `msgpack:"database"`
+	TraceID        string         `msgpack:"trace_id"`
+	Priority       string         `msgpack:"priority"`
+	Timeout        int64          `msgpack:"timeout_ms"`
+	IdempotencyKey string         `msgpack:"idempotency_key"`
+	Returning      bool           `msgpack:"returning"`
 }
 
-// Exec response struct.
+// Exec response struct, with the rows returned by the statement, if any.
 type ExecResponse struct {
-	RowsAffected int64 `msgpack:"rows_affected"`
-	LastInsertID int64 `msgpack:"last_insert_id"`
+	RowsAffected int64            `msgpack:"rows_affected"`
+	LastInsertID int64            `msgpack:"last_insert_id"`
+	Columns      []string         `msgpack:"columns"`
+	Data         [][]driver.Value `msgpack:"data"`
+	Consistency  string           `msgpack:"consistency_token"`
+	TraceID      string           `msgpack:"trace_id"`
+	Error        string           `msgpack:"error"`
+	errorCode
 }
 
 // Query execution.
 func (s *Stmt) Query(args []driver.Value) (driver.Rows, error) {
-	request := QueryRequest{Query: s.query, Args: args}
-	err := sendRequest(s.conn, request)
+	database, err := s.databaseOf(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	rows, err := s.runQuery(QueryRequest{Query: s.query, Args: args, Database: database})
+	s.hooks.after(context.Background(), false, QueryEvent{Query: s.query, Args: len(args), Err: err}, start)
+	return rows, err
+}
+
+// QueryContext executes a query with the trace ID of the context.
+func (s *Stmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	values, err := namedValues(args)
+	if err != nil {
+		return nil, err
+	}
+	database, err := s.databaseOf(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	stop := s.conn.watch(ctx)
+	rows, err := s.runQuery(QueryRequest{Query: s.query, Args: values, Database: database, Consistency: consistencyToken(ctx), TraceID: TraceID(ctx), Priority: Priority(ctx), Timeout: StatementTimeout(ctx).Milliseconds()})
+	stop()
+	if r, ok := rows.(*Rows); ok {
+		r.ctx = ctx
+	}
+	s.hooks.after(ctx, false, QueryEvent{Query: s.query, Args: len(values), Err: err}, start)
+	return rows, err
+}
+
+func (s *Stmt) runQuery(request QueryRequest) (driver.Rows, error) {
+	if s.stream != nil {
+		request.Stream = true
+		request.WindowRows = s.stream.WindowRows
+		request.WindowBytes = s.stream.WindowBytes
+	}
+	err := s.conn.send(request)
 	if err != nil {
 		return nil, err
 	}
 
-	response, err := readQueryResponse(s.conn)
+	var response QueryResponse
+	size, err := readResponseSize(s.conn, &response)
 	if err != nil {
 		return nil, err
 	}
+	if response.Error != "" {
+		return nil, responseError(response.Error, response.TraceID, response.errorCode)
+	}
+
+	rows := &Rows{conn: s.conn, columns: response.Columns, types: response.Types, columnTypes: response.ColumnTypes, data: response.Data, more: response.More, size: size, rows: len(response.Data), format: s.format}
+	if rows.more {
+		s.conn.stream = rows
+	}
 
-	return &Rows{columns: response.Columns, data: response.Data}, nil
+	return rows, nil
 }
 
 // Exec execution.
 func (s *Stmt) Exec(args []driver.Value) (driver.Result, error) {
-	request := ExecRequest{Query: s.query, Args: args}
-	err := sendRequest(s.conn, request)
+	database, err := s.databaseOf(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	result, err := s.runExec(ExecRequest{Query: s.query, Args: args, Database: database})
+	s.hooks.after(context.Background(), true, execEvent(s.query, len(args), result, err), start)
+	return result, err
+}
+
+// ExecContext executes a statement with the trace ID and idempotency key of
+// the context, setting the token of its consistency.
+func (s *Stmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	values, err := namedValues(args)
+	if err != nil {
+		return nil, err
+	}
+	key := IdempotencyKey(ctx)
+	// Older proxies would ignore the key, and run retries again.
+	if key != "" && !s.idempotency {
+		return nil, fmt.Errorf("sqlproxy: the proxy does not support idempotency keys")
+	}
+	database, err := s.databaseOf(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	stop := s.conn.watch(ctx)
+	result, err := s.runExec(ExecRequest{Query: s.query, Args: values, Database: database, TraceID: TraceID(ctx), Priority: Priority(ctx), Timeout: StatementTimeout(ctx).Milliseconds(), IdempotencyKey: key})
+	stop()
+	if r, ok := result.(*Result); ok {
+		consistencyOf(ctx).update(r.consistency)
+	}
+	s.hooks.after(ctx, true, execEvent(s.query, len(values), result, err), start)
+	return result, err
+}
+
+func (s *Stmt) runExec(request ExecRequest) (driver.Result, error) {
+	// Statements returning rows then count them as affected, instead of
+	// getting a query response.
+	request.Returning = true
+	err := s.conn.send(request)
 	if err != nil {
 		return nil, err
 	}
@@ -115,15 +512,66 @@ func (s *Stmt) Exec(args []driver.Value) (driver.Result, error) {
 	if err != nil {
 		return nil, err
 	}
+	if response.Error != "" {
+		return nil, responseError(response.Error, response.TraceID, response.errorCode)
+	}
+
+	return &Result{lastInsertID: response.LastInsertID, rowsAffected: response.RowsAffected, consistency: response.Consistency}, nil
+}
+
+// databaseOf returns the database the statements of a context select, the
+// one of the DSN by default.
+func (s *Stmt) databaseOf(ctx context.Context) (string, error) {
+	database := Database(ctx)
+	if database == "" {
+		database = s.database
+	}
+	// Older proxies would run the statements on their default database.
+	if database != "" && !s.databases {
+		return "", fmt.Errorf("sqlproxy: the proxy does not support %s", CapDatabases)
+	}
 
-	return &Result{lastInsertID: response.LastInsertID, rowsAffected: response.RowsAffected}, nil
+	return database, nil
+}
+
+// namedValues converts arguments to positional values: the proxy only
+// supports ? placeholders.
+func namedValues(args []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, fmt.Errorf("sqlproxy: named parameters are not supported")
+		}
+		values[i] = arg.Value
+	}
+
+	return values, nil
 }
 
 // Rows implementation
 type Rows struct {
+	conn    *Conn
 	columns []string
-	data    [][]driver.Value
-	index   int
+	// Types of the typed columns, if any, and what the backend tells of the
+	// columns, unless the proxy is older.
+	types       []string
+	columnTypes []ColumnType
+	data        [][]driver.Value
+	index       int
+	// more is set while a streamed result has responses to come, and size and
+	// rows are the size and the rows of the last one received, acknowledged
+	// with the next fetch. buffered is the size of the responses buffered to
+	// run other requests, not yet iterated.
+	more     bool
+	size     int
+	rows     int
+	buffered int
+	format   valueFormat
+	// ctx is the context of the query, ending the fetches of a streamed
+	// result.
+	ctx context.Context
+	// err ends the rows of a buffered result once they are iterated.
+	err error
 }
 
 // Columns.
@@ -133,23 +581,125 @@ func (r *Rows) Columns() []string {
 
 // Next row.
 func (r *Rows) Next(dest []driver.Value) error {
-	if r.index >= len(r.data) {
-		return io.EOF
+	for r.index >= len(r.data) {
+		if r.err != nil {
+			return r.err
+		}
+		if !r.more {
+			return io.EOF
+		}
+		r.buffered = 0
+		if err := r.fetch(); err != nil {
+			return err
+		}
 	}
 	copy(dest, r.data[r.index])
+	r.format.row(dest)
 	r.index++
 	return nil
 }
 
-// Close the rows.
+// fetch the next response of a streamed result, acknowledging the current
+// one so that the proxy sends more.
+func (r *Rows) fetch() error {
+	defer r.conn.watch(r.ctx)()
+	err := r.conn.write(AckRequest{Op: "ack", Rows: r.rows, Bytes: r.size})
+	if err != nil {
+		r.end()
+		return err
+	}
+
+	var response QueryResponse
+	r.size, err = readResponseSize(r.conn, &response)
+	if err != nil {
+		r.end()
+		return err
+	}
+	r.data, r.index, r.more = response.Data, 0, response.More
+	r.rows = len(r.data)
+	if !r.more {
+		r.end()
+	}
+	if response.Error != "" {
+		return responseError(response.Error, response.TraceID, response.errorCode)
+	}
+
+	return nil
+}
+
+// Close the rows. A streamed result is stopped, and its remaining responses
+// skipped.
 func (r *Rows) Close() error {
+	if !r.more {
+		return nil
+	}
+
+	r.end()
+	err := r.conn.write(AckRequest{Op: "close_stream"})
+	for more := err == nil; more; {
+		var response QueryResponse
+		if _, err = readResponseSize(r.conn, &response); err != nil {
+			break
+		}
+		more = response.More
+	}
+
+	return err
+}
+
+// defaultMaxBufferBytes is the default of Config.MaxBufferBytes.
+const defaultMaxBufferBytes = 64 << 20
+
+// buffer receives the rest of a streamed result, acknowledging its
+// responses as they come, so that the connection can run other requests
+// while its rows are iterated. It fails, leaving the rest of the result to
+// stream, once over MaxBufferBytes bytes are buffered.
+func (r *Rows) buffer() error {
+	limit := r.conn.cfg.MaxBufferBytes
+	if limit == 0 {
+		limit = defaultMaxBufferBytes
+	}
+
+	// The rows iterated since the last call free their share of the bytes.
+	if len(r.data) > 0 {
+		r.buffered = r.buffered * (len(r.data) - r.index) / len(r.data)
+	}
+	data := r.data[r.index:]
+	defer func() { r.data, r.index = data, 0 }()
+	for r.more {
+		if r.buffered >= limit {
+			return fmt.Errorf("sqlproxy: can't run another request while the rows of a streamed result are iterated: over %d bytes of them would be buffered (max_buffer_bytes)", limit)
+		}
+		if r.err = r.fetch(); r.err != nil {
+			break
+		}
+		r.buffered += r.size
+		data = append(data, r.data...)
+	}
+
 	return nil
 }
 
+// end marks a streamed result as received.
+func (r *Rows) end() {
+	r.more = false
+	if r.conn.stream == r {
+		r.conn.stream = nil
+	}
+}
+
+// Ack request struct, acknowledging the responses of a streamed result.
+type AckRequest struct {
+	Op    string `msgpack:"op"`
+	Rows  int    `msgpack:"rows"`
+	Bytes int    `msgpack:"bytes"`
+}
+
 // Result implementation.
 type Result struct {
 	lastInsertID int64
 	rowsAffected int64
+	consistency  string
 }
 
 func (r *Result) LastInsertId() (int64, error) { return r.lastInsertID, nil }
@@ -162,35 +712,23 @@ func sendRequest(conn net.Conn, request interface{}) error {
 		return err
 	}
 
-	length := uint32(len(data))
-	err = binary.Write(conn, binary.BigEndian, length)
-	if err != nil {
-		return err
-	}
-
-	_, err = conn.Write(data)
+	_, err = conn.Write(frame.Encode(data))
 	return err
 }
 
-func readQueryResponse(conn net.Conn) (*QueryResponse, error) {
-	// Read fixed 4-byte length prefix.
-	var lengthBytes [4]byte
-	_, err := io.ReadFull(conn, lengthBytes[:])
+func readQueryResponse(c *Conn) (*QueryResponse, error) {
+	var response QueryResponse
+	err := readResponse(c, &response)
 	if err != nil {
 		return nil, err
 	}
-	length := binary.BigEndian.Uint32(lengthBytes[:])
 
-	// Read the actual data.
-	data := make([]byte, length)
-	_, err = io.ReadFull(conn, data)
-	if err != nil {
-		return nil, err
-	}
+	return &response, nil
+}
 
-	// Decode msgpack.
-	var response QueryResponse
-	err = msgpack.Unmarshal(data, &response)
+func readExecResponse(c *Conn) (*ExecResponse, error) {
+	var response ExecResponse
+	err := readResponse(c, &response)
 	if err != nil {
 		return nil, err
 	}
@@ -198,25 +736,32 @@ func readQueryResponse(conn net.Conn) (*QueryResponse, error) {
 	return &response, nil
 }
 
-func readExecResponse(conn net.Conn) (*ExecResponse, error) {
-	var lengthBytes [4]byte
-	_, err := io.ReadFull(conn, lengthBytes[:])
-	if err != nil {
-		return nil, err
-	}
-	length := binary.BigEndian.Uint32(lengthBytes[:])
+func readResponse(c *Conn, response interface{}) error {
+	_, err := readResponseSize(c, response)
+	return err
+}
 
-	data := make([]byte, length)
-	_, err = io.ReadFull(conn, data)
+// readResponseSize reads a response of the last request and returns its
+// size, length prefix included.
+func readResponseSize(c *Conn, response interface{}) (int, error) {
+	// Results are only limited by the 4-byte length prefix.
+	data, err := frame.Read(c.conn, 0)
 	if err != nil {
-		return nil, err
+		return 0, c.opError(err)
 	}
-
-	var response ExecResponse
-	err = msgpack.Unmarshal(data, &response)
-	if err != nil {
-		return nil, err
+	if err := frame.Unmarshal(data, response); err != nil {
+		return 0, c.opError(err)
+	}
+	switch r := response.(type) {
+	case *QueryResponse:
+		normalizeRows(r.Data)
+	case *ExecResponse:
+		normalizeRows(r.Data)
+	case *MultiResponse:
+		for _, result := range r.Results {
+			normalizeRows(result.Rows)
+		}
 	}
 
-	return &response, nil
+	return 4 + len(data), nil
 }
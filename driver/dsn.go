@@ -0,0 +1,230 @@
+package driver
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arkan/sqlproxy/internal/frame"
+)
+
+// Config is a parsed DSN, of the form:
+//
+//	[user[:password]@]host:port[?param=value&...]
+//
+// where host:port can be srv:<name> to find the proxy with a DNS SRV record,
+// with the parameters application, tag.<key>, database, stream, window_rows,
+// window_bytes, max_buffer_bytes, proxy, dial_timeout, read_timeout, write_timeout, keepalive,
+// keepalive_interval, nodelay, read_buffer, write_buffer, compress,
+// compress_min, tls, tlsrootcert, tlsservername and sign_key.
+type Config struct {
+	// Address of the proxy, or srv:<name>.
+	Addr string
+	// Credentials sent to the proxy when it requires authentication.
+	User     string
+	Password string
+	// Application name and tags, identifying the client in the proxy logs,
+	// metrics and connection list.
+	Application string
+	Tags        map[string]string
+	// Database of the configuration of the proxy the statements select,
+	// unless their context has one (see WithDatabase).
+	Database string
+	// Stream results, fetched as the rows are read, instead of receiving
+	// them at once, with at most WindowRows rows (1000 by default) or
+	// WindowBytes bytes in flight. True by default.
+	Stream      bool
+	WindowRows  int
+	WindowBytes int
+	// MaxBufferBytes caps the streamed rows received ahead of the iteration to
+	// run another statement on the connection (64 MiB by default), the
+	// statement failing rather than buffering more.
+	MaxBufferBytes int
+	// SOCKS5 or HTTP CONNECT proxy the connections go through, as a
+	// socks5://[user:password@]host:port or http://[user:password@]host:port
+	// URL.
+	Proxy *url.URL
+	// Timeouts of the dial (bastion included), and of every read and write of
+	// the connection, none by default. Reads wait for the whole statement to
+	// run on the backend.
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// Idle time before TCP keepalive probes and interval between them, the Go
+	// defaults (15s) when 0. A negative KeepAlive disables them.
+	KeepAlive         time.Duration
+	KeepAliveInterval time.Duration
+	// NoDelay sends small writes without delay (TCP_NODELAY), true by default.
+	NoDelay bool
+	// UUIDBytes returns the UUIDs of results as [16]byte instead of strings.
+	UUIDBytes bool
+	// JSONRawMessage returns JSON documents as json.RawMessage instead of
+	// []byte.
+	JSONRawMessage bool
+	// Socket buffer sizes, the OS defaults when 0.
+	ReadBuffer  int
+	WriteBuffer int
+	// Compression algorithm of the frames of at least CompressMin bytes
+	// (4096 by default) sent both ways, none when empty or when the proxy
+	// doesn't accept it.
+	Compression string
+	CompressMin int
+	// TLS configuration of the connections, for proxies behind a TLS
+	// endpoint, none by default. The server name is the host of the address
+	// unless set.
+	TLS *tls.Config
+	// Key of the HMAC signing of the frames, for proxies started with
+	// -sign-key-env or -sign-key-file. Connections fail when the proxy
+	// doesn't sign them.
+	SigningKey string
+	// Dial connects to the proxy, or to the SOCKS5 or HTTP CONNECT proxy, with
+	// net.Dialer by default. It can't be set from a DSN, see NewConnector.
+	Dial DialFunc
+	// Hooks called after the statements, none by default. They can't be set
+	// from a DSN, see Connector.SetHooks.
+	Hooks *Hooks
+}
+
+// ParseDSN parses a DSN into a Config.
+func ParseDSN(dsn string) (*Config, error) {
+	cfg := &Config{Addr: dsn, Stream: true, NoDelay: true}
+
+	if i := strings.LastIndex(dsn, "@"); i >= 0 {
+		userinfo := dsn[:i]
+		cfg.Addr = dsn[i+1:]
+
+		user, password, _ := strings.Cut(userinfo, ":")
+		var err error
+		if cfg.User, err = url.PathUnescape(user); err != nil {
+			return nil, fmt.Errorf("invalid user in DSN: %w", err)
+		}
+		if cfg.Password, err = url.PathUnescape(password); err != nil {
+			return nil, fmt.Errorf("invalid password in DSN: %w", err)
+		}
+	}
+
+	var tlsMode, tlsRootCert, tlsServerName string
+	if addr, query, ok := strings.Cut(cfg.Addr, "?"); ok {
+		cfg.Addr = addr
+		params, err := url.ParseQuery(query)
+		if err != nil {
+			return nil, fmt.Errorf("invalid parameters in DSN: %w", err)
+		}
+		for name, values := range params {
+			value := values[len(values)-1]
+			switch {
+			case name == "application":
+				cfg.Application = value
+			case strings.HasPrefix(name, "tag."):
+				if cfg.Tags == nil {
+					cfg.Tags = map[string]string{}
+				}
+				cfg.Tags[name[len("tag."):]] = value
+			case name == "database":
+				cfg.Database = value
+			case name == "stream":
+				if cfg.Stream, err = strconv.ParseBool(value); err != nil {
+					return nil, fmt.Errorf("invalid stream in DSN: %w", err)
+				}
+			case name == "window_rows":
+				if cfg.WindowRows, err = strconv.Atoi(value); err != nil {
+					return nil, fmt.Errorf("invalid window_rows in DSN: %w", err)
+				}
+			case name == "window_bytes":
+				if cfg.WindowBytes, err = strconv.Atoi(value); err != nil {
+					return nil, fmt.Errorf("invalid window_bytes in DSN: %w", err)
+				}
+			case name == "max_buffer_bytes":
+				if cfg.MaxBufferBytes, err = strconv.Atoi(value); err != nil {
+					return nil, fmt.Errorf("invalid max_buffer_bytes in DSN: %w", err)
+				}
+			case name == "dial_timeout":
+				if cfg.DialTimeout, err = time.ParseDuration(value); err != nil {
+					return nil, fmt.Errorf("invalid dial_timeout in DSN: %w", err)
+				}
+			case name == "read_timeout":
+				if cfg.ReadTimeout, err = time.ParseDuration(value); err != nil {
+					return nil, fmt.Errorf("invalid read_timeout in DSN: %w", err)
+				}
+			case name == "write_timeout":
+				if cfg.WriteTimeout, err = time.ParseDuration(value); err != nil {
+					return nil, fmt.Errorf("invalid write_timeout in DSN: %w", err)
+				}
+			case name == "keepalive":
+				if cfg.KeepAlive, err = time.ParseDuration(value); err != nil {
+					return nil, fmt.Errorf("invalid keepalive in DSN: %w", err)
+				}
+			case name == "keepalive_interval":
+				if cfg.KeepAliveInterval, err = time.ParseDuration(value); err != nil {
+					return nil, fmt.Errorf("invalid keepalive_interval in DSN: %w", err)
+				}
+			case name == "nodelay":
+				if cfg.NoDelay, err = strconv.ParseBool(value); err != nil {
+					return nil, fmt.Errorf("invalid nodelay in DSN: %w", err)
+				}
+			case name == "uuid":
+				switch value {
+				case "string":
+					cfg.UUIDBytes = false
+				case "bytes":
+					cfg.UUIDBytes = true
+				default:
+					return nil, fmt.Errorf("invalid uuid in DSN: %q (string or bytes)", value)
+				}
+			case name == "json":
+				switch value {
+				case "bytes":
+					cfg.JSONRawMessage = false
+				case "raw":
+					cfg.JSONRawMessage = true
+				default:
+					return nil, fmt.Errorf("invalid json in DSN: %q (bytes or raw)", value)
+				}
+			case name == "read_buffer":
+				if cfg.ReadBuffer, err = strconv.Atoi(value); err != nil {
+					return nil, fmt.Errorf("invalid read_buffer in DSN: %w", err)
+				}
+			case name == "write_buffer":
+				if cfg.WriteBuffer, err = strconv.Atoi(value); err != nil {
+					return nil, fmt.Errorf("invalid write_buffer in DSN: %w", err)
+				}
+			case name == "compress":
+				if frame.Negotiate([]string{value}, frame.Compressions) == "" {
+					return nil, fmt.Errorf("invalid compress in DSN: %q (%s)", value, strings.Join(frame.Compressions, ", "))
+				}
+				cfg.Compression = value
+			case name == "compress_min":
+				if cfg.CompressMin, err = strconv.Atoi(value); err != nil {
+					return nil, fmt.Errorf("invalid compress_min in DSN: %w", err)
+				}
+			case name == "tls":
+				tlsMode = value
+			case name == "tlsrootcert":
+				tlsRootCert = value
+			case name == "tlsservername":
+				tlsServerName = value
+			case name == "sign_key":
+				cfg.SigningKey = value
+			case name == "proxy":
+				if cfg.Proxy, err = parseProxyURL(value); err != nil {
+					return nil, fmt.Errorf("invalid proxy in DSN: %w", err)
+				}
+			default:
+				return nil, fmt.Errorf("unknown DSN parameter %q", name)
+			}
+		}
+	}
+
+	if cfg.Addr == "" {
+		return nil, fmt.Errorf("missing proxy address in DSN")
+	}
+	var err error
+	if cfg.TLS, err = tlsConfig(tlsMode, tlsRootCert, tlsServerName); err != nil {
+		return nil, fmt.Errorf("invalid tls in DSN: %w", err)
+	}
+
+	return cfg, nil
+}
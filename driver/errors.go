@@ -0,0 +1,145 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+
+	"github.com/arkan/sqlproxy/internal/frame"
+)
+
+var (
+	// ErrConnClosed is matched by the errors of a request whose connection
+	// was closed, by the proxy, the network or the application.
+	ErrConnClosed = errors.New("sqlproxy: connection closed")
+	// ErrProtocol is matched by the errors of a request whose response
+	// couldn't be read: malformed, too large or wrongly signed.
+	ErrProtocol = errors.New("sqlproxy: protocol error")
+	// ErrServerBusy is matched by the errors of the requests refused by an
+	// overloaded proxy or backend, which may succeed when sent again.
+	ErrServerBusy = errors.New("sqlproxy: server busy")
+)
+
+// Error classes, telling apart the errors applications may handle, whatever
+// the backend.
+const (
+	ClassUniqueViolation     = "unique_violation"
+	ClassForeignKeyViolation = "foreign_key_violation"
+	ClassNotNullViolation    = "not_null_violation"
+	ClassCheckViolation      = "check_violation"
+	ClassIntegrity           = "integrity_constraint_violation"
+	ClassDeadlock            = "deadlock"
+	ClassSerialization       = "serialization_failure"
+	ClassSyntax              = "syntax_error"
+	ClassPrivilege           = "insufficient_privilege"
+	ClassUndefinedTable      = "undefined_table"
+	ClassUndefinedColumn     = "undefined_column"
+	ClassStatementTimeout    = "statement_timeout"
+	ClassConnection          = "connection_exception"
+	ClassData                = "data_exception"
+	ClassOverloaded          = "overloaded"
+	ClassCostLimit           = "cost_limit_exceeded"
+	ClassMaintenance         = "maintenance"
+)
+
+// errorCode is the code of the error of a response, if any.
+type errorCode struct {
+	Code       string `msgpack:"code"`
+	NativeCode int    `msgpack:"native_code"`
+	Class      string `msgpack:"class"`
+	Retryable  bool   `msgpack:"retryable"`
+}
+
+// Error is an error returned by the proxy:
+//
+//	var e *driver.Error
+//	if errors.As(err, &e) && e.Class == driver.ClassUniqueViolation {
+//		...
+//	}
+type Error struct {
+	Message string
+	// Trace ID of the request, to find it in the proxy logs.
+	TraceID string
+	// SQLSTATE and vendor code of the backend error, when it tells them.
+	SQLState   string
+	NativeCode int
+	// Class of the error, one of the Class constants, or empty when the
+	// proxy doesn't know it.
+	Class string
+	// Retryable is set on the transient errors, such as deadlocks or an
+	// overloaded proxy: the request may succeed when sent again.
+	Retryable bool
+}
+
+func (e *Error) Error() string {
+	if e.TraceID != "" {
+		return fmt.Sprintf("sqlproxy: %s (trace %s)", e.Message, e.TraceID)
+	}
+	return fmt.Sprintf("sqlproxy: %s", e.Message)
+}
+
+// Is tells that an overloaded proxy or backend refused the request.
+func (e *Error) Is(target error) bool {
+	return target == ErrServerBusy && e.Class == ClassOverloaded
+}
+
+// OpError is the error of a request which failed on its connection, with
+// the address of the proxy and the fingerprint of its query, if any. It
+// matches ErrConnClosed or ErrProtocol, depending on the cause:
+//
+//	if errors.Is(err, driver.ErrConnClosed) {
+//		...
+//	}
+type OpError struct {
+	// Op is the request: query, exec, begin, fetch...
+	Op   string
+	Addr string
+	// Fingerprint is the query of the request, its literals replaced with
+	// placeholders.
+	Fingerprint string
+	Err         error
+}
+
+func (e *OpError) Error() string {
+	if e.Fingerprint != "" {
+		return fmt.Sprintf("sqlproxy: %s %q to %s: %v", e.Op, e.Fingerprint, e.Addr, e.Err)
+	}
+	return fmt.Sprintf("sqlproxy: %s to %s: %v", e.Op, e.Addr, e.Err)
+}
+
+func (e *OpError) Unwrap() error { return e.Err }
+
+func (e *OpError) Is(target error) bool {
+	switch target {
+	case ErrConnClosed:
+		for _, err := range []error{io.EOF, io.ErrUnexpectedEOF, frame.ErrTruncated, net.ErrClosed, syscall.ECONNRESET, syscall.EPIPE} {
+			if errors.Is(e.Err, err) {
+				return true
+			}
+		}
+	case ErrProtocol:
+		for _, err := range []error{frame.ErrMalformed, frame.ErrTooLarge, frame.ErrSignature} {
+			if errors.Is(e.Err, err) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// responseError returns the error of a response, with its trace ID so that
+// it can be found in the proxy logs.
+func responseError(msg, traceID string, code errorCode) error {
+	return &Error{Message: msg, TraceID: traceID, SQLState: code.Code, NativeCode: code.NativeCode, Class: code.Class, Retryable: code.Retryable}
+}
+
+// IsRetryable reports whether a request failed with a transient error of
+// the proxy or its backend, and may be sent again. A deadlock rolls back
+// the whole transaction, which is the one to retry, and a statement cut by
+// a lost backend connection may have been applied.
+func IsRetryable(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Retryable
+}
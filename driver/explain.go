@@ -0,0 +1,66 @@
+package driver
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"strings"
+)
+
+// Explain request struct.
+type ExplainRequest struct {
+	Op       string        `msgpack:"op"`
+	Query    string        `msgpack:"query"`
+	Args     []interface{} `msgpack:"args"`
+	TraceID  string        `msgpack:"trace_id"`
+	Priority string        `msgpack:"priority"`
+	Timeout  int64         `msgpack:"timeout_ms"`
+}
+
+// Plan is the execution plan of a statement, as returned by the backend.
+type Plan struct {
+	Columns []string
+	Rows    [][]driver.Value
+}
+
+// String returns the plan as text, a line per row.
+func (p *Plan) String() string {
+	var b strings.Builder
+	for _, row := range p.Rows {
+		for i := range row {
+			if i > 0 {
+				b.WriteString("\t")
+			}
+			b.WriteString(asString(row, i))
+		}
+		b.WriteString("\n")
+	}
+
+	return b.String()
+}
+
+// Explain returns the plan of a statement, using the EXPLAIN variant of the
+// backend. Stored queries can be explained with "@name".
+func Explain(ctx context.Context, db *sql.DB, query string, args ...interface{}) (*Plan, error) {
+	request := ExplainRequest{Op: "explain", Query: query, Args: args, TraceID: TraceID(ctx), Priority: Priority(ctx), Timeout: StatementTimeout(ctx).Milliseconds()}
+
+	var plan *Plan
+	err := withConn(ctx, db, func(c *Conn) error {
+		err := c.send(request)
+		if err != nil {
+			return err
+		}
+
+		response, err := readQueryResponse(c)
+		if err != nil {
+			return err
+		}
+		if response.Error != "" {
+			return responseError(response.Error, response.TraceID, response.errorCode)
+		}
+		plan = &Plan{Columns: response.Columns, Rows: response.Data}
+		return nil
+	})
+
+	return plan, err
+}
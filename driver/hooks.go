@@ -0,0 +1,69 @@
+package driver
+
+import (
+	"context"
+	"database/sql/driver"
+	"time"
+
+	"github.com/arkan/sqlproxy/internal/sqltext"
+)
+
+// Hooks are called after the statements of the connections of a connector,
+// to plug in metrics or tracing. Any of them may be nil.
+type Hooks struct {
+	// OnQuery is called after every query, once its first rows are received.
+	OnQuery func(ctx context.Context, e QueryEvent)
+	// OnExec is called after every exec statement.
+	OnExec func(ctx context.Context, e QueryEvent)
+	// OnError is called after the statements failing, once their OnQuery or
+	// OnExec hook is called.
+	OnError func(ctx context.Context, e QueryEvent)
+}
+
+// QueryEvent describes a statement run.
+type QueryEvent struct {
+	Query string
+	// Fingerprint of the query, the same for queries differing only by
+	// their literals, such as "SELECT * FROM orders WHERE id = ?".
+	Fingerprint string
+	Args        int
+	Duration    time.Duration
+	// Rows affected by an exec statement.
+	RowsAffected int64
+	Err          error
+}
+
+// SetHooks sets the hooks of the connections of the connector, which must
+// not be opened yet.
+func (c *Connector) SetHooks(hooks Hooks) {
+	c.cfg.Hooks = &hooks
+}
+
+// execEvent returns the event of an exec statement.
+func execEvent(query string, args int, result driver.Result, err error) QueryEvent {
+	e := QueryEvent{Query: query, Args: args, Err: err}
+	if err == nil {
+		e.RowsAffected, _ = result.RowsAffected()
+	}
+	return e
+}
+
+// after calls the hooks of a query or exec statement which started at a
+// time.
+func (h *Hooks) after(ctx context.Context, exec bool, e QueryEvent, start time.Time) {
+	if h == nil {
+		return
+	}
+	e.Duration = time.Since(start)
+	e.Fingerprint = sqltext.Fingerprint(e.Query)
+	hook := h.OnQuery
+	if exec {
+		hook = h.OnExec
+	}
+	if hook != nil {
+		hook(ctx, e)
+	}
+	if e.Err != nil && h.OnError != nil {
+		h.OnError(ctx, e)
+	}
+}
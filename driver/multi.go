@@ -0,0 +1,80 @@
+package driver
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+)
+
+// Multi request struct.
+type MultiRequest struct {
+	Op          string        `msgpack:"op"`
+	Query       string        `msgpack:"query"`
+	Args        []interface{} `msgpack:"args"`
+	TraceID     string        `msgpack:"trace_id"`
+	Priority    string        `msgpack:"priority"`
+	Timeout     int64         `msgpack:"timeout_ms"`
+	Transaction bool          `msgpack:"transaction"`
+}
+
+// Multi response struct.
+type MultiResponse struct {
+	Results []StatementResult `msgpack:"results"`
+	TraceID string            `msgpack:"trace_id"`
+	Error   string            `msgpack:"error"`
+	errorCode
+}
+
+// StatementResult is the result of a statement of a script: the rows of
+// those returning some, counts for the others.
+type StatementResult struct {
+	Columns      []string         `msgpack:"columns"`
+	Rows         [][]driver.Value `msgpack:"data"`
+	RowsAffected int64            `msgpack:"rows_affected"`
+	LastInsertID int64            `msgpack:"last_insert_id"`
+}
+
+// ExecScript runs the semicolon-separated statements of a script in order,
+// in a single round trip, and returns their results. args are those of the ?
+// placeholders of every statement. When a statement fails, the results of
+// the previous ones are returned with the error, and the following ones
+// aren't run.
+func ExecScript(ctx context.Context, db *sql.DB, script string, args ...interface{}) ([]StatementResult, error) {
+	return execScript(ctx, db, MultiRequest{Op: "multi", Query: script, Args: args})
+}
+
+// ExecScriptTx runs a script like ExecScript, in a transaction rolled back
+// when a statement fails.
+func ExecScriptTx(ctx context.Context, db *sql.DB, script string, args ...interface{}) ([]StatementResult, error) {
+	return execScript(ctx, db, MultiRequest{Op: "multi", Query: script, Args: args, Transaction: true})
+}
+
+func execScript(ctx context.Context, db *sql.DB, request MultiRequest) ([]StatementResult, error) {
+	request.TraceID, request.Priority, request.Timeout = TraceID(ctx), Priority(ctx), StatementTimeout(ctx).Milliseconds()
+
+	var results []StatementResult
+	err := withConn(ctx, db, func(c *Conn) error {
+		if !c.Supports(CapMultiStatements) {
+			return fmt.Errorf("sqlproxy: the proxy does not support %s", CapMultiStatements)
+		}
+		if err := c.send(request); err != nil {
+			return err
+		}
+
+		var response MultiResponse
+		if err := readResponse(c, &response); err != nil {
+			return err
+		}
+		results = response.Results
+		for _, result := range results {
+			c.formatRows(result.Rows)
+		}
+		if response.Error != "" {
+			return responseError(response.Error, response.TraceID, response.errorCode)
+		}
+		return nil
+	})
+
+	return results, err
+}
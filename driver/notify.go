@@ -0,0 +1,265 @@
+package driver
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+)
+
+// Listen request struct.
+type ListenRequest struct {
+	Op       string   `msgpack:"op"`
+	Channels []string `msgpack:"channels"`
+	TraceID  string   `msgpack:"trace_id"`
+}
+
+// Notify request struct.
+type NotifyRequest struct {
+	Op      string `msgpack:"op"`
+	Channel string `msgpack:"channel"`
+	Payload string `msgpack:"payload"`
+	TraceID string `msgpack:"trace_id"`
+}
+
+// Notify response struct.
+type NotifyResponse struct {
+	Listeners int    `msgpack:"listeners"`
+	TraceID   string `msgpack:"trace_id"`
+	Error     string `msgpack:"error"`
+	errorCode
+}
+
+// Notification received on a channel.
+type Notification struct {
+	Channel string `msgpack:"channel"`
+	Payload string `msgpack:"payload"`
+}
+
+// listenFrame is a frame received by a listener: a notification, or the
+// response to a listen or unlisten request.
+type listenFrame struct {
+	Notification *Notification `msgpack:"notification"`
+	Channels     []string      `msgpack:"channels"`
+	TraceID      string        `msgpack:"trace_id"`
+	Error        string        `msgpack:"error"`
+	errorCode
+}
+
+// Notify publishes a notification to the clients of the proxy listening to
+// a channel, and returns their number.
+func Notify(ctx context.Context, db *sql.DB, channel, payload string) (int, error) {
+	request := NotifyRequest{Op: "notify", Channel: channel, Payload: payload, TraceID: TraceID(ctx)}
+
+	var listeners int
+	err := withConn(ctx, db, func(c *Conn) error {
+		if !c.Supports(CapNotifications) {
+			return fmt.Errorf("sqlproxy: the proxy does not support %s", CapNotifications)
+		}
+		if err := c.send(request); err != nil {
+			return err
+		}
+
+		var response NotifyResponse
+		if err := readResponse(c, &response); err != nil {
+			return err
+		}
+		if response.Error != "" {
+			return responseError(response.Error, response.TraceID, response.errorCode)
+		}
+		listeners = response.Listeners
+		return nil
+	})
+
+	return listeners, err
+}
+
+// Listener receives the notifications of channels on a connection of its
+// own, outside of any sql.DB pool:
+//
+//	l, err := driver.Listen(ctx, connector, "orders")
+//	for n := range l.Notifications() {
+//		...
+//	}
+type Listener struct {
+	conn *Conn
+	// mu serializes the listen and unlisten requests.
+	mu        sync.Mutex
+	responses chan listenFrame
+
+	// Notifications read and not delivered yet.
+	queueMu sync.Mutex
+	queue   []Notification
+	wake    chan struct{}
+
+	notifications chan Notification
+	done          chan struct{}
+	closed        chan struct{}
+	closeOnce     sync.Once
+	err           error
+}
+
+// Listen opens a listener on a connection of a connector, listening to
+// channels. The read timeout of the connector doesn't apply to it.
+func Listen(ctx context.Context, connector *Connector, channels ...string) (*Listener, error) {
+	cfg := *connector.cfg
+	cfg.ReadTimeout = 0
+	conn, err := open(ctx, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	c := conn.(*Conn)
+	if !c.Supports(CapNotifications) {
+		c.Close()
+		return nil, fmt.Errorf("sqlproxy: the proxy does not support %s", CapNotifications)
+	}
+	// The requests of the listener are sent while it reads.
+	c.op, c.query = "listen", ""
+
+	l := &Listener{
+		conn:          c,
+		responses:     make(chan listenFrame, 1),
+		wake:          make(chan struct{}, 1),
+		notifications: make(chan Notification),
+		done:          make(chan struct{}),
+		closed:        make(chan struct{}),
+	}
+	go l.read()
+	go l.deliver()
+
+	if len(channels) > 0 {
+		if err := l.Listen(ctx, channels...); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+// Notifications returns the channel of the notifications received, closed
+// when the listener is closed or its connection lost.
+func (l *Listener) Notifications() <-chan Notification {
+	return l.notifications
+}
+
+// Listen adds channels to those of the listener.
+func (l *Listener) Listen(ctx context.Context, channels ...string) error {
+	return l.request(ctx, ListenRequest{Op: "listen", Channels: channels, TraceID: TraceID(ctx)})
+}
+
+// Unlisten removes channels from those of the listener, all of them when
+// none is given.
+func (l *Listener) Unlisten(ctx context.Context, channels ...string) error {
+	return l.request(ctx, ListenRequest{Op: "unlisten", Channels: channels, TraceID: TraceID(ctx)})
+}
+
+// Err returns the error which ended the listener: nil while it runs, or once
+// it is closed.
+func (l *Listener) Err() error {
+	select {
+	case <-l.closed:
+		return nil
+	default:
+	}
+	select {
+	case <-l.done:
+		return l.err
+	default:
+		return nil
+	}
+}
+
+// Close closes the listener and its connection.
+func (l *Listener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.conn.Close()
+	})
+	return err
+}
+
+func (l *Listener) request(ctx context.Context, request ListenRequest) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.conn.write(request); err != nil {
+		return err
+	}
+	select {
+	case response := <-l.responses:
+		if response.Error != "" {
+			return responseError(response.Error, response.TraceID, response.errorCode)
+		}
+		return nil
+	case <-l.done:
+		return fmt.Errorf("sqlproxy: listener closed: %v", l.err)
+	case <-ctx.Done():
+		// The response would be taken for that of the next request.
+		l.Close()
+		return ctx.Err()
+	}
+}
+
+// read reads the frames of the connection until it is closed.
+func (l *Listener) read() {
+	defer close(l.done)
+
+	for {
+		var frame listenFrame
+		if err := readResponse(l.conn, &frame); err != nil {
+			l.err = err
+			return
+		}
+		if frame.Notification == nil {
+			l.responses <- frame
+			continue
+		}
+
+		l.queueMu.Lock()
+		l.queue = append(l.queue, *frame.Notification)
+		l.queueMu.Unlock()
+		select {
+		case l.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// deliver sends the notifications read to the notification channel, so
+// that a slow reader never holds up the responses.
+func (l *Listener) deliver() {
+	defer close(l.notifications)
+
+	for {
+		l.queueMu.Lock()
+		if len(l.queue) == 0 {
+			l.queueMu.Unlock()
+			select {
+			case <-l.wake:
+				continue
+			case <-l.done:
+				// Notifications read before the end are still delivered.
+				l.queueMu.Lock()
+				empty := len(l.queue) == 0
+				l.queueMu.Unlock()
+				if empty {
+					return
+				}
+				continue
+			case <-l.closed:
+				return
+			}
+		}
+		n := l.queue[0]
+		l.queue = l.queue[1:]
+		l.queueMu.Unlock()
+
+		select {
+		case l.notifications <- n:
+		case <-l.closed:
+			return
+		}
+	}
+}
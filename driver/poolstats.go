@@ -0,0 +1,61 @@
+package driver
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// PoolStats are the statistics of the backend pool of the proxy (see
+// sql.DBStats).
+type PoolStats struct {
+	MaxOpenConnections int           `msgpack:"max_open_connections"`
+	OpenConnections    int           `msgpack:"open_connections"`
+	InUse              int           `msgpack:"in_use"`
+	Idle               int           `msgpack:"idle"`
+	WaitCount          int64         `msgpack:"wait_count"`
+	WaitDuration       time.Duration `msgpack:"wait_duration"`
+	MaxIdleClosed      int64         `msgpack:"max_idle_closed"`
+	MaxIdleTimeClosed  int64         `msgpack:"max_idle_time_closed"`
+	MaxLifetimeClosed  int64         `msgpack:"max_lifetime_closed"`
+	// Requests waiting in the admission queue of the proxy.
+	Queued int `msgpack:"queued"`
+}
+
+// Pool stats request struct.
+type PoolStatsRequest struct {
+	Op string `msgpack:"op"`
+}
+
+// Pool stats response struct.
+type PoolStatsResponse struct {
+	Stats PoolStats `msgpack:"stats"`
+	Error string    `msgpack:"error"`
+}
+
+// BackendStats returns the statistics of the backend pool serving db, which
+// is the pool of its tenant in multi-tenant mode.
+func BackendStats(ctx context.Context, db *sql.DB) (*PoolStats, error) {
+	var response PoolStatsResponse
+	err := withConn(ctx, db, func(c *Conn) error {
+		err := c.send(PoolStatsRequest{Op: "pool_stats"})
+		if err != nil {
+			return err
+		}
+
+		err = readResponse(c, &response)
+		if err != nil {
+			return err
+		}
+		if response.Error != "" {
+			return fmt.Errorf("sqlproxy: %s", response.Error)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &response.Stats, nil
+}
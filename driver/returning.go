@@ -0,0 +1,57 @@
+package driver
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// ExecReturning runs a statement returning rows, such as a write with a
+// RETURNING (or SQL Server OUTPUT) clause, and returns them with its counts.
+// It carries the idempotency key of the context, if any:
+//
+//	res, err := driver.ExecReturning(ctx, db, "INSERT INTO orders (total) VALUES (?) RETURNING id", 12.5)
+func ExecReturning(ctx context.Context, db *sql.DB, query string, args ...interface{}) (*StatementResult, error) {
+	request := ExecRequest{Query: query, TraceID: TraceID(ctx), Priority: Priority(ctx), Timeout: StatementTimeout(ctx).Milliseconds(), IdempotencyKey: IdempotencyKey(ctx), Returning: true}
+	for _, arg := range args {
+		request.Args = append(request.Args, arg)
+	}
+
+	var result *StatementResult
+	err := withConn(ctx, db, func(c *Conn) error {
+		if !c.Supports(CapExecReturning) {
+			return fmt.Errorf("sqlproxy: the proxy does not support %s", CapExecReturning)
+		}
+		if request.IdempotencyKey != "" && !c.Supports(CapIdempotencyKeys) {
+			return fmt.Errorf("sqlproxy: the proxy does not support idempotency keys")
+		}
+		if request.Database = Database(ctx); request.Database == "" {
+			request.Database = c.cfg.Database
+		}
+		if request.Database != "" && !c.Supports(CapDatabases) {
+			return fmt.Errorf("sqlproxy: the proxy does not support %s", CapDatabases)
+		}
+		if err := c.send(request); err != nil {
+			return err
+		}
+
+		response, err := readExecResponse(c)
+		if err != nil {
+			return err
+		}
+		if response.Error != "" {
+			return responseError(response.Error, response.TraceID, response.errorCode)
+		}
+		consistencyOf(ctx).update(response.Consistency)
+		c.formatRows(response.Data)
+		result = &StatementResult{
+			Columns:      response.Columns,
+			Rows:         response.Data,
+			RowsAffected: response.RowsAffected,
+			LastInsertID: response.LastInsertID,
+		}
+		return nil
+	})
+
+	return result, err
+}
@@ -0,0 +1,173 @@
+package driver
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// structFields caches the field indexes of the struct types scanned, by
+// column name.
+var structFields sync.Map
+
+// ScanMap scans the current row of rows into a map of its column names to
+// their values.
+func ScanMap(rows *sql.Rows) (map[string]interface{}, error) {
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, len(cols))
+	dest := make([]interface{}, len(cols))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return nil, err
+	}
+
+	row := make(map[string]interface{}, len(cols))
+	for i, col := range cols {
+		row[col] = values[i]
+	}
+
+	return row, nil
+}
+
+// ScanStruct scans the current row of rows into the struct dest points to.
+// Columns go to the field tagged with their name, such as `db:"created_at"`,
+// or else to the field of their name, case insensitively. Fields tagged
+// `db:"-"` are skipped, and fields of embedded structs are used too. A
+// column without a field is an error.
+func ScanStruct(rows *sql.Rows, dest interface{}) error {
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("sqlproxy: ScanStruct needs a pointer to a struct, not %T", dest)
+	}
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	return scanStruct(rows, cols, v.Elem())
+}
+
+// ScanAll scans the remaining rows of rows into the slice dest points to,
+// of structs as ScanStruct does, pointers to structs, or maps as ScanMap
+// does, and closes rows:
+//
+//	var orders []Order
+//	err := driver.ScanAll(rows, &orders)
+func ScanAll(rows *sql.Rows, dest interface{}) error {
+	defer rows.Close()
+
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("sqlproxy: ScanAll needs a pointer to a slice, not %T", dest)
+	}
+	slice := v.Elem()
+	elemType := slice.Type().Elem()
+	isPtr := elemType.Kind() == reflect.Ptr
+	if isPtr {
+		elemType = elemType.Elem()
+	}
+	isMap := !isPtr && elemType == reflect.TypeOf(map[string]interface{}(nil))
+	if !isMap && elemType.Kind() != reflect.Struct {
+		return fmt.Errorf("sqlproxy: ScanAll can't scan rows into %s", slice.Type())
+	}
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	for rows.Next() {
+		if isMap {
+			row, err := ScanMap(rows)
+			if err != nil {
+				return err
+			}
+			slice.Set(reflect.Append(slice, reflect.ValueOf(row)))
+			continue
+		}
+
+		elem := reflect.New(elemType)
+		if err := scanStruct(rows, cols, elem.Elem()); err != nil {
+			return err
+		}
+		if !isPtr {
+			elem = elem.Elem()
+		}
+		slice.Set(reflect.Append(slice, elem))
+	}
+
+	return rows.Err()
+}
+
+// scanStruct scans the current row into the fields of a struct.
+func scanStruct(rows *sql.Rows, cols []string, v reflect.Value) error {
+	fields := fieldIndexes(v.Type())
+	dest := make([]interface{}, len(cols))
+	for i, col := range cols {
+		index, ok := fields[strings.ToLower(col)]
+		if !ok {
+			return fmt.Errorf("sqlproxy: %s has no field for column %s", v.Type(), col)
+		}
+		dest[i] = fieldByIndex(v, index).Addr().Interface()
+	}
+
+	return rows.Scan(dest...)
+}
+
+// fieldByIndex returns a nested field of a struct, allocating the embedded
+// struct pointers on its way.
+func fieldByIndex(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+
+	return v
+}
+
+// fieldIndexes returns the indexes of the exported fields of a struct type,
+// by lower-case column name. Tagged fields take precedence over the fields
+// named after a column, and then shallower fields over those of embedded
+// structs.
+func fieldIndexes(t reflect.Type) map[string][]int {
+	if fields, ok := structFields.Load(t); ok {
+		return fields.(map[string][]int)
+	}
+
+	fields := map[string][]int{}
+	tagged := map[string]bool{}
+	for _, f := range reflect.VisibleFields(t) {
+		if !f.IsExported() || f.Anonymous && (f.Type.Kind() == reflect.Struct || f.Type.Kind() == reflect.Ptr) {
+			continue
+		}
+		tag := f.Tag.Get("db")
+		if tag == "-" {
+			continue
+		}
+		name := strings.ToLower(f.Name)
+		if tag != "" {
+			name = strings.ToLower(tag)
+		}
+		if index, ok := fields[name]; ok {
+			if tagged[name] && tag == "" || tagged[name] == (tag != "") && len(index) <= len(f.Index) {
+				continue
+			}
+		}
+		fields[name] = f.Index
+		tagged[name] = tag != ""
+	}
+	structFields.Store(t, fields)
+
+	return fields
+}
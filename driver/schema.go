@@ -0,0 +1,174 @@
+package driver
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strconv"
+)
+
+// Schema request struct.
+type SchemaRequest struct {
+	Op      string `msgpack:"op"`
+	Kind    string `msgpack:"kind"`
+	Catalog string `msgpack:"catalog"`
+	Schema  string `msgpack:"schema"`
+	Table   string `msgpack:"table"`
+	TraceID string `msgpack:"trace_id"`
+}
+
+// Table describes a table or a view.
+type Table struct {
+	Catalog string
+	Schema  string
+	Name    string
+	// Type as reported by the backend, e.g. "BASE TABLE" or "VIEW".
+	Type string
+}
+
+// Column describes a column of a table.
+type Column struct {
+	Catalog  string
+	Schema   string
+	Table    string
+	Name     string
+	Position int
+	// DataType as reported by the backend, e.g. "integer" or "varchar".
+	DataType string
+	Nullable bool
+}
+
+// Catalogs lists the catalogs of the backend.
+func Catalogs(ctx context.Context, db *sql.DB) ([]string, error) {
+	response, err := querySchema(ctx, db, SchemaRequest{Kind: "catalogs"})
+	if err != nil {
+		return nil, err
+	}
+
+	catalogs := make([]string, 0, len(response.Data))
+	for _, row := range response.Data {
+		catalogs = append(catalogs, asString(row, 0))
+	}
+
+	return catalogs, nil
+}
+
+// Schemas lists the schemas of a catalog ("" for every catalog).
+func Schemas(ctx context.Context, db *sql.DB, catalog string) ([]string, error) {
+	response, err := querySchema(ctx, db, SchemaRequest{Kind: "schemas", Catalog: catalog})
+	if err != nil {
+		return nil, err
+	}
+
+	schemas := make([]string, 0, len(response.Data))
+	for _, row := range response.Data {
+		schemas = append(schemas, asString(row, 1))
+	}
+
+	return schemas, nil
+}
+
+// Tables lists the tables and views of a schema ("" for every schema).
+func Tables(ctx context.Context, db *sql.DB, schema string) ([]Table, error) {
+	response, err := querySchema(ctx, db, SchemaRequest{Kind: "tables", Schema: schema})
+	if err != nil {
+		return nil, err
+	}
+
+	tables := make([]Table, 0, len(response.Data))
+	for _, row := range response.Data {
+		tables = append(tables, Table{
+			Catalog: asString(row, 0),
+			Schema:  asString(row, 1),
+			Name:    asString(row, 2),
+			Type:    asString(row, 3),
+		})
+	}
+
+	return tables, nil
+}
+
+// Columns lists the columns of a table. Some backends require the table,
+// otherwise "" lists the columns of every table of the schema.
+func Columns(ctx context.Context, db *sql.DB, schema, table string) ([]Column, error) {
+	response, err := querySchema(ctx, db, SchemaRequest{Kind: "columns", Schema: schema, Table: table})
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make([]Column, 0, len(response.Data))
+	for _, row := range response.Data {
+		position, _ := strconv.Atoi(asString(row, 4))
+		columns = append(columns, Column{
+			Catalog:  asString(row, 0),
+			Schema:   asString(row, 1),
+			Table:    asString(row, 2),
+			Name:     asString(row, 3),
+			Position: position,
+			DataType: asString(row, 5),
+			Nullable: asString(row, 6) == "YES",
+		})
+	}
+
+	return columns, nil
+}
+
+func querySchema(ctx context.Context, db *sql.DB, request SchemaRequest) (*QueryResponse, error) {
+	request.Op = "schema"
+	request.TraceID = TraceID(ctx)
+
+	var response *QueryResponse
+	err := withConn(ctx, db, func(c *Conn) error {
+		err := c.send(request)
+		if err != nil {
+			return err
+		}
+
+		response, err = readQueryResponse(c)
+		if err != nil {
+			return err
+		}
+		if response.Error != "" {
+			return responseError(response.Error, response.TraceID, response.errorCode)
+		}
+		return nil
+	})
+
+	return response, err
+}
+
+// withConn runs fn with a proxy connection of the pool, its requests ending
+// with the context.
+func withConn(ctx context.Context, db *sql.DB, fn func(c *Conn) error) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn interface{}) error {
+		c, ok := driverConn.(*Conn)
+		if !ok {
+			return fmt.Errorf("sqlproxy: not a sqlproxy connection (%T)", driverConn)
+		}
+		defer c.watch(ctx)()
+		return fn(c)
+	})
+}
+
+// asString returns a column of a metadata row as a string.
+func asString(row []driver.Value, i int) string {
+	if i >= len(row) || row[i] == nil {
+		return ""
+	}
+
+	switch v := row[i].(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,61 @@
+package driver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+)
+
+// tlsConfig returns the TLS configuration of the tls, tlsrootcert and
+// tlsservername DSN parameters, nil when TLS is disabled. mode is verify,
+// insecure-skip-verify or disable (the default).
+func tlsConfig(mode, rootCert, serverName string) (*tls.Config, error) {
+	switch mode {
+	case "", "disable":
+		if rootCert != "" || serverName != "" {
+			return nil, fmt.Errorf("tlsrootcert and tlsservername require tls=verify")
+		}
+		return nil, nil
+	case "insecure-skip-verify":
+		return &tls.Config{InsecureSkipVerify: true, ServerName: serverName}, nil
+	case "verify":
+	default:
+		return nil, fmt.Errorf("%q (verify, insecure-skip-verify or disable)", mode)
+	}
+
+	cfg := &tls.Config{ServerName: serverName}
+	if rootCert != "" {
+		pem, err := os.ReadFile(rootCert)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in %s", rootCert)
+		}
+	}
+
+	return cfg, nil
+}
+
+// startTLS runs the TLS handshake on a connection to an address, whose host
+// is the server name unless the configuration has one.
+func startTLS(ctx context.Context, conn net.Conn, cfg *Config, addr string) (net.Conn, error) {
+	config := cfg.TLS
+	if config.ServerName == "" {
+		config = config.Clone()
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			config.ServerName = host
+		}
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, fmt.Errorf("sqlproxy: TLS handshake with %s: %w", addr, err)
+	}
+
+	return tlsConn, nil
+}
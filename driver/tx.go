@@ -0,0 +1,107 @@
+package driver
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+)
+
+// Begin request struct.
+type BeginRequest struct {
+	Op        string `msgpack:"op"`
+	Isolation string `msgpack:"isolation"`
+	ReadOnly  bool   `msgpack:"read_only"`
+	TraceID   string `msgpack:"trace_id"`
+}
+
+// Transaction request struct, committing or rolling back.
+type TxRequest struct {
+	Op      string `msgpack:"op"`
+	TraceID string `msgpack:"trace_id"`
+}
+
+// Transaction response struct, answering begin, commit, rollback and ping
+// requests.
+type TxResponse struct {
+	Consistency string `msgpack:"consistency_token"`
+	TraceID     string `msgpack:"trace_id"`
+	Error       string `msgpack:"error"`
+	errorCode
+}
+
+// Tx implementation. The statements of the connection run in the
+// transaction on the proxy until it ends, its commit setting the token of
+// the consistency of the context it began with.
+type Tx struct {
+	conn        *Conn
+	consistency *Consistency
+}
+
+func (c *Conn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+// BeginTx begins a transaction on the backend, with the isolation level and
+// read-only mode of the options.
+func (c *Conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if !c.Supports(CapTransactions) {
+		return nil, fmt.Errorf("sqlproxy: the proxy does not support %s", CapTransactions)
+	}
+	request := BeginRequest{Op: "begin", ReadOnly: opts.ReadOnly, TraceID: TraceID(ctx)}
+	if level := sql.IsolationLevel(opts.Isolation); level != sql.LevelDefault {
+		request.Isolation = level.String()
+	}
+	defer c.watch(ctx)()
+	if err := c.txRequest(request); err != nil {
+		return nil, err
+	}
+
+	return &Tx{conn: c, consistency: consistencyOf(ctx)}, nil
+}
+
+func (tx *Tx) Commit() error {
+	response, err := tx.conn.txResponse(TxRequest{Op: "commit"})
+	if err != nil {
+		return err
+	}
+	tx.consistency.update(response.Consistency)
+	return nil
+}
+
+func (tx *Tx) Rollback() error {
+	return tx.conn.txRequest(TxRequest{Op: "rollback"})
+}
+
+// Ping checks that the proxy can reach the backend. It does nothing with
+// proxies older than pings.
+func (c *Conn) Ping(ctx context.Context) error {
+	if !c.Supports(CapPing) {
+		return nil
+	}
+	defer c.watch(ctx)()
+	return c.txRequest(TxRequest{Op: "ping", TraceID: TraceID(ctx)})
+}
+
+// txRequest sends a request answered by a TxResponse.
+func (c *Conn) txRequest(request interface{}) error {
+	_, err := c.txResponse(request)
+	return err
+}
+
+// txResponse sends a request and returns its TxResponse.
+func (c *Conn) txResponse(request interface{}) (TxResponse, error) {
+	if err := c.send(request); err != nil {
+		return TxResponse{}, err
+	}
+
+	var response TxResponse
+	if err := readResponse(c, &response); err != nil {
+		return TxResponse{}, err
+	}
+	if response.Error != "" {
+		return TxResponse{}, responseError(response.Error, response.TraceID, response.errorCode)
+	}
+
+	return response, nil
+}
@@ -0,0 +1,239 @@
+package driver
+
+import (
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+// Msgpack extension types of the tagged values.
+const (
+	extUUID = iota + 1
+	extIntArray
+	extTextArray
+	extJSON
+	extTimestamp
+)
+
+func init() {
+	msgpack.RegisterExt(extUUID, (*UUID)(nil))
+	msgpack.RegisterExt(extIntArray, (*intArray)(nil))
+	msgpack.RegisterExt(extTextArray, (*textArray)(nil))
+	msgpack.RegisterExt(extJSON, (*jsonValue)(nil))
+	msgpack.RegisterExt(extTimestamp, (*timestampValue)(nil))
+}
+
+// decodedTypes are the types of the tagged values the driver decodes.
+var decodedTypes = []string{"uuid", "int[]", "text[]", "json", "timestamptz"}
+
+// UUID is a UUID, tagged on the wire. UUID and [16]byte arguments are sent
+// as UUIDs, and the UUIDs of results are returned as strings, or as [16]byte
+// with Config.UUIDBytes.
+type UUID [16]byte
+
+// String returns the canonical form of the UUID.
+func (u UUID) String() string {
+	s := hex.EncodeToString(u[:])
+	return s[:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
+
+func (u UUID) MarshalMsgpack() ([]byte, error) {
+	return u[:], nil
+}
+
+func (u *UUID) UnmarshalMsgpack(data []byte) error {
+	if len(data) != len(u) {
+		return fmt.Errorf("sqlproxy: invalid UUID of %d bytes", len(data))
+	}
+	copy(u[:], data)
+	return nil
+}
+
+// intArray and textArray are the int[] and text[] arrays, tagged on the
+// wire. Results hold them as []int64 and []string, which are also accepted
+// as arguments.
+type (
+	intArray  []int64
+	textArray []string
+)
+
+func (a intArray) MarshalMsgpack() ([]byte, error) {
+	return msgpack.Marshal([]int64(a))
+}
+
+func (a *intArray) UnmarshalMsgpack(data []byte) error {
+	return msgpack.Unmarshal(data, (*[]int64)(a))
+}
+
+func (a textArray) MarshalMsgpack() ([]byte, error) {
+	return msgpack.Marshal([]string(a))
+}
+
+func (a *textArray) UnmarshalMsgpack(data []byte) error {
+	return msgpack.Unmarshal(data, (*[]string)(a))
+}
+
+// jsonValue is a JSON document, tagged on the wire. Results hold them as
+// []byte, or as json.RawMessage with Config.JSONRawMessage. json.RawMessage
+// arguments are sent as JSON documents.
+type jsonValue []byte
+
+func (j jsonValue) MarshalMsgpack() ([]byte, error) {
+	return j, nil
+}
+
+func (j *jsonValue) UnmarshalMsgpack(data []byte) error {
+	*j = append((*j)[:0], data...)
+	return nil
+}
+
+// timestampValue is a timestamp with its offset, tagged on the wire when the
+// proxy runs with -timestamps offset. Results hold them as time.Time in a
+// fixed zone of the offset, and the other timestamps in UTC.
+type timestampValue struct {
+	time.Time
+}
+
+func (t timestampValue) MarshalMsgpack() ([]byte, error) {
+	_, offset := t.Zone()
+	return msgpack.Marshal([]int64{t.Unix(), int64(t.Nanosecond()), int64(offset)})
+}
+
+func (t *timestampValue) UnmarshalMsgpack(data []byte) error {
+	var parts []int64
+	if err := msgpack.Unmarshal(data, &parts); err != nil {
+		return err
+	}
+	if len(parts) != 3 {
+		return fmt.Errorf("sqlproxy: invalid timestamp of %d parts", len(parts))
+	}
+	t.Time = time.Unix(parts[0], parts[1]).In(time.FixedZone("", int(parts[2])))
+	return nil
+}
+
+// CheckNamedValue keeps uint64 arguments, which database/sql rejects above
+// the int64 range, UUIDs, arrays and JSON documents. Other values are
+// converted as usual.
+func (c *Conn) CheckNamedValue(nv *driver.NamedValue) error {
+	switch v := nv.Value.(type) {
+	case uint64, UUID:
+		return nil
+	case uint:
+		nv.Value = uint64(v)
+		return nil
+	case [16]byte:
+		nv.Value = UUID(v)
+		return nil
+	case []int64:
+		nv.Value = intArray(v)
+		return nil
+	case []int:
+		a := make(intArray, len(v))
+		for i, n := range v {
+			a[i] = int64(n)
+		}
+		nv.Value = a
+		return nil
+	case []string:
+		nv.Value = textArray(v)
+		return nil
+	case json.RawMessage:
+		nv.Value = jsonValue(v)
+		return nil
+	}
+
+	return driver.ErrSkip
+}
+
+// normalizeRows converts the values of rows decoded from msgpack, which keeps
+// the width of integers, to driver values: integers to int64, and unsigned
+// ones above the int64 range to uint64, without going through float64. UUIDs
+// become [16]byte, arrays []int64 or []string and JSON documents
+// json.RawMessage. Timestamps without offset are set in UTC rather than the
+// local time zone.
+func normalizeRows(rows [][]driver.Value) {
+	for _, row := range rows {
+		for i, v := range row {
+			row[i] = normalizeValue(v)
+		}
+	}
+}
+
+func normalizeValue(v driver.Value) driver.Value {
+	switch n := v.(type) {
+	case int8:
+		return int64(n)
+	case int16:
+		return int64(n)
+	case int32:
+		return int64(n)
+	case uint8:
+		return int64(n)
+	case uint16:
+		return int64(n)
+	case uint32:
+		return int64(n)
+	case uint64:
+		if n <= math.MaxInt64 {
+			return int64(n)
+		}
+	case float32:
+		return float64(n)
+	case *UUID:
+		return [16]byte(*n)
+	case *intArray:
+		return []int64(*n)
+	case *textArray:
+		return []string(*n)
+	case *jsonValue:
+		return json.RawMessage(*n)
+	case *timestampValue:
+		return n.Time
+	case *time.Time:
+		return n.UTC()
+	}
+
+	return v
+}
+
+// valueFormat is how a connection returns the tagged values.
+type valueFormat struct {
+	// uuidBytes returns UUIDs as [16]byte instead of strings.
+	uuidBytes bool
+	// rawJSON returns JSON documents as json.RawMessage instead of []byte.
+	rawJSON bool
+}
+
+func (c *Conn) valueFormat() valueFormat {
+	return valueFormat{uuidBytes: c.cfg.UUIDBytes, rawJSON: c.cfg.JSONRawMessage}
+}
+
+// row converts the tagged values of a row to their format.
+func (f valueFormat) row(row []driver.Value) {
+	for i, v := range row {
+		switch v := v.(type) {
+		case [16]byte:
+			if !f.uuidBytes {
+				row[i] = UUID(v).String()
+			}
+		case json.RawMessage:
+			if !f.rawJSON {
+				row[i] = []byte(v)
+			}
+		}
+	}
+}
+
+// formatRows converts the tagged values of rows to the format of the
+// connection.
+func (c *Conn) formatRows(rows [][]driver.Value) {
+	f := c.valueFormat()
+	for _, row := range rows {
+		f.row(row)
+	}
+}
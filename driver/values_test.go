@@ -0,0 +1,125 @@
+package driver
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+func TestCheckNamedValue(t *testing.T) {
+	uuid := UUID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	tests := []struct {
+		name  string
+		value interface{}
+		want  interface{}
+	}{
+		{"uint64", uint64(math.MaxUint64), uint64(math.MaxUint64)},
+		{"uint", uint(7), uint64(7)},
+		{"UUID", uuid, uuid},
+		{"[16]byte", [16]byte(uuid), uuid},
+		{"[]int64", []int64{1, 2}, intArray{1, 2}},
+		{"[]int", []int{1, 2}, intArray{1, 2}},
+		{"[]string", []string{"a", "b"}, textArray{"a", "b"}},
+		{"json.RawMessage", json.RawMessage(`{"a":1}`), jsonValue(`{"a":1}`)},
+	}
+	for _, test := range tests {
+		nv := driver.NamedValue{Value: test.value}
+		if err := (&Conn{}).CheckNamedValue(&nv); err != nil {
+			t.Errorf("%s: CheckNamedValue: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(nv.Value, test.want) {
+			t.Errorf("%s: CheckNamedValue = %#v, want %#v", test.name, nv.Value, test.want)
+		}
+	}
+}
+
+func TestCheckNamedValueSkip(t *testing.T) {
+	// Left to the default conversion of database/sql.
+	for _, v := range []interface{}{nil, int64(1), "a", 1.5, true, []byte{1}, time.Now(), struct{}{}} {
+		nv := driver.NamedValue{Value: v}
+		if err := (&Conn{}).CheckNamedValue(&nv); err != driver.ErrSkip {
+			t.Errorf("CheckNamedValue(%#v) = %v, want driver.ErrSkip", v, err)
+		}
+	}
+}
+
+func TestNormalizeValue(t *testing.T) {
+	uuid := UUID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	local := time.Date(2024, 3, 1, 12, 0, 0, 0, time.FixedZone("", 3600))
+	offset := timestampValue{local}
+	tests := []struct {
+		name  string
+		value driver.Value
+		want  driver.Value
+	}{
+		{"nil", nil, nil},
+		{"int8", int8(-8), int64(-8)},
+		{"int16", int16(-16), int64(-16)},
+		{"int32", int32(-32), int64(-32)},
+		{"int64", int64(-64), int64(-64)},
+		{"uint8", uint8(8), int64(8)},
+		{"uint16", uint16(16), int64(16)},
+		{"uint32", uint32(32), int64(32)},
+		{"uint64", uint64(64), int64(64)},
+		{"uint64 over int64", uint64(math.MaxUint64), uint64(math.MaxUint64)},
+		{"float32", float32(1.5), float64(1.5)},
+		{"string", "a", "a"},
+		{"UUID", &uuid, [16]byte(uuid)},
+		{"int[]", &intArray{1, 2}, []int64{1, 2}},
+		{"text[]", &textArray{"a"}, []string{"a"}},
+		{"json", &jsonValue{'1'}, json.RawMessage("1")},
+		{"timestamptz", &offset, local},
+		{"timestamp", &local, local.UTC()},
+	}
+	for _, test := range tests {
+		if got := normalizeValue(test.value); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: normalizeValue = %#v, want %#v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestTaggedValuesRoundTrip(t *testing.T) {
+	uuid := UUID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	offset := timestampValue{time.Date(2024, 3, 1, 12, 0, 0, 5, time.FixedZone("", -7200))}
+	for _, v := range []interface{}{uuid, intArray{1, -2}, textArray{"a", ""}, jsonValue(`[1]`), offset} {
+		data, err := msgpack.Marshal(v)
+		if err != nil {
+			t.Errorf("Marshal(%#v): %v", v, err)
+			continue
+		}
+		var decoded interface{}
+		if err := msgpack.Unmarshal(data, &decoded); err != nil {
+			t.Errorf("Unmarshal(%#v): %v", v, err)
+			continue
+		}
+		got, want := normalizeValue(decoded), normalizeValue(reflect.New(reflect.TypeOf(v)).Interface())
+		if reflect.TypeOf(got) != reflect.TypeOf(want) {
+			t.Errorf("%#v decoded as %T, want %T", v, got, want)
+		}
+	}
+	if got := uuid.String(); got != "01020304-0506-0708-090a-0b0c0d0e0f10" {
+		t.Errorf("UUID.String() = %q", got)
+	}
+}
+
+func TestTaggedValuesInvalid(t *testing.T) {
+	var uuid UUID
+	if err := uuid.UnmarshalMsgpack([]byte{1, 2, 3}); err == nil {
+		t.Error("UUID of 3 bytes decoded")
+	}
+
+	var ts timestampValue
+	data, _ := msgpack.Marshal([]int64{1, 2})
+	if err := ts.UnmarshalMsgpack(data); err == nil {
+		t.Error("timestamp of 2 parts decoded")
+	}
+	if err := ts.UnmarshalMsgpack([]byte{0xc1}); err == nil {
+		t.Error("timestamp of invalid msgpack decoded")
+	}
+}
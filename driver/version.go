@@ -0,0 +1,73 @@
+package driver
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"runtime/debug"
+)
+
+// Version request struct.
+type VersionRequest struct {
+	Op string `msgpack:"op"`
+}
+
+// Version response struct.
+type VersionResponse struct {
+	Version        string `msgpack:"version"`
+	Revision       string `msgpack:"revision"`
+	GoVersion      string `msgpack:"go_version"`
+	BackendDriver  string `msgpack:"backend_driver"`
+	BackendVersion string `msgpack:"backend_version"`
+	Error          string `msgpack:"error"`
+}
+
+// Version returns the version of the proxy and of its backend.
+func Version(ctx context.Context, db *sql.DB) (*VersionResponse, error) {
+	var response VersionResponse
+	err := withConn(ctx, db, func(c *Conn) error {
+		err := c.send(VersionRequest{Op: "version"})
+		if err != nil {
+			return err
+		}
+
+		err = readResponse(c, &response)
+		if err != nil {
+			return err
+		}
+		if response.Error != "" {
+			return fmt.Errorf("sqlproxy: %s", response.Error)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &response, nil
+}
+
+// modulePath is the path of the module of the driver.
+const modulePath = "github.com/arkan/sqlproxy"
+
+// libraryVersion returns the version of the driver module the program was
+// built with, sent to the proxy in the hello request.
+func libraryVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	if info.Main.Path == modulePath {
+		return info.Main.Version
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == modulePath {
+			if dep.Replace != nil {
+				return dep.Replace.Version
+			}
+			return dep.Version
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,81 @@
+// Package charset decodes the text of the single-byte character sets of
+// legacy databases to UTF-8.
+package charset
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Charset is a single-byte character set, ASCII in its low half.
+type Charset struct {
+	name string
+	// high maps the bytes from 0x80, ISO-8859-1 being the identity when nil.
+	high *[128]rune
+}
+
+var charsets = map[string]*Charset{
+	"iso-8859-1":   {name: "iso-8859-1"},
+	"iso-8859-15":  {name: "iso-8859-15", high: &iso885915},
+	"windows-1250": {name: "windows-1250", high: &windows1250},
+	"windows-1251": {name: "windows-1251", high: &windows1251},
+	"windows-1252": {name: "windows-1252", high: &windows1252},
+}
+
+var aliases = map[string]string{
+	"latin1": "iso-8859-1",
+	"latin9": "iso-8859-15",
+	"cp1250": "windows-1250",
+	"cp1251": "windows-1251",
+	"cp1252": "windows-1252",
+}
+
+// Lookup returns a character set by name or alias, such as "latin1" or
+// "windows-1252".
+func Lookup(name string) (*Charset, error) {
+	key := strings.ToLower(name)
+	if alias, ok := aliases[key]; ok {
+		key = alias
+	}
+	c, ok := charsets[key]
+	if !ok {
+		return nil, fmt.Errorf("unknown charset %q", name)
+	}
+
+	return c, nil
+}
+
+// Name returns the canonical name of the character set.
+func (c *Charset) Name() string {
+	return c.name
+}
+
+// Decode returns the UTF-8 text of bytes of the character set.
+func (c *Charset) Decode(b []byte) string {
+	ascii := true
+	for _, x := range b {
+		if x >= utf8.RuneSelf {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return string(b)
+	}
+
+	var s strings.Builder
+	s.Grow(len(b) * 2)
+	for _, x := range b {
+		switch {
+		case x < utf8.RuneSelf:
+			s.WriteByte(x)
+		case c.high == nil:
+			s.WriteRune(rune(x))
+		default:
+			s.WriteRune(c.high[x-0x80])
+		}
+	}
+
+	return s.String()
+}
@@ -0,0 +1,137 @@
+package frame
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// Compressions are the compression algorithms, in order of preference.
+var Compressions = []string{"deflate"}
+
+// DefaultCompressMin is the size of the smallest frames compressed by
+// default.
+const DefaultCompressMin = 4096
+
+// compressedFrame starts the data of compressed frames: msgpack never uses
+// the byte, so that they can't be taken for a value.
+const compressedFrame = 0xc1
+
+// Compressor compresses the frames sent on a connection of at least a size,
+// when it makes them smaller, and decompresses those received.
+type Compressor struct {
+	min     int
+	writers sync.Pool
+}
+
+// NewCompressor returns the compressor of an algorithm, compressing the
+// frames of at least min bytes (DefaultCompressMin when 0).
+func NewCompressor(alg string, min int) (*Compressor, error) {
+	if alg != "deflate" {
+		return nil, fmt.Errorf("unsupported compression %q", alg)
+	}
+	if min <= 0 {
+		min = DefaultCompressMin
+	}
+
+	return &Compressor{min: min}, nil
+}
+
+// Compress returns the data of a frame, compressed when it is large enough
+// and compresses well.
+func (c *Compressor) Compress(data []byte) []byte {
+	if len(data) < c.min {
+		return data
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(compressedFrame)
+	w, _ := c.writers.Get().(*flate.Writer)
+	if w == nil {
+		w, _ = flate.NewWriter(&buf, flate.BestSpeed)
+	} else {
+		w.Reset(&buf)
+	}
+	w.Write(data)
+	w.Close()
+	c.writers.Put(w)
+	if buf.Len() >= len(data) {
+		return data
+	}
+
+	return buf.Bytes()
+}
+
+// Decompress returns the data of a frame received, decompressed if it was
+// compressed, refusing data larger than maxSize bytes (unlimited when 0).
+func (c *Compressor) Decompress(data []byte, maxSize uint32) ([]byte, error) {
+	if len(data) == 0 || data[0] != compressedFrame {
+		return data, nil
+	}
+
+	r := flate.NewReader(bytes.NewReader(data[1:]))
+	defer r.Close()
+	var buf bytes.Buffer
+	var src io.Reader = r
+	if maxSize > 0 {
+		src = io.LimitReader(r, int64(maxSize)+1)
+	}
+	if _, err := buf.ReadFrom(src); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	if maxSize > 0 && buf.Len() > int(maxSize) {
+		return nil, fmt.Errorf("%w: more than %d bytes once decompressed", ErrTooLarge, maxSize)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// CompressedConn compresses the frames written on a connection, each one
+// written at once, and decompresses those read.
+type CompressedConn struct {
+	net.Conn
+	compressor *Compressor
+
+	mu sync.Mutex
+	// Decompressed frame being read.
+	pending bytes.Buffer
+}
+
+// NewCompressedConn returns a connection compressing its frames.
+func NewCompressedConn(conn net.Conn, compressor *Compressor) *CompressedConn {
+	return &CompressedConn{Conn: conn, compressor: compressor}
+}
+
+// Write compresses a whole frame, its length prefix included.
+func (c *CompressedConn) Write(p []byte) (int, error) {
+	if len(p) < 4 || int(binary.BigEndian.Uint32(p)) != len(p)-4 {
+		return 0, errors.New("frame written in parts on a compressed connection")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.Conn.Write(Encode(c.compressor.Compress(p[4:]))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Read reads the frames received, decompressed.
+func (c *CompressedConn) Read(p []byte) (int, error) {
+	if c.pending.Len() == 0 {
+		data, err := Read(c.Conn, 0)
+		if err != nil {
+			return 0, err
+		}
+		if data, err = c.compressor.Decompress(data, 0); err != nil {
+			return 0, err
+		}
+		c.pending.Write(Encode(data))
+	}
+	return c.pending.Read(p)
+}
@@ -0,0 +1,218 @@
+// Package frame reads and writes the frames of the wire protocol, a
+// big-endian uint32 length followed by a msgpack value, and checks their
+// content before it is decoded: a malformed length or msgpack value fails
+// with an error, never with a panic or an allocation larger than the frame.
+package frame
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+// DefaultMaxSize is the largest frame read by default.
+const DefaultMaxSize = 64 << 20
+
+// MaxDepth is the deepest nesting of arrays and maps accepted.
+const MaxDepth = 32
+
+var (
+	// ErrTooLarge is returned for frames larger than the maximum size.
+	ErrTooLarge = errors.New("frame too large")
+	// ErrTruncated is returned for frames shorter than their length.
+	ErrTruncated = errors.New("truncated frame")
+	// ErrMalformed is returned for frames which are not a msgpack value.
+	ErrMalformed = errors.New("malformed frame")
+)
+
+// Read reads a frame and returns its data, refusing frames larger than
+// maxSize bytes (unlimited when 0). The data is read as it arrives, so that a
+// length alone never allocates the whole frame.
+func Read(r io.Reader, maxSize uint32) ([]byte, error) {
+	var lengthBytes [4]byte
+	if _, err := io.ReadFull(r, lengthBytes[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(lengthBytes[:])
+	if maxSize > 0 && length > maxSize {
+		return nil, fmt.Errorf("%w: %d bytes, at most %d", ErrTooLarge, length, maxSize)
+	}
+
+	var buf bytes.Buffer
+	if length <= 64<<10 {
+		buf.Grow(int(length))
+	}
+	n, err := buf.ReadFrom(io.LimitReader(r, int64(length)))
+	if err != nil {
+		return nil, err
+	}
+	if n < int64(length) {
+		return nil, fmt.Errorf("%w: %d of %d bytes", ErrTruncated, n, length)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Encode returns the frame of data, its length prefix included.
+func Encode(data []byte) []byte {
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+	return frame
+}
+
+// Unmarshal decodes the msgpack data of a frame, once it is checked. Data
+// which doesn't decode into v is malformed too.
+func Unmarshal(data []byte, v interface{}) (err error) {
+	if err := Check(data); err != nil {
+		return err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", ErrMalformed, r)
+		}
+	}()
+
+	if err := msgpack.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	return nil
+}
+
+// Check checks that data is a single complete msgpack value, whose strings,
+// arrays and maps fit in it, nested at most MaxDepth deep.
+func Check(data []byte) error {
+	c := checker{data: data}
+	if err := c.value(0); err != nil {
+		return err
+	}
+	if c.pos != len(data) {
+		return fmt.Errorf("%w: %d bytes after the value", ErrMalformed, len(data)-c.pos)
+	}
+	return nil
+}
+
+type checker struct {
+	data []byte
+	pos  int
+}
+
+func (c *checker) malformed(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s at byte %d", ErrMalformed, fmt.Sprintf(format, args...), c.pos)
+}
+
+// uint reads a big-endian unsigned integer of size bytes.
+func (c *checker) uint(size int) (uint64, error) {
+	if len(c.data)-c.pos < size {
+		return 0, c.malformed("truncated length")
+	}
+	var n uint64
+	for _, b := range c.data[c.pos : c.pos+size] {
+		n = n<<8 | uint64(b)
+	}
+	c.pos += size
+	return n, nil
+}
+
+// skip skips n bytes of content.
+func (c *checker) skip(n uint64) error {
+	if uint64(len(c.data)-c.pos) < n {
+		return c.malformed("%d bytes of content past the end", n)
+	}
+	c.pos += int(n)
+	return nil
+}
+
+// value checks the value at the current position.
+func (c *checker) value(depth int) error {
+	if c.pos >= len(c.data) {
+		return c.malformed("missing value")
+	}
+	b := c.data[c.pos]
+	c.pos++
+
+	switch {
+	case b <= 0x7f || b >= 0xe0, b == 0xc0, b == 0xc2, b == 0xc3:
+		// Fixint, nil or bool.
+		return nil
+	case b >= 0x80 && b <= 0x8f:
+		return c.container(depth, uint64(b&0x0f)*2)
+	case b >= 0x90 && b <= 0x9f:
+		return c.container(depth, uint64(b&0x0f))
+	case b >= 0xa0 && b <= 0xbf:
+		return c.skip(uint64(b & 0x1f))
+	}
+
+	switch b {
+	case 0xc4, 0xd9:
+		return c.sized(1, 0)
+	case 0xc5, 0xda:
+		return c.sized(2, 0)
+	case 0xc6, 0xdb:
+		return c.sized(4, 0)
+	case 0xc7:
+		return c.sized(1, 1)
+	case 0xc8:
+		return c.sized(2, 1)
+	case 0xc9:
+		return c.sized(4, 1)
+	case 0xcc, 0xd0:
+		return c.skip(1)
+	case 0xcd, 0xd1:
+		return c.skip(2)
+	case 0xca, 0xce, 0xd2:
+		return c.skip(4)
+	case 0xcb, 0xcf, 0xd3:
+		return c.skip(8)
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		// Fixext: a type byte and 1 to 16 bytes.
+		return c.skip(1 + 1<<(b-0xd4))
+	case 0xdc, 0xdd, 0xde, 0xdf:
+		size := 2
+		if b == 0xdd || b == 0xdf {
+			size = 4
+		}
+		n, err := c.uint(size)
+		if err != nil {
+			return err
+		}
+		if b >= 0xde {
+			n *= 2
+		}
+		return c.container(depth, n)
+	}
+
+	return c.malformed("invalid type 0x%02x", b)
+}
+
+// sized skips a string, binary or extension of a length of size bytes, and
+// extra bytes for the type of extensions.
+func (c *checker) sized(size int, extra uint64) error {
+	n, err := c.uint(size)
+	if err != nil {
+		return err
+	}
+	return c.skip(n + extra)
+}
+
+// container checks the n values of an array, or keys and values of a map.
+// Each one takes a byte at least, so larger counts are refused before any of
+// them is read.
+func (c *checker) container(depth int, n uint64) error {
+	if depth >= MaxDepth {
+		return c.malformed("nested more than %d deep", MaxDepth)
+	}
+	if n > uint64(len(c.data)-c.pos) {
+		return c.malformed("%d values past the end", n)
+	}
+	for i := uint64(0); i < n; i++ {
+		if err := c.value(depth + 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
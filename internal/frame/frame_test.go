@@ -0,0 +1,127 @@
+package frame
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+// request mirrors the fields of the requests decoded by the proxy.
+type request struct {
+	Op      string            `msgpack:"op"`
+	Query   string            `msgpack:"query"`
+	Args    []interface{}     `msgpack:"args"`
+	Tags    map[string]string `msgpack:"tags"`
+	Timeout int64             `msgpack:"timeout_ms"`
+}
+
+// fuzzMaxSize is the largest frame read by the fuzz targets.
+const fuzzMaxSize = 1 << 10
+
+// seedFrames are valid frames, as sent by the driver.
+func seedFrames(tb testing.TB) [][]byte {
+	var frames [][]byte
+	for _, req := range []request{
+		{Op: "hello"},
+		{Query: "SELECT * FROM users WHERE id = ?", Args: []interface{}{int64(42), "Ada", nil, 1.5, true, []byte{1, 2}}},
+		{Op: "exec", Query: "UPDATE users SET name = ?", Args: []interface{}{"Grace"}, Tags: map[string]string{"env": "prod"}, Timeout: 1000},
+	} {
+		data, err := msgpack.Marshal(req)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		frames = append(frames, Encode(data))
+	}
+	return frames
+}
+
+// lengthPrefix returns a frame prefix announcing length bytes.
+func lengthPrefix(length uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, length)
+}
+
+func FuzzRead(f *testing.F) {
+	for _, frame := range seedFrames(f) {
+		f.Add(frame)
+		// Truncated prefixes, the length included.
+		f.Add(frame[:2])
+		f.Add(frame[:len(frame)/2])
+		f.Add(frame[:len(frame)-1])
+	}
+	f.Add([]byte{})
+	f.Add(lengthPrefix(fuzzMaxSize + 1))
+	f.Add(lengthPrefix(0xffffffff))
+	f.Add(append(lengthPrefix(64<<10), 0x90))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		frame, err := Read(bytes.NewReader(data), fuzzMaxSize)
+		if err != nil {
+			return
+		}
+		if len(data) < 4 {
+			t.Fatalf("read a frame of %d bytes out of %d", len(frame), len(data))
+		}
+		if length := binary.BigEndian.Uint32(data); uint32(len(frame)) != length || length > fuzzMaxSize {
+			t.Fatalf("read %d bytes for a length of %d, at most %d", len(frame), length, fuzzMaxSize)
+		}
+		// Buffers only grow with the bytes received.
+		if max := 2*len(data) + 64<<10; cap(frame) > max {
+			t.Fatalf("allocated %d bytes for %d received", cap(frame), len(data))
+		}
+	})
+}
+
+func FuzzCheck(f *testing.F) {
+	for _, frame := range seedFrames(f) {
+		data := frame[4:]
+		f.Add(data)
+		f.Add(data[:len(data)/2])
+		f.Add(data[:len(data)-1])
+	}
+	// Lengths larger than the data, and nesting deeper than MaxDepth.
+	f.Add([]byte{0xdb, 0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{0xdd, 0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{0xdf, 0x7f, 0xff, 0xff, 0xff})
+	f.Add(bytes.Repeat([]byte{0x91}, MaxDepth+1))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var req request
+		Unmarshal(data, &req)
+
+		// Checked data may still not decode, such as a map mixing key types,
+		// but fails with an error.
+		if err := Check(data); err == nil {
+			var v interface{}
+			Unmarshal(data, &v)
+		}
+	})
+}
+
+func TestSealHello(t *testing.T) {
+	key, nonce := []byte("key"), bytes.Repeat([]byte{1}, NonceSize)
+	data := []byte{0x81, 0xa2, 'o', 'p', 0xa5, 'h', 'e', 'l', 'l', 'o'}
+	value, mac, err := Split(SealHello(key, nonce, data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := OpenHello(key, nonce, value, mac); err != nil {
+		t.Errorf("OpenHello: %v", err)
+	}
+
+	other := bytes.Repeat([]byte{2}, NonceSize)
+	tampered := append([]byte{}, value...)
+	tampered[len(tampered)-1] = 'O'
+	for name, err := range map[string]error{
+		"another key":   OpenHello([]byte("other"), nonce, value, mac),
+		"another nonce": OpenHello(key, other, value, mac),
+		"tampered":      OpenHello(key, nonce, tampered, mac),
+		"unsigned":      OpenHello(key, nonce, value, nil),
+		"no nonce":      OpenHello(key, nil, value, mac),
+	} {
+		if err != ErrSignature {
+			t.Errorf("OpenHello with %s = %v, want ErrSignature", name, err)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package frame
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"net"
+	"sync"
+)
+
+// Signing algorithms, in order of preference.
+var Algorithms = []string{"hmac-sha256", "hmac-sha512"}
+
+// ErrSignature is returned for frames whose MAC is missing or wrong.
+var ErrSignature = errors.New("invalid frame signature")
+
+// Negotiate returns the first allowed algorithm which is also offered, ""
+// when there is none.
+func Negotiate(offered, allowed []string) string {
+	for _, alg := range allowed {
+		for _, o := range offered {
+			if alg == o {
+				return alg
+			}
+		}
+	}
+	return ""
+}
+
+// NonceSize is the size of the nonces of the client and the proxy.
+const NonceSize = 16
+
+// Signer signs the frames sent on a connection with an HMAC of a shared key,
+// and checks those received. The MAC follows the msgpack value in the frame,
+// and covers the direction of the frame, so that responses can't be sent
+// back as requests, and its sequence number in that direction with the
+// nonces of the connection, so that frames can't be replayed, on the same
+// connection or another one.
+type Signer struct {
+	hash    func() hash.Hash
+	key     []byte
+	nonce   []byte
+	send    byte
+	receive byte
+
+	mu sync.Mutex
+	// Frames sent and received.
+	sent, received uint64
+}
+
+// NewSigner returns the signer of a client or of the proxy, for the nonces
+// of the client and of the proxy, sent in the hello request and response.
+func NewSigner(alg string, key, clientNonce, proxyNonce []byte, client bool) (*Signer, error) {
+	if len(clientNonce) != NonceSize || len(proxyNonce) != NonceSize {
+		return nil, fmt.Errorf("nonces of %d bytes are required", NonceSize)
+	}
+	s := &Signer{key: key, nonce: append(clientNonce[:NonceSize:NonceSize], proxyNonce...), send: 'R', receive: 'r'}
+	switch alg {
+	case "hmac-sha256":
+		s.hash = sha256.New
+	case "hmac-sha512":
+		s.hash = sha512.New
+	default:
+		return nil, fmt.Errorf("unknown signing algorithm %q", alg)
+	}
+	if !client {
+		s.send, s.receive = s.receive, s.send
+	}
+
+	return s, nil
+}
+
+// Nonce returns a random nonce.
+func Nonce() ([]byte, error) {
+	nonce := make([]byte, NonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+func (s *Signer) mac(direction byte, seq uint64, data []byte) []byte {
+	mac := hmac.New(s.hash, s.key)
+	mac.Write(s.nonce)
+	mac.Write([]byte{direction})
+	mac.Write(binary.BigEndian.AppendUint64(nil, seq))
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// Seal returns the data of the next frame sent followed by its MAC.
+func (s *Signer) Seal(data []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mac := s.mac(s.send, s.sent, data)
+	s.sent++
+	return append(data[:len(data):len(data)], mac...)
+}
+
+// Open checks the MAC of the next frame received and returns its data.
+// Frames replayed, reordered or missing fail the check.
+func (s *Signer) Open(signed []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	size := s.hash().Size()
+	if len(signed) < size {
+		return nil, ErrSignature
+	}
+	data, mac := signed[:len(signed)-size], signed[len(signed)-size:]
+	if !hmac.Equal(mac, s.mac(s.receive, s.received, data)) {
+		return nil, ErrSignature
+	}
+	s.received++
+	return data, nil
+}
+
+// SealHello returns the data of a hello request followed by its MAC. The
+// hello is sent before an algorithm is negotiated, and is signed with
+// HMAC-SHA256 of the key and of the nonce of the client it holds, so that
+// its credentials and options can't be tampered with.
+func SealHello(key, nonce, data []byte) []byte {
+	return append(data[:len(data):len(data)], helloMAC(key, nonce, data)...)
+}
+
+// OpenHello checks the MAC following the msgpack value of a hello request,
+// for the nonce of the client it holds.
+func OpenHello(key, nonce, data, mac []byte) error {
+	if len(nonce) != NonceSize || !hmac.Equal(mac, helloMAC(key, nonce, data)) {
+		return ErrSignature
+	}
+	return nil
+}
+
+func helloMAC(key, nonce, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(nonce)
+	mac.Write([]byte{'H'})
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// Split returns the msgpack value at the start of data, and what follows it,
+// such as the MAC of a signed frame.
+func Split(data []byte) ([]byte, []byte, error) {
+	c := checker{data: data}
+	if err := c.value(0); err != nil {
+		return nil, nil, err
+	}
+	return data[:c.pos], data[c.pos:], nil
+}
+
+// SignedConn signs the frames written on a connection, each one written at
+// once, and checks those read.
+type SignedConn struct {
+	net.Conn
+	signer *Signer
+
+	mu sync.Mutex
+	// Unsigned frame being read.
+	pending bytes.Buffer
+}
+
+// NewSignedConn returns a connection signing its frames.
+func NewSignedConn(conn net.Conn, signer *Signer) *SignedConn {
+	return &SignedConn{Conn: conn, signer: signer}
+}
+
+// Write signs a whole frame, its length prefix included.
+func (c *SignedConn) Write(p []byte) (int, error) {
+	if len(p) < 4 || int(binary.BigEndian.Uint32(p)) != len(p)-4 {
+		return 0, errors.New("frame written in parts on a signed connection")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.Conn.Write(Encode(c.signer.Seal(p[4:]))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Read reads the frames received once their MAC is checked, without it.
+func (c *SignedConn) Read(p []byte) (int, error) {
+	if c.pending.Len() == 0 {
+		signed, err := Read(c.Conn, 0)
+		if err != nil {
+			return 0, err
+		}
+		data, err := c.signer.Open(signed)
+		if err != nil {
+			return 0, err
+		}
+		c.pending.Write(Encode(data))
+	}
+	return c.pending.Read(p)
+}
@@ -0,0 +1,124 @@
+package sqltext
+
+import "strings"
+
+// rowStatements are the statements always returning rows.
+var rowStatements = map[string]bool{
+	"SELECT": true, "VALUES": true, "TABLE": true, "SHOW": true,
+	"EXPLAIN": true, "DESCRIBE": true, "DESC": true,
+}
+
+// writeStatements are the statements returning rows with a RETURNING (or
+// SQL Server OUTPUT) clause.
+var writeStatements = map[string]bool{
+	"INSERT": true, "UPDATE": true, "DELETE": true, "MERGE": true,
+}
+
+// ReturnsRows reports whether a statement returns rows: queries (WITH ...
+// SELECT included), SHOW, EXPLAIN and DESCRIBE, and writes with a RETURNING
+// or OUTPUT clause.
+func ReturnsRows(tokens []Token) bool {
+	statement, i := statementAt(tokens)
+	if rowStatements[statement] {
+		return true
+	}
+	if !writeStatements[statement] {
+		return false
+	}
+
+	depth := 0
+	for _, t := range tokens[i+1:] {
+		switch {
+		case t.Kind == Punct && t.Text == "(":
+			depth++
+		case t.Kind == Punct && t.Text == ")":
+			depth--
+		case t.Kind == Punct && t.Text == ";" && depth == 0:
+			return false
+		case depth == 0 && (t.Is("RETURNING") || t.Is("OUTPUT")):
+			return true
+		}
+	}
+
+	return false
+}
+
+// Statement returns the keyword of a statement in upper case, that of its
+// main statement for a WITH statement, or "" when it doesn't start with one.
+func Statement(tokens []Token) string {
+	statement, _ := statementAt(tokens)
+	return statement
+}
+
+// modifyingWords are the keywords of the statements and clauses modifying
+// data or schema, or locking rows.
+var modifyingWords = map[string]bool{
+	"INSERT": true, "UPDATE": true, "DELETE": true, "MERGE": true,
+	"INTO": true, "CREATE": true, "DROP": true, "ALTER": true,
+	"TRUNCATE": true, "GRANT": true, "REVOKE": true, "LOCK": true,
+	"CALL": true, "EXEC": true, "EXECUTE": true, "COPY": true,
+}
+
+// ReadOnly reports whether a statement returns rows without modifying
+// anything: a query none of whose words, in common table expressions or
+// following statements included, is that of a write, a SELECT INTO or a row
+// lock. The side effects of functions are not detected.
+func ReadOnly(tokens []Token) bool {
+	if statement, _ := statementAt(tokens); !rowStatements[statement] {
+		return false
+	}
+
+	return !Modifies(tokens)
+}
+
+// Modifies reports whether a word of a statement is that of a write, a
+// schema change or a row lock, wherever it is.
+func Modifies(tokens []Token) bool {
+	for _, t := range tokens {
+		if t.Kind == Word && modifyingWords[strings.ToUpper(t.Text)] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// statementAt returns the keyword of a statement, and its index.
+func statementAt(tokens []Token) (string, int) {
+	// Leading parentheses, as in "(SELECT ...) UNION (SELECT ...)".
+	i := nextSignificant(tokens, 0)
+	for i < len(tokens) && tokens[i].Kind == Punct && tokens[i].Text == "(" {
+		i = nextSignificant(tokens, i+1)
+	}
+	if i == len(tokens) || tokens[i].Kind != Word {
+		return "", i
+	}
+
+	statement := strings.ToUpper(tokens[i].Text)
+	if statement == "WITH" {
+		return mainStatement(tokens, i+1)
+	}
+	return statement, i
+}
+
+// mainStatement returns the statement following the common table
+// expressions of a WITH clause starting at tokens[i], and its index.
+func mainStatement(tokens []Token, i int) (string, int) {
+	depth := 0
+	for ; i < len(tokens); i++ {
+		t := tokens[i]
+		switch {
+		case t.Kind == Punct && t.Text == "(":
+			depth++
+		case t.Kind == Punct && t.Text == ")":
+			depth--
+		case depth == 0 && t.Kind == Word:
+			word := strings.ToUpper(t.Text)
+			if rowStatements[word] || writeStatements[word] {
+				return word, i
+			}
+		}
+	}
+
+	return "", len(tokens)
+}
@@ -0,0 +1,75 @@
+package sqltext
+
+import "testing"
+
+func TestReturnsRows(t *testing.T) {
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"SELECT 1", true},
+		{"  -- comment\n/* c */ select 1", true},
+		{"(SELECT 1) UNION (SELECT 2)", true},
+		{"WITH t AS (SELECT 1) SELECT * FROM t", true},
+		{"WITH t AS (DELETE FROM a RETURNING id) SELECT * FROM t", true},
+		{"WITH t AS (SELECT 1) DELETE FROM a", false},
+		{"VALUES (1)", true},
+		{"SHOW TABLES", true},
+		{"EXPLAIN SELECT 1", true},
+		{"INSERT INTO t VALUES (1) RETURNING id", true},
+		{"DELETE FROM t OUTPUT deleted.id", true},
+		{"INSERT INTO t VALUES ('RETURNING')", false},
+		{`UPDATE t SET "returning" = 1`, false},
+		{"INSERT INTO t SELECT (SELECT 1 RETURNING) FROM u", false},
+		{"DELETE FROM t; SELECT 1 RETURNING", false},
+		{"UPDATE t SET a = 1 -- RETURNING id", false},
+		{"CREATE TABLE t (id int)", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if got := ReturnsRows(Tokenize(test.query)); got != test.want {
+			t.Errorf("ReturnsRows(%q) = %v, want %v", test.query, got, test.want)
+		}
+	}
+}
+
+func TestStatement(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"select 1", "SELECT"},
+		{"((SELECT 1))", "SELECT"},
+		{"WITH a AS (SELECT 1), b AS (SELECT 2) insert INTO t SELECT * FROM b", "INSERT"},
+		{"/* x */ UPDATE t SET a = 1", "UPDATE"},
+		{"'SELECT'", ""},
+	}
+	for _, test := range tests {
+		if got := Statement(Tokenize(test.query)); got != test.want {
+			t.Errorf("Statement(%q) = %q, want %q", test.query, got, test.want)
+		}
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"SELECT * FROM t", true},
+		{"SELECT 'DELETE', \"update\" FROM t -- DROP", true},
+		{"SELECT $$INSERT$$", true},
+		{"WITH d AS (DELETE FROM t RETURNING *) SELECT * FROM d", false},
+		{"SELECT * INTO t2 FROM t", false},
+		{"SELECT * FROM t FOR UPDATE", false},
+		{"SELECT 1; DROP TABLE t", false},
+		{"SELECT * FROM (SELECT * FROM (SELECT 1) a) b", true},
+		{"INSERT INTO t VALUES (1) RETURNING id", false},
+		{"BEGIN", false},
+	}
+	for _, test := range tests {
+		if got := ReadOnly(Tokenize(test.query)); got != test.want {
+			t.Errorf("ReadOnly(%q) = %v, want %v", test.query, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package sqltext
+
+import "strings"
+
+// Fingerprint returns the shape of a statement, the same for statements
+// differing only by their literals, parameters, comments or whitespace:
+// literals and parameters become ?, and lists of them a single ?.
+func Fingerprint(query string) string {
+	var texts []string
+	for _, t := range Tokenize(query) {
+		var text string
+		switch {
+		case !t.Significant():
+			continue
+		case t.Kind == String || t.Kind == Number || t.Kind == Param:
+			text = "?"
+		default:
+			text = t.Text
+		}
+
+		n := len(texts)
+		if text == "?" && n >= 2 && texts[n-1] == "," && texts[n-2] == "?" {
+			texts = texts[:n-1]
+			continue
+		}
+		texts = append(texts, text)
+	}
+	if n := len(texts); n > 0 && texts[n-1] == ";" {
+		texts = texts[:n-1]
+	}
+
+	var b strings.Builder
+	for i, text := range texts {
+		if i > 0 && !tight(texts[i-1], text) {
+			b.WriteByte(' ')
+		}
+		b.WriteString(text)
+	}
+
+	return b.String()
+}
+
+// tight reports whether two tokens are written without a space between
+// them, as in f(x), t.c or a, b.
+func tight(prev, text string) bool {
+	return prev == "(" || prev == "." || text == ")" || text == "," || text == "." || (text == "(" && prev != "" && !isKeyword(prev) && isIdentStart(prev))
+}
+
+// Redact returns a statement with its string and numeric literals replaced
+// by ?, keeping the rest of its text as is.
+func Redact(query string) string {
+	tokens := Tokenize(query)
+	for i, t := range tokens {
+		if t.Kind == String || t.Kind == Number {
+			tokens[i].Text = "?"
+		}
+	}
+
+	return Join(tokens)
+}
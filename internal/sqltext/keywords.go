@@ -0,0 +1,31 @@
+package sqltext
+
+import "strings"
+
+// keywords are the reserved words that can't be used as an alias without
+// quoting, across the common dialects.
+var keywords = map[string]bool{}
+
+func init() {
+	for _, k := range strings.Fields(`
+		ALL AND ANY APPLY AS ASC BETWEEN BY CASE CAST CHECK COLLATE CONSTRAINT
+		CROSS CURRENT DEFAULT DELETE DESC DISTINCT DO ELSE END ESCAPE EXCEPT
+		EXISTS FETCH FOR FORCE FOREIGN FROM FULL GROUP HAVING IGNORE IN INNER
+		INSERT INTERSECT INTO IS JOIN KEY LATERAL LEFT LIKE LIMIT MERGE MINUS
+		NATURAL NOT NULL OFFSET ON OR ORDER OUTER OUTPUT OVER PARTITION PIVOT
+		PRIMARY QUALIFY REFERENCES RETURNING RIGHT SELECT SET SOME
+		STRAIGHT_JOIN TABLE TABLESAMPLE THEN TOP UNION UNIQUE UNPIVOT UPDATE
+		USE USING VALUES WHEN WHERE WINDOW WITH`) {
+		keywords[k] = true
+	}
+}
+
+// isKeyword reports whether word is a reserved keyword.
+func isKeyword(word string) bool {
+	return keywords[strings.ToUpper(word)]
+}
+
+// IsKeyword reports whether the token is a reserved keyword.
+func (t Token) IsKeyword() bool {
+	return t.Kind == Word && isKeyword(t.Text)
+}
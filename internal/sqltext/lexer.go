@@ -0,0 +1,265 @@
+// Package sqltext works on the text of SQL statements: a lightweight,
+// dialect-agnostic lexer and helpers built on it. It doesn't parse SQL, but
+// knows enough about its lexical structure (strings, quoted identifiers,
+// comments) to never mistake their content for code.
+package sqltext
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Kind of token.
+type Kind int
+
+const (
+	Space       Kind = iota // Whitespace.
+	Comment                 // -- line or /* block */ comment.
+	Word                    // Keyword or unquoted identifier.
+	QuotedIdent             // "ident", `ident` or [ident].
+	String                  // 'string' or $tag$string$tag$.
+	Number                  // Numeric literal.
+	Param                   // Placeholder: ?, $1, :name or @name.
+	Punct                   // Operator or punctuation.
+)
+
+// Token of a statement.
+type Token struct {
+	Kind Kind
+	Text string
+}
+
+// Is reports whether the token is the given keyword (case insensitive).
+func (t Token) Is(keyword string) bool {
+	return t.Kind == Word && strings.EqualFold(t.Text, keyword)
+}
+
+// IsIdent reports whether the token may be an identifier.
+func (t Token) IsIdent() bool {
+	return t.Kind == Word || t.Kind == QuotedIdent
+}
+
+// Ident returns the name of an identifier, without quotes.
+func (t Token) Ident() string {
+	if t.Kind != QuotedIdent || len(t.Text) < 2 {
+		return t.Text
+	}
+
+	quote := t.Text[len(t.Text)-1]
+	inner := t.Text[1 : len(t.Text)-1]
+	return strings.ReplaceAll(inner, string([]byte{quote, quote}), string(quote))
+}
+
+// Significant reports whether the token carries meaning (isn't whitespace or
+// a comment).
+func (t Token) Significant() bool {
+	return t.Kind != Space && t.Kind != Comment
+}
+
+// Join concatenates the text of tokens.
+func Join(tokens []Token) string {
+	var b strings.Builder
+	for _, t := range tokens {
+		b.WriteString(t.Text)
+	}
+
+	return b.String()
+}
+
+// Tokenize splits a statement into tokens. Concatenating the text of the
+// tokens always gives back the input.
+func Tokenize(s string) []Token {
+	var tokens []Token
+	prev := Token{Kind: Space}
+
+	for i := 0; i < len(s); {
+		kind, n := next(s[i:], prev)
+		tok := Token{Kind: kind, Text: s[i : i+n]}
+		tokens = append(tokens, tok)
+		if tok.Significant() {
+			prev = tok
+		}
+		i += n
+	}
+
+	return tokens
+}
+
+// next returns the kind and length of the token at the start of s.
+func next(s string, prev Token) (Kind, int) {
+	c := s[0]
+	switch {
+	case isSpace(c):
+		n := 1
+		for n < len(s) && isSpace(s[n]) {
+			n++
+		}
+		return Space, n
+
+	case strings.HasPrefix(s, "--"):
+		n := strings.IndexByte(s, '\n')
+		if n < 0 {
+			return Comment, len(s)
+		}
+		return Comment, n
+
+	case strings.HasPrefix(s, "/*"):
+		n := strings.Index(s[2:], "*/")
+		if n < 0 {
+			return Comment, len(s)
+		}
+		return Comment, n + 4
+
+	case c == '\'':
+		return String, quoted(s, '\'')
+
+	case c == '"' || c == '`':
+		return QuotedIdent, quoted(s, c)
+
+	case c == '[' && !followsOperand(prev):
+		return QuotedIdent, quoted(s, ']')
+
+	case c == '$':
+		if n := dollarQuoted(s); n > 0 {
+			return String, n
+		}
+		if n := digits(s[1:]); n > 0 {
+			return Param, n + 1
+		}
+		return Punct, 1
+
+	case c == '?':
+		return Param, 1
+
+	case (c == ':' || c == '@') && len(s) > 1 && isIdentStart(s[1:]):
+		if c == ':' && prev.Kind == Punct && prev.Text == ":" {
+			return Punct, 1
+		}
+		return Param, 1 + identLength(s[1:])
+
+	case c >= '0' && c <= '9' || c == '.' && len(s) > 1 && s[1] >= '0' && s[1] <= '9':
+		return Number, number(s)
+
+	case isIdentStart(s) || c == '@' || c == '#':
+		// @@globals and #temp tables are words too.
+		n := 1
+		for n < len(s) && (s[n] == '@' || s[n] == '#') {
+			n++
+		}
+		return Word, n + identLength(s[n:])
+	}
+
+	// Keep multi-character operators together.
+	for _, op := range []string{"::", "<=", ">=", "<>", "!=", "||", "->>", "->"} {
+		if strings.HasPrefix(s, op) {
+			return Punct, len(op)
+		}
+	}
+	_, n := utf8.DecodeRuneInString(s)
+	return Punct, n
+}
+
+// followsOperand reports whether a token ends an operand, in which case a
+// following '[' is a subscript rather than a quoted identifier.
+func followsOperand(prev Token) bool {
+	switch prev.Kind {
+	case QuotedIdent, String, Number, Param:
+		return true
+	case Word:
+		return !isKeyword(prev.Text)
+	case Punct:
+		return prev.Text == ")" || prev.Text == "]"
+	}
+
+	return false
+}
+
+// quoted returns the length of a quoted token starting at s[0], where the
+// closing quote is escaped by doubling it.
+func quoted(s string, closing byte) int {
+	for i := 1; i < len(s); i++ {
+		if s[i] != closing {
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == closing {
+			i++
+			continue
+		}
+		return i + 1
+	}
+
+	return len(s)
+}
+
+// dollarQuoted returns the length of a PostgreSQL $tag$...$tag$ string, or 0.
+func dollarQuoted(s string) int {
+	end := strings.IndexByte(s[1:], '$')
+	if end < 0 {
+		return 0
+	}
+	tag := s[:end+2]
+	for _, r := range tag[1 : len(tag)-1] {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' {
+			return 0
+		}
+	}
+	if len(tag) > 2 && tag[1] >= '0' && tag[1] <= '9' {
+		return 0
+	}
+
+	n := strings.Index(s[len(tag):], tag)
+	if n < 0 {
+		return len(s)
+	}
+	return len(tag) + n + len(tag)
+}
+
+func number(s string) int {
+	n := digits(s)
+	if n < len(s) && s[n] == '.' {
+		n += 1 + digits(s[n+1:])
+	}
+	if n < len(s) && (s[n] == 'e' || s[n] == 'E') {
+		m := n + 1
+		if m < len(s) && (s[m] == '+' || s[m] == '-') {
+			m++
+		}
+		if d := digits(s[m:]); d > 0 {
+			n = m + d
+		}
+	}
+
+	return n
+}
+
+func digits(s string) int {
+	n := 0
+	for n < len(s) && s[n] >= '0' && s[n] <= '9' {
+		n++
+	}
+
+	return n
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+func isIdentStart(s string) bool {
+	r, _ := utf8.DecodeRuneInString(s)
+	return r == '_' || unicode.IsLetter(r)
+}
+
+func identLength(s string) int {
+	n := 0
+	for n < len(s) {
+		r, size := utf8.DecodeRuneInString(s[n:])
+		if r != '_' && r != '$' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			break
+		}
+		n += size
+	}
+
+	return n
+}
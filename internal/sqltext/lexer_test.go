@@ -0,0 +1,57 @@
+package sqltext
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []Token
+	}{
+		{"SELECT 1", []Token{{Word, "SELECT"}, {Space, " "}, {Number, "1"}}},
+		{"'it''s' x", []Token{{String, "'it''s'"}, {Space, " "}, {Word, "x"}}},
+		{`"a""b".c`, []Token{{QuotedIdent, `"a""b"`}, {Punct, "."}, {Word, "c"}}},
+		{"`t`", []Token{{QuotedIdent, "`t`"}}},
+		{"FROM [my table]", []Token{{Word, "FROM"}, {Space, " "}, {QuotedIdent, "[my table]"}}},
+		{"a[1]", []Token{{Word, "a"}, {Punct, "["}, {Number, "1"}, {Punct, "]"}}},
+		{"-- x; 'y'\n1", []Token{{Comment, "-- x; 'y'"}, {Space, "\n"}, {Number, "1"}}},
+		{"/* a -- b */1", []Token{{Comment, "/* a -- b */"}, {Number, "1"}}},
+		{"/* open", []Token{{Comment, "/* open"}}},
+		{"$$a;'b'$$", []Token{{String, "$$a;'b'$$"}}},
+		{"$fn$ $x$ $fn$", []Token{{String, "$fn$ $x$ $fn$"}}},
+		{"$1::int", []Token{{Param, "$1"}, {Punct, "::"}, {Word, "int"}}},
+		{"? :name @p", []Token{{Param, "?"}, {Space, " "}, {Param, ":name"}, {Space, " "}, {Param, "@p"}}},
+		{"@@version #tmp", []Token{{Word, "@@version"}, {Space, " "}, {Word, "#tmp"}}},
+		{"1.5e-3 .5", []Token{{Number, "1.5e-3"}, {Space, " "}, {Number, ".5"}}},
+		{"a<>b->>'k'", []Token{{Word, "a"}, {Punct, "<>"}, {Word, "b"}, {Punct, "->>"}, {String, "'k'"}}},
+		{"'open", []Token{{String, "'open"}}},
+	}
+	for _, test := range tests {
+		got := Tokenize(test.query)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Tokenize(%q) = %v, want %v", test.query, got, test.want)
+		}
+		if joined := Join(got); joined != test.query {
+			t.Errorf("Join(Tokenize(%q)) = %q", test.query, joined)
+		}
+	}
+}
+
+func TestTokenIdent(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{`"a""b"`, `a"b`},
+		{"`t`", "t"},
+		{"[my table]", "my table"},
+		{"plain", "plain"},
+	}
+	for _, test := range tests {
+		if got := Tokenize(test.text)[0].Ident(); got != test.want {
+			t.Errorf("Ident(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package sqltext
+
+import "strings"
+
+// comparisons are the operators comparing a column to a placeholder.
+var comparisons = map[string]bool{"=": true, "<>": true, "!=": true, "<": true, ">": true, "<=": true, ">=": true}
+
+// PlaceholderColumns returns the column bound to each ? placeholder of a
+// statement, in order, as written without quotes (e.g. "o.created_at"), or ""
+// when it isn't one of:
+//
+//	col = ? (or <>, !=, <, >, <=, >=, LIKE), ? = col
+//	col IN (?, ?), col BETWEEN ? AND ?
+//	UPDATE t SET col = ?
+//	INSERT INTO t (col, ...) VALUES (?, ...)
+func PlaceholderColumns(tokens []Token) []string {
+	var sig []Token
+	for _, t := range tokens {
+		if t.Significant() {
+			sig = append(sig, t)
+		}
+	}
+
+	// Column of the IN list of each open parenthesis, and position in the
+	// VALUES rows.
+	type paren struct {
+		in  string
+		row bool
+		pos int
+	}
+	var parens []paren
+	var columns, insert []string
+	values, valuesDepth := false, 0
+	between := ""
+
+	for i := 0; i < len(sig); i++ {
+		t := sig[i]
+		switch {
+		case t.Is("INTO"):
+			insert = insertColumns(sig, i+1)
+		case t.Is("VALUES"):
+			values, valuesDepth = true, len(parens)
+		case t.Kind == Punct && t.Text == "(":
+			p := paren{row: values && len(parens) == valuesDepth}
+			if i > 0 && sig[i-1].Is("IN") {
+				p.in = columnBefore(sig, i-1)
+			}
+			parens = append(parens, p)
+		case t.Kind == Punct && t.Text == ")":
+			if len(parens) > 0 {
+				parens = parens[:len(parens)-1]
+			}
+		case t.Kind == Punct && t.Text == ",":
+			if n := len(parens); n > 0 {
+				parens[n-1].pos++
+			}
+		case t.Kind == Param && t.Text == "?":
+			var top paren
+			if n := len(parens); n > 0 {
+				top = parens[n-1]
+			}
+			column := ""
+			if top.row {
+				if top.pos < len(insert) {
+					column = insert[top.pos]
+				}
+			} else {
+				column = placeholderColumn(sig, i, top.in, &between)
+			}
+			columns = append(columns, column)
+		}
+		// The rows of VALUES end with the first token between them but a
+		// comma.
+		if values && (len(parens) < valuesDepth || len(parens) == valuesDepth && t.Text != "," && t.Text != ")" && !t.Is("VALUES")) {
+			values = false
+		}
+	}
+
+	return columns
+}
+
+// insertColumns returns the column list of the table named at sig[i], by
+// INSERT INTO, nil when it has none.
+func insertColumns(sig []Token, i int) []string {
+	for i+1 < len(sig) && sig[i].IsIdent() && sig[i+1].Text == "." {
+		i += 2
+	}
+	if i+1 >= len(sig) || !sig[i].IsIdent() || sig[i+1].Text != "(" {
+		return nil
+	}
+
+	var columns []string
+	for i += 2; i < len(sig) && sig[i].IsIdent(); i += 2 {
+		columns = append(columns, sig[i].Ident())
+		if i+1 >= len(sig) || sig[i+1].Text != "," {
+			break
+		}
+	}
+
+	return columns
+}
+
+// columnBefore returns the column ending right before sig[i], skipping a
+// NOT, "" when there is none.
+func columnBefore(sig []Token, i int) string {
+	i--
+	if i >= 0 && sig[i].Is("NOT") {
+		i--
+	}
+	if i < 0 || !sig[i].IsIdent() || sig[i].IsKeyword() {
+		return ""
+	}
+
+	parts := []string{sig[i].Ident()}
+	for i >= 2 && sig[i-1].Text == "." && sig[i-2].IsIdent() {
+		i -= 2
+		parts = append([]string{sig[i].Ident()}, parts...)
+	}
+
+	return strings.Join(parts, ".")
+}
+
+// placeholderColumn returns the column compared to the placeholder at
+// sig[i], in the IN list of a column or not. between is the column of the
+// BETWEEN whose upper bound may follow.
+func placeholderColumn(sig []Token, i int, in string, between *string) string {
+	var prev Token
+	if i > 0 {
+		prev = sig[i-1]
+	}
+	lower := *between
+	*between = ""
+
+	switch {
+	case in != "" && (prev.Text == "(" || prev.Text == ","):
+		return in
+	case prev.Kind == Punct && comparisons[prev.Text] || prev.Is("LIKE"):
+		return columnBefore(sig, i-1)
+	case prev.Is("BETWEEN"):
+		*between = columnBefore(sig, i-1)
+		return *between
+	case prev.Is("AND") && lower != "" && i >= 2 && sig[i-2].Kind == Param:
+		return lower
+	case i+2 < len(sig) && sig[i+1].Kind == Punct && comparisons[sig[i+1].Text]:
+		return columnAt(sig, i+2)
+	}
+
+	return ""
+}
+
+// columnAt returns the column starting at sig[i], "" when there is none or
+// it is a function call.
+func columnAt(sig []Token, i int) string {
+	var parts []string
+	for i < len(sig) && sig[i].IsIdent() && !sig[i].IsKeyword() {
+		parts = append(parts, sig[i].Ident())
+		i++
+		if i+1 >= len(sig) || sig[i].Text != "." {
+			break
+		}
+		i++
+	}
+	if len(parts) == 0 || i < len(sig) && sig[i].Text == "(" {
+		return ""
+	}
+
+	return strings.Join(parts, ".")
+}
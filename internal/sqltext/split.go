@@ -0,0 +1,42 @@
+package sqltext
+
+import "strings"
+
+// Split splits a script into its statements, on the semicolons outside of
+// strings, quoted identifiers and comments. Statements are trimmed, and empty
+// ones dropped. Procedural blocks (BEGIN ... END) holding semicolons are
+// split too.
+func Split(script string) []string {
+	var statements []string
+	start := 0
+	add := func(s string) {
+		if s = strings.TrimSpace(s); s != "" {
+			statements = append(statements, s)
+		}
+	}
+
+	tokens := Tokenize(script)
+	offset := 0
+	for _, t := range tokens {
+		if t.Kind == Punct && t.Text == ";" {
+			add(script[start:offset])
+			start = offset + len(t.Text)
+		}
+		offset += len(t.Text)
+	}
+	add(script[start:])
+
+	return statements
+}
+
+// Placeholders returns the number of ? placeholders of a statement.
+func Placeholders(tokens []Token) int {
+	n := 0
+	for _, t := range tokens {
+		if t.Kind == Param && t.Text == "?" {
+			n++
+		}
+	}
+
+	return n
+}
@@ -0,0 +1,43 @@
+package sqltext
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		script string
+		want   []string
+	}{
+		{"SELECT 1; SELECT 2;", []string{"SELECT 1", "SELECT 2"}},
+		{" ; ;\n", nil},
+		{"SELECT ';'; SELECT \"a;b\"", []string{"SELECT ';'", `SELECT "a;b"`}},
+		{"SELECT 1 -- a; b\n; SELECT 2 /* ; */", []string{"SELECT 1 -- a; b", "SELECT 2 /* ; */"}},
+		{"CREATE FUNCTION f() AS $$ BEGIN; END $$; SELECT f()", []string{"CREATE FUNCTION f() AS $$ BEGIN; END $$", "SELECT f()"}},
+		{"SELECT [a;b] FROM t", []string{"SELECT [a;b] FROM t"}},
+	}
+	for _, test := range tests {
+		if got := Split(test.script); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Split(%q) = %q, want %q", test.script, got, test.want)
+		}
+	}
+}
+
+func TestPlaceholders(t *testing.T) {
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"SELECT ?, ?", 2},
+		{"SELECT '?', \"?\", `?` -- ?\n/* ? */", 0},
+		{"SELECT $$?$$, ?", 1},
+		{"SELECT $1, :a, @b", 0},
+		{"SELECT * FROM t WHERE a IN (?, (SELECT ? FROM u))", 2},
+	}
+	for _, test := range tests {
+		if got := Placeholders(Tokenize(test.query)); got != test.want {
+			t.Errorf("Placeholders(%q) = %d, want %d", test.query, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package sqltext
+
+import "strings"
+
+// TableRef is a table referenced by a statement, in a FROM or JOIN clause or
+// as the target of INSERT, UPDATE, DELETE or MERGE.
+type TableRef struct {
+	// Name of the table without quotes, qualified if it is in the statement
+	// (e.g. "public.orders").
+	Name string
+	// Alias of the table, or "" when it has none.
+	Alias string
+	// Start and End delimit the tokens of the name (End excluded).
+	Start, End int
+	// Target is set for the table written by INSERT, UPDATE, DELETE or MERGE.
+	Target bool
+	// Depth is the parenthesis nesting level of the reference.
+	Depth int
+}
+
+// Table returns the unqualified name of the table.
+func (r TableRef) Table() string {
+	return r.Name[strings.LastIndexByte(r.Name, '.')+1:]
+}
+
+// Matches reports whether the reference is to the given table, written
+// qualified or not (case insensitive).
+func (r TableRef) Matches(table string) bool {
+	if strings.Contains(table, ".") {
+		return strings.EqualFold(r.Name, table)
+	}
+	return strings.EqualFold(r.Table(), table)
+}
+
+// endsFromList are the keywords ending a FROM clause.
+var endsFromList = map[string]bool{
+	"WHERE": true, "GROUP": true, "ORDER": true, "HAVING": true, "LIMIT": true,
+	"UNION": true, "EXCEPT": true, "INTERSECT": true, "MINUS": true,
+	"WINDOW": true, "QUALIFY": true, "OFFSET": true, "FETCH": true,
+	"FOR": true, "RETURNING": true, "SET": true,
+}
+
+// modifiers are the words between the keyword of a statement and its target
+// table, or between a FROM and its table, e.g. UPDATE IGNORE t or DELETE
+// LOW_PRIORITY FROM t.
+var modifiers = map[string]bool{
+	"ONLY": true, "LATERAL": true, "IGNORE": true, "LOW_PRIORITY": true,
+	"HIGH_PRIORITY": true, "DELAYED": true, "QUICK": true,
+}
+
+// IsModifier reports whether the token is a modifier of the table that
+// follows it, such as IGNORE or ONLY.
+func (t Token) IsModifier() bool {
+	return t.Kind == Word && modifiers[strings.ToUpper(t.Text)]
+}
+
+// TableRefs returns the tables referenced by the tokens of a statement.
+// Derived tables and table functions are skipped, but the tables they
+// reference are returned.
+func TableRefs(tokens []Token) []TableRef {
+	var refs []TableRef
+	depth := 0
+	inFromList := map[int]bool{}
+	expect, target := false, false
+	prev := ""
+
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		if !t.Significant() {
+			continue
+		}
+
+		if expect {
+			expect = false
+			if t.IsModifier() {
+				expect = true
+				continue
+			}
+			if t.IsIdent() && !t.IsKeyword() {
+				ref, next, ok := readTableRef(tokens, i, target)
+				if ok {
+					ref.Depth = depth
+					refs = append(refs, ref)
+					i = next - 1
+					prev = strings.ToUpper(tokens[i].Text)
+					continue
+				}
+			}
+		}
+
+		// DELETE LOW_PRIORITY FROM still names the target.
+		if t.IsModifier() && (prev == "DELETE" || prev == "INSERT" || prev == "REPLACE") {
+			continue
+		}
+
+		switch {
+		case t.Kind == Punct && t.Text == "(":
+			depth++
+		case t.Kind == Punct && t.Text == ")":
+			delete(inFromList, depth)
+			if depth > 0 {
+				depth--
+			}
+		case t.Kind == Punct && t.Text == ";":
+			depth = 0
+			inFromList = map[int]bool{}
+		case t.Kind == Punct && t.Text == ",":
+			expect, target = inFromList[depth], false
+		case t.Is("FROM"):
+			// DELETE FROM names the target, other FROMs start a list.
+			expect, target = true, prev == "DELETE"
+			if !target {
+				inFromList[depth] = true
+			}
+		case t.Is("JOIN") || t.Is("USING") || t.Is("STRAIGHT_JOIN"):
+			expect, target = true, false
+		case t.Is("UPDATE") && (prev == "" || prev == ";" || prev == ")"):
+			expect, target = true, true
+		case t.Is("INTO") && (prev == "INSERT" || prev == "REPLACE" || prev == "MERGE" || prev == "IGNORE"):
+			expect, target = true, true
+		case t.Kind == Word && endsFromList[strings.ToUpper(t.Text)]:
+			delete(inFromList, depth)
+		}
+
+		prev = strings.ToUpper(t.Text)
+	}
+
+	return refs
+}
+
+// readTableRef reads a table name starting at tokens[i] and its alias. It
+// returns the index of the token following the reference, and false when the
+// name is a table function rather than a table.
+func readTableRef(tokens []Token, i int, target bool) (TableRef, int, bool) {
+	ref := TableRef{Start: i, Target: target}
+
+	var parts []string
+	for {
+		parts = append(parts, tokens[i].Ident())
+		ref.End = i + 1
+
+		dot := nextSignificant(tokens, i+1)
+		if dot >= len(tokens) || tokens[dot].Text != "." {
+			break
+		}
+		name := nextSignificant(tokens, dot+1)
+		if name >= len(tokens) || !tokens[name].IsIdent() {
+			break
+		}
+		i = name
+	}
+	ref.Name = strings.Join(parts, ".")
+
+	next := nextSignificant(tokens, ref.End)
+	if next < len(tokens) && tokens[next].Text == "(" && !target {
+		return ref, next, false
+	}
+
+	if next < len(tokens) && tokens[next].Is("AS") {
+		alias := nextSignificant(tokens, next+1)
+		if alias < len(tokens) && tokens[alias].IsIdent() {
+			ref.Alias = tokens[alias].Ident()
+			return ref, alias + 1, true
+		}
+	}
+	if next < len(tokens) && tokens[next].IsIdent() && !tokens[next].IsKeyword() {
+		ref.Alias = tokens[next].Ident()
+		return ref, next + 1, true
+	}
+
+	return ref, ref.End, true
+}
+
+// nextSignificant returns the index of the first significant token at or
+// after i, or len(tokens).
+func nextSignificant(tokens []Token, i int) int {
+	for i < len(tokens) && !tokens[i].Significant() {
+		i++
+	}
+
+	return i
+}
+
+// Tables returns the names of the tables referenced by a statement, without
+// duplicates.
+func Tables(query string) []string {
+	var tables []string
+	seen := map[string]bool{}
+	for _, ref := range TableRefs(Tokenize(query)) {
+		key := strings.ToLower(ref.Name)
+		if !seen[key] {
+			seen[key] = true
+			tables = append(tables, ref.Name)
+		}
+	}
+
+	return tables
+}
@@ -0,0 +1,68 @@
+package sqltext
+
+import "testing"
+
+func TestTableRefs(t *testing.T) {
+	type ref struct {
+		Name, Alias string
+		Target      bool
+		Depth       int
+	}
+	tests := []struct {
+		query string
+		want  []ref
+	}{
+		{"SELECT * FROM a, b AS x JOIN c y ON x.id = y.id", []ref{{"a", "", false, 0}, {"b", "x", false, 0}, {"c", "y", false, 0}}},
+		{`SELECT * FROM public."Order Items" oi`, []ref{{"public.Order Items", "oi", false, 0}}},
+		{"SELECT * FROM [dbo].[t] -- FROM u\n/* JOIN v */", []ref{{"dbo.t", "", false, 0}}},
+		{"SELECT 'FROM u' FROM t WHERE a = $$ JOIN v $$", []ref{{"t", "", false, 0}}},
+		{"SELECT * FROM (SELECT * FROM (SELECT id FROM a) x JOIN b ON true) y", []ref{{"a", "", false, 2}, {"b", "", false, 1}}},
+		{"SELECT * FROM a WHERE id IN (SELECT id FROM b), c", []ref{{"a", "", false, 0}, {"b", "", false, 1}}},
+		{"SELECT * FROM generate_series(1, 3) g, t", []ref{{"t", "", false, 0}}},
+		{"INSERT INTO a (id) SELECT id FROM b", []ref{{"a", "", true, 0}, {"b", "", false, 0}}},
+		{"INSERT IGNORE INTO a VALUES (1)", []ref{{"a", "", true, 0}}},
+		{"UPDATE ONLY a SET x = 1 FROM b", []ref{{"a", "", true, 0}, {"b", "", false, 0}}},
+		{"DELETE LOW_PRIORITY FROM a USING b", []ref{{"a", "", true, 0}, {"b", "", false, 0}}},
+		{"MERGE INTO a t USING b s ON t.id = s.id", []ref{{"a", "t", true, 0}, {"b", "s", false, 0}}},
+		{"SELECT 1 FROM a; DELETE FROM b", []ref{{"a", "", false, 0}, {"b", "", true, 0}}},
+	}
+	for _, test := range tests {
+		var got []ref
+		for _, r := range TableRefs(Tokenize(test.query)) {
+			got = append(got, ref{r.Name, r.Alias, r.Target, r.Depth})
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("TableRefs(%q) = %+v, want %+v", test.query, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("TableRefs(%q) = %+v, want %+v", test.query, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestTableRefsSpan(t *testing.T) {
+	query := `SELECT * FROM s . "t" x`
+	tokens := Tokenize(query)
+	refs := TableRefs(tokens)
+	if len(refs) != 1 {
+		t.Fatalf("TableRefs(%q) = %+v, want one reference", query, refs)
+	}
+	if got := Join(tokens[refs[0].Start:refs[0].End]); got != `s . "t"` {
+		t.Errorf("tokens of the name of %q = %q, want %q", query, got, `s . "t"`)
+	}
+}
+
+func TestTableRefMatches(t *testing.T) {
+	ref := TableRef{Name: "public.Orders"}
+	for table, want := range map[string]bool{
+		"orders": true, "PUBLIC.ORDERS": true, "other.orders": false, "order": false,
+	} {
+		if got := ref.Matches(table); got != want {
+			t.Errorf("Matches(%q) = %v, want %v", table, got, want)
+		}
+	}
+}
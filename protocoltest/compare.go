@@ -0,0 +1,152 @@
+package protocoltest
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack"
+)
+
+// Compare checks that msgpack data encodes the same values as a golden frame.
+// Integers are compared whatever their width and sign, and missing keys are
+// the same as keys with their zero value (nil, "", 0, false or empty).
+func Compare(data []byte, golden Frame) error {
+	got, err := decode(data)
+	if err != nil {
+		return errors.Wrapf(err, "%s: invalid msgpack", golden.Name)
+	}
+	want, err := decode(golden.Data)
+	if err != nil {
+		return errors.Wrapf(err, "%s: invalid golden frame", golden.Name)
+	}
+	gotMap, ok := got.(map[string]interface{})
+	if !ok {
+		return errors.Errorf("%s: not a map but %T", golden.Name, got)
+	}
+	wantMap := want.(map[string]interface{})
+	for _, key := range golden.Ignored {
+		delete(gotMap, key)
+		delete(wantMap, key)
+	}
+
+	return diff(golden.Name, gotMap, wantMap)
+}
+
+func decode(data []byte) (interface{}, error) {
+	var v interface{}
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return normalize(v), nil
+}
+
+// normalize converts integers to int64, floats to float64 and maps to maps
+// by string key without their zero values.
+func normalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			if value = normalize(value); !isZero(value) {
+				m[key] = value
+			}
+		}
+		return m
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			if value = normalize(value); !isZero(value) {
+				m[fmt.Sprint(key)] = value
+			}
+		}
+		return m
+	case []interface{}:
+		if len(v) == 0 {
+			return nil
+		}
+		s := make([]interface{}, len(v))
+		for i, value := range v {
+			s[i] = normalize(value)
+		}
+		return s
+	case float32:
+		return float64(v)
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rv.Uint())
+	}
+	return v
+}
+
+func isZero(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case int64:
+		return v == 0
+	case float64:
+		return v == 0
+	case bool:
+		return !v
+	case []byte:
+		return len(v) == 0
+	case map[string]interface{}:
+		return len(v) == 0
+	}
+	return false
+}
+
+// diff returns the first difference between two normalized values, at a
+// path such as "query_response.data[0][1]".
+func diff(path string, got, want interface{}) error {
+	switch want := want.(type) {
+	case map[string]interface{}:
+		gotMap, ok := got.(map[string]interface{})
+		if !ok {
+			return errors.Errorf("%s: got %v, want a map", path, got)
+		}
+		keys := make([]string, 0, len(want)+len(gotMap))
+		for key := range want {
+			keys = append(keys, key)
+		}
+		for key := range gotMap {
+			if _, ok := want[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if err := diff(path+"."+key, gotMap[key], want[key]); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []interface{}:
+		gotSlice, ok := got.([]interface{})
+		if !ok || len(gotSlice) != len(want) {
+			return errors.Errorf("%s: got %v, want %v", path, got, want)
+		}
+		for i := range want {
+			if err := diff(fmt.Sprintf("%s[%d]", path, i), gotSlice[i], want[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		return errors.Errorf("%s: got %#v, want %#v", path, got, want)
+	}
+	return nil
+}
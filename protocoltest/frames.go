@@ -0,0 +1,79 @@
+// Package protocoltest holds golden frames of the wire protocol between the
+// driver and the proxy, and a conformance harness checking that other
+// implementations of either side produce and consume them.
+//
+// A frame is a big-endian uint32 length followed by a msgpack map. The golden
+// frames are those of the Go driver and proxy; other encoders may order the
+// map keys differently, use other integer widths and leave out fields with
+// their zero value, so frames are compared by their decoded values (see
+// Compare).
+package protocoltest
+
+import (
+	"encoding/hex"
+	"io"
+
+	"github.com/arkan/sqlproxy/internal/frame"
+)
+
+// MaxFrameSize is the largest frame read by the harness.
+const MaxFrameSize = 16 << 20
+
+// Frame is a golden frame.
+type Frame struct {
+	Name string
+	// Whether the frame is sent by clients, or else by the proxy.
+	Request     bool
+	Description string
+	// Encoded msgpack map, without the length prefix.
+	Data []byte
+	// Top-level keys whose values depend on the implementation, such as the
+	// version of a client, not compared.
+	Ignored []string
+}
+
+// Encoded returns the frame as written on the wire, its length prefix
+// included.
+func (f Frame) Encoded() []byte {
+	return frame.Encode(f.Data)
+}
+
+// Golden are the golden frames, in the order of the conformance script.
+var Golden = []Frame{
+	{Name: "hello", Request: true, Description: "Hello of user alice, password secret, application conformance.", Ignored: []string{"version", "tags", "types"}, Data: mustHex("87a26f70a568656c6c6fa475736572a5616c696365a870617373776f7264a6736563726574ab6170706c69636174696f6eab636f6e666f726d616e6365a776657273696f6ea0a474616773c0a57479706573c0")},
+	{Name: "hello_response", Request: false, Description: "Hello response advertising transactions and pings.", Data: mustHex("82ac6361706162696c697469657392ac7472616e73616374696f6e73a470696e67a56572726f72a0")},
+	{Name: "query", Request: true, Description: "Query with an integer argument and a trace ID.", Data: mustHex("88a57175657279d92753454c4543542069642c206e616d652046524f4d207573657273205748455245206964203d203fa46172677391d3000000000000002aa874726163655f6964a774726163652d31a87072696f72697479a0aa74696d656f75745f6d73d30000000000000000a673747265616dc2ab77696e646f775f726f7773d30000000000000000ac77696e646f775f6279746573d30000000000000000")},
+	{Name: "query_response", Request: false, Description: "Query result with column types and one row.", Data: mustHex("8ba7636f6c756d6e7392a26964a46e616d65a57479706573c0ac636f6c756d6e5f74797065739286ad64617461626173655f74797065a7494e5445474552a97363616e5f74797065a5696e743634a86e756c6c61626c65a26e6fa66c656e677468d30000000000000000a9707265636973696f6ed30000000000000000a57363616c65d3000000000000000086ad64617461626173655f74797065a756415243484152a97363616e5f74797065a6737472696e67a86e756c6c61626c65a3796573a66c656e677468d30000000000000064a9707265636973696f6ed30000000000000000a57363616c65d30000000000000000a4646174619192d3000000000000002aa3416461a46d6f7265c2a874726163655f6964a774726163652d31a56572726f72a0a4636f6465a0ab6e61746976655f636f6465d30000000000000000a5636c617373a0a9726574727961626c65c2")},
+	{Name: "query_error", Request: true, Description: "Query of a missing table.", Data: mustHex("88a57175657279b553454c454354202a2046524f4d206d697373696e67a461726773c0a874726163655f6964a0a87072696f72697479a0aa74696d656f75745f6d73d30000000000000000a673747265616dc2ab77696e646f775f726f7773d30000000000000000ac77696e646f775f6279746573d30000000000000000")},
+	{Name: "error_response", Request: false, Description: "Error with its SQLSTATE and class.", Data: mustHex("86a874726163655f6964a0a56572726f72b66e6f2073756368207461626c653a206d697373696e67a4636f6465a53432503031ab6e61746976655f636f6465d30000000000000000a5636c617373af756e646566696e65645f7461626c65a9726574727961626c65c2")},
+	{Name: "begin", Request: true, Description: "Begin of a serializable transaction.", Data: mustHex("84a26f70a5626567696ea969736f6c6174696f6eac53657269616c697a61626c65a9726561645f6f6e6c79c2a874726163655f6964a0")},
+	{Name: "tx_response", Request: false, Description: "Successful begin, commit, rollback or ping.", Data: mustHex("86a874726163655f6964a0a56572726f72a0a4636f6465a0ab6e61746976655f636f6465d30000000000000000a5636c617373a0a9726574727961626c65c2")},
+	{Name: "exec", Request: true, Description: "Exec with a string and an integer argument, counting the rows returned as affected.", Data: mustHex("87a57175657279d92655504441544520757365727320534554206e616d65203d203f205748455245206964203d203fa46172677392a54772616365d3000000000000002aa874726163655f6964a0a87072696f72697479a0aa74696d656f75745f6d73d30000000000000000af6964656d706f74656e63795f6b6579a0a972657475726e696e67c3")},
+	{Name: "exec_response", Request: false, Description: "Exec result affecting one row.", Data: mustHex("8aad726f77735f6166666563746564d30000000000000001ae6c6173745f696e736572745f6964d30000000000000000a7636f6c756d6e73c0a464617461c0a874726163655f6964a0a56572726f72a0a4636f6465a0ab6e61746976655f636f6465d30000000000000000a5636c617373a0a9726574727961626c65c2")},
+	{Name: "commit", Request: true, Description: "Commit of the transaction.", Data: mustHex("82a26f70a6636f6d6d6974a874726163655f6964a0")},
+	{Name: "ping", Request: true, Description: "Ping of the backend.", Data: mustHex("82a26f70a470696e67a874726163655f6964a0")},
+}
+
+// Lookup returns the golden frame of a name.
+func Lookup(name string) (Frame, bool) {
+	for _, f := range Golden {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return Frame{}, false
+}
+
+// ReadFrame reads a frame and returns its msgpack data, refusing frames
+// larger than MaxFrameSize.
+func ReadFrame(r io.Reader) ([]byte, error) {
+	return frame.Read(r, MaxFrameSize)
+}
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
@@ -0,0 +1,82 @@
+package protocoltest
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Exchange is a golden request of a client and the golden response of the
+// proxy.
+type Exchange struct {
+	Request  string
+	Response string
+}
+
+// Script is the conformance script of clients, run by ServeClient. The client
+// under test must, in order:
+//
+//  1. connect as user alice, with password secret and application
+//     conformance;
+//  2. query "SELECT id, name FROM users WHERE id = ?" with 42 and trace ID
+//     trace-1, and read the row (42, "Ada") with its column types;
+//  3. query "SELECT * FROM missing" and get the undefined_table error of
+//     SQLSTATE 42P01;
+//  4. begin a serializable transaction;
+//  5. exec "UPDATE users SET name = ? WHERE id = ?" with "Grace" and 42, one
+//     row being affected;
+//  6. commit;
+//  7. ping.
+var Script = []Exchange{
+	{"hello", "hello_response"},
+	{"query", "query_response"},
+	{"query_error", "error_response"},
+	{"begin", "tx_response"},
+	{"exec", "exec_response"},
+	{"commit", "tx_response"},
+	{"ping", "tx_response"},
+}
+
+// ServeClient plays the proxy for a client connection: it reads the requests
+// of the script, checking each one against its golden frame, and answers
+// with the golden responses. It returns the first nonconforming request.
+func ServeClient(conn io.ReadWriter, script []Exchange) error {
+	for i, e := range script {
+		request, ok := Lookup(e.Request)
+		response, ok2 := Lookup(e.Response)
+		if !ok || !ok2 {
+			return errors.Errorf("step %d: unknown frames %s, %s", i+1, e.Request, e.Response)
+		}
+
+		data, err := ReadFrame(conn)
+		if err != nil {
+			return errors.Wrapf(err, "step %d: failed to read %s", i+1, e.Request)
+		}
+		if err := Compare(data, request); err != nil {
+			return errors.Wrapf(err, "step %d", i+1)
+		}
+		if _, err := conn.Write(response.Encoded()); err != nil {
+			return errors.Wrapf(err, "step %d: failed to write %s", i+1, e.Response)
+		}
+	}
+
+	return nil
+}
+
+// CheckRoundTrip checks that an implementation decodes and encodes every
+// golden frame: roundTrip decodes the frame data into the types of the
+// implementation and returns them encoded again. It returns the errors of
+// the frames that don't match.
+func CheckRoundTrip(roundTrip func(f Frame) ([]byte, error)) []error {
+	var errs []error
+	for _, f := range Golden {
+		data, err := roundTrip(f)
+		if err != nil {
+			errs = append(errs, errors.Wrap(err, f.Name))
+		} else if err := Compare(data, f); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}